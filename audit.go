@@ -0,0 +1,415 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one successful mutation of a build: who made it,
+// when, through which method, and the build before and after. Before is nil
+// for a creation and After for a deletion. Sensitive labels are recorded
+// redacted, as an anonymous caller would see them.
+type AuditEntry struct {
+	ID        string    `json:"id"`
+	BuildID   string    `json:"buildId"`
+	Method    string    `json:"method"`
+	Actor     string    `json:"actor,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Time      time.Time `json:"time"`
+	Before    *Build    `json:"before,omitempty"`
+	After     *Build    `json:"after,omitempty"`
+
+	seq uint64 // ID as a number
+
+	// WithDiffAudit, Before and After are stored as these merge patches.
+	beforePatch, afterPatch auditState
+}
+
+// AuditFilter selects audit entries. Empty fields don't filter. Since is
+// inclusive and Until exclusive. Cursor continues a previous GetAuditLog
+// call from where it stopped, and Limit caps the entries returned, at most
+// MaxAuditPage; zero means MaxAuditPage.
+type AuditFilter struct {
+	Method string
+	Actor  string
+	Since  time.Time
+	Until  time.Time
+	Cursor string
+	Limit  int
+}
+
+// MaxAuditPage caps the entries returned by one GetAuditLog call.
+const MaxAuditPage = 100
+
+// AuditLog keeps the most recent audit entries of every build in memory.
+type AuditLog struct {
+	mtx      sync.RWMutex
+	seq      uint64
+	perBuild int
+	clock    Clock
+	entries  map[string][]AuditEntry // oldest first
+	diff     bool                    // WithDiffAudit
+	tails    map[string]auditState   // WithDiffAudit, the state after each build's last entry
+}
+
+// AuditOption configures an AuditLog.
+type AuditOption func(*AuditLog)
+
+// WithAuditClock timestamps entries with c rather than SystemClock.
+func WithAuditClock(c Clock) AuditOption {
+	return func(a *AuditLog) { a.clock = c }
+}
+
+// NewAuditLog keeps up to perBuild entries per build, dropping the oldest
+// beyond that; zero or less keeps them all.
+func NewAuditLog(perBuild int, opts ...AuditOption) *AuditLog {
+	a := &AuditLog{perBuild: perBuild, clock: SystemClock, entries: map[string][]AuditEntry{}, tails: map[string]auditState{}}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+func (a *AuditLog) record(e AuditEntry) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.seq++
+	e.seq, e.ID = a.seq, strconv.FormatUint(a.seq, 10)
+	if a.diff {
+		a.tails[e.BuildID] = compress(&e, a.tails[e.BuildID])
+	}
+	entries := append(a.entries[e.BuildID], e)
+	if a.perBuild > 0 && len(entries) > a.perBuild {
+		dropped := len(entries) - a.perBuild
+		if a.diff {
+			rebase(entries, dropped)
+		}
+		entries = append(entries[:0:0], entries[dropped:]...)
+	}
+	a.entries[e.BuildID] = entries
+}
+
+// rebase makes the compressed entries[dropped] hold its Before in full, as
+// entries before it are about to be dropped.
+func rebase(entries []AuditEntry, dropped int) {
+	var state auditState
+	for _, e := range entries[:dropped] {
+		_, state = expand(e, state)
+	}
+	entries[dropped].beforePatch = mergeApply(state, entries[dropped].beforePatch)
+}
+
+// rename moves the entries of oldID to newID, merged in order with any
+// newID already has from an earlier build of that ID.
+func (a *AuditLog) rename(oldID, newID string) {
+	if oldID == newID {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	old, current := a.entries[oldID], a.entries[newID]
+	if a.diff {
+		old, current = expandAll(old), expandAll(current)
+	}
+	entries := append(old, current...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	for i := range entries {
+		entries[i].BuildID = newID
+	}
+	if a.perBuild > 0 && len(entries) > a.perBuild {
+		entries = entries[len(entries)-a.perBuild:]
+	}
+	delete(a.entries, oldID)
+	delete(a.tails, oldID)
+	if a.diff {
+		entries, a.tails[newID] = compressAll(entries)
+	}
+	if len(entries) > 0 {
+		a.entries[newID] = entries
+	}
+}
+
+// GetAuditLog returns the entries of buildID matching filter, newest first,
+// and a cursor for the next page, which is empty once there are no more.
+// Entries of deleted builds are kept. ErrValidation is returned for a
+// malformed cursor.
+func (a *AuditLog) GetAuditLog(ctx context.Context, buildID string, filter AuditFilter) ([]AuditEntry, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	var before uint64 // only entries older than the cursor
+	if filter.Cursor != "" {
+		n, err := strconv.ParseUint(filter.Cursor, 10, 64)
+		if err != nil {
+			var errs ValidationErrors
+			errs.add("cursor", "must be a cursor returned by a previous page")
+			return nil, "", errs
+		}
+		before = n
+	}
+	limit := filter.Limit
+	if limit <= 0 || limit > MaxAuditPage {
+		limit = MaxAuditPage
+	}
+
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	entries := a.entries[buildID]
+	if a.diff {
+		entries = expandAll(entries)
+	}
+	page := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if (before > 0 && e.seq >= before) || !filter.matches(e) {
+			continue
+		}
+		if len(page) == limit {
+			return page, page[len(page)-1].ID, nil
+		}
+		page = append(page, e)
+	}
+	return page, "", nil
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	switch {
+	case f.Method != "" && e.Method != f.Method,
+		f.Actor != "" && e.Actor != f.Actor,
+		!f.Since.IsZero() && e.Time.Before(f.Since),
+		!f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// AuditMiddleware records every successful mutation made through the
+// service into a. The build is read before and after the mutation, so the
+// entries show its state even for methods that don't return it; a
+// concurrent write to the same build may slip between those reads. Other
+// methods are passed through unchanged.
+func AuditMiddleware(a *AuditLog) Middleware {
+	return func(next Service) Service {
+		return &auditMiddleware{Service: next, log: a}
+	}
+}
+
+type auditMiddleware struct {
+	Service
+	log *AuditLog
+}
+
+// snapshot reads build id for the audit log, as an anonymous caller so
+// that sensitive labels stay redacted, or nil if it doesn't exist.
+func (mw *auditMiddleware) snapshot(ctx context.Context, id string) *Build {
+	b, err := mw.Service.GetBuild(WithActor(ctx, ""), id)
+	if err != nil {
+		return nil
+	}
+	return &b
+}
+
+// audit runs mutation on build id and records it if it reports a change.
+func (mw *auditMiddleware) audit(ctx context.Context, method, id string, mutation func() (bool, error)) error {
+	before := mw.snapshot(ctx, id)
+	if changed, err := mutation(); err != nil || !changed {
+		return err
+	}
+	mw.log.record(AuditEntry{
+		BuildID:   id,
+		Method:    method,
+		Actor:     ActorFromContext(ctx),
+		RequestID: RequestIDFromContext(ctx),
+		Time:      mw.log.clock.Now(),
+		Before:    before,
+		After:     mw.snapshot(ctx, id),
+	})
+	return nil
+}
+
+func (mw *auditMiddleware) PostBuild(ctx context.Context, b Build) error {
+	return mw.audit(ctx, "PostBuild", b.ID, func() (bool, error) { return true, mw.Service.PostBuild(ctx, b) })
+}
+
+func (mw *auditMiddleware) GetOrCreateBuild(ctx context.Context, b Build) (got Build, created bool, err error) {
+	err = mw.audit(ctx, "GetOrCreateBuild", b.ID, func() (bool, error) {
+		got, created, err = mw.Service.GetOrCreateBuild(ctx, b)
+		return created, err
+	})
+	return got, created, err
+}
+
+func (mw *auditMiddleware) PutBuild(ctx context.Context, id string, b Build) error {
+	return mw.audit(ctx, "PutBuild", id, func() (bool, error) { return true, mw.Service.PutBuild(ctx, id, b) })
+}
+
+func (mw *auditMiddleware) PatchBuild(ctx context.Context, id string, b Build) error {
+	return mw.audit(ctx, "PatchBuild", id, func() (bool, error) { return true, mw.Service.PatchBuild(ctx, id, b) })
+}
+
+// PatchBuilds records an entry for each build the patch succeeded on.
+func (mw *auditMiddleware) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) ([]BatchResult, error) {
+	before := make(map[string]*Build, len(ids))
+	for _, id := range ids {
+		before[id] = mw.snapshot(ctx, id)
+	}
+	results, err := mw.Service.PatchBuilds(ctx, ids, patch)
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		mw.log.record(AuditEntry{
+			BuildID:   r.ID,
+			Method:    "PatchBuilds",
+			Actor:     ActorFromContext(ctx),
+			RequestID: RequestIDFromContext(ctx),
+			Time:      mw.log.clock.Now(),
+			Before:    before[r.ID],
+			After:     mw.snapshot(ctx, r.ID),
+		})
+	}
+	return results, err
+}
+
+// BatchPostBuilds records an entry for each build it created.
+func (mw *auditMiddleware) BatchPostBuilds(ctx context.Context, builds []Build) ([]BatchResult, error) {
+	results, err := mw.Service.BatchPostBuilds(ctx, builds)
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		mw.log.record(AuditEntry{
+			BuildID:   r.ID,
+			Method:    "BatchPostBuilds",
+			Actor:     ActorFromContext(ctx),
+			RequestID: RequestIDFromContext(ctx),
+			Time:      mw.log.clock.Now(),
+			After:     mw.snapshot(ctx, r.ID),
+		})
+	}
+	return results, err
+}
+
+// CancelGroup records an entry for each member the cancel finished.
+func (mw *auditMiddleware) CancelGroup(ctx context.Context, groupID string) (int, error) {
+	members, err := mw.Service.ListBuildsByGroup(WithActor(ctx, ""), groupID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := mw.Service.CancelGroup(ctx, groupID)
+	for i, b := range members {
+		if b.Status.Terminal() {
+			continue
+		}
+		after := mw.snapshot(ctx, b.ID)
+		if after == nil || after.Status != StatusCancelled {
+			continue
+		}
+		mw.log.record(AuditEntry{
+			BuildID:   b.ID,
+			Method:    "CancelGroup",
+			Actor:     ActorFromContext(ctx),
+			RequestID: RequestIDFromContext(ctx),
+			Time:      mw.log.clock.Now(),
+			Before:    &members[i],
+			After:     after,
+		})
+	}
+	return n, err
+}
+
+func (mw *auditMiddleware) DeleteBuild(ctx context.Context, id string) error {
+	return mw.audit(ctx, "DeleteBuild", id, func() (bool, error) { return true, mw.Service.DeleteBuild(ctx, id) })
+}
+
+func (mw *auditMiddleware) ForceReleaseLease(ctx context.Context, id string) error {
+	return mw.audit(ctx, "ForceReleaseLease", id, func() (bool, error) { return true, mw.Service.ForceReleaseLease(ctx, id) })
+}
+
+func (mw *auditMiddleware) FailBuild(ctx context.Context, id, reason string, exitCode int) error {
+	return mw.audit(ctx, "FailBuild", id, func() (bool, error) { return true, mw.Service.FailBuild(ctx, id, reason, exitCode) })
+}
+
+func (mw *auditMiddleware) SetOutput(ctx context.Context, id, key, value string) error {
+	return mw.audit(ctx, "SetOutput", id, func() (bool, error) { return true, mw.Service.SetOutput(ctx, id, key, value) })
+}
+
+func (mw *auditMiddleware) RerunFailedSteps(ctx context.Context, id string) (b Build, err error) {
+	err = mw.audit(ctx, "RerunFailedSteps", id, func() (bool, error) {
+		b, err = mw.Service.RerunFailedSteps(ctx, id)
+		return true, err
+	})
+	return b, err
+}
+
+func (mw *auditMiddleware) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (ok bool, err error) {
+	err = mw.audit(ctx, "CompareAndSetStatus", id, func() (bool, error) {
+		ok, err = mw.Service.CompareAndSetStatus(ctx, id, expected, next)
+		return ok, err
+	})
+	return ok, err
+}
+
+func (mw *auditMiddleware) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (ok bool, err error) {
+	err = mw.audit(ctx, "CompareAndDeleteBuild", id, func() (bool, error) {
+		ok, err = mw.Service.CompareAndDeleteBuild(ctx, id, updatedAt)
+		return ok, err
+	})
+	return ok, err
+}
+
+// RenameBuild moves the build's entries to its new ID, so its history
+// follows it, and records the rename there.
+func (mw *auditMiddleware) RenameBuild(ctx context.Context, oldID, newID string) error {
+	before := mw.snapshot(ctx, oldID)
+	if err := mw.Service.RenameBuild(ctx, oldID, newID); err != nil {
+		return err
+	}
+	mw.log.rename(oldID, newID)
+	mw.log.record(AuditEntry{
+		BuildID:   newID,
+		Method:    "RenameBuild",
+		Actor:     ActorFromContext(ctx),
+		RequestID: RequestIDFromContext(ctx),
+		Time:      mw.log.clock.Now(),
+		Before:    before,
+		After:     mw.snapshot(ctx, newID),
+	})
+	return nil
+}
+
+// ClaimAndStart audits the claimed build like LeaseBuild.
+func (mw *auditMiddleware) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (Build, bool, error) {
+	b, ok, err := mw.Service.ClaimAndStart(ctx, workerID, filter)
+	if err == nil && ok {
+		mw.log.record(AuditEntry{
+			BuildID:   b.ID,
+			Method:    "ClaimAndStart",
+			Actor:     ActorFromContext(ctx),
+			RequestID: RequestIDFromContext(ctx),
+			Time:      mw.log.clock.Now(),
+			After:     mw.snapshot(ctx, b.ID),
+		})
+	}
+	return b, ok, err
+}
+
+// LeaseBuild audits the leased build; which one it is isn't known until
+// the lease is taken, so there's no before.
+func (mw *auditMiddleware) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (Build, bool, error) {
+	b, ok, err := mw.Service.LeaseBuild(ctx, workerID, ttl)
+	if err == nil && ok {
+		mw.log.record(AuditEntry{
+			BuildID:   b.ID,
+			Method:    "LeaseBuild",
+			Actor:     ActorFromContext(ctx),
+			RequestID: RequestIDFromContext(ctx),
+			Time:      mw.log.clock.Now(),
+			After:     mw.snapshot(ctx, b.ID),
+		})
+	}
+	return b, ok, err
+}
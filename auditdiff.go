@@ -0,0 +1,141 @@
+package gokitbuildservice
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// WithDiffAudit stores each entry's Before and After as JSON merge patches
+// (RFC 7386), Before against the previous entry's After and After against
+// Before, rather than as whole builds. Frequently changed builds then take
+// a fraction of the memory, as each entry only holds what changed. Entries
+// are rebuilt in full on read, walking the build's entries from the oldest
+// kept, which holds its Before in full.
+//
+// Rebuilt builds are what the stored ones encode to as JSON and back, so
+// they can differ from the originals where JSON can't tell, such as empty
+// and nil maps.
+func WithDiffAudit(diff bool) AuditOption {
+	return func(a *AuditLog) { a.diff = diff }
+}
+
+// auditState is a build as a generic JSON value, or nil for no build.
+type auditState = interface{}
+
+func stateOf(b *Build) auditState {
+	if b == nil {
+		return nil
+	}
+	p, err := json.Marshal(b)
+	if err != nil {
+		panic(err) // builds always encode
+	}
+	var s auditState
+	if err := json.Unmarshal(p, &s); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func buildOf(s auditState) *Build {
+	if s == nil {
+		return nil
+	}
+	p, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	var b Build
+	if err := json.Unmarshal(p, &b); err != nil {
+		panic(err)
+	}
+	return &b
+}
+
+// mergeDiff returns the merge patch taking from to to. Builds encode no
+// nulls, as their nillable fields are omitted when empty, so a null in
+// the patch always means the field was cleared.
+func mergeDiff(from, to auditState) auditState {
+	f, fok := from.(map[string]interface{})
+	t, tok := to.(map[string]interface{})
+	if !fok || !tok {
+		return to
+	}
+	patch := map[string]interface{}{}
+	for k, tv := range t {
+		fv, ok := f[k]
+		switch {
+		case !ok:
+			patch[k] = tv
+		case !reflect.DeepEqual(fv, tv):
+			patch[k] = mergeDiff(fv, tv)
+		}
+	}
+	for k := range f {
+		if _, ok := t[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch
+}
+
+// mergeApply applies patch to target, without changing target.
+func mergeApply(target, patch auditState) auditState {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, _ := target.(map[string]interface{})
+	out := make(map[string]interface{}, len(t)+len(p))
+	for k, v := range t {
+		out[k] = v
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(out, k)
+		} else {
+			out[k] = mergeApply(out[k], v)
+		}
+	}
+	return out
+}
+
+// compress replaces e's Before and After with patches, Before against
+// prev, and returns the state after e.
+func compress(e *AuditEntry, prev auditState) auditState {
+	before, after := stateOf(e.Before), stateOf(e.After)
+	e.beforePatch, e.afterPatch = mergeDiff(prev, before), mergeDiff(before, after)
+	e.Before, e.After = nil, nil
+	return after
+}
+
+// expand fills in e's Before and After from its patches, Before against
+// prev, and returns the state after e, leaving the stored entry as it is.
+func expand(e AuditEntry, prev auditState) (AuditEntry, auditState) {
+	before := mergeApply(prev, e.beforePatch)
+	after := mergeApply(before, e.afterPatch)
+	e.Before, e.After = buildOf(before), buildOf(after)
+	return e, after
+}
+
+// expandAll returns entries, compressed from a nil state, in full.
+func expandAll(entries []AuditEntry) []AuditEntry {
+	full := make([]AuditEntry, len(entries))
+	var state auditState
+	for i, e := range entries {
+		full[i], state = expand(e, state)
+	}
+	return full
+}
+
+// compressAll compresses full entries from a nil state, returning them and
+// the state after the last.
+func compressAll(full []AuditEntry) ([]AuditEntry, auditState) {
+	entries := make([]AuditEntry, len(full))
+	var state auditState
+	for i, e := range full {
+		state = compress(&e, state)
+		entries[i] = e
+	}
+	return entries, state
+}
@@ -0,0 +1,72 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDiffAuditMatchesFullAudit(t *testing.T) {
+	const perBuild = 3
+	full, diff := NewAuditLog(perBuild), NewAuditLog(perBuild, WithDiffAudit(true))
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := func(id, method string, before, after *Build) {
+		at = at.Add(time.Second)
+		for _, a := range []*AuditLog{full, diff} {
+			a.record(AuditEntry{BuildID: id, Method: method, Time: at, Before: before, After: after})
+		}
+	}
+	check := func(when string, ids ...string) {
+		t.Helper()
+		for _, id := range ids {
+			want, _, err := full.GetAuditLog(context.Background(), id, AuditFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := diff.GetAuditLog(context.Background(), id, AuditFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, _ := json.Marshal(want)
+			g, _ := json.Marshal(got)
+			if string(g) != string(w) {
+				t.Errorf("%s, entries of %q:\n got %s\nwant %s", when, id, g, w)
+			}
+		}
+	}
+
+	v1 := &Build{ID: "a", Name: "first", Status: StatusPending, Labels: map[string]string{"env": "ci"}}
+	v2 := &Build{ID: "a", Name: "first", Status: StatusRunning, Labels: map[string]string{"env": "ci", "team": "x"}}
+	v3 := &Build{ID: "a", Name: "second", Status: StatusRunning, Labels: map[string]string{"team": "x"}, DependsOn: []string{"z"}}
+	v4 := &Build{ID: "a", Name: "second", Status: StatusFailed, FailureReason: "boom"}
+	record("a", "PostBuild", nil, v1)
+	record("a", "PatchBuild", v1, v2)
+	check("before any eviction", "a")
+	record("a", "PatchBuild", v2, v3)
+	record("a", "FailBuild", v3, v4)
+	record("a", "PutBuild", v4, v1)
+	check("after evicting the creation", "a")
+
+	record("a", "DeleteBuild", v1, nil)
+	record("a", "PostBuild", nil, v2)
+	check("after a delete and re-create", "a")
+
+	b1 := &Build{ID: "b", Name: "old b", Status: StatusSucceeded}
+	record("b", "PostBuild", nil, b1)
+	record("b", "DeleteBuild", b1, nil)
+	for _, a := range []*AuditLog{full, diff} {
+		a.rename("a", "b")
+	}
+	renamed := *v2
+	renamed.ID = "b"
+	record("b", "RenameBuild", v2, &renamed)
+	check("after a rename onto an ID with history", "a", "b")
+
+	after := renamed
+	after.Labels = nil
+	after.Name = "renamed"
+	record("b", "PatchBuild", &renamed, &after)
+	record("b", "PatchBuild", &after, &renamed)
+	check("after editing the renamed build", "b")
+}
@@ -0,0 +1,41 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// ErrUnauthorized is returned when a request lacks valid credentials for the
+// operation.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// tokenToContext maps a bearer token to the name of the caller it belongs
+// to, and records them as the actor. Unknown tokens leave the context
+// untouched.
+func tokenToContext(tokens map[string]string) func(context.Context, *http.Request) context.Context {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return ctx
+		}
+		if name, ok := tokens[token]; ok {
+			return WithActor(ctx, name)
+		}
+		return ctx
+	}
+}
+
+// requireActor is an endpoint middleware rejecting calls with no
+// authenticated actor in the context.
+func requireActor(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if ActorFromContext(ctx) == "" {
+			return nil, ErrUnauthorized
+		}
+		return next(ctx, request)
+	}
+}
@@ -0,0 +1,325 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// ErrForbidden is returned when an Authorizer denies an operation.
+var ErrForbidden = errors.New("forbidden")
+
+// Authorizer decides whether the actor in ctx (see ActorFromContext) may
+// call method, the name of a Service method such as "DeleteBuild", on b.
+// It's asked by AuthorizingEndpoint, which MakeHTTPHandler puts in front
+// of every endpoint WithAuthorizer.
+// It returns nil to allow the call, and ErrForbidden, or an error wrapping
+// it, to deny it; any other error fails the call as it is.
+//
+// b is the build the call is about, as currently stored, or as given in
+// the call if it isn't stored yet. Calls about no build in particular,
+// such as ListBuilds or LeaseBuild, get a zero Build, and calls about
+// several builds are authorized once for each of them.
+//
+// To hand decisions to a policy engine such as OPA, implement Authorize
+// with a request to its decision API, passing method, the actor and b as
+// the input, and return ErrForbidden unless the result allows the call.
+// Keep such a request short with a deadline on ctx: it's made before every
+// call to the endpoints.
+type Authorizer interface {
+	Authorize(ctx context.Context, method string, b Build) error
+}
+
+// AuthorizerFunc adapts a function to an Authorizer.
+type AuthorizerFunc func(ctx context.Context, method string, b Build) error
+
+// Authorize calls f.
+func (f AuthorizerFunc) Authorize(ctx context.Context, method string, b Build) error {
+	return f(ctx, method, b)
+}
+
+// AuthorizingEndpoint returns an endpoint middleware asking a whether each
+// call to the endpoint for method may go ahead, and failing it with a's
+// error if not. method is the name of the Service method the endpoint
+// calls, such as "DeleteBuild", or for endpoints calling several, the
+// endpoint's own name, such as "DiffBuilds" or "ImportBuilds".
+//
+// The builds the request names are first read from s, so a decides on
+// what's stored rather than on what the caller claims.
+func AuthorizingEndpoint(a Authorizer, s Service, method string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if err := authorizeRequest(ctx, a, s, method, request); err != nil {
+				return nil, err
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// authorizeRequest asks a about each of the builds request is about.
+func authorizeRequest(ctx context.Context, a Authorizer, s Service, method string, request interface{}) error {
+	if req, ok := request.(cancelGroupRequest); ok {
+		members, err := s.ListBuildsByGroup(ctx, req.GroupID)
+		if err != nil {
+			return err
+		}
+		for _, b := range members {
+			if err := a.Authorize(ctx, method, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if req, ok := request.(batchPostBuildsRequest); ok {
+		for _, b := range req.Builds {
+			if err := authorizeBuild(ctx, a, s, method, b.ID, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ids, fallback := authzTarget(request)
+	if len(ids) == 0 {
+		return a.Authorize(ctx, method, fallback)
+	}
+	for _, id := range ids {
+		b := fallback
+		if b.ID != id {
+			b = Build{ID: id}
+		}
+		if err := authorizeBuild(ctx, a, s, method, id, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeBuild asks a about build id as stored in s, or about fallback
+// if id is blank or isn't stored.
+func authorizeBuild(ctx context.Context, a Authorizer, s Service, method, id string, fallback Build) error {
+	b := fallback
+	if id != "" {
+		stored, err := s.GetBuild(ctx, id)
+		switch {
+		case err == nil:
+			b = stored
+		case !errors.Is(err, ErrNotFound):
+			return err
+		}
+	}
+	return a.Authorize(ctx, method, b)
+}
+
+// authzTarget returns the IDs of the builds request is about, and the
+// build to decide on for an ID that isn't stored, or if there are none.
+func authzTarget(request interface{}) (ids []string, fallback Build) {
+	switch req := request.(type) {
+	case postBuildRequest:
+		return []string{req.Build.ID}, req.Build
+	case putBuildRequest:
+		return []string{req.ID}, req.Build
+	case validateBuildRequest:
+		return nil, req.Build
+	case getBuildsRequest:
+		return req.IDs, Build{}
+	case listBuildStatusesRequest:
+		return req.IDs, Build{}
+	case patchBuildsRequest:
+		return req.IDs, Build{}
+	case diffBuildsRequest:
+		return []string{req.IDA, req.IDB}, Build{}
+	case listBuildsByGroupRequest:
+		return nil, Build{GroupID: req.GroupID}
+	case groupStatusRequest:
+		return nil, Build{GroupID: req.GroupID}
+	case getBuildRequest:
+		return []string{req.ID}, Build{}
+	case patchBuildRequest:
+		return []string{req.ID}, Build{}
+	case compareAndSetStatusRequest:
+		return []string{req.ID}, Build{}
+	case deleteBuildRequest:
+		return []string{req.ID}, Build{}
+	case appendBuildLogsRequest:
+		return []string{req.ID}, Build{}
+	case getBuildLogLengthRequest:
+		return []string{req.ID}, Build{}
+	case getBuildLogsRequest:
+		return []string{req.ID}, Build{}
+	case setOutputRequest:
+		return []string{req.ID}, Build{}
+	case getOutputRequest:
+		return []string{req.ID}, Build{}
+	case replayBuildRequest:
+		return []string{req.ID}, Build{}
+	case queuePositionRequest:
+		return []string{req.ID}, Build{}
+	case rerunFailedStepsRequest:
+		return []string{req.ID}, Build{}
+	case failBuildRequest:
+		return []string{req.ID}, Build{}
+	case renameBuildRequest:
+		return []string{req.ID}, Build{}
+	case getStatusHistoryRequest:
+		return []string{req.ID}, Build{}
+	case getDependencyTreeRequest:
+		return []string{req.ID}, Build{}
+	case forceReleaseLeaseRequest:
+		return []string{req.ID}, Build{}
+	case getAuditLogRequest:
+		return []string{req.ID}, Build{}
+	}
+	return nil, Build{}
+}
+
+// authorized returns e with every endpoint behind AuthorizingEndpoint.
+func (e Endpoints) authorized(a Authorizer, s Service) Endpoints {
+	mw := func(method string, next endpoint.Endpoint) endpoint.Endpoint {
+		return AuthorizingEndpoint(a, s, method)(next)
+	}
+	e.PostBuildEndpoint = mw("PostBuild", e.PostBuildEndpoint)
+	e.GetOrCreateBuildEndpoint = mw("GetOrCreateBuild", e.GetOrCreateBuildEndpoint)
+	e.GetBuildEndpoint = mw("GetBuild", e.GetBuildEndpoint)
+	e.GetBuildsEndpoint = mw("GetBuilds", e.GetBuildsEndpoint)
+	e.ListBuildStatusesEndpoint = mw("ListBuildStatuses", e.ListBuildStatusesEndpoint)
+	e.ReserveIDEndpoint = mw("ReserveID", e.ReserveIDEndpoint)
+	e.ListBuildsEndpoint = mw("ListBuilds", e.ListBuildsEndpoint)
+	e.PutBuildEndpoint = mw("PutBuild", e.PutBuildEndpoint)
+	e.PatchBuildEndpoint = mw("PatchBuild", e.PatchBuildEndpoint)
+	e.PatchBuildsEndpoint = mw("PatchBuilds", e.PatchBuildsEndpoint)
+	e.BatchPostBuildsEndpoint = mw("BatchPostBuilds", e.BatchPostBuildsEndpoint)
+	e.DeleteBuildEndpoint = mw("DeleteBuild", e.DeleteBuildEndpoint)
+	e.AppendBuildLogsEndpoint = mw("AppendBuildLogs", e.AppendBuildLogsEndpoint)
+	e.GetBuildLogLengthEndpoint = mw("GetBuildLogLength", e.GetBuildLogLengthEndpoint)
+	e.GetBuildLogsEndpoint = mw("GetBuildLogs", e.GetBuildLogsEndpoint)
+	e.ReplayBuildEndpoint = mw("ReplayBuild", e.ReplayBuildEndpoint)
+	e.GetLimitsEndpoint = mw("GetLimits", e.GetLimitsEndpoint)
+	e.FindByFingerprintEndpoint = mw("FindSucceededByFingerprint", e.FindByFingerprintEndpoint)
+	e.SetOutputEndpoint = mw("SetOutput", e.SetOutputEndpoint)
+	e.GetOutputEndpoint = mw("GetOutput", e.GetOutputEndpoint)
+	e.DiffBuildsEndpoint = mw("DiffBuilds", e.DiffBuildsEndpoint)
+	e.ValidateBuildEndpoint = mw("ValidateBuild", e.ValidateBuildEndpoint)
+	e.ForceReleaseLeaseEndpoint = mw("ForceReleaseLease", e.ForceReleaseLeaseEndpoint)
+	e.ImportBuildsEndpoint = mw("ImportBuilds", e.ImportBuildsEndpoint)
+	e.QueuePositionEndpoint = mw("QueuePosition", e.QueuePositionEndpoint)
+	e.CompareAndSetStatusEndpoint = mw("CompareAndSetStatus", e.CompareAndSetStatusEndpoint)
+	e.RerunFailedStepsEndpoint = mw("RerunFailedSteps", e.RerunFailedStepsEndpoint)
+	e.GetDependencyTreeEndpoint = mw("GetDependencyTree", e.GetDependencyTreeEndpoint)
+	e.GetStatusHistoryEndpoint = mw("GetStatusHistory", e.GetStatusHistoryEndpoint)
+	e.BuildMetricsEndpoint = mw("BuildMetrics", e.BuildMetricsEndpoint)
+	e.FailBuildEndpoint = mw("FailBuild", e.FailBuildEndpoint)
+	e.RenameBuildEndpoint = mw("RenameBuild", e.RenameBuildEndpoint)
+	e.ListLabelKeysEndpoint = mw("ListLabelKeys", e.ListLabelKeysEndpoint)
+	e.ListLabelValuesEndpoint = mw("ListLabelValues", e.ListLabelValuesEndpoint)
+	e.FindBuildsBySpecHashEndpoint = mw("FindBuildsBySpecHash", e.FindBuildsBySpecHashEndpoint)
+	e.ListBuildsByGroupEndpoint = mw("ListBuildsByGroup", e.ListBuildsByGroupEndpoint)
+	e.CancelGroupEndpoint = mw("CancelGroup", e.CancelGroupEndpoint)
+	e.GroupStatusEndpoint = mw("GroupStatus", e.GroupStatusEndpoint)
+	return e
+}
+
+// Role is what an actor may do, according to a RoleAuthorizer.
+type Role string
+
+const (
+	// RoleReader may call the methods that don't change anything.
+	RoleReader Role = "reader"
+	// RoleWriter may also create and change builds, and delete or rename
+	// the ones it created.
+	RoleWriter Role = "writer"
+	// RoleAdmin may call every method on every build.
+	RoleAdmin Role = "admin"
+)
+
+// readMethods are the Service methods RoleReader may call.
+var readMethods = map[string]bool{
+	"GetBuild":                   true,
+	"GetBuilds":                  true,
+	"ListBuildStatuses":          true,
+	"ListBuilds":                 true,
+	"ListBuildsModifiedBetween":  true,
+	"GetBuildLogLength":          true,
+	"GetBuildLogs":               true,
+	"ValidateBuild":              true,
+	"QueuePosition":              true,
+	"ListLabelKeys":              true,
+	"ListLabelValues":            true,
+	"FindBuildsBySpecHash":       true,
+	"FindSucceededByFingerprint": true,
+	"ReplayBuild":                true,
+	"GetLimits":                  true,
+	"GetOutput":                  true,
+	"ListBuildsByGroup":          true,
+	"GroupStatus":                true,
+	"DiffBuilds":                 true,
+	"GetDependencyTree":          true,
+	"GetStatusHistory":           true,
+	"BuildMetrics":               true,
+	"GetAuditLog":                true,
+}
+
+// ownerMethods are the Service methods RoleWriter may only call on the
+// builds it created.
+var ownerMethods = map[string]bool{
+	"DeleteBuild": true,
+	"RenameBuild": true,
+}
+
+// adminMethods are the Service methods only RoleAdmin may call.
+var adminMethods = map[string]bool{
+	"ForceReleaseLease": true,
+}
+
+// RoleAuthorizer is the Authorizer deciding by the role of the actor, as
+// given to NewRoleAuthorizer. The creator of a build is its CreatedBy.
+type RoleAuthorizer struct {
+	roles     map[string]Role
+	anonymous Role
+}
+
+// RoleAuthorizerOption configures a RoleAuthorizer.
+type RoleAuthorizerOption func(*RoleAuthorizer)
+
+// WithAnonymousRole gives r to calls with no actor, and to actors with no
+// role. By default they may do nothing.
+func WithAnonymousRole(r Role) RoleAuthorizerOption {
+	return func(a *RoleAuthorizer) { a.anonymous = r }
+}
+
+// NewRoleAuthorizer returns a RoleAuthorizer giving each actor in roles its
+// role.
+func NewRoleAuthorizer(roles map[string]Role, opts ...RoleAuthorizerOption) *RoleAuthorizer {
+	a := &RoleAuthorizer{roles: roles}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Authorize allows method on b if the actor's role covers it.
+func (a *RoleAuthorizer) Authorize(ctx context.Context, method string, b Build) error {
+	actor := ActorFromContext(ctx)
+	role, ok := a.roles[actor]
+	if !ok || actor == "" {
+		role = a.anonymous
+	}
+	switch role {
+	case RoleAdmin:
+		return nil
+	case RoleWriter:
+		if adminMethods[method] {
+			return ErrForbidden
+		}
+		if ownerMethods[method] && (actor == "" || b.CreatedBy != actor) {
+			return ErrForbidden
+		}
+		return nil
+	case RoleReader:
+		if readMethods[method] {
+			return nil
+		}
+	}
+	return ErrForbidden
+}
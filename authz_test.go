@@ -0,0 +1,86 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestAuthorizerOverHTTP(t *testing.T) {
+	s := NewInmemService()
+	a := NewRoleAuthorizer(map[string]Role{"alice": RoleWriter, "bob": RoleWriter, "carol": RoleReader})
+	srv := httptest.NewServer(MakeHTTPHandler(s, log.NewNopLogger(),
+		WithActorTokens(map[string]string{"ta": "alice", "tb": "bob", "tc": "carol"}),
+		WithAuthorizer(a),
+	))
+	defer srv.Close()
+
+	do := func(method, path, token, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := do("POST", "/builds/", "", `{"id":"a1"}`); code != http.StatusForbidden {
+		t.Fatalf("anonymous POST: got %d, want 403", code)
+	}
+	if code := do("POST", "/builds/", "tc", `{"id":"a1"}`); code != http.StatusForbidden {
+		t.Fatalf("reader POST: got %d, want 403", code)
+	}
+	if code := do("POST", "/builds/", "ta", `{"id":"a1","createdBy":"bob"}`); code != http.StatusOK {
+		t.Fatalf("writer POST: got %d, want 200", code)
+	}
+	if b, _ := s.GetBuild(context.Background(), "a1"); b.CreatedBy != "alice" {
+		t.Fatalf("CreatedBy: got %q, want the caller, not the body's claim", b.CreatedBy)
+	}
+	if code := do("GET", "/builds/a1", "tc", ""); code != http.StatusOK {
+		t.Fatalf("reader GET: got %d, want 200", code)
+	}
+	if code := do("DELETE", "/builds/a1", "tb", ""); code != http.StatusForbidden {
+		t.Fatalf("other writer DELETE: got %d, want 403", code)
+	}
+	if code := do("DELETE", "/builds/a1", "ta", ""); code != http.StatusOK {
+		t.Fatalf("creator DELETE: got %d, want 200", code)
+	}
+}
+
+func TestCreatorOutlivesStatusHistory(t *testing.T) {
+	s := NewInmemService()
+	ctx := WithActor(context.Background(), "alice")
+	if err := s.PostBuild(ctx, Build{ID: "long"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxStatusHistory+10; i++ {
+		from, to := StatusPending, StatusRunning
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		if ok, err := s.CompareAndSetStatus(WithActor(context.Background(), "worker"), "long", from, to); !ok || err != nil {
+			t.Fatalf("transition %d: %v, %v", i, ok, err)
+		}
+	}
+	b, err := s.GetBuild(ctx, "long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.StatusHistory[0].From == "" {
+		t.Fatal("creation entry still in the history; the test doesn't trim it")
+	}
+	a := NewRoleAuthorizer(map[string]Role{"alice": RoleWriter})
+	if err := a.Authorize(ctx, "DeleteBuild", b); err != nil {
+		t.Fatalf("creator denied after the history was trimmed: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// BuildPatch is the change PatchBuilds applies to every build it's given.
+// As with PatchBuild, zero fields are left as they are.
+type BuildPatch struct {
+	Name       string            `json:"name,omitempty"`
+	Steps      []Step            `json:"steps,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	DependsOn  []string          `json:"dependsOn,omitempty"`
+	Priority   int               `json:"priority,omitempty"`
+	ExpiresAt  *time.Time        `json:"expiresAt,omitempty"`
+	Status     BuildStatus       `json:"status,omitempty"`
+}
+
+func (p BuildPatch) build(id string) Build {
+	return Build{
+		ID:         id,
+		Name:       p.Name,
+		Steps:      p.Steps,
+		Labels:     p.Labels,
+		Parameters: p.Parameters,
+		DependsOn:  p.DependsOn,
+		Priority:   p.Priority,
+		ExpiresAt:  p.ExpiresAt,
+		Status:     p.Status,
+	}
+}
+
+// BatchResult is the outcome of a batch operation for one build. Err is
+// nil if it succeeded.
+type BatchResult struct {
+	ID  string
+	Err error
+}
+
+// MarshalJSON encodes r as {"id", "error"}, leaving error out on success.
+func (r BatchResult) MarshalJSON() ([]byte, error) {
+	v := struct {
+		ID    string `json:"id"`
+		Error string `json:"error,omitempty"`
+	}{ID: r.ID}
+	if r.Err != nil {
+		v.Error = r.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// failedResults counts the results that didn't succeed.
+func failedResults(results []BatchResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// PatchBuilds applies patch to each of the builds in ids, in order, under
+// one write lock, and reports the outcome for each: ErrNotFound for a build
+// that doesn't exist, or the validation errors of one the patch would make
+// invalid. A build is either patched completely or left alone, and one
+// failing doesn't stop the others. Once ctx is done, the builds not yet
+// patched fail with its error.
+func (s *buildService) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	results := make([]BatchResult, len(ids))
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			results[i] = BatchResult{ID: id, Err: err}
+			continue
+		}
+		results[i] = BatchResult{ID: id, Err: s.patch(ctx, id, patch.build(id))}
+	}
+	return results, nil
+}
+
+// BatchPostBuilds creates each of builds, in order, under one write lock,
+// and reports the outcome for each as PostBuild would: ErrAlreadyExists for
+// a build whose ID is taken, or its validation errors. One failing doesn't
+// stop the others. Once ctx is done, the builds not yet created fail with
+// its error.
+func (s *buildService) BatchPostBuilds(ctx context.Context, builds []Build) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	results := make([]BatchResult, len(builds))
+	for i, b := range builds {
+		results[i] = BatchResult{ID: b.ID}
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if errs := b.ValidateWithin(s.limits); errs != nil {
+			results[i].Err = errs
+			continue
+		}
+		results[i].Err = s.post(ctx, b)
+	}
+	return results, nil
+}
+
+// BatchOption configures BatchFanOutMiddleware.
+type BatchOption func(*batchFanOutMiddleware)
+
+// WithBatchConcurrency sets how many builds of a batch are worked on at
+// once. The default is 8; values under 1 are taken as 1.
+func WithBatchConcurrency(n int) BatchOption {
+	return func(mw *batchFanOutMiddleware) {
+		if n < 1 {
+			n = 1
+		}
+		mw.concurrency = n
+	}
+}
+
+// BatchFanOutMiddleware runs PatchBuilds as concurrent PatchBuild calls,
+// and BatchPostBuilds as concurrent PostBuild calls, a bounded number at a
+// time, with the results in the order they were asked for. It's
+// meant for backends where each call waits on the network, such as a remote
+// service, and a batch is otherwise as slow as the sum of its builds. The
+// in-memory service already patches a batch under a single lock, and gains
+// nothing from it.
+//
+// Each build is still written completely or not at all, but the builds are
+// written in no particular order, and concurrent writers may see some of
+// the batch applied before the rest. Once ctx is done, the builds not yet
+// started fail with its error.
+func BatchFanOutMiddleware(opts ...BatchOption) Middleware {
+	return func(next Service) Service {
+		mw := &batchFanOutMiddleware{Service: next, concurrency: 8}
+		for _, opt := range opts {
+			opt(mw)
+		}
+		return mw
+	}
+}
+
+type batchFanOutMiddleware struct {
+	Service
+	concurrency int
+}
+
+func (mw *batchFanOutMiddleware) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) ([]BatchResult, error) {
+	return mw.fanOut(ctx, ids, func(i int) error {
+		return mw.Service.PatchBuild(ctx, ids[i], patch.build(ids[i]))
+	})
+}
+
+func (mw *batchFanOutMiddleware) BatchPostBuilds(ctx context.Context, builds []Build) ([]BatchResult, error) {
+	ids := make([]string, len(builds))
+	for i, b := range builds {
+		ids[i] = b.ID
+	}
+	return mw.fanOut(ctx, ids, func(i int) error {
+		return mw.Service.PostBuild(ctx, builds[i])
+	})
+}
+
+// fanOut calls write for each index of ids, at most mw.concurrency at a
+// time, and returns the result of each in the same place.
+func (mw *batchFanOutMiddleware) fanOut(ctx context.Context, ids []string, write func(i int) error) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, len(ids))
+	sem := make(chan struct{}, mw.concurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = BatchResult{ID: id, Err: ctx.Err()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, id string) {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = BatchResult{ID: id, Err: write(i)}
+		}(i, id)
+	}
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,93 @@
+package gokitbuildservice_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+func TestBatchPostBuilds(t *testing.T) {
+	s := gokitbuildservice.NewInmemService()
+	ctx := context.Background()
+	if err := s.PostBuild(ctx, gokitbuildservice.Build{ID: "taken"}); err != nil {
+		t.Fatal(err)
+	}
+	results, err := s.BatchPostBuilds(ctx, []gokitbuildservice.Build{{ID: "a"}, {ID: "taken"}, {ID: ""}, {ID: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []error{nil, gokitbuildservice.ErrAlreadyExists, gokitbuildservice.ErrValidation, nil}
+	for i, r := range results {
+		if !errors.Is(r.Err, want[i]) || (want[i] == nil && r.Err != nil) {
+			t.Errorf("results[%d] = %+v, want error %v", i, r, want[i])
+		}
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := s.GetBuild(ctx, id); err != nil {
+			t.Errorf("GetBuild(%q): %v", id, err)
+		}
+	}
+}
+
+func TestBatchFanOutKeepsOrder(t *testing.T) {
+	fake := &servicetest.FakeService{
+		PostBuildFunc: func(ctx context.Context, b gokitbuildservice.Build) error {
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+			if b.Name == "bad" {
+				return gokitbuildservice.ErrAlreadyExists
+			}
+			return nil
+		},
+	}
+	s := gokitbuildservice.BatchFanOutMiddleware(gokitbuildservice.WithBatchConcurrency(4))(fake)
+	var builds []gokitbuildservice.Build
+	for i := 0; i < 50; i++ {
+		b := gokitbuildservice.Build{ID: fmt.Sprint("b", i)}
+		if i%7 == 0 {
+			b.Name = "bad"
+		}
+		builds = append(builds, b)
+	}
+	results, err := s.BatchPostBuilds(context.Background(), builds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(builds) {
+		t.Fatalf("got %d results for %d builds", len(results), len(builds))
+	}
+	for i, r := range results {
+		if r.ID != builds[i].ID || (r.Err != nil) != (i%7 == 0) {
+			t.Errorf("results[%d] = %+v, for build %q", i, r, builds[i].ID)
+		}
+	}
+	if n := len(fake.CallsTo("PostBuild")); n != len(builds) {
+		t.Errorf("PostBuild called %d times, want %d", n, len(builds))
+	}
+}
+
+// BenchmarkBatchPostBuilds compares writing a batch one build at a time
+// with fanning it out, against a backend taking a millisecond per write.
+func BenchmarkBatchPostBuilds(b *testing.B) {
+	builds := make([]gokitbuildservice.Build, 64)
+	for i := range builds {
+		builds[i] = gokitbuildservice.Build{ID: fmt.Sprint("b", i)}
+	}
+	for _, n := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("concurrency=%d", n), func(b *testing.B) {
+			fake := &servicetest.FakeService{Delays: map[string]time.Duration{"PostBuild": time.Millisecond}}
+			s := gokitbuildservice.BatchFanOutMiddleware(gokitbuildservice.WithBatchConcurrency(n))(fake)
+			for i := 0; i < b.N; i++ {
+				if _, err := s.BatchPostBuilds(context.Background(), builds); err != nil {
+					b.Fatal(err)
+				}
+				fake.Reset()
+			}
+		})
+	}
+}
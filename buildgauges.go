@@ -0,0 +1,129 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// BuildGaugeOption configures a build status collector.
+type BuildGaugeOption func(*buildStatusCollector)
+
+// WithMaxBuildSeries caps how many builds the collector exports, 1000 by
+// default; a negative n is taken as 0, which exports none but still counts
+// them in build_status_dropped. See NewBuildStatusCollector for which are
+// dropped.
+func WithMaxBuildSeries(n int) BuildGaugeOption {
+	return func(c *buildStatusCollector) { c.max = max(n, 0) }
+}
+
+// WithRecentTerminal sets how long after finishing a build is still
+// exported, 15 minutes by default, so alerts on a build's last status have
+// time to resolve. Zero exports unfinished builds only.
+func WithRecentTerminal(d time.Duration) BuildGaugeOption {
+	return func(c *buildStatusCollector) { c.recent = d }
+}
+
+// WithBuildGaugeClock judges how long ago builds finished with c rather
+// than SystemClock.
+func WithBuildGaugeClock(clk Clock) BuildGaugeOption {
+	return func(c *buildStatusCollector) { c.clock = clk }
+}
+
+var (
+	buildStatusDesc = stdprometheus.NewDesc(
+		"build_status",
+		"Status of an individual build: 1 for the status it's in.",
+		[]string{"id", "name", "status"}, nil,
+	)
+	buildStatusDroppedDesc = stdprometheus.NewDesc(
+		"build_status_dropped",
+		"Number of builds left out of build_status by the series cap.",
+		nil, nil,
+	)
+)
+
+// NewBuildStatusCollector returns a Prometheus collector exporting one
+// build_status{id,name,status} gauge per build of s, so individual builds
+// can be alerted on, e.g. builds running longer than an hour with
+//
+//	build_status{status="running"} and build_status{status="running"} offset 1h
+//
+// Every build is its own series, which is the opposite of what Prometheus
+// is built for: each one costs memory in every server scraping it for as
+// long as the series is retained, and a series ends whenever its build
+// leaves the export. The collector bounds the cost by exporting unfinished
+// builds plus those that finished within WithRecentTerminal, and at most
+// WithMaxBuildSeries of them: past the cap, the longest finished builds are
+// dropped first, then the most recently created unfinished ones, so the
+// builds that have been running longest are the last to go. The count left
+// out is exported as build_status_dropped. Keep the cap well below what
+// the Prometheus servers are sized for, and scrape the collector from its
+// own registry, apart from the aggregate metrics, so it can be dropped or
+// scraped less often on its own.
+//
+// Builds are listed from s on every scrape.
+func NewBuildStatusCollector(s Service, opts ...BuildGaugeOption) stdprometheus.Collector {
+	c := &buildStatusCollector{
+		s:      s,
+		max:    1000,
+		recent: 15 * time.Minute,
+		clock:  SystemClock,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type buildStatusCollector struct {
+	s      Service
+	max    int
+	recent time.Duration
+	clock  Clock
+}
+
+func (c *buildStatusCollector) Describe(ch chan<- *stdprometheus.Desc) {
+	ch <- buildStatusDesc
+	ch <- buildStatusDroppedDesc
+}
+
+func (c *buildStatusCollector) Collect(ch chan<- stdprometheus.Metric) {
+	builds, err := c.s.ListBuilds(context.Background(), ListOptions{SortBy: "createdAt"})
+	if err != nil {
+		ch <- stdprometheus.NewInvalidMetric(buildStatusDesc, err)
+		return
+	}
+	exported, dropped := c.pick(builds, c.clock.Now())
+	for _, b := range exported {
+		ch <- stdprometheus.MustNewConstMetric(buildStatusDesc, stdprometheus.GaugeValue, 1, b.ID, b.Name, string(b.Status))
+	}
+	ch <- stdprometheus.MustNewConstMetric(buildStatusDroppedDesc, stdprometheus.GaugeValue, float64(dropped))
+}
+
+// pick returns the builds to export out of builds, listed oldest first,
+// and how many were left out for the cap.
+func (c *buildStatusCollector) pick(builds []Build, now time.Time) ([]Build, int) {
+	var active, finished []Build
+	for _, b := range builds {
+		switch {
+		case !b.Status.Terminal():
+			active = append(active, b)
+		case b.FinishedAt != nil && now.Sub(*b.FinishedAt) <= c.recent:
+			finished = append(finished, b)
+		}
+	}
+	total := len(active) + len(finished)
+	if total <= c.max {
+		return append(active, finished...), 0
+	}
+	if len(active) >= c.max {
+		return active[:c.max], total - c.max
+	}
+	sort.SliceStable(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.After(*finished[j].FinishedAt)
+	})
+	return append(active, finished[:c.max-len(active)]...), total - c.max
+}
@@ -0,0 +1,95 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestBuildGaugesPick(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) *time.Time { at := now.Add(-d); return &at }
+	// Oldest first, as Collect lists them.
+	builds := []Build{
+		{ID: "run1", Status: StatusRunning},
+		{ID: "done5m", Status: StatusSucceeded, FinishedAt: ago(5 * time.Minute)},
+		{ID: "pend1", Status: StatusPending},
+		{ID: "done1m", Status: StatusFailed, FinishedAt: ago(time.Minute)},
+		{ID: "done1h", Status: StatusSucceeded, FinishedAt: ago(time.Hour)},
+		{ID: "done10m", Status: StatusCancelled, FinishedAt: ago(10 * time.Minute)},
+		{ID: "run2", Status: StatusRunning},
+	}
+	for _, tc := range []struct {
+		max     int
+		want    []string
+		dropped int
+	}{
+		// done1h finished longer ago than WithRecentTerminal, so it's never
+		// exported nor counted.
+		{10, []string{"run1", "pend1", "run2", "done5m", "done1m", "done10m"}, 0},
+		{6, []string{"run1", "pend1", "run2", "done5m", "done1m", "done10m"}, 0},
+		// Finished builds go first, longest finished first...
+		{5, []string{"run1", "pend1", "run2", "done1m", "done5m"}, 1},
+		{4, []string{"run1", "pend1", "run2", "done1m"}, 2},
+		{3, []string{"run1", "pend1", "run2"}, 3},
+		// ...then the most recently created unfinished ones.
+		{2, []string{"run1", "pend1"}, 4},
+		{0, nil, 6},
+		{-1, nil, 6},
+	} {
+		c := NewBuildStatusCollector(nil, WithMaxBuildSeries(tc.max)).(*buildStatusCollector)
+		got, dropped := c.pick(builds, now)
+		var ids []string
+		for _, b := range got {
+			ids = append(ids, b.ID)
+		}
+		if !reflect.DeepEqual(ids, tc.want) || dropped != tc.dropped {
+			t.Errorf("max %d: got %v dropping %d, want %v dropping %d", tc.max, ids, dropped, tc.want, tc.dropped)
+		}
+	}
+}
+
+func TestBuildGaugesCollect(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewInmemService(WithClock(clock))
+	for _, b := range []Build{{ID: "a", Name: "alpha"}, {ID: "b"}, {ID: "c"}} {
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Second)
+	}
+	if ok, err := s.CompareAndSetStatus(ctx, "a", StatusPending, StatusRunning); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	c := NewBuildStatusCollector(s, WithMaxBuildSeries(2), WithBuildGaugeClock(clock))
+	ch := make(chan stdprometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	var got []string
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, l := range pb.GetLabel() {
+			labels = append(labels, l.GetName()+"="+l.GetValue())
+		}
+		got = append(got, fmt.Sprintf("{%s} %g", strings.Join(labels, ","), pb.GetGauge().GetValue()))
+	}
+	want := []string{
+		"{id=a,name=alpha,status=running} 1",
+		"{id=b,name=,status=pending} 1",
+		"{} 1", // build_status_dropped
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,385 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// CanaryWeight is the share of builds, from 0 to 1, that a canary service
+// sends to its candidate. It may be changed while the service is in use.
+type CanaryWeight struct {
+	bits atomic.Uint64
+}
+
+// NewCanaryWeight returns a CanaryWeight starting at w, clamped to [0, 1].
+func NewCanaryWeight(w float64) *CanaryWeight {
+	cw := &CanaryWeight{}
+	cw.Set(math.Min(math.Max(w, 0), 1))
+	return cw
+}
+
+// Get returns the current weight.
+func (w *CanaryWeight) Get() float64 {
+	return math.Float64frombits(w.bits.Load())
+}
+
+// Set changes the weight, failing if v isn't between 0 and 1.
+func (w *CanaryWeight) Set(v float64) error {
+	if !(v >= 0 && v <= 1) {
+		var errs ValidationErrors
+		errs.add("weight", "must be between 0 and 1")
+		return errs
+	}
+	w.bits.Store(math.Float64bits(v))
+	return nil
+}
+
+// CanaryOption configures a canary service.
+type CanaryOption func(*canaryService)
+
+// WithCanaryMetrics counts the calls routed by the canary service, labelled
+// by "method", "path" ("stable" or "candidate") and "error" ("true" or
+// "false"), so the error rates of the two paths can be compared.
+func WithCanaryMetrics(requests metrics.Counter) CanaryOption {
+	return func(c *canaryService) { c.requests = requests }
+}
+
+// NewCanaryService returns a Service that sends the calls for weight of
+// builds to candidate, and everything else to stable. Builds are picked by
+// a hash of their ID, so all the calls for a build take the same path, and
+// raising the weight only ever moves builds onto the candidate. Calls that
+// aren't about one build, such as lists and leases, always go to stable.
+func NewCanaryService(stable, candidate Service, weight *CanaryWeight, opts ...CanaryOption) Service {
+	c := &canaryService{
+		stable:    stable,
+		candidate: candidate,
+		weight:    weight,
+		requests:  discard.NewCounter(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type canaryService struct {
+	stable    Service
+	candidate Service
+	weight    *CanaryWeight
+	requests  metrics.Counter
+}
+
+// route picks the path for build id.
+func (c *canaryService) route(id string) (Service, string) {
+	sum := sha256.Sum256([]byte(id))
+	if w := c.weight.Get(); w >= 1 || float64(binary.BigEndian.Uint64(sum[:])) < w*math.MaxUint64 {
+		return c.candidate, "candidate"
+	}
+	return c.stable, "stable"
+}
+
+func (c *canaryService) count(method, path string, err error) {
+	c.requests.With("method", method, "path", path, "error", fmt.Sprint(err != nil)).Add(1)
+}
+
+func (c *canaryService) PostBuild(ctx context.Context, b Build) error {
+	s, path := c.route(b.ID)
+	err := s.PostBuild(ctx, b)
+	c.count("PostBuild", path, err)
+	return err
+}
+
+func (c *canaryService) GetOrCreateBuild(ctx context.Context, b Build) (Build, bool, error) {
+	s, path := c.route(b.ID)
+	got, created, err := s.GetOrCreateBuild(ctx, b)
+	c.count("GetOrCreateBuild", path, err)
+	return got, created, err
+}
+
+func (c *canaryService) GetBuild(ctx context.Context, id string) (Build, error) {
+	s, path := c.route(id)
+	b, err := s.GetBuild(ctx, id)
+	c.count("GetBuild", path, err)
+	return b, err
+}
+
+func (c *canaryService) GetBuilds(ctx context.Context, ids []string) (map[string]Build, []string, error) {
+	found, missing, err := c.stable.GetBuilds(ctx, ids)
+	c.count("GetBuilds", "stable", err)
+	return found, missing, err
+}
+
+func (c *canaryService) ListBuildStatuses(ctx context.Context, ids []string) (map[string]BuildStatus, error) {
+	statuses, err := c.stable.ListBuildStatuses(ctx, ids)
+	c.count("ListBuildStatuses", "stable", err)
+	return statuses, err
+}
+
+func (c *canaryService) ReserveID(ctx context.Context, prefix string) (string, error) {
+	id, err := c.stable.ReserveID(ctx, prefix)
+	c.count("ReserveID", "stable", err)
+	return id, err
+}
+
+func (c *canaryService) ListBuilds(ctx context.Context, opts ListOptions) ([]Build, error) {
+	builds, err := c.stable.ListBuilds(ctx, opts)
+	c.count("ListBuilds", "stable", err)
+	return builds, err
+}
+
+func (c *canaryService) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) ([]Build, error) {
+	builds, err := c.stable.ListBuildsModifiedBetween(ctx, from, to)
+	c.count("ListBuildsModifiedBetween", "stable", err)
+	return builds, err
+}
+
+func (c *canaryService) PutBuild(ctx context.Context, id string, b Build) error {
+	s, path := c.route(id)
+	err := s.PutBuild(ctx, id, b)
+	c.count("PutBuild", path, err)
+	return err
+}
+
+func (c *canaryService) PatchBuild(ctx context.Context, id string, b Build) error {
+	s, path := c.route(id)
+	err := s.PatchBuild(ctx, id, b)
+	c.count("PatchBuild", path, err)
+	return err
+}
+
+func (c *canaryService) DeleteBuild(ctx context.Context, id string) error {
+	s, path := c.route(id)
+	err := s.DeleteBuild(ctx, id)
+	c.count("DeleteBuild", path, err)
+	return err
+}
+
+func (c *canaryService) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (int64, error) {
+	s, path := c.route(id)
+	n, err := s.AppendBuildLogs(ctx, id, offset, p)
+	c.count("AppendBuildLogs", path, err)
+	return n, err
+}
+
+func (c *canaryService) GetBuildLogLength(ctx context.Context, id string) (int64, error) {
+	s, path := c.route(id)
+	n, err := s.GetBuildLogLength(ctx, id)
+	c.count("GetBuildLogLength", path, err)
+	return n, err
+}
+
+func (c *canaryService) GetBuildLogs(ctx context.Context, id string, step int, from int64) ([]byte, error) {
+	s, path := c.route(id)
+	p, err := s.GetBuildLogs(ctx, id, step, from)
+	c.count("GetBuildLogs", path, err)
+	return p, err
+}
+
+func (c *canaryService) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) error {
+	s, path := c.route(id)
+	err := s.ReplayBuild(ctx, id, sink)
+	c.count("ReplayBuild", path, err)
+	return err
+}
+
+// BuildMetrics summarizes stable's builds.
+func (c *canaryService) BuildMetrics(ctx context.Context, window time.Duration) (MetricsSummary, error) {
+	m, err := c.stable.BuildMetrics(ctx, window)
+	c.count("BuildMetrics", "stable", err)
+	return m, err
+}
+
+// GetLimits reports stable's limits, which most builds are held to.
+func (c *canaryService) GetLimits(ctx context.Context) (ServiceLimits, error) {
+	l, err := c.stable.GetLimits(ctx)
+	c.count("GetLimits", "stable", err)
+	return l, err
+}
+
+func (c *canaryService) FindSucceededByFingerprint(ctx context.Context, fp string) (Build, bool, error) {
+	b, found, err := c.stable.FindSucceededByFingerprint(ctx, fp)
+	c.count("FindSucceededByFingerprint", "stable", err)
+	return b, found, err
+}
+
+func (c *canaryService) SetOutput(ctx context.Context, id, key, value string) error {
+	s, path := c.route(id)
+	err := s.SetOutput(ctx, id, key, value)
+	c.count("SetOutput", path, err)
+	return err
+}
+
+func (c *canaryService) GetOutput(ctx context.Context, id, key string) (string, error) {
+	s, path := c.route(id)
+	value, err := s.GetOutput(ctx, id, key)
+	c.count("GetOutput", path, err)
+	return value, err
+}
+
+func (c *canaryService) ListBuildsByGroup(ctx context.Context, groupID string) ([]Build, error) {
+	builds, err := c.stable.ListBuildsByGroup(ctx, groupID)
+	c.count("ListBuildsByGroup", "stable", err)
+	return builds, err
+}
+
+func (c *canaryService) CancelGroup(ctx context.Context, groupID string) (int, error) {
+	n, err := c.stable.CancelGroup(ctx, groupID)
+	c.count("CancelGroup", "stable", err)
+	return n, err
+}
+
+func (c *canaryService) GroupStatus(ctx context.Context, groupID string) (GroupSummary, error) {
+	sum, err := c.stable.GroupStatus(ctx, groupID)
+	c.count("GroupStatus", "stable", err)
+	return sum, err
+}
+
+func (c *canaryService) ValidateBuild(ctx context.Context, b Build) (ValidationErrors, error) {
+	s, path := c.route(b.ID)
+	errs, err := s.ValidateBuild(ctx, b)
+	c.count("ValidateBuild", path, err)
+	return errs, err
+}
+
+func (c *canaryService) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (Build, bool, error) {
+	b, ok, err := c.stable.LeaseBuild(ctx, workerID, ttl)
+	c.count("LeaseBuild", "stable", err)
+	return b, ok, err
+}
+
+func (c *canaryService) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (Build, bool, error) {
+	b, ok, err := c.stable.ClaimAndStart(ctx, workerID, filter)
+	c.count("ClaimAndStart", "stable", err)
+	return b, ok, err
+}
+
+func (c *canaryService) ForceReleaseLease(ctx context.Context, id string) error {
+	s, path := c.route(id)
+	err := s.ForceReleaseLease(ctx, id)
+	c.count("ForceReleaseLease", path, err)
+	return err
+}
+
+func (c *canaryService) QueuePosition(ctx context.Context, id string) (int, time.Duration, error) {
+	s, path := c.route(id)
+	pos, wait, err := s.QueuePosition(ctx, id)
+	c.count("QueuePosition", path, err)
+	return pos, wait, err
+}
+
+func (c *canaryService) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (bool, error) {
+	s, path := c.route(id)
+	ok, err := s.CompareAndSetStatus(ctx, id, expected, next)
+	c.count("CompareAndSetStatus", path, err)
+	return ok, err
+}
+
+func (c *canaryService) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (bool, error) {
+	s, path := c.route(id)
+	ok, err := s.CompareAndDeleteBuild(ctx, id, updatedAt)
+	c.count("CompareAndDeleteBuild", path, err)
+	return ok, err
+}
+
+func (c *canaryService) RerunFailedSteps(ctx context.Context, id string) (Build, error) {
+	s, path := c.route(id)
+	b, err := s.RerunFailedSteps(ctx, id)
+	c.count("RerunFailedSteps", path, err)
+	return b, err
+}
+
+func (c *canaryService) FailBuild(ctx context.Context, id, reason string, exitCode int) error {
+	s, path := c.route(id)
+	err := s.FailBuild(ctx, id, reason, exitCode)
+	c.count("FailBuild", path, err)
+	return err
+}
+
+// RenameBuild goes the way of the old ID.
+func (c *canaryService) RenameBuild(ctx context.Context, oldID, newID string) error {
+	s, path := c.route(oldID)
+	err := s.RenameBuild(ctx, oldID, newID)
+	c.count("RenameBuild", path, err)
+	return err
+}
+
+func (c *canaryService) ListLabelKeys(ctx context.Context) ([]string, error) {
+	keys, err := c.stable.ListLabelKeys(ctx)
+	c.count("ListLabelKeys", "stable", err)
+	return keys, err
+}
+
+func (c *canaryService) ListLabelValues(ctx context.Context, key string) ([]string, error) {
+	values, err := c.stable.ListLabelValues(ctx, key)
+	c.count("ListLabelValues", "stable", err)
+	return values, err
+}
+
+// PatchBuilds splits ids by path, so each build is patched where its other
+// calls go, and puts the results back in the order of ids.
+func (c *canaryService) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) ([]BatchResult, error) {
+	byPath := map[string][]string{}
+	services := map[string]Service{}
+	for _, id := range ids {
+		s, path := c.route(id)
+		byPath[path] = append(byPath[path], id)
+		services[path] = s
+	}
+	results := map[string]BatchResult{}
+	for path, pathIDs := range byPath {
+		rs, err := services[path].PatchBuilds(ctx, pathIDs, patch)
+		c.count("PatchBuilds", path, err)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			results[r.ID] = r
+		}
+	}
+	ordered := make([]BatchResult, len(ids))
+	for i, id := range ids {
+		ordered[i] = results[id]
+	}
+	return ordered, nil
+}
+
+// BatchPostBuilds splits builds by path, like PatchBuilds.
+func (c *canaryService) BatchPostBuilds(ctx context.Context, builds []Build) ([]BatchResult, error) {
+	byPath := map[string][]Build{}
+	services := map[string]Service{}
+	for _, b := range builds {
+		s, path := c.route(b.ID)
+		byPath[path] = append(byPath[path], b)
+		services[path] = s
+	}
+	results := map[string]BatchResult{}
+	for path, pathBuilds := range byPath {
+		rs, err := services[path].BatchPostBuilds(ctx, pathBuilds)
+		c.count("BatchPostBuilds", path, err)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			results[r.ID] = r
+		}
+	}
+	ordered := make([]BatchResult, len(builds))
+	for i, b := range builds {
+		ordered[i] = results[b.ID]
+	}
+	return ordered, nil
+}
+
+func (c *canaryService) FindBuildsBySpecHash(ctx context.Context, hash string) ([]Build, error) {
+	builds, err := c.stable.FindBuildsBySpecHash(ctx, hash)
+	c.count("FindBuildsBySpecHash", "stable", err)
+	return builds, err
+}
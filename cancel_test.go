@@ -0,0 +1,181 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCancelledContext(t *testing.T) {
+	s := NewInmemService()
+	if err := s.PostBuild(context.Background(), Build{ID: "b1", GroupID: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for name, call := range map[string]func() error{
+		"PostBuild": func() error { return s.PostBuild(ctx, Build{ID: "b2"}) },
+		"GetOrCreateBuild": func() error {
+			_, _, err := s.GetOrCreateBuild(ctx, Build{ID: "b2"})
+			return err
+		},
+		"GetBuild": func() error { _, err := s.GetBuild(ctx, "b1"); return err },
+		"GetBuilds": func() error {
+			_, _, err := s.GetBuilds(ctx, []string{"b1"})
+			return err
+		},
+		"ListBuildStatuses": func() error { _, err := s.ListBuildStatuses(ctx, []string{"b1"}); return err },
+		"ReserveID":         func() error { _, err := s.ReserveID(ctx, "r"); return err },
+		"ListBuilds":        func() error { _, err := s.ListBuilds(ctx, ListOptions{}); return err },
+		"ListBuildsModifiedBetween": func() error {
+			_, err := s.ListBuildsModifiedBetween(ctx, time.Time{}, time.Time{})
+			return err
+		},
+		"PutBuild":   func() error { return s.PutBuild(ctx, "b1", Build{ID: "b1"}) },
+		"PatchBuild": func() error { return s.PatchBuild(ctx, "b1", Build{Name: "n"}) },
+		"PatchBuilds": func() error {
+			_, err := s.PatchBuilds(ctx, []string{"b1"}, BuildPatch{Name: "n"})
+			return err
+		},
+		"BatchPostBuilds": func() error { _, err := s.BatchPostBuilds(ctx, []Build{{ID: "b2"}}); return err },
+		"DeleteBuild":     func() error { return s.DeleteBuild(ctx, "b1") },
+		"AppendBuildLogs": func() error {
+			_, err := s.AppendBuildLogs(ctx, "b1", 0, []byte("x"))
+			return err
+		},
+		"GetBuildLogLength": func() error { _, err := s.GetBuildLogLength(ctx, "b1"); return err },
+		"GetBuildLogs":      func() error { _, err := s.GetBuildLogs(ctx, "b1", -1, 0); return err },
+		"ReplayBuild": func() error {
+			return s.ReplayBuild(ctx, "b1", func(BuildEvent) error { return nil })
+		},
+		"GetLimits":    func() error { _, err := s.GetLimits(ctx); return err },
+		"BuildMetrics": func() error { _, err := s.BuildMetrics(ctx, time.Hour); return err },
+		"FindSucceededByFingerprint": func() error {
+			_, _, err := s.FindSucceededByFingerprint(ctx, "fp")
+			return err
+		},
+		"SetOutput":         func() error { return s.SetOutput(ctx, "b1", "k", "v") },
+		"GetOutput":         func() error { _, err := s.GetOutput(ctx, "b1", "k"); return err },
+		"ListBuildsByGroup": func() error { _, err := s.ListBuildsByGroup(ctx, "g"); return err },
+		"CancelGroup":       func() error { _, err := s.CancelGroup(ctx, "g"); return err },
+		"GroupStatus":       func() error { _, err := s.GroupStatus(ctx, "g"); return err },
+		"ValidateBuild":     func() error { _, err := s.ValidateBuild(ctx, Build{ID: "b2"}); return err },
+		"LeaseBuild": func() error {
+			_, _, err := s.LeaseBuild(ctx, "w", time.Minute)
+			return err
+		},
+		"ClaimAndStart": func() error {
+			_, _, err := s.ClaimAndStart(ctx, "w", BuildFilter{})
+			return err
+		},
+		"ForceReleaseLease": func() error { return s.ForceReleaseLease(ctx, "b1") },
+		"QueuePosition": func() error {
+			_, _, err := s.QueuePosition(ctx, "b1")
+			return err
+		},
+		"CompareAndSetStatus": func() error {
+			_, err := s.CompareAndSetStatus(ctx, "b1", StatusPending, StatusRunning)
+			return err
+		},
+		"CompareAndDeleteBuild": func() error {
+			_, err := s.CompareAndDeleteBuild(ctx, "b1", time.Time{})
+			return err
+		},
+		"RerunFailedSteps":     func() error { _, err := s.RerunFailedSteps(ctx, "b1"); return err },
+		"FailBuild":            func() error { return s.FailBuild(ctx, "b1", "r", 1) },
+		"RenameBuild":          func() error { return s.RenameBuild(ctx, "b1", "b3") },
+		"ListLabelKeys":        func() error { _, err := s.ListLabelKeys(ctx); return err },
+		"ListLabelValues":      func() error { _, err := s.ListLabelValues(ctx, "k"); return err },
+		"FindBuildsBySpecHash": func() error { _, err := s.FindBuildsBySpecHash(ctx, "h"); return err },
+	} {
+		if err := call(); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got %v, want context.Canceled", name, err)
+		}
+	}
+	if _, err := s.GetBuild(context.Background(), "b1"); err != nil {
+		t.Errorf("b1 changed by a cancelled call: %v", err)
+	}
+}
+
+// cancellingRepository calls cancel after its next Save or List, to cancel
+// a call partway through. Until then cancel is nil and nothing happens.
+type cancellingRepository struct {
+	Repository
+	cancel func()
+}
+
+func (r *cancellingRepository) Save(ctx context.Context, b Build) error {
+	err := r.Repository.Save(ctx, b)
+	r.fire()
+	return err
+}
+
+func (r *cancellingRepository) List(ctx context.Context) ([]Build, error) {
+	builds, err := r.Repository.List(ctx)
+	r.fire()
+	return builds, err
+}
+
+func (r *cancellingRepository) fire() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+func TestCancelMidOperation(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	for _, tc := range []struct {
+		name  string
+		setup bool // post ids before the call
+		call  func(*testing.T, Service, context.Context) ([]BatchResult, error)
+	}{
+		{"BatchPostBuilds", false, func(_ *testing.T, s Service, ctx context.Context) ([]BatchResult, error) {
+			return s.BatchPostBuilds(ctx, []Build{{ID: "a"}, {ID: "b"}, {ID: "c"}})
+		}},
+		{"PatchBuilds", true, func(_ *testing.T, s Service, ctx context.Context) ([]BatchResult, error) {
+			return s.PatchBuilds(ctx, ids, BuildPatch{Name: "patched"})
+		}},
+		{"ListBuilds", true, func(t *testing.T, s Service, ctx context.Context) ([]BatchResult, error) {
+			builds, err := s.ListBuilds(ctx, ListOptions{})
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %d builds and %v, want context.Canceled", len(builds), err)
+			}
+			return nil, nil
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := &cancellingRepository{Repository: NewInmemRepository()}
+			s, err := NewService(repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.setup {
+				for _, id := range ids {
+					if err := s.PostBuild(context.Background(), Build{ID: id}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			repo.cancel = cancel
+			results, err := tc.call(t, s, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) == 0 {
+				return
+			}
+			if results[0].Err != nil {
+				t.Errorf("first build, written before the cancel: %v", results[0].Err)
+			}
+			for _, r := range results[1:] {
+				if !errors.Is(r.Err, context.Canceled) {
+					t.Errorf("%s after the cancel: got %v, want context.Canceled", r.ID, r.Err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// RequiresLabel lists, comma-separated, the capabilities a worker needs to
+// claim a build with ClaimAndStart, such as "gpu,arm64".
+const RequiresLabel = "build.requires"
+
+// DefaultClaimTTL is the lease ClaimAndStart takes when the filter doesn't
+// say.
+const DefaultClaimTTL = 5 * time.Minute
+
+// BuildFilter restricts the builds a worker claims with ClaimAndStart. The
+// zero BuildFilter claims any build that requires no capabilities.
+type BuildFilter struct {
+	// Selector restricts the claim to builds whose labels match.
+	Selector Selector
+
+	// GroupID, if set, restricts the claim to builds in that group.
+	GroupID string
+
+	// Capabilities are what the worker can do. Builds listing in
+	// RequiresLabel a capability that's not among them are left to other
+	// workers.
+	Capabilities []string
+
+	// LeaseTTL is how long the worker's lease lasts; zero means
+	// DefaultClaimTTL.
+	LeaseTTL time.Duration
+}
+
+// matches reports whether b passes the filters in f.
+func (f BuildFilter) matches(b Build) bool {
+	if f.GroupID != "" && b.GroupID != f.GroupID {
+		return false
+	}
+	if !f.Selector.Matches(b.Labels) {
+		return false
+	}
+	for _, c := range strings.Split(b.Labels[RequiresLabel], ",") {
+		if c = strings.TrimSpace(c); c != "" && !contains(f.Capabilities, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// ClaimAndStart is LeaseBuild restricted to the builds matching filter: it
+// picks the first of them in the lease order and marks it running, leased
+// to workerID and stamped with StartedAt, in one write lock, so no two
+// workers ever claim the same build. It returns false if no matching build
+// is available.
+func (s *buildService) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (Build, bool, error) {
+	ttl := filter.LeaseTTL
+	if ttl <= 0 {
+		ttl = DefaultClaimTTL
+	}
+	return s.lease(ctx, workerID, ttl, filter.matches)
+}
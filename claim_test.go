@@ -0,0 +1,89 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClaimAndStartNeverDoubleClaims(t *testing.T) {
+	const builds, workers = 50, 16
+	ctx := context.Background()
+	s := NewInmemService()
+	for i := 0; i < builds; i++ {
+		b := Build{ID: fmt.Sprintf("b%02d", i)}
+		if i%5 == 0 {
+			b.Labels = map[string]string{RequiresLabel: "gpu"}
+		}
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mtx     sync.Mutex
+		claimed = map[string]string{} // build ID to worker
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		worker := fmt.Sprintf("w%d", w)
+		filter := BuildFilter{}
+		if w%2 == 0 {
+			filter.Capabilities = []string{"gpu"}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				b, ok, err := s.ClaimAndStart(ctx, worker, filter)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !ok {
+					return
+				}
+				if b.Status != StatusRunning || b.Lease == nil || b.Lease.WorkerID != worker {
+					t.Errorf("%s claimed %s as %s, leased %+v", worker, b.ID, b.Status, b.Lease)
+				}
+				mtx.Lock()
+				if prev, dup := claimed[b.ID]; dup {
+					t.Errorf("%s claimed by both %s and %s", b.ID, prev, worker)
+				}
+				claimed[b.ID] = worker
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(claimed) != builds {
+		t.Errorf("claimed %d builds, want all %d", len(claimed), builds)
+	}
+}
+
+func TestLeaseBuildSkipsBuildsNeedingCapabilities(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmemService()
+	for _, b := range []Build{
+		{ID: "gpu", Priority: 10, Labels: map[string]string{RequiresLabel: "gpu"}},
+		{ID: "blank", Priority: 5, Labels: map[string]string{RequiresLabel: " , "}},
+		{ID: "plain"},
+	} {
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"blank", "plain"} {
+		if b, ok, err := s.LeaseBuild(ctx, "w", time.Minute); err != nil || !ok || b.ID != want {
+			t.Fatalf("LeaseBuild: got %q, %v, %v; want %s", b.ID, ok, err, want)
+		}
+	}
+	if b, ok, err := s.LeaseBuild(ctx, "w", time.Minute); err != nil || ok {
+		t.Fatalf("LeaseBuild leased %q, %v; want the gpu build left alone", b.ID, err)
+	}
+	if b, ok, err := s.ClaimAndStart(ctx, "w-gpu", BuildFilter{Capabilities: []string{"gpu"}}); err != nil || !ok || b.ID != "gpu" {
+		t.Fatalf("ClaimAndStart with gpu: got %q, %v, %v", b.ID, ok, err)
+	}
+}
@@ -0,0 +1,126 @@
+// Package client provides a Go client for the build service's HTTP API.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+)
+
+// Client talks to one build service instance.
+type Client struct {
+	base *url.URL
+	http *http.Client
+
+	retries    int // WithRetry
+	retryDelay time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests. Streaming calls
+// such as WatchBuild need a client without a Timeout.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) { cl.http = c }
+}
+
+// New returns a Client for the instance at the given base URL, such as
+// "http://localhost:8080". A scheme-less instance is taken as http.
+func New(instance string, opts ...Option) (*Client, error) {
+	if !strings.HasPrefix(instance, "http") {
+		instance = "http://" + instance
+	}
+	u, err := url.Parse(instance)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{base: u, http: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// BuildUpdate is one change to a watched build. The last update sent on a
+// stream that ended for any reason other than the context being cancelled
+// has Err set, and no event.
+type BuildUpdate struct {
+	EventID uint64
+	Type    gokitbuildservice.BuildEventType
+	Build   gokitbuildservice.Build
+	Err     error
+}
+
+// WatchBuild streams the changes to build id from the service's event feed,
+// filtered to that build by the server, until ctx is done or the stream
+// ends, then closes the channel. The error is only for failing to open the
+// stream; later failures are delivered as a final BuildUpdate with Err set.
+func (c *Client) WatchBuild(ctx context.Context, id string) (<-chan BuildUpdate, error) {
+	u := c.base.ResolveReference(&url.URL{Path: "/events", RawQuery: url.Values{"build": {id}}.Encode()})
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if baggage := gokitbuildservice.BaggageFromContext(ctx); baggage != "" {
+		req.Header.Set(gokitbuildservice.BaggageHeader, baggage)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("watching build %s: server responded %s", id, resp.Status)
+	}
+
+	updates := make(chan BuildUpdate)
+	go func() {
+		defer close(updates)
+		defer resp.Body.Close()
+		send := func(u BuildUpdate) bool {
+			select {
+			case updates <- u:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for sc.Scan() {
+			data, ok := strings.CutPrefix(sc.Text(), "data: ")
+			if !ok {
+				continue // id and event lines repeat what's in the data
+			}
+			var e gokitbuildservice.BuildEvent
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				send(BuildUpdate{Err: fmt.Errorf("decoding event: %w", err)})
+				return
+			}
+			if e.Build.ID != id {
+				continue // from a server that doesn't filter
+			}
+			if !send(BuildUpdate{EventID: e.ID, Type: e.Type, Build: e.Build}) {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		err := sc.Err()
+		if err == nil {
+			err = fmt.Errorf("watching build %s: stream ended", id)
+		}
+		send(BuildUpdate{Err: err})
+	}()
+	return updates, nil
+}
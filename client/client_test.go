@@ -0,0 +1,50 @@
+package client_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/client"
+)
+
+func TestWatchBuildIsFilteredByTheServer(t *testing.T) {
+	hub := gokitbuildservice.NewEventHub(16)
+	srv := httptest.NewServer(gokitbuildservice.MakeEventsHTTPHandler(hub, log.NewNopLogger()))
+	defer srv.Close()
+	c, err := client.New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	updates, err := c.WatchBuild(ctx, "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subs := hub.Subscriptions()
+	if len(subs) != 1 || subs[0].Build != "mine" {
+		t.Fatalf("got subscriptions %+v, want one for build mine", subs)
+	}
+	for i := 0; i < 100; i++ {
+		hub.Publish(gokitbuildservice.BuildEvent{Type: gokitbuildservice.BuildUpdated, Build: gokitbuildservice.Build{ID: "other"}})
+	}
+	hub.Publish(gokitbuildservice.BuildEvent{Type: gokitbuildservice.BuildCreated, Build: gokitbuildservice.Build{ID: "mine"}})
+
+	select {
+	case u := <-updates:
+		if u.Err != nil || u.Build.ID != "mine" || u.Type != gokitbuildservice.BuildCreated {
+			t.Fatalf("got %+v, want mine's creation", u)
+		}
+	case <-ctx.Done():
+		t.Fatal("no update")
+	}
+	if subs := hub.Subscriptions(); subs[0].Dropped != 0 {
+		t.Errorf("other builds' events counted against the watcher: %d dropped", subs[0].Dropped)
+	}
+}
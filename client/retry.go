@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// IdempotencyKeyHeader marks a POST as safe to retry: a request carrying it
+// is retried WithRetry like the idempotent methods.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// WithRetry retries requests that fail to connect or get a 5xx response up
+// to max more times, waiting baseDelay before the first retry and twice as
+// long before each one after that up to maxRetryDelay, each wait randomly
+// shortened by up to half so clients that failed together don't retry
+// together. Only GET,
+// HEAD, PUT and DELETE are retried, and POSTs carrying
+// IdempotencyKeyHeader. No retry is started that the context's deadline
+// wouldn't leave time to wait for; the last attempt's response or error is
+// returned as it is. By default nothing is retried.
+func WithRetry(max int, baseDelay time.Duration) Option {
+	return func(c *Client) { c.retries, c.retryDelay = max, baseDelay }
+}
+
+// do sends req, retrying it as configured WithRetry.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, err := c.http.Do(req)
+		if attempt >= c.retries || !retryable(req) || (err == nil && resp.StatusCode < 500) || ctx.Err() != nil {
+			return resp, err
+		}
+		wait := backoff(c.retryDelay, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return resp, err
+		}
+		next, rerr := rewind(req)
+		if rerr != nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body) // so the connection is reused
+			resp.Body.Close()
+		}
+		if !sleep(ctx, wait) {
+			return nil, ctx.Err()
+		}
+		req = next
+	}
+}
+
+// retryable reports whether req may be sent more than once.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return req.Header.Get(IdempotencyKeyHeader) != ""
+	}
+	return false
+}
+
+// maxRetryDelay caps the wait between retries, however many there are.
+const maxRetryDelay = time.Minute
+
+// backoff is the jittered wait before retry attempt+1.
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := maxRetryDelay
+	if attempt < 32 && base < maxRetryDelay>>attempt {
+		d = base << attempt
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// rewind returns a copy of req with its body, if any, ready to be sent
+// again.
+func rewind(req *http.Request) (*http.Request, error) {
+	next := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return next, nil
+	}
+	if req.GetBody == nil {
+		return nil, errNoRewind
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	next.Body = body
+	return next, nil
+}
+
+var errNoRewind = errors.New("request body can't be sent again")
+
+// sleep waits for d, and reports false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer answers each request with the next of codes, repeating the
+// last one, and records the bodies it got.
+type flakyServer struct {
+	*httptest.Server
+	mtx    sync.Mutex
+	codes  []int
+	bodies []string
+}
+
+func newFlakyServer(codes ...int) *flakyServer {
+	s := &flakyServer{codes: codes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mtx.Lock()
+		code := s.codes[min(len(s.bodies), len(s.codes)-1)]
+		s.bodies = append(s.bodies, string(body))
+		s.mtx.Unlock()
+		w.WriteHeader(code)
+	}))
+	return s
+}
+
+func (s *flakyServer) attempts() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.bodies)
+}
+
+func newRetryClient(t *testing.T, url string, max int, delay time.Duration) *Client {
+	t.Helper()
+	c, err := New(url, WithRetry(max, delay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRetryOnlyIdempotentRequests(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		key    bool
+		want   int
+	}{
+		{http.MethodGet, false, 3},
+		{http.MethodHead, false, 3},
+		{http.MethodPut, false, 3},
+		{http.MethodDelete, false, 3},
+		{http.MethodPost, true, 3},
+		{http.MethodPost, false, 1},
+		{http.MethodPatch, false, 1},
+	} {
+		srv := newFlakyServer(http.StatusServiceUnavailable)
+		c := newRetryClient(t, srv.URL, 2, time.Millisecond)
+		req, _ := http.NewRequest(tc.method, srv.URL, nil)
+		if tc.key {
+			req.Header.Set(IdempotencyKeyHeader, "k1")
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.method, err)
+		}
+		resp.Body.Close()
+		if got := srv.attempts(); got != tc.want || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s (key %v): %d attempts ending in %d, want %d ending in the last 503", tc.method, tc.key, got, resp.StatusCode, tc.want)
+		}
+		srv.Close()
+	}
+}
+
+func TestRetryOnlyServerErrors(t *testing.T) {
+	for _, tc := range []struct {
+		codes []int
+		want  int // attempts
+		final int
+	}{
+		{[]int{http.StatusInternalServerError, http.StatusOK}, 2, http.StatusOK},
+		{[]int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusNotFound}, 3, http.StatusNotFound},
+		{[]int{http.StatusNotFound}, 1, http.StatusNotFound},
+		{[]int{http.StatusConflict}, 1, http.StatusConflict},
+		{[]int{http.StatusTooManyRequests}, 1, http.StatusTooManyRequests},
+	} {
+		srv := newFlakyServer(tc.codes...)
+		c := newRetryClient(t, srv.URL, 5, time.Millisecond)
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		resp, err := c.do(req)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.codes, err)
+		}
+		resp.Body.Close()
+		if got := srv.attempts(); got != tc.want || resp.StatusCode != tc.final {
+			t.Errorf("%v: %d attempts ending in %d, want %d ending in %d", tc.codes, got, resp.StatusCode, tc.want, tc.final)
+		}
+		srv.Close()
+	}
+}
+
+func TestRetryRewindsTheBody(t *testing.T) {
+	srv := newFlakyServer(http.StatusBadGateway, http.StatusBadGateway, http.StatusOK)
+	defer srv.Close()
+	c := newRetryClient(t, srv.URL, 3, time.Millisecond)
+	req, _ := http.NewRequest(http.MethodPut, srv.URL, strings.NewReader(`{"id":"b1"}`))
+	resp, err := c.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(srv.bodies) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(srv.bodies))
+	}
+	for i, body := range srv.bodies {
+		if body != `{"id":"b1"}` {
+			t.Errorf("attempt %d sent %q, want the whole body", i+1, body)
+		}
+	}
+
+	// A body that can't be read again isn't retried.
+	srv2 := newFlakyServer(http.StatusBadGateway)
+	defer srv2.Close()
+	req, _ = http.NewRequest(http.MethodPut, srv2.URL, io.NopCloser(strings.NewReader("x")))
+	resp, err = c.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := srv2.attempts(); got != 1 {
+		t.Errorf("unrewindable body: %d attempts, want 1", got)
+	}
+}
+
+func TestRetryStopsAtTheDeadline(t *testing.T) {
+	srv := newFlakyServer(http.StatusServiceUnavailable)
+	defer srv.Close()
+	c := newRetryClient(t, srv.URL, 5, 40*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	begin := time.Now()
+	resp, err := c.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Waits of 20-40ms, 40-80ms and 80-160ms: the second may fit in what's
+	// left, the third never does.
+	if got := srv.attempts(); got < 2 || got > 3 {
+		t.Errorf("got %d attempts, want the retries cut short by the deadline", got)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || time.Since(begin) > 100*time.Millisecond {
+		t.Errorf("got %d after %s, want the last 503 before the deadline", resp.StatusCode, time.Since(begin))
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	for _, base := range []time.Duration{time.Nanosecond, time.Millisecond, time.Second, time.Hour} {
+		for attempt := 0; attempt < 200; attempt++ {
+			d := backoff(base, attempt)
+			if d <= 0 || d > maxRetryDelay {
+				t.Fatalf("backoff(%s, %d) = %s, want within (0, %s]", base, attempt, d, maxRetryDelay)
+			}
+			full := maxRetryDelay
+			if attempt < 32 && base < maxRetryDelay>>attempt {
+				full = base << attempt
+			}
+			if d < full/2 {
+				t.Fatalf("backoff(%s, %d) = %s, want at least half of %s", base, attempt, d, full)
+			}
+		}
+	}
+	if d := backoff(0, 3); d != 0 {
+		t.Errorf("backoff with no base delay = %s, want 0", d)
+	}
+}
@@ -0,0 +1,47 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time to everything in the service that depends on it:
+// timestamps, TTLs, leases, reservations, retention and pin windows. A fake
+// one, such as servicetest.FakeClock, makes those deterministic in tests.
+// Latencies reported by the logging and metrics middlewares are measured
+// with the system clock regardless, as they're about real elapsed time.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock used unless another is configured.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// WithClock makes the service read the time from c rather than
+// SystemClock.
+func WithClock(c Clock) InmemOption {
+	return func(s *buildService) { s.clock = c }
+}
+
+type opTimeKey struct{}
+
+// begin fixes the time of the operation ctx is for, unless it's already
+// fixed, so every timestamp and expiry check the operation makes agrees.
+func (s *buildService) begin(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(opTimeKey{}).(time.Time); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, opTimeKey{}, s.clock.Now())
+}
+
+// now returns the time fixed by begin, or the clock's time if there's none.
+func (s *buildService) now(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(opTimeKey{}).(time.Time); ok {
+		return t
+	}
+	return s.clock.Now()
+}
@@ -1,23 +1,387 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"flag"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
 )
 
 func main() {
 	var (
-		httpAddr = flag.String("http.addr", ":8080", "HTTP listen address")
+		httpAddr  = flag.String("http.addr", ":8080", "HTTP listen address")
+		logLevel  = flag.String("log.level", "info", "Log level: debug, info, warn or error")
+		logSlow   = flag.Duration("log.slow", time.Second, "Log service calls taking longer than this at warn; 0 disables it, and admins can change it under /admin/config/slow")
+		logRedact = flag.String("log.redact", "token,password,secret", "Comma-separated label keys whose values are redacted from logs")
+		hookKey   = flag.String("webhook.secret", "", "Key used to sign webhook deliveries")
+		slackURL  = flag.String("notify.slack", "", "Slack incoming webhook URL told about every finished build")
+		evHistory = flag.Int("events.history", 1024, "Number of recent events kept for feed replay")
+		adminKeys = flag.String("admin.tokens", "", "Comma-separated name=token pairs allowed to call /admin endpoints")
+		apiKeys   = flag.String("api.tokens", "", "Comma-separated name=token pairs identifying callers of the API by bearer token")
+		authzRole = flag.String("authz.roles", "", "Comma-separated name=role pairs, with roles reader, writer or admin, authorizing callers named by api.tokens; empty allows everyone everything")
+		authzAnon = flag.String("authz.anonymous", "reader", "Role of callers without a token, or with no role in authz.roles; empty allows them nothing")
+		tlsCert   = flag.String("tls.cert", "", "TLS certificate file; serves HTTPS and HTTP/2 when set, and is reloaded on SIGHUP")
+		tlsKey    = flag.String("tls.key", "", "TLS private key file")
+		tlsCA     = flag.String("tls.clientca", "", "CA bundle for verifying client certificates; when set, clients must present one")
+		errFormat = flag.String("http.errors", "structured", "Default error body format, structured or bare; clients can override it with X-Error-Format")
+		retention = flag.Duration("retention", 0, "Delete terminal builds this long after they finish; 0 keeps them")
+		retFailed = flag.Duration("retention.failed", 0, "Retention for failed builds; 0 means the same as retention")
+		retEvery  = flag.Duration("retention.interval", 10*time.Minute, "How often the retention sweeper runs")
+		dataDir   = flag.String("data.dir", "", "Directory to persist builds in; empty keeps them in memory only")
+		batchPar  = flag.Int("batch.concurrency", 0, "Write the builds of POST and PATCH /builds/batch this many at a time, as separate store calls; for slow, networked stores. 0 writes each batch under one lock")
+		opTimeout = flag.Duration("backend.timeout", 0, "Longest a single store operation may take before failing with a 504; 0 means no limit")
+		dataFlush = flag.Duration("data.flush", time.Second, "How often persisted writes are fsynced; 0 syncs every write")
+		labelKey  = flag.String("labels.key", "", "Base64 AES key encrypting sensitive label values; empty stores them in plaintext. Only callers named by api.tokens see them decrypted, and with authz.roles only writers and admins")
+		labelPfx  = flag.String("labels.sensitive", "secret.", "Key prefix of labels encrypted with labels.key")
+		strictIDs = flag.Bool("ids.strict", false, "Reject PATCH bodies without an id matching the path")
+		dedup     = flag.Bool("builds.dedup", false, "Return the existing unfinished build, rather than create another, when a POST has the same spec")
+		listDef   = flag.Int("list.default", gokitbuildservice.DefaultListLimit, "Page of builds a list returns when it asks for no limit")
+		listMax   = flag.Int("list.max", gokitbuildservice.DefaultMaxListLimit, "Largest page of builds a list returns; lists asking for more get this many")
+		leaseFIFO = flag.Bool("lease.fifo", false, "Lease builds strictly oldest first, ignoring their priority")
+		maxRun    = flag.Int("builds.maxrunning", 0, "Maximum number of builds running at once; 0 means no limit")
+		auditKeep = flag.Int("audit.perbuild", 1000, "Number of audit entries kept per build; 0 keeps them all")
+		auditDiff = flag.Bool("audit.diff", false, "Store audit entries as diffs against the previous entry, to save memory")
+		buildTTL  = flag.Duration("builds.ttl", 0, "Delete builds this long after they're created unless they set expiresAt; 0 keeps them")
+		buildSer  = flag.Int("metrics.builds", 0, "Serve a build_status gauge per unfinished or recently finished build under /metrics/builds, at most this many; each build is its own series, so keep it small. 0 disables it")
+		debug     = flag.Bool("debug", false, "Serve diagnostics under /debug/")
+		sample    = flag.Float64("trace.sample", 1, "Ratio of traced requests to sample, from 0 to 1; requests with X-Trace-Debug: true are always sampled")
 	)
 	flag.Parse()
 
+	allowLevel, err := levelOption(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if f := gokitbuildservice.ErrorFormat(*errFormat); f != gokitbuildservice.ErrorFormatStructured && f != gokitbuildservice.ErrorFormatBare {
+		fmt.Fprintf(os.Stderr, "unknown error format %q\n", *errFormat)
+		os.Exit(1)
+	}
+
 	var logger log.Logger
 	{
 		logger = log.NewLogfmtLogger(os.Stderr)
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
+		logger = level.NewFilter(logger, allowLevel)
+	}
+
+	events := gokitbuildservice.NewEventHub(*evHistory,
+		gokitbuildservice.WithDroppedSubscriberMetrics(kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "build_service",
+			Name:      "event_subscribers_dropped_total",
+			Help:      "Number of event feed subscribers dropped for reading too slowly.",
+		}, []string{})),
+	)
+
+	var hooks *gokitbuildservice.WebhookDispatcher
+	{
+		fieldKeys := []string{}
+		hooks = gokitbuildservice.NewWebhookDispatcher([]byte(*hookKey), log.With(logger, "component", "webhooks"),
+			gokitbuildservice.WithWebhookMetrics(
+				kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+					Namespace: "build_service",
+					Name:      "webhook_deliveries_total",
+					Help:      "Number of webhook notifications delivered.",
+				}, fieldKeys),
+				kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+					Namespace: "build_service",
+					Name:      "webhook_failures_total",
+					Help:      "Number of webhook notifications dropped after exhausting retries.",
+				}, fieldKeys),
+			),
+		)
+		c, _ := events.Subscribe(1024)
+		go hooks.Run(context.Background(), c)
+	}
+
+	{
+		notifiers := gokitbuildservice.NewNotifierRegistry(log.With(logger, "component", "notify"),
+			gokitbuildservice.WithNotifierMetrics(
+				kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+					Namespace: "build_service",
+					Name:      "notifications_sent_total",
+					Help:      "Number of finished builds notified.",
+				}, []string{"notifier"}),
+				kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+					Namespace: "build_service",
+					Name:      "notification_failures_total",
+					Help:      "Number of finished build notifications that failed.",
+				}, []string{"notifier"}),
+			),
+		)
+		if *slackURL != "" {
+			notifiers.Register("slack", gokitbuildservice.NewSlackNotifier(*slackURL))
+		}
+		c, _ := events.Subscribe(1024)
+		go notifiers.Run(context.Background(), c)
+	}
+
+	runStats := gokitbuildservice.NewRunStats(100)
+	audit := gokitbuildservice.NewAuditLog(*auditKeep, gokitbuildservice.WithDiffAudit(*auditDiff))
+	slow := gokitbuildservice.NewSlowThresholds(*logSlow)
+	queue := gokitbuildservice.NewQueueGate(gokitbuildservice.WithQueuePausedGauge(kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "build_service",
+		Name:      "queue_paused",
+		Help:      "1 while admins have paused the leasing of builds, 0 otherwise.",
+	}, []string{})))
+	{
+		c, _ := events.Subscribe(1024)
+		go gokitbuildservice.ObserveRunDurations(c, kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "build_service",
+			Name:      "build_run_duration_seconds",
+			Help:      "How long finished builds spent running.",
+			Buckets:   stdprometheus.ExponentialBuckets(1, 2, 14),
+		}, []string{"status"}), runStats)
+	}
+
+	var authz gokitbuildservice.Authorizer
+	if *authzRole != "" {
+		roles, err := parseRoles(*authzRole, *authzAnon)
+		if err != nil {
+			logger.Log("authz.roles", *authzRole, "err", err)
+			os.Exit(1)
+		}
+		authz = gokitbuildservice.NewRoleAuthorizer(roles, gokitbuildservice.WithAnonymousRole(gokitbuildservice.Role(*authzAnon)))
+	}
+
+	var (
+		s         gokitbuildservice.Service
+		compactor gokitbuildservice.Compactor
+	)
+	{
+		opts := []gokitbuildservice.InmemOption{
+			gokitbuildservice.WithEvents(events),
+			gokitbuildservice.WithRunStats(runStats),
+			gokitbuildservice.WithQueueWaitMetrics(kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "build_service",
+				Name:      "build_queue_wait_seconds",
+				Help:      "How long builds waited in pending before they started running.",
+				Buckets:   stdprometheus.ExponentialBuckets(0.1, 2, 16),
+			}, nil)),
+			gokitbuildservice.WithStrictIDs(*strictIDs),
+			gokitbuildservice.WithStrictFIFO(*leaseFIFO),
+			gokitbuildservice.WithMaxConcurrentRunning(*maxRun),
+			gokitbuildservice.WithDefaultTTL(*buildTTL),
+			gokitbuildservice.WithExpiryJanitor(time.Minute),
+			gokitbuildservice.WithSpecDedup(*dedup),
+		}
+		if *labelKey != "" {
+			key, err := base64.StdEncoding.DecodeString(*labelKey)
+			if err != nil {
+				logger.Log("labels.key", "invalid", "err", err)
+				os.Exit(1)
+			}
+			c, err := gokitbuildservice.NewAESGCMCipher(key)
+			if err != nil {
+				logger.Log("labels.key", "invalid", "err", err)
+				os.Exit(1)
+			}
+			opts = append(opts, gokitbuildservice.WithEncryption(c, *labelPfx))
+			if authz != nil {
+				opts = append(opts, gokitbuildservice.WithLabelAuthorizer(authz))
+			}
+		}
+		if *dataDir != "" {
+			opts = append(opts, gokitbuildservice.WithPersistence(*dataDir, *dataFlush))
+		}
+		store, err := gokitbuildservice.OpenInmemService(opts...)
+		if err != nil {
+			logger.Log("data.dir", *dataDir, "err", err)
+			os.Exit(1)
+		}
+		defer store.(io.Closer).Close()
+		s = store
+		compactor = store.(gokitbuildservice.Compactor)
+		if *opTimeout > 0 {
+			s = gokitbuildservice.NewTimeoutService(s, *opTimeout)
+		}
+		if *batchPar > 0 {
+			s = gokitbuildservice.BatchFanOutMiddleware(gokitbuildservice.WithBatchConcurrency(*batchPar))(s)
+		}
+		s = gokitbuildservice.QueueGateMiddleware(queue)(s)
+		s = gokitbuildservice.CoalescingMiddleware()(s)
+		s = gokitbuildservice.AuditMiddleware(audit)(s)
+		s = gokitbuildservice.BuildLockMiddleware()(s)
+		s = gokitbuildservice.LoggingMiddleware(logger, strings.Split(*logRedact, ",")...)(s)
+		s = gokitbuildservice.SlowRequestMiddleware(logger, kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "build_service",
+			Name:      "slow_requests_total",
+			Help:      "Number of service calls that took longer than their slow request threshold.",
+		}, []string{"method"}), slow)(s)
+		s = gokitbuildservice.RecoveringMiddleware(logger, kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "build_service",
+			Name:      "panics_total",
+			Help:      "Number of panics recovered from service methods.",
+		}, []string{"method"}))(s)
+		s = gokitbuildservice.InstrumentingMiddleware(promauto.NewHistogramVec(stdprometheus.HistogramOpts{
+			Namespace: "build_service",
+			Name:      "request_duration_seconds",
+			Help:      "Time spent in service methods, with exemplars for traced requests.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{"method", "error"}))(s)
 	}
 
+	byStatus := map[gokitbuildservice.BuildStatus]time.Duration{}
+	if *retFailed > 0 {
+		byStatus[gokitbuildservice.StatusFailed] = *retFailed
+	}
+	if *retention > 0 || *retFailed > 0 {
+		opts := []gokitbuildservice.RetentionOption{
+			gokitbuildservice.WithRetentionLogger(logger),
+			gokitbuildservice.WithRetentionMetrics(kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "build_service",
+				Name:      "builds_retention_deleted_total",
+				Help:      "Number of finished builds deleted by the retention sweeper.",
+			}, []string{"status"})),
+		}
+		for status, d := range byStatus {
+			opts = append(opts, gokitbuildservice.WithStatusRetention(status, d))
+		}
+		gokitbuildservice.StartRetentionSweeper(context.Background(), s, *retEvery, *retention, opts...)
+	}
+
+	var h http.Handler
+	{
+		format := gokitbuildservice.WithErrorFormat(gokitbuildservice.ErrorFormat(*errFormat))
+		sampling := gokitbuildservice.WithTraceSampling(*sample)
+		m := http.NewServeMux()
+		api := []gokitbuildservice.HandlerOption{
+			format, sampling,
+			gokitbuildservice.WithAuditLog(audit),
+			gokitbuildservice.WithDefaultListLimit(*listDef),
+			gokitbuildservice.WithMaxListLimit(*listMax),
+			gokitbuildservice.WithQueueGate(queue),
+			gokitbuildservice.WithReportedRetention(*retention, byStatus),
+			gokitbuildservice.WithActorTokens(parseTokens(*apiKeys)),
+		}
+		if authz != nil {
+			api = append(api, gokitbuildservice.WithAuthorizer(authz))
+		}
+		m.Handle("/", gokitbuildservice.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"), api...))
+		m.Handle("/admin/", gokitbuildservice.MakeAdminHTTPHandler(s, parseTokens(*adminKeys), log.With(logger, "component", "HTTP"), format, sampling, gokitbuildservice.WithSlowThresholds(slow), gokitbuildservice.WithQueueGate(queue), gokitbuildservice.WithCompactor(compactor)))
+		m.Handle("/webhooks/", gokitbuildservice.MakeWebhookHTTPHandler(hooks, log.With(logger, "component", "HTTP"), format, sampling))
+		m.Handle("/events", gokitbuildservice.MakeEventsHTTPHandler(events, log.With(logger, "component", "HTTP"), format))
+		m.Handle("/metrics", promhttp.HandlerFor(stdprometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+		if *buildSer > 0 {
+			r := stdprometheus.NewRegistry()
+			r.MustRegister(gokitbuildservice.NewBuildStatusCollector(s, gokitbuildservice.WithMaxBuildSeries(*buildSer)))
+			m.Handle("/metrics/builds", promhttp.HandlerFor(r, promhttp.HandlerOpts{}))
+		}
+		if *debug {
+			m.Handle("/debug/", gokitbuildservice.MakeDebugHTTPHandler(events, log.With(logger, "component", "HTTP"), format, sampling))
+		}
+		h = m
+	}
+
+	errs := make(chan error)
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errs <- fmt.Errorf("%s", <-c)
+	}()
+
+	if (*tlsCert == "") != (*tlsKey == "") || (*tlsCA != "" && *tlsCert == "") {
+		logger.Log("err", errTLSFlags)
+		os.Exit(1)
+	}
+	if *tlsCert == "" {
+		go func() {
+			logger.Log("transport", "HTTP", "addr", *httpAddr)
+			errs <- http.ListenAndServe(*httpAddr, h)
+		}()
+	} else {
+		certs, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			logger.Log("tls.cert", *tlsCert, "err", err)
+			os.Exit(1)
+		}
+		cfg, err := tlsConfig(certs, *tlsCA)
+		if err != nil {
+			logger.Log("tls.clientca", *tlsCA, "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, syscall.SIGHUP)
+			for range c {
+				if err := certs.reload(); err != nil {
+					logger.Log("tls.cert", *tlsCert, "reload", "failed", "err", err)
+					continue
+				}
+				logger.Log("tls.cert", *tlsCert, "reload", "ok")
+			}
+		}()
+		go func() {
+			logger.Log("transport", "HTTPS", "addr", *httpAddr, "mtls", *tlsCA != "")
+			// ServeTLS enables HTTP/2 on its own as long as
+			// TLSNextProto is left nil.
+			srv := &http.Server{Addr: *httpAddr, Handler: h, TLSConfig: cfg}
+			errs <- srv.ListenAndServeTLS("", "")
+		}()
+	}
+
+	logger.Log("exit", <-errs)
+}
+
+// parseTokens turns "alice=t1,bob=t2" into a token-to-name map.
+func parseTokens(s string) map[string]string {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if name, token, ok := strings.Cut(pair, "="); ok && name != "" && token != "" {
+			tokens[token] = name
+		}
+	}
+	return tokens
+}
+
+// parseRoles turns "alice=admin,bob=writer" into a name-to-role map,
+// checking every role, and anonymous, is one a RoleAuthorizer knows.
+func parseRoles(s, anonymous string) (map[string]gokitbuildservice.Role, error) {
+	known := func(r gokitbuildservice.Role) bool {
+		return r == gokitbuildservice.RoleReader || r == gokitbuildservice.RoleWriter || r == gokitbuildservice.RoleAdmin
+	}
+	if anonymous != "" && !known(gokitbuildservice.Role(anonymous)) {
+		return nil, fmt.Errorf("unknown role %q", anonymous)
+	}
+	roles := map[string]gokitbuildservice.Role{}
+	for _, pair := range strings.Split(s, ",") {
+		name, role, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || !known(gokitbuildservice.Role(role)) {
+			return nil, fmt.Errorf("bad name=role pair %q", pair)
+		}
+		roles[name] = gokitbuildservice.Role(role)
+	}
+	return roles, nil
+}
+
+func levelOption(s string) (level.Option, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return level.AllowDebug(), nil
+	case "info":
+		return level.AllowInfo(), nil
+	case "warn":
+		return level.AllowWarn(), nil
+	case "error":
+		return level.AllowError(), nil
+	default:
+		return nil, fmt.Errorf("unknown log level %q", s)
+	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// certReloader serves the certificate from a key pair on disk, and swaps in
+// a new one when reload is called, so rotated certificates take effect
+// without dropping connections or restarting.
+type certReloader struct {
+	certFile, keyFile string
+
+	mtx  sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the key pair again. If that fails, the current certificate
+// stays in use.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	r.cert = &cert
+	r.mtx.Unlock()
+	return nil
+}
+
+// GetCertificate is a tls.Config.GetCertificate callback.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.cert, nil
+}
+
+// tlsConfig returns the server TLS configuration. If clientCAFile is set,
+// clients must present a certificate signed by one of its CAs.
+func tlsConfig(certs *certReloader, clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+var errTLSFlags = errors.New("tls.cert and tls.key must be set together, and tls.clientca needs both")
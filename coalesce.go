@@ -0,0 +1,45 @@
+package gokitbuildservice
+
+import (
+	"context"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CoalescingMiddleware shares one call to the next service between
+// concurrent GetBuild calls for the same build, so a thundering herd of
+// identical reads costs one backend read. It only joins calls already in
+// flight; nothing is cached once the shared call returns.
+//
+// Every caller gets the shared result, error included. The shared call runs
+// with the first caller's context values but without its cancellation, so a
+// caller giving up returns its own context's error without failing the
+// others. Calls are only shared between callers acting as the same actor,
+// since what a build looks like depends on who asks. The returned Build is
+// shared too, so callers must not modify its maps or slices.
+//
+// Other methods are passed through unchanged.
+func CoalescingMiddleware() Middleware {
+	return func(next Service) Service {
+		return &coalescingMiddleware{Service: next}
+	}
+}
+
+type coalescingMiddleware struct {
+	Service
+	group singleflight.Group
+}
+
+func (mw *coalescingMiddleware) GetBuild(ctx context.Context, id string) (Build, error) {
+	key := ActorFromContext(ctx) + "\x00" + id
+	ch := mw.group.DoChan(key, func() (interface{}, error) {
+		return mw.Service.GetBuild(context.WithoutCancel(ctx), id)
+	})
+	select {
+	case res := <-ch:
+		b, _ := res.Val.(Build)
+		return b, res.Err
+	case <-ctx.Done():
+		return Build{}, ctx.Err()
+	}
+}
@@ -0,0 +1,268 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"sigs.k8s.io/yaml"
+)
+
+// ErrUnsupportedMediaType is returned when a request body is in a format we
+// can't decode.
+var ErrUnsupportedMediaType = errors.New("unsupported media type; use application/json or application/yaml")
+
+// isYAML reports whether a Content-Type or Accept value names YAML.
+func isYAML(mediaType string) bool {
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return true
+	}
+	return false
+}
+
+// decodeBody decodes the request body into v according to its Content-Type.
+// YAML is converted to JSON before decoding, so both formats share the json
+// struct tags. A missing Content-Type is treated as JSON.
+func decodeBody(r *http.Request, v interface{}) error {
+	mediaType := "application/json"
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return ErrUnsupportedMediaType
+		}
+	}
+	switch {
+	case mediaType == "application/json":
+		return json.NewDecoder(r.Body).Decode(v)
+	case isYAML(mediaType):
+		p, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		return yaml.Unmarshal(p, v)
+	default:
+		return ErrUnsupportedMediaType
+	}
+}
+
+// acceptsYAML reports whether the request that produced ctx asked for YAML.
+// It relies on httptransport.PopulateRequestContext having run.
+func acceptsYAML(ctx context.Context) bool {
+	accept, _ := ctx.Value(httptransport.ContextKeyRequestAccept).(string)
+	for _, part := range strings.Split(accept, ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && isYAML(mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorFormatHeader lets a client choose the ErrorFormat of its error
+// responses, overriding the server's default.
+const ErrorFormatHeader = "X-Error-Format"
+
+// ErrorFormat is the shape of error response bodies. The status code is the
+// same whichever format is used.
+type ErrorFormat string
+
+const (
+	// ErrorFormatStructured is the default:
+	//	{"error": {"code": 400, "message": "...", "problems": [...]}}
+	// where problems is only present for validation errors.
+	ErrorFormatStructured ErrorFormat = "structured"
+
+	// ErrorFormatBare is the legacy flat format, {"message": "..."}.
+	ErrorFormatBare ErrorFormat = "bare"
+)
+
+// HandlerOption configures the HTTP handlers.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	errorFormat ErrorFormat
+	audit       *AuditLog
+	traceSample float64
+	canary      *CanaryWeight
+	slow        *SlowThresholds
+	defaultList int
+	maxList     int
+	maxOutput   int
+	queue       *QueueGate
+	retention   *retentionReport
+	compactor   Compactor
+	actors      map[string]string // bearer token to actor name
+	authorizer  Authorizer
+}
+
+func newHandlerConfig(opts []HandlerOption) handlerConfig {
+	c := handlerConfig{errorFormat: ErrorFormatStructured, traceSample: 1, defaultList: DefaultListLimit, maxList: DefaultMaxListLimit, maxOutput: DefaultLimits.MaxOutputBytes}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// listLimit is the page size of a list asking for requested builds: the
+// default for no limit, and never more than the maximum.
+func (c handlerConfig) listLimit(requested int) int {
+	if requested == 0 {
+		requested = c.defaultList
+	}
+	if requested > c.maxList {
+		return c.maxList
+	}
+	return requested
+}
+
+// WithErrorFormat sets the error format used when the request doesn't
+// choose one with ErrorFormatHeader.
+func WithErrorFormat(f ErrorFormat) HandlerOption {
+	return func(c *handlerConfig) { c.errorFormat = f }
+}
+
+// WithTraceSampling samples ratio, between 0 and 1, of the traced requests
+// the caller sampled, rather than all of them. Only sampled traces are
+// linked from metrics as exemplars.
+func WithTraceSampling(ratio float64) HandlerOption {
+	return func(c *handlerConfig) { c.traceSample = ratio }
+}
+
+// WithMaxOutputBytes sets how much of a PUT /builds/:id/outputs/:key body
+// is read, rather than DefaultLimits.MaxOutputBytes. Set it to the
+// service's Limits.MaxOutputBytes if WithLimits raised it. Zero or less
+// keeps the default.
+func WithMaxOutputBytes(n int) HandlerOption {
+	return func(c *handlerConfig) {
+		if n > 0 {
+			c.maxOutput = n
+		}
+	}
+}
+
+// WithDefaultListLimit sets the page size of GET /builds/ lists that ask
+// for no limit, rather than DefaultListLimit. It's capped by
+// WithMaxListLimit like any other limit. Zero or less keeps the default.
+func WithDefaultListLimit(n int) HandlerOption {
+	return func(c *handlerConfig) {
+		if n > 0 {
+			c.defaultList = n
+		}
+	}
+}
+
+// WithMaxListLimit caps the page size of GET /builds/ at n, rather than
+// DefaultMaxListLimit. Lists asking for a larger limit get n. Zero or less
+// keeps the default.
+func WithMaxListLimit(n int) HandlerOption {
+	return func(c *handlerConfig) {
+		if n > 0 {
+			c.maxList = n
+		}
+	}
+}
+
+// WithCanaryWeight lets admins read and change w under
+// /admin/config/canary.
+func WithCanaryWeight(w *CanaryWeight) HandlerOption {
+	return func(c *handlerConfig) { c.canary = w }
+}
+
+// WithSlowThresholds lets admins read and change t under
+// /admin/config/slow.
+func WithSlowThresholds(t *SlowThresholds) HandlerOption {
+	return func(c *handlerConfig) { c.slow = t }
+}
+
+// WithQueueGate lets admins pause and resume g under /admin/queue/, and
+// reports whether it's paused from GET /health.
+func WithQueueGate(g *QueueGate) HandlerOption {
+	return func(c *handlerConfig) { c.queue = g }
+}
+
+// WithActorTokens identifies the callers of MakeHTTPHandler's endpoints by
+// bearer token: tokens maps each token to the name recorded as the actor,
+// for AuditLog entries, Authorizer decisions and reading encrypted labels.
+// Callers without a known token are anonymous.
+func WithActorTokens(tokens map[string]string) HandlerOption {
+	return func(c *handlerConfig) { c.actors = tokens }
+}
+
+// WithAuthorizer puts every endpoint of MakeHTTPHandler behind
+// AuthorizingEndpoint, asking a before each call.
+func WithAuthorizer(a Authorizer) HandlerOption {
+	return func(c *handlerConfig) { c.authorizer = a }
+}
+
+// WithCompactor lets admins compact c's storage with POST /admin/compact.
+func WithCompactor(c Compactor) HandlerOption {
+	return func(cfg *handlerConfig) { cfg.compactor = c }
+}
+
+// WithReportedRetention reports, from GET /limits, the retention the
+// builds are swept with, as given to StartRetentionSweeper.
+func WithReportedRetention(retention time.Duration, byStatus map[BuildStatus]time.Duration) HandlerOption {
+	return func(c *handlerConfig) { c.retention = &retentionReport{retention, byStatus} }
+}
+
+type retentionReport struct {
+	retention time.Duration
+	byStatus  map[BuildStatus]time.Duration
+}
+
+// WithAuditLog serves a's entries under GET /builds/:id/audit.
+func WithAuditLog(a *AuditLog) HandlerOption {
+	return func(c *handlerConfig) { c.audit = a }
+}
+
+// errorFormatToContext returns a ServerBefore func recording the error
+// format the request asked for, or def.
+func errorFormatToContext(def ErrorFormat) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		f := ErrorFormat(strings.ToLower(r.Header.Get(ErrorFormatHeader)))
+		if f != ErrorFormatStructured && f != ErrorFormatBare {
+			f = def
+		}
+		return context.WithValue(ctx, errorFormatContextKey, f)
+	}
+}
+
+func errorFormatFromContext(ctx context.Context) ErrorFormat {
+	if f, ok := ctx.Value(errorFormatContextKey).(ErrorFormat); ok {
+		return f
+	}
+	return ErrorFormatStructured
+}
+
+// writeBody writes v as YAML if the client asked for it, and JSON otherwise,
+// with its builds in full if the client asked for FullProfile. Headers
+// other than Content-Type, and the status code, must not have been written
+// yet when code is non-zero.
+func writeBody(ctx context.Context, w http.ResponseWriter, code int, v interface{}) error {
+	if f, ok := v.(fullViewer); ok && acceptsFull(ctx) {
+		v = f.full()
+	}
+	if acceptsYAML(ctx) {
+		p, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+		if code != 0 {
+			w.WriteHeader(code)
+		}
+		_, err = w.Write(p)
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if code != 0 {
+		w.WriteHeader(code)
+	}
+	return json.NewEncoder(w).Encode(v)
+}
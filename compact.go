@@ -0,0 +1,106 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrCompactionInProgress is returned by Compact while another compaction
+// of the same store is running.
+var ErrCompactionInProgress = errors.New("compaction in progress")
+
+// CompactStats reports what a compaction did.
+type CompactStats struct {
+	// ReclaimedBytes is how much less space the store takes up on disk
+	// afterwards, or zero if it grew in the meantime.
+	ReclaimedBytes int64
+
+	// Duration is how long the compaction took.
+	Duration time.Duration
+}
+
+// Compactor is implemented by backends whose storage can be compacted on
+// demand, rather than only when they decide to.
+type Compactor interface {
+	Compact(ctx context.Context) (CompactStats, error)
+}
+
+// Compact compacts a persistent service's write-ahead log into a fresh
+// snapshot, as happens when the log grows long, and removes the older
+// generations. Only copying the store holds the lock; writes carry on into
+// the new log while the snapshot is written. A service that isn't
+// persistent has nothing to compact, and returns zero stats.
+func (s *buildService) Compact(ctx context.Context) (CompactStats, error) {
+	if err := ctx.Err(); err != nil {
+		return CompactStats{}, err
+	}
+	if s.wal == nil {
+		return CompactStats{}, nil
+	}
+	begin := s.clock.Now()
+	before, err := s.wal.size()
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	s.mtx.Lock()
+	if s.wal.compacting {
+		s.mtx.Unlock()
+		return CompactStats{}, ErrCompactionInProgress
+	}
+	gen, taken, records, err := s.startCompaction(ctx)
+	s.mtx.Unlock()
+	if err != nil {
+		return CompactStats{}, err
+	}
+	err = s.wal.writeSnapshot(gen, taken, records)
+	s.mtx.Lock()
+	s.wal.compacting = false
+	s.wal.err = err
+	s.mtx.Unlock()
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	after, err := s.wal.size()
+	if err != nil {
+		return CompactStats{}, err
+	}
+	stats := CompactStats{Duration: s.clock.Now().Sub(begin)}
+	if before > after {
+		stats.ReclaimedBytes = before - after
+	}
+	return stats, nil
+}
+
+// size is how many bytes the snapshots and logs in dir take up.
+func (w *wal) size() (int64, error) {
+	snapshots, wals, err := w.generations()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	add := func(path string) error {
+		fi, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // removed by a compaction finishing meanwhile
+		}
+		if err == nil {
+			n += fi.Size()
+		}
+		return err
+	}
+	for _, g := range snapshots {
+		if err := add(w.snapshotPath(g)); err != nil {
+			return 0, err
+		}
+	}
+	for _, g := range wals {
+		if err := add(w.walPath(g)); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,363 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// SecondaryWritePolicy decides what a composite service does when a write
+// succeeds on the primary backend but fails on the secondary.
+type SecondaryWritePolicy int
+
+const (
+	// LogSecondaryFailures logs the secondary's error and reports success,
+	// since the primary remains the source of truth.
+	LogSecondaryFailures SecondaryWritePolicy = iota
+
+	// FailOnSecondaryFailure returns the secondary's error to the caller. The
+	// primary write is not rolled back.
+	FailOnSecondaryFailure
+)
+
+// CompositeOption configures a composite service.
+type CompositeOption func(*compositeService)
+
+// WithSecondaryWrite dual-writes every successful primary mutation to s,
+// handling its failures according to policy.
+func WithSecondaryWrite(s Service, policy SecondaryWritePolicy) CompositeOption {
+	return func(c *compositeService) {
+		c.secondary = s
+		c.policy = policy
+	}
+}
+
+// WithCompositeLogger sets the logger used to report secondary write
+// failures. By default they're discarded.
+func WithCompositeLogger(logger log.Logger) CompositeOption {
+	return func(c *compositeService) { c.logger = logger }
+}
+
+// NewCompositeService returns a Service that sends reads to read and
+// mutations to primaryWrite, optionally mirroring mutations to a secondary
+// backend. Pointing read and primaryWrite at different backends, and moving
+// them one at a time, lets us migrate between backends without downtime.
+func NewCompositeService(read, primaryWrite Service, opts ...CompositeOption) Service {
+	c := &compositeService{
+		read:    read,
+		primary: primaryWrite,
+		logger:  log.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type compositeService struct {
+	read      Service
+	primary   Service
+	secondary Service
+	policy    SecondaryWritePolicy
+	logger    log.Logger
+}
+
+func (c *compositeService) PostBuild(ctx context.Context, b Build) error {
+	if err := c.primary.PostBuild(ctx, b); err != nil {
+		return err
+	}
+	return c.mirror("PostBuild", b.ID, func(s Service) error { return s.PostBuild(ctx, b) })
+}
+
+func (c *compositeService) GetBuild(ctx context.Context, id string) (Build, error) {
+	return c.read.GetBuild(ctx, id)
+}
+
+func (c *compositeService) GetBuilds(ctx context.Context, ids []string) (map[string]Build, []string, error) {
+	return c.read.GetBuilds(ctx, ids)
+}
+
+func (c *compositeService) ListBuildStatuses(ctx context.Context, ids []string) (map[string]BuildStatus, error) {
+	return c.read.ListBuildStatuses(ctx, ids)
+}
+
+// ReserveID reserves on the primary only: creating the build there claims
+// the reservation, and the creation is mirrored as usual.
+func (c *compositeService) ReserveID(ctx context.Context, prefix string) (string, error) {
+	return c.primary.ReserveID(ctx, prefix)
+}
+
+func (c *compositeService) ListBuilds(ctx context.Context, opts ListOptions) ([]Build, error) {
+	return c.read.ListBuilds(ctx, opts)
+}
+
+func (c *compositeService) PutBuild(ctx context.Context, id string, b Build) error {
+	if err := c.primary.PutBuild(ctx, id, b); err != nil {
+		return err
+	}
+	return c.mirror("PutBuild", id, func(s Service) error { return s.PutBuild(ctx, id, b) })
+}
+
+func (c *compositeService) PatchBuild(ctx context.Context, id string, b Build) error {
+	if err := c.primary.PatchBuild(ctx, id, b); err != nil {
+		return err
+	}
+	return c.mirror("PatchBuild", id, func(s Service) error { return s.PatchBuild(ctx, id, b) })
+}
+
+func (c *compositeService) DeleteBuild(ctx context.Context, id string) error {
+	if err := c.primary.DeleteBuild(ctx, id); err != nil {
+		return err
+	}
+	return c.mirror("DeleteBuild", id, func(s Service) error { return s.DeleteBuild(ctx, id) })
+}
+
+func (c *compositeService) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (int64, error) {
+	n, err := c.primary.AppendBuildLogs(ctx, id, offset, p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.mirror("AppendBuildLogs", id, func(s Service) error {
+		_, err := s.AppendBuildLogs(ctx, id, offset, p)
+		return err
+	})
+}
+
+func (c *compositeService) GetBuildLogLength(ctx context.Context, id string) (int64, error) {
+	return c.read.GetBuildLogLength(ctx, id)
+}
+
+func (c *compositeService) ValidateBuild(ctx context.Context, b Build) (ValidationErrors, error) {
+	return c.read.ValidateBuild(ctx, b)
+}
+
+func (c *compositeService) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (Build, bool, error) {
+	b, ok, err := c.primary.LeaseBuild(ctx, workerID, ttl)
+	if err != nil || !ok {
+		return b, ok, err
+	}
+	// The secondary might pick a different build, so copy the primary's
+	// choice over instead of leasing again.
+	return b, ok, c.mirror("LeaseBuild", b.ID, func(s Service) error { return s.PutBuild(ctx, b.ID, b) })
+}
+
+func (c *compositeService) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (Build, bool, error) {
+	b, ok, err := c.primary.ClaimAndStart(ctx, workerID, filter)
+	if err != nil || !ok {
+		return b, ok, err
+	}
+	return b, ok, c.mirror("ClaimAndStart", b.ID, func(s Service) error { return s.PutBuild(ctx, b.ID, b) })
+}
+
+func (c *compositeService) ForceReleaseLease(ctx context.Context, id string) error {
+	if err := c.primary.ForceReleaseLease(ctx, id); err != nil {
+		return err
+	}
+	return c.mirror("ForceReleaseLease", id, func(s Service) error { return s.ForceReleaseLease(ctx, id) })
+}
+
+func (c *compositeService) QueuePosition(ctx context.Context, id string) (int, time.Duration, error) {
+	return c.read.QueuePosition(ctx, id)
+}
+
+func (c *compositeService) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (bool, error) {
+	ok, err := c.primary.CompareAndSetStatus(ctx, id, expected, next)
+	if err != nil || !ok {
+		return ok, err
+	}
+	// The primary decided; the secondary just follows, whatever it holds.
+	return ok, c.mirror("CompareAndSetStatus", id, func(s Service) error {
+		return s.PatchBuild(ctx, id, Build{ID: id, Status: next})
+	})
+}
+
+func (c *compositeService) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (bool, error) {
+	ok, err := c.primary.CompareAndDeleteBuild(ctx, id, updatedAt)
+	if err != nil || !ok {
+		return ok, err
+	}
+	return ok, c.mirror("CompareAndDeleteBuild", id, func(s Service) error { return s.DeleteBuild(ctx, id) })
+}
+
+// mirror applies a mutation that already succeeded on the primary to the
+// secondary, if there is one.
+func (c *compositeService) mirror(method, id string, write func(Service) error) error {
+	if c.secondary == nil {
+		return nil
+	}
+	err := write(c.secondary)
+	if err == nil {
+		return nil
+	}
+	level.Warn(c.logger).Log("method", method, "id", id, "backend", "secondary", "err", err)
+	if c.policy == FailOnSecondaryFailure {
+		return err
+	}
+	return nil
+}
+
+func (c *compositeService) RerunFailedSteps(ctx context.Context, id string) (Build, error) {
+	b, err := c.primary.RerunFailedSteps(ctx, id)
+	if err != nil {
+		return b, err
+	}
+	return b, c.mirror("RerunFailedSteps", id, func(s Service) error { return s.PutBuild(ctx, id, b) })
+}
+
+func (c *compositeService) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) ([]Build, error) {
+	return c.read.ListBuildsModifiedBetween(ctx, from, to)
+}
+
+func (c *compositeService) FailBuild(ctx context.Context, id, reason string, exitCode int) error {
+	if err := c.primary.FailBuild(ctx, id, reason, exitCode); err != nil {
+		return err
+	}
+	return c.mirror("FailBuild", id, func(s Service) error { return s.FailBuild(ctx, id, reason, exitCode) })
+}
+
+func (c *compositeService) RenameBuild(ctx context.Context, oldID, newID string) error {
+	if err := c.primary.RenameBuild(ctx, oldID, newID); err != nil {
+		return err
+	}
+	return c.mirror("RenameBuild", oldID, func(s Service) error { return s.RenameBuild(ctx, oldID, newID) })
+}
+
+func (c *compositeService) GetOrCreateBuild(ctx context.Context, b Build) (Build, bool, error) {
+	got, created, err := c.primary.GetOrCreateBuild(ctx, b)
+	if err != nil || !created {
+		return got, created, err
+	}
+	return got, created, c.mirror("GetOrCreateBuild", b.ID, func(s Service) error {
+		_, _, err := s.GetOrCreateBuild(ctx, b)
+		return err
+	})
+}
+
+func (c *compositeService) ListLabelKeys(ctx context.Context) ([]string, error) {
+	return c.read.ListLabelKeys(ctx)
+}
+
+func (c *compositeService) ListLabelValues(ctx context.Context, key string) ([]string, error) {
+	return c.read.ListLabelValues(ctx, key)
+}
+
+// PatchBuilds mirrors the patch to the builds it succeeded on in the
+// primary.
+func (c *compositeService) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) ([]BatchResult, error) {
+	results, err := c.primary.PatchBuilds(ctx, ids, patch)
+	if err != nil {
+		return results, err
+	}
+	var patched []string
+	for _, r := range results {
+		if r.Err == nil {
+			patched = append(patched, r.ID)
+		}
+	}
+	if len(patched) == 0 {
+		return results, nil
+	}
+	return results, c.mirror("PatchBuilds", strings.Join(patched, ","), func(s Service) error {
+		mirrored, err := s.PatchBuilds(ctx, patched, patch)
+		if err != nil {
+			return err
+		}
+		for _, r := range mirrored {
+			if r.Err != nil {
+				return r.Err
+			}
+		}
+		return nil
+	})
+}
+
+// BatchPostBuilds mirrors the builds it created in the primary.
+func (c *compositeService) BatchPostBuilds(ctx context.Context, builds []Build) ([]BatchResult, error) {
+	results, err := c.primary.BatchPostBuilds(ctx, builds)
+	if err != nil {
+		return results, err
+	}
+	var created []Build
+	var ids []string
+	for i, r := range results {
+		if r.Err == nil {
+			created = append(created, builds[i])
+			ids = append(ids, r.ID)
+		}
+	}
+	if len(created) == 0 {
+		return results, nil
+	}
+	return results, c.mirror("BatchPostBuilds", strings.Join(ids, ","), func(s Service) error {
+		mirrored, err := s.BatchPostBuilds(ctx, created)
+		if err != nil {
+			return err
+		}
+		for _, r := range mirrored {
+			if r.Err != nil {
+				return r.Err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *compositeService) FindBuildsBySpecHash(ctx context.Context, hash string) ([]Build, error) {
+	return c.read.FindBuildsBySpecHash(ctx, hash)
+}
+
+func (c *compositeService) GetBuildLogs(ctx context.Context, id string, step int, from int64) ([]byte, error) {
+	return c.read.GetBuildLogs(ctx, id, step, from)
+}
+
+func (c *compositeService) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) error {
+	return c.read.ReplayBuild(ctx, id, sink)
+}
+
+// GetLimits reports the primary's limits, since they're the ones writes
+// are held to.
+func (c *compositeService) GetLimits(ctx context.Context) (ServiceLimits, error) {
+	return c.primary.GetLimits(ctx)
+}
+
+// BuildMetrics summarizes the builds of the service reads go to.
+func (c *compositeService) BuildMetrics(ctx context.Context, window time.Duration) (MetricsSummary, error) {
+	return c.read.BuildMetrics(ctx, window)
+}
+
+func (c *compositeService) FindSucceededByFingerprint(ctx context.Context, fp string) (Build, bool, error) {
+	return c.read.FindSucceededByFingerprint(ctx, fp)
+}
+
+func (c *compositeService) SetOutput(ctx context.Context, id, key, value string) error {
+	if err := c.primary.SetOutput(ctx, id, key, value); err != nil {
+		return err
+	}
+	return c.mirror("SetOutput", id, func(s Service) error { return s.SetOutput(ctx, id, key, value) })
+}
+
+func (c *compositeService) GetOutput(ctx context.Context, id, key string) (string, error) {
+	return c.read.GetOutput(ctx, id, key)
+}
+
+func (c *compositeService) ListBuildsByGroup(ctx context.Context, groupID string) ([]Build, error) {
+	return c.read.ListBuildsByGroup(ctx, groupID)
+}
+
+func (c *compositeService) CancelGroup(ctx context.Context, groupID string) (int, error) {
+	n, err := c.primary.CancelGroup(ctx, groupID)
+	if err != nil {
+		return n, err
+	}
+	return n, c.mirror("CancelGroup", groupID, func(s Service) error {
+		_, err := s.CancelGroup(ctx, groupID)
+		return err
+	})
+}
+
+func (c *compositeService) GroupStatus(ctx context.Context, groupID string) (GroupSummary, error) {
+	return c.read.GroupStatus(ctx, groupID)
+}
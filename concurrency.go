@@ -0,0 +1,43 @@
+package gokitbuildservice
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConcurrencyLimit is returned when a build can't start running because
+// as many builds as WithMaxConcurrentRunning allows already are.
+var ErrConcurrencyLimit = errors.New("too many running builds")
+
+// WithMaxConcurrentRunning caps how many builds may be running at once.
+// Whichever method would move a build into running beyond the cap fails
+// with ErrConcurrencyLimit and leaves the build as it was. Running builds
+// with an expired lease still hold their slot until they're leased again or
+// leave running. Zero, the default, means no cap.
+func WithMaxConcurrentRunning(n int) InmemOption {
+	return func(s *buildService) { s.maxRunning = n }
+}
+
+// admit checks that the transition from prev to next fits under the cap on
+// running builds. It must be called with s.mtx held.
+func (s *buildService) admit(prev, next Build) error {
+	if s.maxRunning <= 0 || next.Status != StatusRunning || prev.Status == StatusRunning {
+		return nil
+	}
+	if s.running >= s.maxRunning {
+		return fmt.Errorf("%w: %d of %d", ErrConcurrencyLimit, s.running, s.maxRunning)
+	}
+	return nil
+}
+
+// track keeps the count of running builds as a build goes from prev to
+// next; an empty status stands for a build that doesn't exist. It must be
+// called with s.mtx held, whenever s.repo changes.
+func (s *buildService) track(prev, next BuildStatus) {
+	if prev == StatusRunning {
+		s.running--
+	}
+	if next == StatusRunning {
+		s.running++
+	}
+}
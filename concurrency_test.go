@@ -0,0 +1,88 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrentRunningHoldsUnderContention(t *testing.T) {
+	const max, builds = 3, 30
+	ctx := context.Background()
+	s := NewInmemService(WithMaxConcurrentRunning(max))
+	for i := 0; i < builds; i++ {
+		if err := s.PostBuild(ctx, Build{ID: fmt.Sprintf("b%02d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	running := func() int {
+		t.Helper()
+		all, err := s.ListBuilds(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, b := range all {
+			if b.Status == StatusRunning {
+				n++
+			}
+		}
+		return n
+	}
+
+	var started, limited atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < builds; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var ok bool
+			var err error
+			if i%2 == 0 {
+				ok, err = s.CompareAndSetStatus(ctx, fmt.Sprintf("b%02d", i), StatusPending, StatusRunning)
+			} else {
+				_, ok, err = s.LeaseBuild(ctx, fmt.Sprintf("w%d", i), time.Minute)
+			}
+			switch {
+			case errors.Is(err, ErrConcurrencyLimit):
+				limited.Add(1)
+			case err != nil:
+				t.Error(err)
+			case ok:
+				started.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// The rest were refused, unless a lease got to their build first.
+	if started.Load() != max || limited.Load() == 0 {
+		t.Errorf("got %d started and %d refused, want %d started and the rest refused", started.Load(), limited.Load(), max)
+	}
+	if n := running(); n != max {
+		t.Fatalf("%d builds running, want %d", n, max)
+	}
+
+	// A slot frees up when a build leaves running, and only one.
+	all, _ := s.ListBuilds(ctx, ListOptions{})
+	for _, b := range all {
+		if b.Status == StatusRunning {
+			if err := s.FailBuild(ctx, b.ID, "boom", 1); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if _, ok, err := s.LeaseBuild(ctx, "late", time.Minute); err != nil || !ok {
+		t.Fatalf("leasing into the freed slot: %v, %v", ok, err)
+	}
+	if _, _, err := s.LeaseBuild(ctx, "later", time.Minute); !errors.Is(err, ErrConcurrencyLimit) {
+		t.Errorf("leasing past the cap again: got %v, want ErrConcurrencyLimit", err)
+	}
+	if n := running(); n != max {
+		t.Errorf("%d builds running, want %d", n, max)
+	}
+}
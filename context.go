@@ -0,0 +1,182 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strings"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+type contextKey int
+
+const (
+	actorContextKey contextKey = iota
+	requestIDContextKey
+	traceIDContextKey
+	traceSampledContextKey
+	baggageContextKey
+	errorFormatContextKey
+	partialResultsContextKey
+)
+
+// WithActor returns a context recording who is performing the operation.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey, actor)
+}
+
+// ActorFromContext returns the actor recorded by WithActor, or "".
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey).(string)
+	return actor
+}
+
+// WithPartialResults returns a context whose ListBuilds, when the context
+// ends partway through, returns the builds gathered so far with
+// ErrPartialResult instead of only the context's error. Callers that need
+// all or nothing simply don't ask for it.
+func WithPartialResults(ctx context.Context) context.Context {
+	return context.WithValue(ctx, partialResultsContextKey, true)
+}
+
+// PartialResultsFromContext reports whether ctx was made with
+// WithPartialResults.
+func PartialResultsFromContext(ctx context.Context) bool {
+	ok, _ := ctx.Value(partialResultsContextKey).(bool)
+	return ok
+}
+
+// RequestIDHeader carries a caller-chosen request ID. If it's absent, one is
+// generated.
+const RequestIDHeader = "X-Request-ID"
+
+// WithRequestID returns a context carrying the ID of the request being served.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// RequestIDFromContext returns the ID recorded by WithRequestID, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// requestIDToContext is a ServerBefore func recording the request ID.
+func requestIDToContext(ctx context.Context, r *http.Request) context.Context {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" {
+		var buf [8]byte
+		rand.Read(buf[:])
+		id = hex.EncodeToString(buf[:])
+	}
+	return WithRequestID(ctx, id)
+}
+
+// TraceParentHeader is the W3C Trace Context header naming the trace a
+// request belongs to.
+const TraceParentHeader = "traceparent"
+
+// WithTraceID returns a context carrying the ID of the trace the operation
+// is part of.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDContextKey, id)
+}
+
+// TraceIDFromContext returns the ID recorded by WithTraceID, or "".
+func TraceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDContextKey).(string)
+	return id
+}
+
+// WithTraceSampled records whether the trace in ctx was sampled. Traces
+// are sampled unless recorded otherwise.
+func WithTraceSampled(ctx context.Context, sampled bool) context.Context {
+	return context.WithValue(ctx, traceSampledContextKey, sampled)
+}
+
+// TraceSampledFromContext reports whether ctx carries a trace ID, as
+// recorded by WithTraceID, and the trace was sampled.
+func TraceSampledFromContext(ctx context.Context) bool {
+	if TraceIDFromContext(ctx) == "" {
+		return false
+	}
+	sampled, ok := ctx.Value(traceSampledContextKey).(bool)
+	return !ok || sampled
+}
+
+// TraceDebugHeader, set to "true", samples the request's trace whatever
+// the sampling ratio, for debugging a request on demand.
+const TraceDebugHeader = "X-Trace-Debug"
+
+// traceToContext returns a ServerBefore func recording the trace ID from a
+// well-formed traceparent header, "00-<trace-id>-<parent-id>-<flags>", and
+// whether it's sampled. Requests without one aren't traced.
+//
+// Sampling is decided once per request, here, so every span of it agrees.
+// A trace the caller didn't sample isn't sampled; otherwise ratio of them
+// are, chosen by trace ID, so that other services sampling the same way
+// keep or drop the same traces. TraceDebugHeader overrides both.
+func traceToContext(ratio float64) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		parts := strings.Split(r.Header.Get(TraceParentHeader), "-")
+		if len(parts) != 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+			return ctx
+		}
+		id, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return ctx
+		}
+		flags, err := hex.DecodeString(parts[3])
+		sampled := err == nil && len(flags) == 1 && flags[0]&1 == 1 && sampleTrace(id, ratio)
+		if r.Header.Get(TraceDebugHeader) == "true" {
+			sampled = true
+		}
+		return WithTraceSampled(WithTraceID(ctx, parts[1]), sampled)
+	}
+}
+
+// sampleTrace keeps ratio of traces, deciding by the low 8 bytes of the
+// trace ID, which W3C Trace Context requires to be random.
+func sampleTrace(id []byte, ratio float64) bool {
+	switch {
+	case ratio >= 1:
+		return true
+	case ratio <= 0:
+		return false
+	}
+	return binary.BigEndian.Uint64(id[8:]) < uint64(ratio*math.MaxUint64)
+}
+
+// BaggageHeader is the W3C Baggage header, carrying caller-defined
+// key=value pairs along a request's path through services.
+const BaggageHeader = "baggage"
+
+// maxBaggage is the size of the largest baggage header propagated, as
+// W3C Baggage requires propagating at least.
+const maxBaggage = 8192
+
+// WithBaggage returns a context carrying baggage, in BaggageHeader form,
+// to be passed on to the services and webhooks called on its behalf.
+func WithBaggage(ctx context.Context, baggage string) context.Context {
+	return context.WithValue(ctx, baggageContextKey, baggage)
+}
+
+// BaggageFromContext returns the baggage recorded by WithBaggage, or "".
+func BaggageFromContext(ctx context.Context) string {
+	baggage, _ := ctx.Value(baggageContextKey).(string)
+	return baggage
+}
+
+// baggageToContext is a ServerBefore func recording the request's baggage.
+// Oversized baggage is dropped rather than truncated mid-entry.
+func baggageToContext(ctx context.Context, r *http.Request) context.Context {
+	baggage := strings.Join(r.Header.Values(BaggageHeader), ",")
+	if baggage == "" || len(baggage) > maxBaggage {
+		return ctx
+	}
+	return WithBaggage(ctx, baggage)
+}
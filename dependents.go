@@ -0,0 +1,37 @@
+package gokitbuildservice
+
+import "sort"
+
+// link keeps s.dependents, the reverse of every stored build's DependsOn,
+// in step as the build stored under next's ID goes from prev to next; the
+// zero Build stands for one that doesn't exist. It must be called with
+// s.mtx held, whenever s.repo changes.
+func (s *buildService) link(prev, next Build) {
+	for _, dep := range prev.DependsOn {
+		if ids := s.dependents[dep]; ids != nil {
+			delete(ids, prev.ID)
+			if len(ids) == 0 {
+				delete(s.dependents, dep)
+			}
+		}
+	}
+	for _, dep := range next.DependsOn {
+		ids := s.dependents[dep]
+		if ids == nil {
+			ids = map[string]struct{}{}
+			s.dependents[dep] = ids
+		}
+		ids[next.ID] = struct{}{}
+	}
+}
+
+// dependentsOf returns the IDs of the stored builds, expired or not, whose
+// DependsOn names id, in order. It must be called with s.mtx held.
+func (s *buildService) dependentsOf(id string) []string {
+	ids := make([]string, 0, len(s.dependents[id]))
+	for dependent := range s.dependents[id] {
+		ids = append(ids, dependent)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,76 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRenameFollowsTheReverseIndex(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmemService().(*buildService)
+	for _, b := range []Build{
+		{ID: "a"},
+		{ID: "b", DependsOn: []string{"a"}},
+		{ID: "c", DependsOn: []string{"b", "a"}},
+		{ID: "d"},
+	} {
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := s.dependentsOf("a"), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("dependents of a: got %v, want %v", got, want)
+	}
+
+	if err := s.RenameBuild(ctx, "a", "z"); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string][]string{"b": {"z"}, "c": {"b", "z"}, "d": nil} {
+		b, err := s.GetBuild(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(b.DependsOn, want) {
+			t.Errorf("%s depends on %v, want %v", id, b.DependsOn, want)
+		}
+	}
+	if got := s.dependentsOf("a"); len(got) != 0 {
+		t.Errorf("a still has dependents %v", got)
+	}
+	if got, want := s.dependentsOf("z"), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dependents of z: got %v, want %v", got, want)
+	}
+	if err := s.PatchBuild(ctx, "z", Build{DependsOn: []string{"c"}}); !errors.Is(err, ErrValidation) {
+		t.Errorf("cycle through the renamed build: got %v, want a validation error", err)
+	}
+
+	if err := s.DeleteBuild(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.dependentsOf("z"), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dependents of z after deleting c: got %v, want %v", got, want)
+	}
+}
+
+func TestRenameOntoAReservedID(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmemService()
+	if err := s.PostBuild(ctx, Build{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.ReserveID(WithActor(ctx, "alice"), "r-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RenameBuild(ctx, "a", id); err != ErrAlreadyExists {
+		t.Fatalf("got %v, want ErrAlreadyExists", err)
+	}
+	if _, err := s.GetBuild(ctx, "a"); err != nil {
+		t.Fatalf("a is gone after the failed rename: %v", err)
+	}
+	if err := s.RenameBuild(WithActor(ctx, "alice"), "a", id); err != nil {
+		t.Fatalf("rename by the reservation's holder: %v", err)
+	}
+}
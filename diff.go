@@ -0,0 +1,134 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ChangeKind describes how a single field differs between two builds.
+type ChangeKind string
+
+const (
+	ChangeAdded   ChangeKind = "added"
+	ChangeRemoved ChangeKind = "removed"
+	ChangeChanged ChangeKind = "changed"
+)
+
+// FieldChange is one difference between two builds. Field is a path into the
+// build such as "name", "steps[2]", "labels.env" or "dependsOn".
+type FieldChange struct {
+	Field string      `json:"field"`
+	Kind  ChangeKind  `json:"kind"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+// BuildDiff is the structured difference between the specs of two builds.
+// Changes are ordered by field, so identical inputs always yield identical
+// output.
+type BuildDiff struct {
+	A       string        `json:"a"`
+	B       string        `json:"b"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// DiffBuilds compares the specs of builds idA and idB. It only relies on
+// GetBuild, so it works against any Service implementation. ErrNotFound is
+// returned if either build is missing.
+func DiffBuilds(ctx context.Context, s Service, idA, idB string) (BuildDiff, error) {
+	a, err := s.GetBuild(ctx, idA)
+	if err != nil {
+		return BuildDiff{}, err
+	}
+	b, err := s.GetBuild(ctx, idB)
+	if err != nil {
+		return BuildDiff{}, err
+	}
+	return diffBuilds(a, b), nil
+}
+
+func diffBuilds(a, b Build) BuildDiff {
+	d := BuildDiff{A: a.ID, B: b.ID, Changes: []FieldChange{}}
+
+	if a.Name != b.Name {
+		d.Changes = append(d.Changes, FieldChange{Field: "name", Kind: ChangeChanged, Old: a.Name, New: b.Name})
+	}
+	if a.Priority != b.Priority {
+		d.Changes = append(d.Changes, FieldChange{Field: "priority", Kind: ChangeChanged, Old: a.Priority, New: b.Priority})
+	}
+
+	for i := 0; i < len(a.Steps) || i < len(b.Steps); i++ {
+		field := fmt.Sprintf("steps[%d]", i)
+		switch {
+		case i >= len(a.Steps):
+			d.Changes = append(d.Changes, FieldChange{Field: field, Kind: ChangeAdded, New: b.Steps[i]})
+		case i >= len(b.Steps):
+			d.Changes = append(d.Changes, FieldChange{Field: field, Kind: ChangeRemoved, Old: a.Steps[i]})
+		case !reflect.DeepEqual(a.Steps[i], b.Steps[i]):
+			d.Changes = append(d.Changes, FieldChange{Field: field, Kind: ChangeChanged, Old: a.Steps[i], New: b.Steps[i]})
+		}
+	}
+
+	d.Changes = append(d.Changes, diffMaps("labels", a.Labels, b.Labels)...)
+	d.Changes = append(d.Changes, diffMaps("parameters", a.Parameters, b.Parameters)...)
+
+	// Dependencies are a set; their order carries no meaning.
+	depsA, depsB := stringSet(a.DependsOn), stringSet(b.DependsOn)
+	for _, dep := range sortedKeys(depsA) {
+		if _, ok := depsB[dep]; !ok {
+			d.Changes = append(d.Changes, FieldChange{Field: "dependsOn", Kind: ChangeRemoved, Old: dep})
+		}
+	}
+	for _, dep := range sortedKeys(depsB) {
+		if _, ok := depsA[dep]; !ok {
+			d.Changes = append(d.Changes, FieldChange{Field: "dependsOn", Kind: ChangeAdded, New: dep})
+		}
+	}
+
+	return d
+}
+
+// diffMaps compares two string maps key by key, in key order.
+func diffMaps(field string, a, b map[string]string) []FieldChange {
+	keys := map[string]struct{}{}
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+	for k := range b {
+		keys[k] = struct{}{}
+	}
+	var changes []FieldChange
+	for _, k := range sortedKeys(keys) {
+		field := field + "." + k
+		av, inA := a[k]
+		bv, inB := b[k]
+		switch {
+		case !inA:
+			changes = append(changes, FieldChange{Field: field, Kind: ChangeAdded, New: bv})
+		case !inB:
+			changes = append(changes, FieldChange{Field: field, Kind: ChangeRemoved, Old: av})
+		case av != bv:
+			changes = append(changes, FieldChange{Field: field, Kind: ChangeChanged, Old: av, New: bv})
+		}
+	}
+	return changes
+}
+
+func stringSet(ss []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(ss))
+	for _, s := range ss {
+		set[s] = struct{}{}
+	}
+	return set
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
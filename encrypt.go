@@ -0,0 +1,195 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Cipher encrypts sensitive label values before they're stored. Open must
+// fail for anything Seal didn't produce with the same key.
+type Cipher interface {
+	Seal(plaintext []byte) ([]byte, error)
+	Open(ciphertext []byte) ([]byte, error)
+}
+
+// NewAESGCMCipher returns a Cipher using AES-GCM with a random nonce per
+// value. The key must be 16, 24 or 32 bytes long.
+func NewAESGCMCipher(key []byte) (Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcmCipher{aead}, nil
+}
+
+type gcmCipher struct{ aead cipher.AEAD }
+
+func (c gcmCipher) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c gcmCipher) Open(ciphertext []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return c.aead.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+}
+
+// RedactedValue replaces sensitive label values shown to callers who may not
+// see them.
+const RedactedValue = "***"
+
+// encryptedPrefix marks a stored label value as ciphertext.
+const encryptedPrefix = "enc:"
+
+// WithEncryption encrypts the values of labels whose keys start with
+// keyPrefix before they're stored, so the store, its snapshots and its
+// events only ever hold ciphertext. Reads decrypt them for callers with an
+// actor in their context (see WithActor), or WithLabelAuthorizer for those
+// its Authorizer allows, and show everyone else RedactedValue; label
+// selectors match what the caller would see. Over HTTP, the actor is the
+// caller named by a token given to WithActorTokens.
+//
+// A value that's already ciphertext under this cipher is stored as is, so
+// exported builds can be imported again. Writing back RedactedValue keeps
+// the existing secret, so a redacted read followed by a PUT doesn't destroy
+// it.
+func WithEncryption(c Cipher, keyPrefix string) InmemOption {
+	return func(s *buildService) {
+		s.cipher = c
+		s.sensitivePrefix = keyPrefix
+	}
+}
+
+// ReadSensitiveLabels is the method an Authorizer given WithLabelAuthorizer
+// is asked about, with the stored build, before the caller is shown its
+// sensitive labels decrypted.
+const ReadSensitiveLabels = "ReadSensitiveLabels"
+
+// WithLabelAuthorizer decrypts sensitive labels only for the callers a
+// allows ReadSensitiveLabels, rather than for any caller with an actor.
+func WithLabelAuthorizer(a Authorizer) InmemOption {
+	return func(s *buildService) { s.labelAuthz = a }
+}
+
+// mayOpen reports whether the caller in ctx may see b's sensitive labels.
+func (s *buildService) mayOpen(ctx context.Context, b Build) (bool, error) {
+	if s.labelAuthz == nil {
+		return ActorFromContext(ctx) != "", nil
+	}
+	switch err := s.labelAuthz.Authorize(ctx, ReadSensitiveLabels, b); {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrForbidden):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (s *buildService) sensitive(key string) bool {
+	return s.cipher != nil && strings.HasPrefix(key, s.sensitivePrefix)
+}
+
+// seal returns next's labels with every sensitive value encrypted.
+func (s *buildService) seal(prev, next map[string]string) (map[string]string, error) {
+	if s.cipher == nil || len(next) == 0 {
+		return next, nil
+	}
+	out := make(map[string]string, len(next))
+	for k, v := range next {
+		switch {
+		case !s.sensitive(k), s.opens(v):
+			out[k] = v
+		case v == RedactedValue && prev[k] != "":
+			out[k] = prev[k]
+		default:
+			ct, err := s.cipher.Seal([]byte(v))
+			if err != nil {
+				return nil, fmt.Errorf("encrypting label %q: %w", k, err)
+			}
+			out[k] = encryptedPrefix + base64.StdEncoding.EncodeToString(ct)
+		}
+	}
+	return out, nil
+}
+
+func (s *buildService) opens(v string) bool {
+	_, err := s.open(v)
+	return err == nil
+}
+
+func (s *buildService) open(v string) (string, error) {
+	if !strings.HasPrefix(v, encryptedPrefix) {
+		return "", errors.New("not encrypted")
+	}
+	ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	pt, err := s.cipher.Open(ct)
+	if err != nil {
+		return "", err
+	}
+	return string(pt), nil
+}
+
+// view returns b as the caller in ctx may see it: sensitive labels are
+// decrypted for callers mayOpen allows, and redacted for everyone else. A
+// label that can't be decrypted is redacted and quarantines the build.
+func (s *buildService) view(ctx context.Context, b Build) (Build, error) {
+	if s.cipher == nil || len(b.Labels) == 0 {
+		return b, nil
+	}
+	sensitive := false
+	for k := range b.Labels {
+		sensitive = sensitive || s.sensitive(k)
+	}
+	if !sensitive {
+		return b, nil
+	}
+	authorized, err := s.mayOpen(ctx, b)
+	if err != nil {
+		return Build{}, err
+	}
+	labels := make(map[string]string, len(b.Labels))
+	for k, v := range b.Labels {
+		switch {
+		case !s.sensitive(k):
+			labels[k] = v
+		case !authorized:
+			labels[k] = RedactedValue
+		default:
+			pt, err := s.open(v)
+			if err != nil {
+				// Quarantine the build rather than fail every read of it.
+				labels[k] = RedactedValue
+				b.Quarantined = true
+				b.Problems = append(append(ValidationErrors(nil), b.Problems...), ValidationError{
+					Field:   "labels." + k,
+					Message: "can't be decrypted: " + err.Error(),
+				})
+				continue
+			}
+			labels[k] = pt
+		}
+	}
+	b.Labels = labels
+	return b, nil
+}
@@ -0,0 +1,140 @@
+package gokitbuildservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func testCipher(t *testing.T) Cipher {
+	t.Helper()
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEncryptedLabelsOverHTTP(t *testing.T) {
+	s := NewInmemService(WithEncryption(testCipher(t), "secret."))
+	srv := httptest.NewServer(MakeHTTPHandler(s, log.NewNopLogger(), WithActorTokens(map[string]string{"t": "alice"})))
+	defer srv.Close()
+
+	get := func(path, token string) map[string]string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Build Build   `json:"build"`
+			Items []Build `json:"items"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Items) == 1 {
+			return body.Items[0].Labels
+		}
+		return body.Build.Labels
+	}
+
+	req, _ := http.NewRequest("POST", srv.URL+"/builds/", strings.NewReader(`{"id":"b1","labels":{"secret.pw":"hunter2","env":"ci"}}`))
+	req.Header.Set("Authorization", "Bearer t")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST: %v, %v", resp, err)
+	}
+
+	for _, path := range []string{"/builds/b1", "/builds/"} {
+		if got := get(path, ""); got["secret.pw"] != RedactedValue || got["env"] != "ci" {
+			t.Errorf("anonymous GET %s: got labels %v, want the secret redacted", path, got)
+		}
+		if got := get(path, "unknown"); got["secret.pw"] != RedactedValue {
+			t.Errorf("GET %s with an unknown token: got labels %v, want the secret redacted", path, got)
+		}
+		if got := get(path, "t"); got["secret.pw"] != "hunter2" {
+			t.Errorf("authenticated GET %s: got labels %v, want the secret decrypted", path, got)
+		}
+	}
+}
+
+func TestEncryptedLabelsWithLabelAuthorizer(t *testing.T) {
+	a := NewRoleAuthorizer(map[string]Role{"w": RoleWriter, "r": RoleReader})
+	s := NewInmemService(WithEncryption(testCipher(t), "secret."), WithLabelAuthorizer(a))
+	ctx := context.Background()
+	if err := s.PostBuild(WithActor(ctx, "w"), Build{ID: "b1", Labels: map[string]string{"secret.pw": "hunter2"}}); err != nil {
+		t.Fatal(err)
+	}
+	for actor, want := range map[string]string{"w": "hunter2", "r": RedactedValue, "": RedactedValue} {
+		b, err := s.GetBuild(WithActor(ctx, actor), "b1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.Labels["secret.pw"]; got != want {
+			t.Errorf("actor %q: got %q, want %q", actor, got, want)
+		}
+	}
+}
+
+func TestEncryptedLabelsSurviveSnapshotRoundTrip(t *testing.T) {
+	c := testCipher(t)
+	ctx := WithActor(context.Background(), "alice")
+	src := NewInmemService(WithEncryption(c, "secret.")).(*buildService)
+	if err := src.PostBuild(ctx, Build{ID: "b1", Labels: map[string]string{"secret.pw": "hunter2"}}); err != nil {
+		t.Fatal(err)
+	}
+	stored, _, _ := src.repo.Get(ctx, "b1")
+	ciphertext := stored.Labels["secret.pw"]
+	if !strings.HasPrefix(ciphertext, encryptedPrefix) {
+		t.Fatalf("stored label: got %q, want ciphertext", ciphertext)
+	}
+
+	rc, err := src.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(snap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := io.ReadAll(zr)
+	if bytes.Contains(plain, []byte("hunter2")) || !bytes.Contains(plain, []byte(ciphertext)) {
+		t.Fatalf("snapshot holds the plaintext or lost the ciphertext: %s", plain)
+	}
+
+	dst := NewInmemService(WithEncryption(c, "secret.")).(*buildService)
+	if _, err := dst.Restore(ctx, bytes.NewReader(snap)); err != nil {
+		t.Fatal(err)
+	}
+	restored, _, _ := dst.repo.Get(ctx, "b1")
+	if got := restored.Labels["secret.pw"]; got != ciphertext {
+		t.Errorf("restored label: got %q, want the original ciphertext %q", got, ciphertext)
+	}
+	b, err := dst.GetBuild(ctx, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Labels["secret.pw"]; got != "hunter2" {
+		t.Errorf("authorized read after restore: got %q", got)
+	}
+	if b, _ := dst.GetBuild(context.Background(), "b1"); b.Labels["secret.pw"] != RedactedValue {
+		t.Errorf("unauthorized read after restore: got %q", b.Labels["secret.pw"])
+	}
+}
@@ -0,0 +1,919 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// Endpoints collects all of the endpoints that compose a build service. It's
+// meant to be used as a helper struct, to collect all of the endpoints into a
+// single parameter.
+type Endpoints struct {
+	PostBuildEndpoint            endpoint.Endpoint
+	GetOrCreateBuildEndpoint     endpoint.Endpoint
+	GetBuildEndpoint             endpoint.Endpoint
+	GetBuildsEndpoint            endpoint.Endpoint
+	ListBuildStatusesEndpoint    endpoint.Endpoint
+	ReserveIDEndpoint            endpoint.Endpoint
+	ListBuildsEndpoint           endpoint.Endpoint
+	PutBuildEndpoint             endpoint.Endpoint
+	PatchBuildEndpoint           endpoint.Endpoint
+	PatchBuildsEndpoint          endpoint.Endpoint
+	BatchPostBuildsEndpoint      endpoint.Endpoint
+	DeleteBuildEndpoint          endpoint.Endpoint
+	AppendBuildLogsEndpoint      endpoint.Endpoint
+	GetBuildLogLengthEndpoint    endpoint.Endpoint
+	GetBuildLogsEndpoint         endpoint.Endpoint
+	ReplayBuildEndpoint          endpoint.Endpoint
+	GetLimitsEndpoint            endpoint.Endpoint
+	FindByFingerprintEndpoint    endpoint.Endpoint
+	SetOutputEndpoint            endpoint.Endpoint
+	GetOutputEndpoint            endpoint.Endpoint
+	DiffBuildsEndpoint           endpoint.Endpoint
+	ValidateBuildEndpoint        endpoint.Endpoint
+	ForceReleaseLeaseEndpoint    endpoint.Endpoint
+	ImportBuildsEndpoint         endpoint.Endpoint
+	QueuePositionEndpoint        endpoint.Endpoint
+	CompareAndSetStatusEndpoint  endpoint.Endpoint
+	RerunFailedStepsEndpoint     endpoint.Endpoint
+	GetDependencyTreeEndpoint    endpoint.Endpoint
+	GetStatusHistoryEndpoint     endpoint.Endpoint
+	BuildMetricsEndpoint         endpoint.Endpoint
+	FailBuildEndpoint            endpoint.Endpoint
+	RenameBuildEndpoint          endpoint.Endpoint
+	ListLabelKeysEndpoint        endpoint.Endpoint
+	ListLabelValuesEndpoint      endpoint.Endpoint
+	FindBuildsBySpecHashEndpoint endpoint.Endpoint
+	ListBuildsByGroupEndpoint    endpoint.Endpoint
+	CancelGroupEndpoint          endpoint.Endpoint
+	GroupStatusEndpoint          endpoint.Endpoint
+}
+
+// MakeServerEndpoints returns an Endpoints struct where each endpoint invokes
+// the corresponding method on the provided service.
+func MakeServerEndpoints(s Service) Endpoints {
+	return Endpoints{
+		PostBuildEndpoint:            MakePostBuildEndpoint(s),
+		GetOrCreateBuildEndpoint:     MakeGetOrCreateBuildEndpoint(s),
+		GetBuildEndpoint:             MakeGetBuildEndpoint(s),
+		GetBuildsEndpoint:            MakeGetBuildsEndpoint(s),
+		ListBuildStatusesEndpoint:    MakeListBuildStatusesEndpoint(s),
+		ReserveIDEndpoint:            MakeReserveIDEndpoint(s),
+		ListBuildsEndpoint:           MakeListBuildsEndpoint(s),
+		PutBuildEndpoint:             MakePutBuildEndpoint(s),
+		PatchBuildEndpoint:           MakePatchBuildEndpoint(s),
+		PatchBuildsEndpoint:          MakePatchBuildsEndpoint(s),
+		BatchPostBuildsEndpoint:      MakeBatchPostBuildsEndpoint(s),
+		DeleteBuildEndpoint:          MakeDeleteBuildEndpoint(s),
+		AppendBuildLogsEndpoint:      MakeAppendBuildLogsEndpoint(s),
+		GetBuildLogLengthEndpoint:    MakeGetBuildLogLengthEndpoint(s),
+		GetBuildLogsEndpoint:         MakeGetBuildLogsEndpoint(s),
+		ReplayBuildEndpoint:          MakeReplayBuildEndpoint(s),
+		GetLimitsEndpoint:            MakeGetLimitsEndpoint(s),
+		FindByFingerprintEndpoint:    MakeFindByFingerprintEndpoint(s),
+		SetOutputEndpoint:            MakeSetOutputEndpoint(s),
+		GetOutputEndpoint:            MakeGetOutputEndpoint(s),
+		DiffBuildsEndpoint:           MakeDiffBuildsEndpoint(s),
+		ValidateBuildEndpoint:        MakeValidateBuildEndpoint(s),
+		ForceReleaseLeaseEndpoint:    MakeForceReleaseLeaseEndpoint(s),
+		ImportBuildsEndpoint:         MakeImportBuildsEndpoint(s),
+		QueuePositionEndpoint:        MakeQueuePositionEndpoint(s),
+		CompareAndSetStatusEndpoint:  MakeCompareAndSetStatusEndpoint(s),
+		RerunFailedStepsEndpoint:     MakeRerunFailedStepsEndpoint(s),
+		GetDependencyTreeEndpoint:    MakeGetDependencyTreeEndpoint(s),
+		GetStatusHistoryEndpoint:     MakeGetStatusHistoryEndpoint(s),
+		BuildMetricsEndpoint:         MakeBuildMetricsEndpoint(s),
+		FailBuildEndpoint:            MakeFailBuildEndpoint(s),
+		RenameBuildEndpoint:          MakeRenameBuildEndpoint(s),
+		ListLabelKeysEndpoint:        MakeListLabelKeysEndpoint(s),
+		ListLabelValuesEndpoint:      MakeListLabelValuesEndpoint(s),
+		FindBuildsBySpecHashEndpoint: MakeFindBuildsBySpecHashEndpoint(s),
+		ListBuildsByGroupEndpoint:    MakeListBuildsByGroupEndpoint(s),
+		CancelGroupEndpoint:          MakeCancelGroupEndpoint(s),
+		GroupStatusEndpoint:          MakeGroupStatusEndpoint(s),
+	}
+}
+
+// MakePostBuildEndpoint returns an endpoint via the passed service.
+func MakePostBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postBuildRequest)
+		e := s.PostBuild(ctx, req.Build)
+		return postBuildResponse{Err: e}, nil
+	}
+}
+
+// MakeGetOrCreateBuildEndpoint returns an endpoint via the passed service.
+func MakeGetOrCreateBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postBuildRequest)
+		b, created, e := s.GetOrCreateBuild(ctx, req.Build)
+		return getOrCreateBuildResponse{Build: b, Created: created, Err: e}, nil
+	}
+}
+
+// MakeGetBuildEndpoint returns an endpoint via the passed service.
+func MakeGetBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getBuildRequest)
+		b, e := s.GetBuild(ctx, req.ID)
+		return getBuildResponse{Build: b, Err: e}, nil
+	}
+}
+
+// MakeGetBuildsEndpoint returns an endpoint via the passed service.
+func MakeGetBuildsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getBuildsRequest)
+		found, missing, e := s.GetBuilds(ctx, req.IDs)
+		if missing == nil {
+			missing = []string{}
+		}
+		return getBuildsResponse{Builds: found, Missing: missing, Err: e}, nil
+	}
+}
+
+// MakeListBuildStatusesEndpoint returns an endpoint via the passed service.
+func MakeListBuildStatusesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(listBuildStatusesRequest)
+		statuses, e := s.ListBuildStatuses(ctx, req.IDs)
+		return listBuildStatusesResponse{Statuses: statuses, Err: e}, nil
+	}
+}
+
+// MakeReserveIDEndpoint returns an endpoint via the passed service.
+func MakeReserveIDEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(reserveIDRequest)
+		id, e := s.ReserveID(ctx, req.Prefix)
+		return reserveIDResponse{ID: id, Err: e}, nil
+	}
+}
+
+// MakeListBuildsEndpoint returns an endpoint via the passed service.
+func MakeListBuildsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(listBuildsRequest)
+		var (
+			builds []Build
+			e      error
+		)
+		if req.AllowPartial {
+			ctx = WithPartialResults(ctx)
+		}
+		if req.ModifiedAfter.IsZero() && req.ModifiedBefore.IsZero() {
+			builds, e = s.ListBuilds(ctx, req.Options)
+		} else {
+			builds, e = listModifiedBetween(ctx, s, req)
+		}
+		if e != nil && !errors.Is(e, ErrPartialResult) {
+			return listBuildsResponse{Err: e}, nil
+		}
+		resp := listBuildsResponse{Items: []Build{}, Total: len(builds), Offset: req.Offset, Limit: req.Limit, Partial: e != nil}
+		if req.Offset < len(builds) {
+			builds = builds[req.Offset:]
+			if req.Limit > 0 && req.Limit < len(builds) {
+				builds = builds[:req.Limit]
+			}
+			resp.Items = builds
+		}
+		return resp, nil
+	}
+}
+
+// listModifiedBetween serves a list request restricted to a modification
+// range, applying the request's other options to the range's builds. They
+// stay least recently modified first unless a sort was asked for.
+func listModifiedBetween(ctx context.Context, s Service, req listBuildsRequest) ([]Build, error) {
+	var less buildLess
+	if req.Options.SortBy != "" {
+		var err error
+		if less, err = lessFunc(req.Options.SortBy); err != nil {
+			return nil, err
+		}
+	}
+	if err := req.Options.validate(); err != nil {
+		return nil, err
+	}
+	all, err := s.ListBuildsModifiedBetween(ctx, req.ModifiedAfter, req.ModifiedBefore)
+	if err != nil {
+		return nil, err
+	}
+	builds := all[:0]
+	for _, b := range all {
+		if req.Options.matches(b) {
+			builds = append(builds, b)
+		}
+	}
+	if less != nil {
+		sortBuilds(builds, less)
+	}
+	return builds, nil
+}
+
+// MakePutBuildEndpoint returns an endpoint via the passed service.
+func MakePutBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(putBuildRequest)
+		e := s.PutBuild(ctx, req.ID, req.Build)
+		return putBuildResponse{Err: e}, nil
+	}
+}
+
+// MakePatchBuildEndpoint returns an endpoint via the passed service.
+func MakePatchBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(patchBuildRequest)
+		e := s.PatchBuild(ctx, req.ID, req.Build)
+		return patchBuildResponse{Err: e}, nil
+	}
+}
+
+// MakePatchBuildsEndpoint returns an endpoint via the passed service.
+func MakePatchBuildsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(patchBuildsRequest)
+		results, e := s.PatchBuilds(ctx, req.IDs, req.Patch)
+		return patchBuildsResponse{Results: results, Err: e}, nil
+	}
+}
+
+// MakeBatchPostBuildsEndpoint returns an endpoint via the passed service.
+// Its response is a patchBuildsResponse, as both are a result per build.
+func MakeBatchPostBuildsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(batchPostBuildsRequest)
+		results, e := s.BatchPostBuilds(ctx, req.Builds)
+		return patchBuildsResponse{Results: results, Err: e}, nil
+	}
+}
+
+// MakeDeleteBuildEndpoint returns an endpoint via the passed service.
+func MakeDeleteBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(deleteBuildRequest)
+		e := s.DeleteBuild(ctx, req.ID)
+		return deleteBuildResponse{Err: e}, nil
+	}
+}
+
+// MakeAppendBuildLogsEndpoint returns an endpoint via the passed service.
+func MakeAppendBuildLogsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(appendBuildLogsRequest)
+		n, e := s.AppendBuildLogs(ctx, req.ID, req.Offset, req.Data)
+		return buildLogLengthResponse{Length: n, Err: e}, nil
+	}
+}
+
+// MakeGetBuildLogLengthEndpoint returns an endpoint via the passed service.
+func MakeGetBuildLogLengthEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getBuildLogLengthRequest)
+		n, e := s.GetBuildLogLength(ctx, req.ID)
+		return buildLogLengthResponse{Length: n, Err: e}, nil
+	}
+}
+
+// MakeGetBuildLogsEndpoint returns an endpoint via the passed service.
+func MakeGetBuildLogsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getBuildLogsRequest)
+		p, e := s.GetBuildLogs(ctx, req.ID, req.Step, req.From)
+		return getBuildLogsResponse{Data: p, Err: e}, nil
+	}
+}
+
+// MakeSetOutputEndpoint returns an endpoint via the passed service.
+func MakeSetOutputEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(setOutputRequest)
+		e := s.SetOutput(ctx, req.ID, req.Key, req.Value)
+		return setOutputResponse{Err: e}, nil
+	}
+}
+
+// MakeGetOutputEndpoint returns an endpoint via the passed service.
+func MakeGetOutputEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getOutputRequest)
+		value, e := s.GetOutput(ctx, req.ID, req.Key)
+		return getOutputResponse{Value: value, Err: e}, nil
+	}
+}
+
+// MakeReplayBuildEndpoint returns an endpoint via the passed service. The
+// replay is collected in full before it's answered.
+func MakeReplayBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(replayBuildRequest)
+		var events []BuildEvent
+		e := s.ReplayBuild(ctx, req.ID, func(ev BuildEvent) error {
+			events = append(events, ev)
+			return nil
+		})
+		return replayBuildResponse{Events: events, Err: e}, nil
+	}
+}
+
+// MakeGetLimitsEndpoint returns an endpoint via the passed service.
+func MakeGetLimitsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		l, e := s.GetLimits(ctx)
+		return getLimitsResponse{Limits: l, Err: e}, nil
+	}
+}
+
+// MakeDiffBuildsEndpoint returns an endpoint via the passed service.
+func MakeDiffBuildsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(diffBuildsRequest)
+		d, e := DiffBuilds(ctx, s, req.IDA, req.IDB)
+		return diffBuildsResponse{Diff: d, Err: e}, nil
+	}
+}
+
+// MakeValidateBuildEndpoint returns an endpoint via the passed service.
+func MakeValidateBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(validateBuildRequest)
+		problems, e := s.ValidateBuild(ctx, req.Build)
+		if problems == nil {
+			problems = ValidationErrors{}
+		}
+		return validateBuildResponse{Valid: len(problems) == 0, Problems: problems, Err: e}, nil
+	}
+}
+
+// MakeForceReleaseLeaseEndpoint returns an endpoint via the passed service.
+func MakeForceReleaseLeaseEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(forceReleaseLeaseRequest)
+		e := s.ForceReleaseLease(ctx, req.ID)
+		return forceReleaseLeaseResponse{Err: e}, nil
+	}
+}
+
+// MakeImportBuildsEndpoint returns an endpoint via the passed service.
+func MakeImportBuildsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(importBuildsRequest)
+		var opts []ImportOption
+		if req.Progress != nil {
+			opts = append(opts, WithImportProgress(req.Progress))
+		}
+		sum, e := ImportBuilds(ctx, s, req.Body, opts...)
+		return importBuildsResponse{Summary: sum, Err: e}, nil
+	}
+}
+
+// MakeCompareAndSetStatusEndpoint returns an endpoint via the passed service.
+// A build that isn't in the expected status is reported as
+// ErrPreconditionFailed.
+func MakeCompareAndSetStatusEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(compareAndSetStatusRequest)
+		ok, e := s.CompareAndSetStatus(ctx, req.ID, req.Expected, req.Next)
+		if e == nil && !ok {
+			e = ErrPreconditionFailed
+		}
+		return compareAndSetStatusResponse{Err: e}, nil
+	}
+}
+
+// MakeRerunFailedStepsEndpoint returns an endpoint via the passed service.
+func MakeRerunFailedStepsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(rerunFailedStepsRequest)
+		b, e := s.RerunFailedSteps(ctx, req.ID)
+		return rerunFailedStepsResponse{Build: b, Err: e}, nil
+	}
+}
+
+// MakeFailBuildEndpoint returns an endpoint via the passed service.
+func MakeFailBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(failBuildRequest)
+		e := s.FailBuild(ctx, req.ID, req.Reason, req.ExitCode)
+		return failBuildResponse{Err: e}, nil
+	}
+}
+
+// MakeListLabelKeysEndpoint returns an endpoint via the passed service.
+func MakeListLabelKeysEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		keys, e := s.ListLabelKeys(ctx)
+		return listLabelsResponse{Items: keys, Err: e}, nil
+	}
+}
+
+// MakeFindBuildsBySpecHashEndpoint returns an endpoint via the passed
+// service. The builds come back as a single page of a list.
+func MakeFindBuildsBySpecHashEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(findBuildsBySpecHashRequest)
+		builds, e := s.FindBuildsBySpecHash(ctx, req.Hash)
+		return listBuildsResponse{Items: builds, Total: len(builds), Err: e}, nil
+	}
+}
+
+// MakeFindByFingerprintEndpoint returns an endpoint via the passed service.
+// Finding no build is ErrNotFound.
+func MakeFindByFingerprintEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(findByFingerprintRequest)
+		b, found, e := s.FindSucceededByFingerprint(ctx, req.Fingerprint)
+		if e == nil && !found {
+			e = ErrNotFound
+		}
+		return getBuildResponse{Build: b, Err: e}, nil
+	}
+}
+
+// MakeListBuildsByGroupEndpoint returns an endpoint via the passed
+// service. The builds come back as a single page of a list.
+func MakeListBuildsByGroupEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(listBuildsByGroupRequest)
+		builds, e := s.ListBuildsByGroup(ctx, req.GroupID)
+		return listBuildsResponse{Items: builds, Total: len(builds), Err: e}, nil
+	}
+}
+
+// MakeCancelGroupEndpoint returns an endpoint via the passed service.
+func MakeCancelGroupEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(cancelGroupRequest)
+		n, e := s.CancelGroup(ctx, req.GroupID)
+		return cancelGroupResponse{Cancelled: n, Err: e}, nil
+	}
+}
+
+// MakeGroupStatusEndpoint returns an endpoint via the passed service.
+func MakeGroupStatusEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(groupStatusRequest)
+		sum, e := s.GroupStatus(ctx, req.GroupID)
+		return groupStatusResponse{Group: sum, Err: e}, nil
+	}
+}
+
+// MakeListLabelValuesEndpoint returns an endpoint via the passed service.
+func MakeListLabelValuesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(listLabelValuesRequest)
+		values, e := s.ListLabelValues(ctx, req.Key)
+		return listLabelsResponse{Items: values, Err: e}, nil
+	}
+}
+
+// MakeRenameBuildEndpoint returns an endpoint via the passed service.
+func MakeRenameBuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(renameBuildRequest)
+		e := s.RenameBuild(ctx, req.ID, req.NewID)
+		return renameBuildResponse{Err: e}, nil
+	}
+}
+
+// MakeGetStatusHistoryEndpoint returns an endpoint via the passed service.
+func MakeGetStatusHistoryEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getStatusHistoryRequest)
+		history, e := GetStatusHistory(ctx, s, req.ID)
+		return getStatusHistoryResponse{History: history, Err: e}, nil
+	}
+}
+
+// MakeGetDependencyTreeEndpoint returns an endpoint via the passed service.
+func MakeGetDependencyTreeEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getDependencyTreeRequest)
+		tree, e := GetDependencyTree(ctx, s, req.ID, req.Depth)
+		return getDependencyTreeResponse{Tree: tree, Err: e}, nil
+	}
+}
+
+// MakeBuildMetricsEndpoint returns an endpoint via the passed service.
+func MakeBuildMetricsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(buildMetricsRequest)
+		m, e := s.BuildMetrics(ctx, req.Window)
+		return buildMetricsResponse{Metrics: m, Err: e}, nil
+	}
+}
+
+// MakeQueuePositionEndpoint returns an endpoint via the passed service.
+func MakeQueuePositionEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(queuePositionRequest)
+		pos, wait, e := s.QueuePosition(ctx, req.ID)
+		return queuePositionResponse{Position: pos, EstimatedWaitSeconds: wait.Seconds(), Err: e}, nil
+	}
+}
+
+// Business-logic errors are carried in the response structs rather than
+// returned as the endpoint error, so that transports can map them to status
+// codes (see errorer in transport.go) while endpoint middlewares such as
+// circuit breakers only see genuine transport failures.
+
+type postBuildRequest struct {
+	Build Build
+}
+
+type postBuildResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r postBuildResponse) error() error { return r.Err }
+
+type getOrCreateBuildResponse struct {
+	Build   Build `json:"build,omitempty"`
+	Created bool  `json:"created"`
+	Err     error `json:"err,omitempty"`
+}
+
+func (r getOrCreateBuildResponse) error() error { return r.Err }
+
+type getBuildRequest struct {
+	ID string
+}
+
+type getBuildResponse struct {
+	Build Build `json:"build,omitempty"`
+	Err   error `json:"err,omitempty"`
+}
+
+func (r getBuildResponse) error() error { return r.Err }
+
+type getBuildsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type getBuildsResponse struct {
+	Builds  map[string]Build `json:"builds"`
+	Missing []string         `json:"missing"`
+	Err     error            `json:"err,omitempty"`
+}
+
+func (r getBuildsResponse) error() error { return r.Err }
+
+type listBuildStatusesRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type listBuildStatusesResponse struct {
+	Statuses map[string]BuildStatus `json:"statuses"`
+	Err      error                  `json:"err,omitempty"`
+}
+
+func (r listBuildStatusesResponse) error() error { return r.Err }
+
+type reserveIDRequest struct {
+	Prefix string
+}
+
+type reserveIDResponse struct {
+	ID  string `json:"id,omitempty"`
+	Err error  `json:"err,omitempty"`
+}
+
+func (r reserveIDResponse) error() error { return r.Err }
+
+type listBuildsRequest struct {
+	Options ListOptions
+	Offset  int
+	Limit   int // zero means no limit
+
+	// ModifiedAfter and ModifiedBefore, when either is set, restrict the
+	// list to ListBuildsModifiedBetween.
+	ModifiedAfter, ModifiedBefore time.Time
+
+	AllowPartial bool // WithPartialResults
+}
+
+// listBuildsResponse is one page of builds. Next is the URL of the
+// following page, and is filled in by the transport, which knows the
+// request URL.
+type listBuildsResponse struct {
+	Items  []Build `json:"items"`
+	Total  int     `json:"total"`
+	Offset int     `json:"offset"`
+	Limit  int     `json:"limit"`
+	Next   string  `json:"next,omitempty"`
+
+	// Partial is set on a page of a list cut short by ErrPartialResult;
+	// Total counts only the builds gathered.
+	Partial bool  `json:"partial,omitempty"`
+	Err     error `json:"err,omitempty"`
+}
+
+func (r listBuildsResponse) error() error { return r.Err }
+
+type putBuildRequest struct {
+	ID    string
+	Build Build
+}
+
+type putBuildResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r putBuildResponse) error() error { return r.Err }
+
+type patchBuildRequest struct {
+	ID    string
+	Build Build
+}
+
+type patchBuildResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r patchBuildResponse) error() error { return r.Err }
+
+type patchBuildsRequest struct {
+	IDs   []string   `json:"ids"`
+	Patch BuildPatch `json:"patch"`
+}
+
+type patchBuildsResponse struct {
+	Results []BatchResult `json:"results"`
+	Err     error         `json:"err,omitempty"`
+}
+
+func (r patchBuildsResponse) error() error { return r.Err }
+
+type batchPostBuildsRequest struct {
+	Builds []Build `json:"builds"`
+}
+
+type deleteBuildRequest struct {
+	ID string
+}
+
+type deleteBuildResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r deleteBuildResponse) error() error { return r.Err }
+
+type appendBuildLogsRequest struct {
+	ID     string
+	Offset int64
+	Data   []byte
+}
+
+type getBuildLogLengthRequest struct {
+	ID string
+}
+
+type buildLogLengthResponse struct {
+	Length int64 `json:"length"`
+	Err    error `json:"err,omitempty"`
+}
+
+func (r buildLogLengthResponse) error() error { return r.Err }
+
+type getBuildLogsRequest struct {
+	ID   string
+	Step int // negative for every step
+	From int64
+}
+
+type getBuildLogsResponse struct {
+	Data []byte
+	Err  error `json:"err,omitempty"`
+}
+
+func (r getBuildLogsResponse) error() error { return r.Err }
+
+type setOutputRequest struct {
+	ID    string
+	Key   string
+	Value string
+}
+
+type setOutputResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r setOutputResponse) error() error { return r.Err }
+
+type getOutputRequest struct {
+	ID  string
+	Key string
+}
+
+type getOutputResponse struct {
+	Value string
+	Err   error `json:"err,omitempty"`
+}
+
+func (r getOutputResponse) error() error { return r.Err }
+
+type replayBuildRequest struct {
+	ID string
+}
+
+type replayBuildResponse struct {
+	Events []BuildEvent
+	Err    error `json:"err,omitempty"`
+}
+
+func (r replayBuildResponse) error() error { return r.Err }
+
+type getLimitsResponse struct {
+	Limits ServiceLimits
+	Err    error `json:"err,omitempty"`
+}
+
+func (r getLimitsResponse) error() error { return r.Err }
+
+type diffBuildsRequest struct {
+	IDA string
+	IDB string
+}
+
+type diffBuildsResponse struct {
+	Diff BuildDiff `json:"diff,omitempty"`
+	Err  error     `json:"err,omitempty"`
+}
+
+func (r diffBuildsResponse) error() error { return r.Err }
+
+type validateBuildRequest struct {
+	Build Build
+}
+
+type validateBuildResponse struct {
+	Valid    bool             `json:"valid"`
+	Problems ValidationErrors `json:"problems"`
+	Err      error            `json:"err,omitempty"`
+}
+
+func (r validateBuildResponse) error() error { return r.Err }
+
+type forceReleaseLeaseRequest struct {
+	ID string
+}
+
+type forceReleaseLeaseResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r forceReleaseLeaseResponse) error() error { return r.Err }
+
+type importBuildsRequest struct {
+	Body     io.Reader
+	Progress func(ImportProgress) error // nil unless the response is streamed
+}
+
+type importBuildsResponse struct {
+	Summary ImportSummary `json:"summary"`
+	Err     error         `json:"err,omitempty"`
+}
+
+func (r importBuildsResponse) error() error { return r.Err }
+
+type queuePositionRequest struct {
+	ID string
+}
+
+type queuePositionResponse struct {
+	Position             int     `json:"position"`
+	EstimatedWaitSeconds float64 `json:"estimatedWaitSeconds"`
+	Err                  error   `json:"err,omitempty"`
+}
+
+func (r queuePositionResponse) error() error { return r.Err }
+
+type compareAndSetStatusRequest struct {
+	ID       string
+	Expected BuildStatus
+	Next     BuildStatus
+}
+
+type compareAndSetStatusResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r compareAndSetStatusResponse) error() error { return r.Err }
+
+type rerunFailedStepsRequest struct {
+	ID string
+}
+
+type rerunFailedStepsResponse struct {
+	Build Build `json:"build,omitempty"`
+	Err   error `json:"err,omitempty"`
+}
+
+func (r rerunFailedStepsResponse) error() error { return r.Err }
+
+type buildMetricsRequest struct {
+	Window time.Duration
+}
+
+type buildMetricsResponse struct {
+	Metrics MetricsSummary `json:"metrics"`
+	Err     error          `json:"err,omitempty"`
+}
+
+func (r buildMetricsResponse) error() error { return r.Err }
+
+type failBuildRequest struct {
+	ID       string `json:"-"`
+	Reason   string `json:"reason"`
+	ExitCode int    `json:"exitCode"`
+}
+
+type failBuildResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r failBuildResponse) error() error { return r.Err }
+
+type findBuildsBySpecHashRequest struct {
+	Hash string
+}
+
+type findByFingerprintRequest struct {
+	Fingerprint string
+}
+
+type listBuildsByGroupRequest struct {
+	GroupID string
+}
+
+type cancelGroupRequest struct {
+	GroupID string
+}
+
+type cancelGroupResponse struct {
+	Cancelled int   `json:"cancelled"`
+	Err       error `json:"err,omitempty"`
+}
+
+func (r cancelGroupResponse) error() error { return r.Err }
+
+type groupStatusRequest struct {
+	GroupID string
+}
+
+type groupStatusResponse struct {
+	Group GroupSummary `json:"group"`
+	Err   error        `json:"err,omitempty"`
+}
+
+func (r groupStatusResponse) error() error { return r.Err }
+
+type listLabelValuesRequest struct {
+	Key string
+}
+
+type listLabelsResponse struct {
+	Items []string `json:"items"`
+	Err   error    `json:"err,omitempty"`
+}
+
+func (r listLabelsResponse) error() error { return r.Err }
+
+type renameBuildRequest struct {
+	ID    string `json:"-"`
+	NewID string `json:"newId"`
+}
+
+type renameBuildResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r renameBuildResponse) error() error { return r.Err }
+
+type getStatusHistoryRequest struct {
+	ID string
+}
+
+type getStatusHistoryResponse struct {
+	History []StatusTransition `json:"history"`
+	Err     error              `json:"err,omitempty"`
+}
+
+func (r getStatusHistoryResponse) error() error { return r.Err }
+
+type getDependencyTreeRequest struct {
+	ID    string
+	Depth int
+}
+
+type getDependencyTreeResponse struct {
+	Tree DependencyNode `json:"tree"`
+	Err  error          `json:"err,omitempty"`
+}
+
+func (r getDependencyTreeResponse) error() error { return r.Err }
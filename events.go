@@ -0,0 +1,224 @@
+package gokitbuildservice
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// BuildEventType names a kind of domain event.
+type BuildEventType string
+
+const (
+	BuildCreated  BuildEventType = "build.created"
+	BuildUpdated  BuildEventType = "build.updated"
+	BuildDeleted  BuildEventType = "build.deleted"
+	BuildFinished BuildEventType = "build.finished" // status became terminal
+
+	// BuildLogsAppended is only seen in replays; see ReplayBuild.
+	BuildLogsAppended BuildEventType = "build.logs"
+)
+
+// BuildEvent is published after a mutation has been applied. Build is the
+// state after the mutation, or the last known state for BuildDeleted.
+type BuildEvent struct {
+	ID    uint64         `json:"id"`
+	Type  BuildEventType `json:"type"`
+	At    time.Time      `json:"at"`
+	Build Build          `json:"build"`
+	Log   *LogAppend     `json:"log,omitempty"` // for BuildLogsAppended
+
+	baggage string // of the request that caused the event
+}
+
+// EventHub fans published events out to subscribers. Publishing never
+// blocks: a subscriber whose buffer is full misses the event, or is dropped
+// altogether if it subscribed with DropWhenFull. The most recent events are
+// kept in a bounded ring so reconnecting subscribers can replay what they
+// missed.
+type EventHub struct {
+	mtx     sync.Mutex
+	nextID  uint64
+	subs    map[chan BuildEvent]*Subscription
+	subSeq  uint64
+	dropped metrics.Counter
+	clock   Clock
+
+	ring  []BuildEvent // circular, oldest at ring[start] once full
+	start int
+}
+
+// EventHubOption configures an EventHub.
+type EventHubOption func(*EventHub)
+
+// WithDroppedSubscriberMetrics counts the subscribers dropped for being too
+// slow.
+func WithDroppedSubscriberMetrics(dropped metrics.Counter) EventHubOption {
+	return func(h *EventHub) { h.dropped = dropped }
+}
+
+// WithEventClock timestamps events and subscriptions with c rather than
+// SystemClock.
+func WithEventClock(c Clock) EventHubOption {
+	return func(h *EventHub) { h.clock = c }
+}
+
+// NewEventHub returns an EventHub with no subscribers that remembers the
+// last history events for replay.
+func NewEventHub(history int, opts ...EventHubOption) *EventHub {
+	h := &EventHub{
+		subs:    map[chan BuildEvent]*Subscription{},
+		ring:    make([]BuildEvent, 0, history),
+		dropped: discard.NewCounter(),
+		clock:   SystemClock,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Publish assigns e the next event ID, and a timestamp unless it has one,
+// and delivers it to every current subscriber.
+func (h *EventHub) Publish(e BuildEvent) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.nextID++
+	e.ID = h.nextID
+	if e.At.IsZero() {
+		e.At = h.clock.Now()
+	}
+	if cap(h.ring) > 0 {
+		if len(h.ring) < cap(h.ring) {
+			h.ring = append(h.ring, e)
+		} else {
+			h.ring[h.start] = e
+			h.start = (h.start + 1) % len(h.ring)
+		}
+	}
+	for c, sub := range h.subs {
+		if !sub.wants(e) {
+			continue
+		}
+		select {
+		case c <- e:
+		default:
+			sub.Dropped++
+			if sub.DropWhenFull {
+				delete(h.subs, c)
+				close(c)
+				h.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// Subscription describes a live subscription, for spotting leaks: one that
+// lingers after its client went away is usually full and dropping events.
+// A subscription receives the events of every build unless it's ForBuild.
+type Subscription struct {
+	ID        uint64    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Buffered  int       `json:"buffered"` // events waiting to be received
+	Capacity  int       `json:"capacity"`
+	Dropped   uint64    `json:"dropped"` // events missed with the buffer full
+
+	DropWhenFull bool   `json:"dropWhenFull"`
+	Build        string `json:"build,omitempty"` // see ForBuild
+}
+
+func (s *Subscription) wants(e BuildEvent) bool {
+	return s.Build == "" || e.Build.ID == s.Build
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*Subscription)
+
+// DropWhenFull ends the subscription, closing its channel, the first time
+// an event finds its buffer full, instead of skipping the event. It suits
+// subscribers relaying events to remote clients, which can reconnect and
+// replay, where a slow client shouldn't quietly fall further and further
+// behind.
+func DropWhenFull() SubscribeOption {
+	return func(s *Subscription) { s.DropWhenFull = true }
+}
+
+// ForBuild limits the subscription, and any replay, to the events of build
+// id. The filtering is done by the hub, so other builds' events neither
+// fill the buffer nor count as dropped.
+func ForBuild(id string) SubscribeOption {
+	return func(s *Subscription) { s.Build = id }
+}
+
+// Subscriptions returns the live subscriptions, oldest first.
+func (h *EventHub) Subscriptions() []Subscription {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	subs := make([]Subscription, 0, len(h.subs))
+	for c, sub := range h.subs {
+		s := *sub
+		s.Buffered, s.Capacity = len(c), cap(c)
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs
+}
+
+// subscribe registers c. It must be called with h.mtx held.
+func (h *EventHub) subscribe(c chan BuildEvent, opts []SubscribeOption) *Subscription {
+	h.subSeq++
+	sub := &Subscription{ID: h.subSeq, CreatedAt: h.clock.Now()}
+	for _, opt := range opts {
+		opt(sub)
+	}
+	h.subs[c] = sub
+	return sub
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// buffering up to buffer events, and a function that cancels the
+// subscription and closes the channel.
+func (h *EventHub) Subscribe(buffer int, opts ...SubscribeOption) (<-chan BuildEvent, func()) {
+	c := make(chan BuildEvent, buffer)
+	h.mtx.Lock()
+	h.subscribe(c, opts)
+	h.mtx.Unlock()
+	return c, h.unsubscribe(c)
+}
+
+// SubscribeSince is like Subscribe, but also returns the remembered events
+// with IDs after since. Replay and subscription happen atomically, so nothing
+// is missed or seen twice between the two. gap is true if events after since
+// have already been evicted, in which case the client can't catch up by
+// replay alone.
+func (h *EventHub) SubscribeSince(since uint64, buffer int, opts ...SubscribeOption) (replay []BuildEvent, gap bool, events <-chan BuildEvent, cancel func()) {
+	c := make(chan BuildEvent, buffer)
+	h.mtx.Lock()
+	oldest := h.nextID - uint64(len(h.ring)) + 1
+	gap = since+1 < oldest
+	sub := h.subscribe(c, opts)
+	for i := range h.ring {
+		if e := h.ring[(h.start+i)%len(h.ring)]; e.ID > since && sub.wants(e) {
+			replay = append(replay, e)
+		}
+	}
+	h.mtx.Unlock()
+	return replay, gap, c, h.unsubscribe(c)
+}
+
+func (h *EventHub) unsubscribe(c chan BuildEvent) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.mtx.Lock()
+			defer h.mtx.Unlock()
+			if _, ok := h.subs[c]; ok { // not already dropped
+				delete(h.subs, c)
+				close(c)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package gokitbuildservice
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+)
+
+func TestSlowSubscriberIsDroppedOthersKeepReceiving(t *testing.T) {
+	dropped := generic.NewCounter("dropped")
+	h := NewEventHub(0, WithDroppedSubscriberMetrics(dropped))
+	slow, cancelSlow := h.Subscribe(2, DropWhenFull())
+	defer cancelSlow()
+	fast, cancelFast := h.Subscribe(2, DropWhenFull())
+	defer cancelFast()
+
+	for i := 1; i <= 10; i++ {
+		h.Publish(BuildEvent{Type: BuildUpdated, Build: Build{ID: "b1"}})
+		select {
+		case e, ok := <-fast:
+			if !ok {
+				t.Fatalf("the fast reader was dropped at event %d", i)
+			}
+			if e.ID != uint64(i) {
+				t.Fatalf("fast reader: got event %d, want %d", e.ID, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("fast reader: no event %d", i)
+		}
+	}
+
+	var got []uint64
+	for e := range slow {
+		got = append(got, e.ID)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("slow reader: got events %v before being dropped, want its buffer, [1 2]", got)
+	}
+	if v := dropped.Value(); v != 1 {
+		t.Errorf("dropped subscribers: got %v, want 1", v)
+	}
+	if subs := h.Subscriptions(); len(subs) != 1 || subs[0].Dropped != 0 {
+		t.Errorf("subscriptions left: %+v, want only the fast reader's", subs)
+	}
+}
@@ -0,0 +1,75 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Fingerprint is a hex SHA-256 of what b builds: the image and arguments of
+// each of its steps, in order, and its parameters. Names, labels,
+// dependencies, status and timestamps don't count, so two builds with the
+// same fingerprint are expected to produce the same result, and one's can
+// be reused for the other. Empty and missing arguments or parameters are
+// the same. The fingerprint only depends on those fields, and encoding/json
+// sorts map keys, so it's the same across processes and restarts.
+func (b Build) Fingerprint() string {
+	type step struct {
+		Image string   `json:"image"`
+		Args  []string `json:"args"`
+	}
+	spec := struct {
+		Steps      []step            `json:"steps"`
+		Parameters map[string]string `json:"parameters"`
+	}{
+		Steps:      make([]step, len(b.Steps)),
+		Parameters: b.Parameters,
+	}
+	for i, st := range b.Steps {
+		spec.Steps[i] = step{Image: st.Image, Args: st.Args}
+		if len(st.Args) == 0 {
+			spec.Steps[i].Args = nil
+		}
+	}
+	if len(b.Parameters) == 0 {
+		spec.Parameters = nil
+	}
+	p, err := json.Marshal(spec)
+	if err != nil {
+		panic(err) // strings, slices and maps of strings always encode
+	}
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:])
+}
+
+// FindSucceededByFingerprint returns the build that most recently
+// succeeded with fingerprint fp, and false if none did. Like
+// FindBuildsBySpecHash, it scans the whole store under the read lock.
+func (s *buildService) FindSucceededByFingerprint(ctx context.Context, fp string) (Build, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return Build{}, false, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	builds, err := s.repo.List(ctx)
+	if err != nil {
+		return Build{}, false, err
+	}
+	var found *Build
+	now := s.now(ctx)
+	for i, b := range builds {
+		if b.Status != StatusSucceeded || b.FinishedAt == nil || s.expired(b, now) || b.Fingerprint() != fp {
+			continue
+		}
+		if found == nil || b.FinishedAt.After(*found.FinishedAt) {
+			found = &builds[i]
+		}
+	}
+	if found == nil {
+		return Build{}, false, nil
+	}
+	b, err := s.view(ctx, *found)
+	return b, err == nil, err
+}
@@ -0,0 +1,127 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func fingerprintBase() Build {
+	return Build{
+		Steps:      []Step{{Name: "test", Image: "golang:1.21", Args: []string{"go", "test", "./..."}}},
+		Parameters: map[string]string{"os": "linux", "arch": "amd64"},
+	}
+}
+
+func TestFingerprintIsStable(t *testing.T) {
+	// The SHA-256 of
+	// {"steps":[{"image":"golang:1.21","args":["go","test","./..."]}],"parameters":{"arch":"amd64","os":"linux"}}
+	// so a change to the encoding, which would orphan every stored
+	// fingerprint, fails here.
+	const want = "3ff62be44066c20141cadefbc9b624e2bf139be8949547b66bd884503c12922d"
+	for i := 0; i < 20; i++ { // map iteration order varies between runs
+		if got := fingerprintBase().Fingerprint(); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestFingerprintIgnoresWhatDoesntBuild(t *testing.T) {
+	now := time.Now()
+	base := fingerprintBase().Fingerprint()
+	for name, change := range map[string]func(*Build){
+		"id":         func(b *Build) { b.ID = "other" },
+		"name":       func(b *Build) { b.Name = "renamed" },
+		"step name":  func(b *Build) { b.Steps[0].Name = "renamed" },
+		"labels":     func(b *Build) { b.Labels = map[string]string{"team": "infra"} },
+		"status":     func(b *Build) { b.Status = StatusSucceeded },
+		"timestamps": func(b *Build) { b.CreatedAt, b.UpdatedAt, b.FinishedAt = now, now, &now },
+		"depends on": func(b *Build) { b.DependsOn = []string{"dep"} },
+	} {
+		b := fingerprintBase()
+		change(&b)
+		if got := b.Fingerprint(); got != base {
+			t.Errorf("changing %s changed the fingerprint", name)
+		}
+	}
+
+	empty := Build{Steps: []Step{{Image: "golang"}}}
+	for name, b := range map[string]Build{
+		"empty args":       {Steps: []Step{{Image: "golang", Args: []string{}}}},
+		"empty parameters": {Steps: []Step{{Image: "golang"}}, Parameters: map[string]string{}},
+	} {
+		if b.Fingerprint() != empty.Fingerprint() {
+			t.Errorf("%s: fingerprint differs from nil", name)
+		}
+	}
+}
+
+func TestFingerprintChangesWithWhatBuilds(t *testing.T) {
+	base := fingerprintBase().Fingerprint()
+	for name, change := range map[string]func(*Build){
+		"image":           func(b *Build) { b.Steps[0].Image = "golang:1.22" },
+		"arg order":       func(b *Build) { b.Steps[0].Args = []string{"test", "go", "./..."} },
+		"an arg":          func(b *Build) { b.Steps[0].Args = append(b.Steps[0].Args, "-race") },
+		"a parameter":     func(b *Build) { b.Parameters["arch"] = "arm64" },
+		"more parameters": func(b *Build) { b.Parameters["cgo"] = "0" },
+		"no parameters":   func(b *Build) { b.Parameters = nil },
+		"another step":    func(b *Build) { b.Steps = append(b.Steps, Step{Image: "alpine"}) },
+		"args moved between steps": func(b *Build) {
+			b.Steps = []Step{{Image: "golang:1.21", Args: []string{"go"}}, {Image: "golang:1.21", Args: []string{"test", "./..."}}}
+		},
+	} {
+		b := fingerprintBase()
+		change(&b)
+		if got := b.Fingerprint(); got == base {
+			t.Errorf("changing %s left the fingerprint alone", name)
+		}
+	}
+}
+
+func TestFindSucceededByFingerprint(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewInmemService(WithClock(clock))
+	finish := func(id string, st BuildStatus, expires time.Duration) {
+		t.Helper()
+		b := fingerprintBase()
+		b.ID = id
+		if expires > 0 {
+			at := clock.Now().Add(expires)
+			b.ExpiresAt = &at
+		}
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.CompareAndSetStatus(ctx, id, StatusPending, StatusRunning); !ok || err != nil {
+			t.Fatalf("starting %s: %v, %v", id, ok, err)
+		}
+		clock.Advance(time.Minute)
+		if ok, err := s.CompareAndSetStatus(ctx, id, StatusRunning, st); !ok || err != nil {
+			t.Fatalf("finishing %s: %v, %v", id, ok, err)
+		}
+	}
+	fp := fingerprintBase().Fingerprint()
+
+	if _, ok, err := s.FindSucceededByFingerprint(ctx, fp); ok || err != nil {
+		t.Fatalf("found a build in an empty store: %v", err)
+	}
+	finish("first", StatusSucceeded, 0)
+	finish("second", StatusSucceeded, 0)
+	finish("failed", StatusFailed, 0)
+	finish("expiring", StatusSucceeded, 90*time.Second)
+	if err := s.PostBuild(ctx, Build{ID: "pending", Steps: fingerprintBase().Steps, Parameters: fingerprintBase().Parameters}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, ok, err := s.FindSucceededByFingerprint(ctx, fp); err != nil || !ok || b.ID != "expiring" {
+		t.Fatalf("got %q, %v, %v; want the most recently finished success", b.ID, ok, err)
+	}
+	clock.Advance(time.Minute)
+	if b, ok, err := s.FindSucceededByFingerprint(ctx, fp); err != nil || !ok || b.ID != "second" {
+		t.Fatalf("after expiry: got %q, %v, %v; want the latest success that hasn't expired", b.ID, ok, err)
+	}
+	if _, ok, err := s.FindSucceededByFingerprint(ctx, "unknown"); ok || err != nil {
+		t.Errorf("found a build for an unknown fingerprint: %v", err)
+	}
+}
@@ -2,9 +2,26 @@ module github.com/chaitanyapantheor/go-kit-build-service
 
 go 1.21.4
 
-require github.com/go-kit/kit v0.13.0
+require (
+	github.com/go-kit/kit v0.13.0
+	github.com/gorilla/mux v1.8.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
+	golang.org/x/sync v0.6.0
+	sigs.k8s.io/yaml v1.3.0
+)
 
 require (
+	github.com/VividCortex/gohistogram v1.0.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/go-kit/log v0.2.0 // indirect
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/common v0.30.0 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	golang.org/x/sys v0.0.0-20220823224334-20c2bfdbfe24 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,140 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sort"
+)
+
+// GroupSummary is the state of a group of builds as a whole.
+type GroupSummary struct {
+	GroupID string `json:"groupId"`
+
+	// Status is the group's overall status. Until every member has
+	// finished it's running if any member started, and pending otherwise.
+	// Once they all have, it's failed if any member failed, else cancelled
+	// if any was cancelled, and succeeded only if they all succeeded.
+	Status BuildStatus `json:"status"`
+
+	// Total is the number of members, and Counts how many are in each
+	// status.
+	Total  int                 `json:"total"`
+	Counts map[BuildStatus]int `json:"counts"`
+}
+
+// summarize aggregates the statuses of a group's members.
+func summarize(groupID string, members []Build) GroupSummary {
+	sum := GroupSummary{GroupID: groupID, Total: len(members), Counts: map[BuildStatus]int{}}
+	for _, b := range members {
+		sum.Counts[b.Status]++
+	}
+	switch {
+	case sum.Counts[StatusPending]+sum.Counts[StatusRunning] > 0:
+		sum.Status = StatusPending
+		if sum.Counts[StatusPending] < sum.Total {
+			sum.Status = StatusRunning
+		}
+	case sum.Counts[StatusFailed] > 0:
+		sum.Status = StatusFailed
+	case sum.Counts[StatusCancelled] > 0:
+		sum.Status = StatusCancelled
+	default:
+		sum.Status = StatusSucceeded
+	}
+	return sum
+}
+
+// ListBuildsByGroup returns the builds with GroupID groupID, oldest first.
+// A group with no builds is empty rather than ErrNotFound.
+func (s *buildService) ListBuildsByGroup(ctx context.Context, groupID string) ([]Build, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	members, err := s.inGroup(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range members {
+		if members[i], err = s.view(ctx, b); err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+// CancelGroup cancels every member of group groupID that hasn't finished,
+// under one write lock, and returns how many it cancelled. Finished members
+// are left as they are. If a member can't be saved, those cancelled before
+// it stay cancelled, and their number is returned with the error.
+func (s *buildService) CancelGroup(ctx context.Context, groupID string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	members, err := s.inGroup(ctx, groupID)
+	if err != nil {
+		return 0, err
+	}
+	cancelled := 0
+	for _, prev := range members {
+		if prev.Status.Terminal() {
+			continue
+		}
+		b := prev
+		b.Status = StatusCancelled
+		b.Lease = nil
+		if _, err := s.save(ctx, BuildUpdated, prev, b); err != nil {
+			return cancelled, err
+		}
+		cancelled++
+	}
+	return cancelled, nil
+}
+
+// GroupStatus summarizes the members of group groupID. A group with no
+// builds is ErrNotFound.
+func (s *buildService) GroupStatus(ctx context.Context, groupID string) (GroupSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return GroupSummary{}, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	members, err := s.inGroup(ctx, groupID)
+	if err != nil {
+		return GroupSummary{}, err
+	}
+	if len(members) == 0 {
+		return GroupSummary{}, ErrNotFound
+	}
+	return summarize(groupID, members), nil
+}
+
+// inGroup returns the stored builds with GroupID groupID, oldest first,
+// from the repository's index if it has one. It must be called with s.mtx
+// held.
+func (s *buildService) inGroup(ctx context.Context, groupID string) ([]Build, error) {
+	var builds []Build
+	var err error
+	if gr, ok := s.repo.(GroupRepository); ok {
+		builds, err = gr.ListGroup(ctx, groupID)
+	} else {
+		builds, err = s.repo.List(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	members := []Build{}
+	now := s.now(ctx)
+	for _, b := range builds {
+		if groupID != "" && b.GroupID == groupID && !s.expired(b, now) {
+			members = append(members, b)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return bySequence(members[i], members[j]) })
+	return members, nil
+}
@@ -0,0 +1,171 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSummarize(t *testing.T) {
+	for _, tc := range []struct {
+		statuses []BuildStatus
+		want     BuildStatus
+	}{
+		{[]BuildStatus{StatusPending, StatusPending}, StatusPending},
+		{[]BuildStatus{StatusPending, StatusRunning}, StatusRunning},
+		{[]BuildStatus{StatusPending, StatusSucceeded}, StatusRunning}, // one has started, and finished
+		{[]BuildStatus{StatusRunning, StatusFailed}, StatusRunning},    // not over until all finish
+		{[]BuildStatus{StatusSucceeded, StatusCancelled, StatusFailed}, StatusFailed},
+		{[]BuildStatus{StatusSucceeded, StatusCancelled}, StatusCancelled},
+		{[]BuildStatus{StatusSucceeded, StatusSucceeded}, StatusSucceeded},
+	} {
+		var members []Build
+		for _, st := range tc.statuses {
+			members = append(members, Build{Status: st})
+		}
+		sum := summarize("g", members)
+		if sum.Status != tc.want || sum.Total != len(tc.statuses) || sum.GroupID != "g" {
+			t.Errorf("%v: got %s of %d, want %s", tc.statuses, sum.Status, sum.Total, tc.want)
+		}
+		n := 0
+		for _, c := range sum.Counts {
+			n += c
+		}
+		if n != sum.Total {
+			t.Errorf("%v: counts %v don't add up to %d", tc.statuses, sum.Counts, sum.Total)
+		}
+	}
+}
+
+// postGroup posts a build per status into group g, named after its status.
+func postGroup(t *testing.T, s Service, g string, statuses ...BuildStatus) {
+	t.Helper()
+	for _, st := range statuses {
+		if err := s.PostBuild(context.Background(), Build{ID: g + "-" + string(st), GroupID: g, Status: st}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCancelGroup(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmemService()
+	postGroup(t, s, "g", StatusPending, StatusRunning, StatusSucceeded, StatusFailed)
+	postGroup(t, s, "other", StatusPending)
+
+	n, err := s.CancelGroup(ctx, "g")
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v; want the 2 unfinished members cancelled", n, err)
+	}
+	for id, want := range map[string]BuildStatus{
+		"g-pending":     StatusCancelled,
+		"g-running":     StatusCancelled,
+		"g-succeeded":   StatusSucceeded,
+		"g-failed":      StatusFailed,
+		"other-pending": StatusPending,
+	} {
+		if b, err := s.GetBuild(ctx, id); err != nil || b.Status != want {
+			t.Errorf("%s: got %s, %v; want %s", id, b.Status, err, want)
+		}
+	}
+	if sum, err := s.GroupStatus(ctx, "g"); err != nil || sum.Status != StatusFailed || sum.Counts[StatusCancelled] != 2 {
+		t.Errorf("GroupStatus after cancelling: %+v, %v", sum, err)
+	}
+	if n, err := s.CancelGroup(ctx, "g"); err != nil || n != 0 {
+		t.Errorf("cancelling again: got %d, %v; want 0", n, err)
+	}
+}
+
+func TestUnknownGroup(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmemService()
+	postGroup(t, s, "g", StatusPending)
+	if err := s.PostBuild(ctx, Build{ID: "loose"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"none", ""} {
+		if _, err := s.GroupStatus(ctx, g); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GroupStatus(%q): got %v, want ErrNotFound", g, err)
+		}
+		if builds, err := s.ListBuildsByGroup(ctx, g); err != nil || builds == nil || len(builds) != 0 {
+			t.Errorf("ListBuildsByGroup(%q): got %v, %v; want an empty list", g, builds, err)
+		}
+		if n, err := s.CancelGroup(ctx, g); err != nil || n != 0 {
+			t.Errorf("CancelGroup(%q): got %d, %v; want 0", g, n, err)
+		}
+	}
+}
+
+func groupIDs(t *testing.T, r GroupRepository, g string) []string {
+	t.Helper()
+	builds, err := r.ListGroup(context.Background(), g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, b := range builds {
+		ids = append(ids, b.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestGroupIndex(t *testing.T) {
+	ctx := context.Background()
+	repo := NewInmemRepository().(GroupRepository)
+	for _, b := range []Build{{ID: "a", GroupID: "g1"}, {ID: "b", GroupID: "g1"}, {ID: "c"}} {
+		if err := repo.Save(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := groupIDs(t, repo, "g1"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("g1: got %v", got)
+	}
+
+	if err := repo.Save(ctx, Build{ID: "a", GroupID: "g2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := groupIDs(t, repo, "g1"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("g1 after a moved to g2: got %v", got)
+	}
+	if got := groupIDs(t, repo, "g2"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("g2 after a moved to it: got %v", got)
+	}
+
+	if err := repo.Save(ctx, Build{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"g1", "g2", ""} {
+		if got := groupIDs(t, repo, g); len(got) != 0 {
+			t.Errorf("%q after a left its group and b was deleted: got %v", g, got)
+		}
+	}
+}
+
+func TestGroupFollowsRename(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewService(NewInmemRepository())
+	if err != nil {
+		t.Fatal(err)
+	}
+	postGroup(t, s, "g", StatusPending, StatusRunning)
+	if err := s.RenameBuild(ctx, "g-pending", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	builds, err := s.ListBuildsByGroup(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, b := range builds {
+		ids = append(ids, b.ID)
+	}
+	if want := []string{"renamed", "g-running"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v, oldest first", ids, want)
+	}
+}
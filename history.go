@@ -0,0 +1,54 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"time"
+)
+
+// StatusTransition is one change of a build's status.
+type StatusTransition struct {
+	From  BuildStatus `json:"from"` // empty for the build's creation
+	To    BuildStatus `json:"to"`
+	At    time.Time   `json:"at"`
+	Actor string      `json:"actor,omitempty"`
+}
+
+// MaxStatusHistory caps the transitions kept per build; older ones are
+// dropped.
+const MaxStatusHistory = 100
+
+// recordTransition carries prev's status history over to next, which the
+// service owns like its timestamps, and appends to it if the status
+// changed.
+func recordTransition(ctx context.Context, prev Build, next *Build, now time.Time) {
+	next.StatusHistory = prev.StatusHistory
+	if prev.Status == next.Status {
+		return
+	}
+	history := make([]StatusTransition, 0, len(prev.StatusHistory)+1)
+	if n := len(prev.StatusHistory); n >= MaxStatusHistory {
+		history = append(history, prev.StatusHistory[n-MaxStatusHistory+1:]...)
+	} else {
+		history = append(history, prev.StatusHistory...)
+	}
+	next.StatusHistory = append(history, StatusTransition{
+		From:  prev.Status,
+		To:    next.Status,
+		At:    now,
+		Actor: ActorFromContext(ctx),
+	})
+}
+
+// GetStatusHistory returns the status transitions of build id, oldest
+// first. The history is kept on the build itself, so this works against
+// any Service implementation that stores whole builds.
+func GetStatusHistory(ctx context.Context, s Service, id string) ([]StatusTransition, error) {
+	b, err := s.GetBuild(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if b.StatusHistory == nil {
+		return []StatusTransition{}, nil
+	}
+	return b.StatusHistory, nil
+}
@@ -0,0 +1,111 @@
+package gokitbuildservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// maxImportLine bounds a single NDJSON record. It's well above
+// DefaultLimits.MaxBytes so that oversized builds are reported as validation
+// failures on their line rather than aborting the import.
+const maxImportLine = 4 << 20
+
+// ImportSummary reports what happened to every line of an import.
+type ImportSummary struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"` // already existed, left untouched
+	Failed   int           `json:"failed"`  // bad JSON, or rejected for any other reason
+	Errors   []ImportError `json:"errors"`
+}
+
+// ImportError explains why a line wasn't imported. Line numbers start at 1.
+type ImportError struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Partial reports whether any line wasn't imported.
+func (s ImportSummary) Partial() bool { return s.Skipped+s.Failed > 0 }
+
+// ImportProgress is the outcome of one line of an import, as it happens.
+type ImportProgress struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Result string `json:"result"` // "imported", "skipped" or "failed"
+	Reason string `json:"reason,omitempty"`
+}
+
+// ImportOption configures ImportBuilds.
+type ImportOption func(*importer)
+
+// WithImportProgress calls fn with the outcome of every line as soon as
+// it's known, such as to show a long import's progress. An error from fn
+// stops the import with that error.
+func WithImportProgress(fn func(ImportProgress) error) ImportOption {
+	return func(im *importer) { im.progress = fn }
+}
+
+type importer struct {
+	progress func(ImportProgress) error
+}
+
+// ImportBuilds creates one build per line of NDJSON read from r, via
+// PostBuild, so it works against any Service and applies the same validation
+// as any other create; in particular, a build must come after the builds it
+// depends on. A line that isn't imported, whether it's bad JSON or the
+// backend rejects the build, is recorded in the summary and doesn't stop
+// the import; only a read error, a done context or ErrBackendTimeout does,
+// in which case the summary so far is returned alongside the error. Blank
+// lines are ignored.
+func ImportBuilds(ctx context.Context, s Service, r io.Reader, opts ...ImportOption) (ImportSummary, error) {
+	im := importer{progress: func(ImportProgress) error { return nil }}
+	for _, opt := range opts {
+		opt(&im)
+	}
+	sum := ImportSummary{Errors: []ImportError{}}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+	for line := 1; sc.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return sum, err
+		}
+		p := bytes.TrimSpace(sc.Bytes())
+		if len(p) == 0 {
+			continue
+		}
+		var b Build
+		if err := json.Unmarshal(p, &b); err != nil {
+			sum.Failed++
+			sum.Errors = append(sum.Errors, ImportError{Line: line, Reason: err.Error()})
+			if err := im.progress(ImportProgress{Line: line, Result: "failed", Reason: err.Error()}); err != nil {
+				return sum, err
+			}
+			continue
+		}
+		progress := ImportProgress{Line: line, ID: b.ID}
+		switch err := s.PostBuild(ctx, b); {
+		case err == nil:
+			sum.Imported++
+			progress.Result = "imported"
+		case errors.Is(err, ErrAlreadyExists):
+			sum.Skipped++
+			sum.Errors = append(sum.Errors, ImportError{Line: line, ID: b.ID, Reason: err.Error()})
+			progress.Result, progress.Reason = "skipped", err.Error()
+		case errors.Is(err, ErrBackendTimeout), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			return sum, err // the backend or the caller gave up; don't plough on
+		default:
+			sum.Failed++
+			sum.Errors = append(sum.Errors, ImportError{Line: line, ID: b.ID, Reason: err.Error()})
+			progress.Result, progress.Reason = "failed", err.Error()
+		}
+		if err := im.progress(progress); err != nil {
+			return sum, err
+		}
+	}
+	return sum, sc.Err()
+}
@@ -0,0 +1,162 @@
+package gokitbuildservice_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+// rejectingService fails PostBuild for the builds named in errs.
+func rejectingService(errs map[string]error) *servicetest.FakeService {
+	return &servicetest.FakeService{
+		PostBuildFunc: func(ctx context.Context, b gokitbuildservice.Build) error {
+			return errs[b.ID]
+		},
+	}
+}
+
+func TestImportBuildsRecordsRejectedBuilds(t *testing.T) {
+	s := rejectingService(map[string]error{
+		"taken":   gokitbuildservice.ErrAlreadyExists,
+		"invalid": gokitbuildservice.ValidationErrors{{Field: "id", Message: "bad"}},
+		"busy":    gokitbuildservice.ErrConcurrencyLimit,
+		"denied":  gokitbuildservice.ErrForbidden,
+		"moved":   fmt.Errorf("%w: finished", gokitbuildservice.ErrInvalidTransition),
+	})
+	in := strings.Join([]string{
+		`{"id":"a"}`, `{"id":"taken"}`, `{"id":"invalid"}`, `not json`,
+		`{"id":"busy"}`, `{"id":"denied"}`, `{"id":"moved"}`, ``, `{"id":"b"}`,
+	}, "\n")
+	var progress []string
+	sum, err := gokitbuildservice.ImportBuilds(context.Background(), s, strings.NewReader(in),
+		gokitbuildservice.WithImportProgress(func(p gokitbuildservice.ImportProgress) error {
+			progress = append(progress, fmt.Sprintf("%d:%s", p.Line, p.Result))
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("import stopped: %v", err)
+	}
+	if sum.Imported != 2 || sum.Skipped != 1 || sum.Failed != 5 || len(sum.Errors) != 6 {
+		t.Errorf("got %+v, want 2 imported, 1 skipped, 5 failed", sum)
+	}
+	want := "1:imported 2:skipped 3:failed 4:failed 5:failed 6:failed 7:failed 9:imported"
+	if got := strings.Join(progress, " "); got != want {
+		t.Errorf("progress %s, want %s", got, want)
+	}
+}
+
+func TestImportBuildsStopsWhenTheBackendGivesUp(t *testing.T) {
+	for _, stop := range []error{gokitbuildservice.ErrBackendTimeout, context.DeadlineExceeded, context.Canceled} {
+		s := rejectingService(map[string]error{"b": stop})
+		sum, err := gokitbuildservice.ImportBuilds(context.Background(), s, strings.NewReader("{\"id\":\"a\"}\n{\"id\":\"b\"}\n{\"id\":\"c\"}\n"))
+		if !errors.Is(err, stop) {
+			t.Errorf("%v: got %v, want the import stopped with it", stop, err)
+		}
+		if sum.Imported != 1 || sum.Failed != 0 {
+			t.Errorf("%v: got %+v, want only the first build imported", stop, sum)
+		}
+	}
+}
+
+// importOverHTTP posts body to POST /builds/import of a handler over s,
+// accepting accept, and returns the response with its body read.
+func importOverHTTP(t *testing.T, s gokitbuildservice.Service, accept, body string) (*http.Response, string) {
+	t.Helper()
+	srv := httptest.NewServer(gokitbuildservice.MakeHTTPHandler(s, log.NewNopLogger()))
+	defer srv.Close()
+	req, _ := http.NewRequest("POST", srv.URL+"/builds/import", strings.NewReader(body))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var sb strings.Builder
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		sb.WriteString(sc.Text() + "\n")
+	}
+	return resp, sb.String()
+}
+
+func TestImportStreamsProgress(t *testing.T) {
+	s := rejectingService(map[string]error{"taken": gokitbuildservice.ErrAlreadyExists})
+	resp, out := importOverHTTP(t, s, gokitbuildservice.NDJSONMediaType, "{\"id\":\"a\"}\nnot json\n\n{\"id\":\"taken\"}\n{\"id\":\"b\"}\n")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != gokitbuildservice.NDJSONMediaType {
+		t.Fatalf("got %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want one per non-blank input line and the summary:\n%s", len(lines), out)
+	}
+	for i, want := range []struct {
+		line   int
+		result string
+	}{{1, "imported"}, {2, "failed"}, {4, "skipped"}, {5, "imported"}} {
+		var p gokitbuildservice.ImportProgress
+		if err := json.Unmarshal([]byte(lines[i]), &p); err != nil || p.Line != want.line || p.Result != want.result {
+			t.Errorf("line %d: got %s, want line %d %s", i+1, lines[i], want.line, want.result)
+		}
+	}
+	var end struct {
+		Imported int                              `json:"imported"`
+		Summary  *gokitbuildservice.ImportSummary `json:"summary"`
+		Error    string                           `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(lines[4]), &end); err != nil || end.Summary == nil || end.Error != "" {
+		t.Fatalf("final line: %s, %v", lines[4], err)
+	}
+	if end.Imported != 2 || end.Summary.Imported != 2 || end.Summary.Skipped != 1 || end.Summary.Failed != 1 {
+		t.Errorf("final line: got %+v with %+v", end, *end.Summary)
+	}
+}
+
+func TestImportStreamEndsWithTheError(t *testing.T) {
+	s := rejectingService(map[string]error{"c": gokitbuildservice.ErrBackendTimeout})
+	_, out := importOverHTTP(t, s, "text/plain, "+gokitbuildservice.NDJSONMediaType, "{\"id\":\"a\"}\n{\"id\":\"b\"}\n{\"id\":\"c\"}\n{\"id\":\"d\"}\n")
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want two imports and the error:\n%s", len(lines), out)
+	}
+	var end map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[2]), &end); err != nil {
+		t.Fatal(err)
+	}
+	if end["imported"] != float64(2) || end["error"] != gokitbuildservice.ErrBackendTimeout.Error() || end["summary"] != nil {
+		t.Errorf("final line: got %s, want 2 imported and the timeout", lines[2])
+	}
+}
+
+func TestImportWithoutStreaming(t *testing.T) {
+	s := rejectingService(map[string]error{"taken": gokitbuildservice.ErrAlreadyExists})
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{"{\"id\":\"a\"}\n{\"id\":\"b\"}\n", http.StatusOK},
+		{"{\"id\":\"a\"}\n{\"id\":\"taken\"}\n", http.StatusMultiStatus},
+	} {
+		resp, out := importOverHTTP(t, s, "application/json", tc.body)
+		if resp.StatusCode != tc.code {
+			t.Errorf("%q: got %s, want %d", tc.body, resp.Status, tc.code)
+		}
+		var sum gokitbuildservice.ImportSummary
+		if err := json.Unmarshal([]byte(out), &sum); err != nil || sum.Imported+sum.Skipped != 2 {
+			t.Errorf("%q: got %s, want the summary alone", tc.body, out)
+		}
+	}
+}
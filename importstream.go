@@ -0,0 +1,93 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// NDJSONMediaType, when accepted, makes POST /builds/import stream its
+// progress: one ImportProgress line per line of the body, flushed as soon
+// as that line is done, then a final line with the ImportSummary, as
+//
+//	{"imported":2,"summary":{...}}
+//
+// or, if the import stopped part way, the error and how many builds it had
+// created, as
+//
+//	{"imported":1,"error":"..."}
+//
+// The status is always 200, as it's sent with the first line.
+const NDJSONMediaType = "application/x-ndjson"
+
+func acceptsNDJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == NDJSONMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// importStream writes an import's progress to the response as it goes.
+type importStream struct {
+	w       http.ResponseWriter
+	f       http.Flusher
+	started bool
+}
+
+type importStreamKey struct{}
+
+type importStreamEnd struct {
+	Imported int            `json:"imported"`
+	Summary  *ImportSummary `json:"summary,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// streamImports hands the import server an importStream for requests
+// accepting NDJSONMediaType, if w can be flushed.
+func streamImports(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok || !acceptsNDJSON(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		st := &importStream{w: w, f: f}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), importStreamKey{}, st)))
+	})
+}
+
+func importStreamFromContext(ctx context.Context) *importStream {
+	st, _ := ctx.Value(importStreamKey{}).(*importStream)
+	return st
+}
+
+// write sends v as the next line, starting the response if it's the first.
+func (st *importStream) write(v interface{}) error {
+	if !st.started {
+		st.w.Header().Set("Content-Type", NDJSONMediaType)
+		st.w.WriteHeader(http.StatusOK)
+		st.started = true
+	}
+	if err := json.NewEncoder(st.w).Encode(v); err != nil {
+		return err
+	}
+	st.f.Flush()
+	return nil
+}
+
+func (st *importStream) progress(p ImportProgress) error { return st.write(p) }
+
+// end sends the final line for resp.
+func (st *importStream) end(resp importBuildsResponse) error {
+	end := importStreamEnd{Imported: resp.Summary.Imported}
+	if resp.Err != nil {
+		end.Error = resp.Err.Error()
+	} else {
+		end.Summary = &resp.Summary
+	}
+	return st.write(end)
+}
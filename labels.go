@@ -0,0 +1,61 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sort"
+)
+
+// ListLabelKeys returns every label key used by a build, sorted. It scans
+// the whole store under the read lock, so it costs as much as an unfiltered
+// list; an index kept up to date on every write would be the way to go if
+// that stops being cheap enough.
+func (s *buildService) ListLabelKeys(ctx context.Context) ([]string, error) {
+	return s.distinctLabels(ctx, func(labels map[string]string, add func(string)) {
+		for k := range labels {
+			add(k)
+		}
+	})
+}
+
+// ListLabelValues returns every value builds give the label key, sorted,
+// scanning the store like ListLabelKeys. Values of sensitive labels aren't
+// listed.
+func (s *buildService) ListLabelValues(ctx context.Context, key string) ([]string, error) {
+	if s.sensitive(key) {
+		return []string{}, nil
+	}
+	return s.distinctLabels(ctx, func(labels map[string]string, add func(string)) {
+		if v, ok := labels[key]; ok {
+			add(v)
+		}
+	})
+}
+
+// distinctLabels gathers, sorted and without duplicates, whatever collect
+// adds from the labels of every build.
+func (s *buildService) distinctLabels(ctx context.Context, collect func(labels map[string]string, add func(string))) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mtx.RLock()
+	builds, err := s.repo.List(ctx)
+	if err != nil {
+		s.mtx.RUnlock()
+		return nil, err
+	}
+	seen := map[string]bool{}
+	add := func(v string) { seen[v] = true }
+	now := s.now(ctx)
+	for _, b := range builds {
+		if !s.expired(b, now) {
+			collect(b.Labels, add)
+		}
+	}
+	s.mtx.RUnlock()
+	out := make([]string, 0, len(seen))
+	for v := range seen {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out, nil
+}
@@ -0,0 +1,169 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"time"
+)
+
+// WithStrictFIFO makes LeaseBuild hand out builds strictly oldest first,
+// ignoring Priority.
+func WithStrictFIFO(fifo bool) InmemOption {
+	return func(s *buildService) { s.fifo = fifo }
+}
+
+// leaseLess is the lease order: highest Priority first, and oldest first,
+// by Sequence, among builds of equal priority, so low-priority builds still
+// progress as soon as nothing outranks them. WithStrictFIFO drops the
+// priority.
+func (s *buildService) leaseLess(a, b Build) bool {
+	if !s.fifo && a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return bySequence(a, b)
+}
+
+// LeaseBuild hands the first pending build in the lease order to workerID,
+// marking it running under a lease that expires after ttl. A running build
+// whose lease has expired is treated as pending again, so a crashed
+// worker's build is picked up by the next caller. Builds that list
+// capabilities in RequiresLabel are skipped, since the caller declares none;
+// they're left to ClaimAndStart workers that have them. It returns false if
+// no build is available.
+func (s *buildService) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (Build, bool, error) {
+	return s.lease(ctx, workerID, ttl, BuildFilter{}.matches)
+}
+
+// lease leases the first build in the lease order that match accepts.
+func (s *buildService) lease(ctx context.Context, workerID string, ttl time.Duration, match func(Build) bool) (Build, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return Build{}, false, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := s.now(ctx)
+	var (
+		next         Build
+		found, limit bool
+	)
+	builds, err := s.repo.List(ctx)
+	if err != nil {
+		return Build{}, false, err
+	}
+	for _, b := range builds {
+		if !leasable(b, now) || s.expired(b, now) {
+			continue
+		}
+		v, err := s.view(ctx, b)
+		if err != nil {
+			return Build{}, false, err
+		}
+		if !match(v) {
+			continue
+		}
+		if s.admit(b, Build{Status: StatusRunning}) != nil {
+			limit = true // only builds already running may be leased
+			continue
+		}
+		if !found || s.leaseLess(b, next) {
+			next, found = b, true
+		}
+	}
+	if !found {
+		if limit {
+			return Build{}, false, s.admit(Build{}, Build{Status: StatusRunning})
+		}
+		return Build{}, false, nil
+	}
+	prev := next
+	next.Status = StatusRunning
+	next.Lease = &Lease{WorkerID: workerID, ExpiresAt: now.Add(ttl)}
+	next, err = s.save(ctx, BuildUpdated, prev, next)
+	if err != nil {
+		return Build{}, false, err
+	}
+	next, err = s.view(ctx, next)
+	return next, err == nil, err
+}
+
+func leasable(b Build, now time.Time) bool {
+	switch b.Status {
+	case StatusPending:
+		return true
+	case StatusRunning:
+		return b.Lease != nil && !now.Before(b.Lease.ExpiresAt)
+	}
+	return false
+}
+
+// ForceReleaseLease drops the lease on a build and returns it to pending,
+// whether or not the lease has expired. It's meant for operators cleaning up
+// after a crashed worker. ErrNotFound is returned if the build isn't leased.
+func (s *buildService) ForceReleaseLease(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	prev, err := s.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if prev.Lease == nil {
+		return ErrNotFound
+	}
+	b := prev
+	b.Lease = nil
+	b.Status = StatusPending
+	_, err = s.save(ctx, BuildUpdated, prev, b)
+	return err
+}
+
+// QueuePosition returns the 1-based position of a pending build in the lease
+// order, and an estimate of how long until it starts: the builds ahead of it,
+// shared across as many workers as are running builds right now, each taking
+// the recent average run duration. ErrNotFound is returned if the build
+// isn't pending.
+func (s *buildService) QueuePosition(ctx context.Context, id string) (int, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	b, err := s.lookup(ctx, id)
+	if err == nil && b.Status != StatusPending {
+		err = ErrNotFound
+	}
+	if err != nil {
+		s.mtx.RUnlock()
+		return 0, 0, err
+	}
+	builds, err := s.repo.List(ctx)
+	if err != nil {
+		s.mtx.RUnlock()
+		return 0, 0, err
+	}
+	var ahead, running int
+	now := s.now(ctx)
+	for _, other := range builds {
+		switch {
+		case s.expired(other, now):
+		case other.Status == StatusPending && s.leaseLess(other, b):
+			ahead++
+		case other.Status == StatusRunning:
+			running++
+		}
+	}
+	s.mtx.RUnlock()
+
+	var avg time.Duration
+	if s.stats != nil {
+		avg = s.stats.Average()
+	}
+	if running == 0 {
+		running = 1
+	}
+	rounds := (ahead + running - 1) / running
+	return ahead + 1, time.Duration(rounds) * avg, nil
+}
@@ -0,0 +1,71 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLeaseOrder(t *testing.T) {
+	// Posted in this order, so by Sequence too.
+	queue := []Build{
+		{ID: "a"},
+		{ID: "b", Priority: 5},
+		{ID: "c"},
+		{ID: "d", Priority: 5},
+		{ID: "e", Priority: 1},
+		{ID: "f", Priority: -1},
+	}
+	for _, tc := range []struct {
+		name string
+		opts []InmemOption
+		want []string
+	}{
+		{"by priority, then oldest", nil, []string{"b", "d", "e", "a", "c", "f"}},
+		{"strict FIFO", []InmemOption{WithStrictFIFO(true)}, []string{"a", "b", "c", "d", "e", "f"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewInmemService(tc.opts...)
+			for _, b := range queue {
+				if err := s.PostBuild(ctx, b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			for {
+				b, ok, err := s.LeaseBuild(ctx, "w", time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					break
+				}
+				got = append(got, b.ID)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("leased %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpiredLeaseTakesItsTurnAgain(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewInmemService(WithClock(clock))
+	for _, b := range []Build{{ID: "old"}, {ID: "new"}} {
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, _, _ := s.LeaseBuild(ctx, "crashed", time.Minute); b.ID != "old" {
+		t.Fatalf("first lease: got %q, want old", b.ID)
+	}
+	clock.Advance(2 * time.Minute)
+	b, ok, err := s.LeaseBuild(ctx, "w", time.Minute)
+	if err != nil || !ok || b.ID != "old" || b.Lease.WorkerID != "w" {
+		t.Errorf("after the lease expired: got %q leased to %+v, %v, %v; want old, to w", b.ID, b.Lease, ok, err)
+	}
+}
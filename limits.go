@@ -0,0 +1,36 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"time"
+)
+
+// ServiceLimits are the limits and settings a service applies to the builds
+// written to it, as configured with its InmemOptions.
+type ServiceLimits struct {
+	Build          Limits
+	MaxRunning     int           // 0 for no limit
+	DefaultTTL     time.Duration // 0 if builds don't expire by default
+	ReservationTTL time.Duration
+	StrictIDs      bool
+	StrictFIFO     bool
+	SpecDedup      bool
+	Persistent     bool
+}
+
+// GetLimits reports the limits the service enforces.
+func (s *buildService) GetLimits(ctx context.Context) (ServiceLimits, error) {
+	if err := ctx.Err(); err != nil {
+		return ServiceLimits{}, err
+	}
+	return ServiceLimits{
+		Build:          s.limits,
+		MaxRunning:     s.maxRunning,
+		DefaultTTL:     s.defaultTTL,
+		ReservationTTL: s.reservationTTL,
+		StrictIDs:      s.strict,
+		StrictFIFO:     s.fifo,
+		SpecDedup:      s.dedup,
+		Persistent:     s.wal != nil,
+	}, nil
+}
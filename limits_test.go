@@ -0,0 +1,173 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestLimits(t *testing.T) {
+	l := Limits{MaxSteps: 3, MaxLabels: 2, MaxBytes: 512, MaxOutputBytes: 8}
+	steps := func(n int) []Step {
+		out := make([]Step, n)
+		for i := range out {
+			out[i] = Step{Image: "golang"}
+		}
+		return out
+	}
+	labels := func(n int) map[string]string {
+		out := map[string]string{}
+		for i := 0; i < n; i++ {
+			out[fmt.Sprint("k", i)] = "v"
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		name  string
+		build Build
+		field string // the one problem reported, or "" for none
+	}{
+		{"steps at the limit", Build{ID: "b", Steps: steps(3)}, ""},
+		{"too many steps", Build{ID: "b", Steps: steps(4)}, "steps"},
+		{"labels at the limit", Build{ID: "b", Labels: labels(2)}, ""},
+		{"too many labels", Build{ID: "b", Labels: labels(3)}, "labels"},
+		{"output at the limit", Build{ID: "b", Outputs: map[string]string{"sha": "12345678"}}, ""},
+		{"output too big", Build{ID: "b", Outputs: map[string]string{"sha": "123456789"}}, "outputs.sha"},
+		{"too big overall", Build{ID: "b", Name: strings.Repeat("x", 512)}, "build"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := tc.build.ValidateWithin(l)
+			switch {
+			case tc.field == "" && errs != nil:
+				t.Errorf("got %v, want no problems", errs)
+			case tc.field != "" && (len(errs) != 1 || errs[0].Field != tc.field):
+				t.Errorf("got %v, want one problem with %s", errs, tc.field)
+			case tc.field != "" && !strings.Contains(errs[0].Message, "exceeds the limit"):
+				t.Errorf("%q doesn't say which limit was exceeded", errs[0].Message)
+			}
+		})
+	}
+}
+
+func TestServiceEnforcesItsLimits(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmemService(WithLimits(Limits{MaxLabels: 1}))
+	if err := s.PostBuild(ctx, Build{ID: "b1", Labels: map[string]string{"a": "1", "b": "2"}}); !errors.Is(err, ErrValidation) {
+		t.Errorf("POST over the limit: got %v, want a validation error", err)
+	}
+	if err := s.PostBuild(ctx, Build{ID: "b1", Labels: map[string]string{"a": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PatchBuild(ctx, "b1", Build{Labels: map[string]string{"a": "1", "b": "2"}}); !errors.Is(err, ErrValidation) {
+		t.Errorf("PATCH over the limit: got %v, want a validation error", err)
+	}
+	if err := s.PutBuild(ctx, "b1", Build{ID: "b1", Labels: map[string]string{"a": "1", "b": "2"}}); !errors.Is(err, ErrValidation) {
+		t.Errorf("PUT over the limit: got %v, want a validation error", err)
+	}
+	many := make([]Step, DefaultLimits.MaxSteps+1)
+	for i := range many {
+		many[i].Image = "golang"
+	}
+	if err := s.PostBuild(ctx, Build{ID: "b2", Steps: many}); err != nil {
+		t.Errorf("WithLimits replaces the defaults, but the default step limit applied: %v", err)
+	}
+}
+
+func TestGetLimitsOverHTTP(t *testing.T) {
+	build := Limits{MaxSteps: 3, MaxLabels: 2, MaxBytes: 512, MaxOutputBytes: 8}
+	s := NewInmemService(
+		WithLimits(build),
+		WithMaxConcurrentRunning(4),
+		WithDefaultTTL(time.Hour),
+		WithReservationTTL(time.Minute),
+		WithStrictIDs(true),
+		WithSpecDedup(true),
+	)
+	queue := NewQueueGate()
+	srv := httptest.NewServer(MakeHTTPHandler(s, log.NewNopLogger(),
+		WithDefaultListLimit(20),
+		WithMaxListLimit(200),
+		WithReportedRetention(24*time.Hour, map[BuildStatus]time.Duration{StatusFailed: 48 * time.Hour}),
+		WithQueueGate(queue),
+	))
+	defer srv.Close()
+	get := func() limitsDocument {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/limits")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %s", resp.Status)
+		}
+		var doc limitsDocument
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+
+	doc := get()
+	if doc.Build.MaxSteps != 3 || doc.Build.MaxLabels != 2 || doc.Build.MaxBytes != 512 || doc.Build.MaxOutputBytes != 8 {
+		t.Errorf("build limits: got %+v, want %+v", doc.Build, build)
+	}
+	if doc.MaxRunning != 4 || doc.DefaultTTLSeconds != 3600 || doc.ReservationTTLSeconds != 60 {
+		t.Errorf("service limits: got %d running, TTL %gs, reservations %gs", doc.MaxRunning, doc.DefaultTTLSeconds, doc.ReservationTTLSeconds)
+	}
+	if doc.DefaultListLimit != 20 || doc.MaxListLimit != 200 || doc.MaxBatchIDs != maxGetBuilds || doc.MaxImportLineBytes != maxImportLine {
+		t.Errorf("handler limits: got lists of %d up to %d, batches of %d, import lines of %d", doc.DefaultListLimit, doc.MaxListLimit, doc.MaxBatchIDs, doc.MaxImportLineBytes)
+	}
+	want := &limitsRetention{Seconds: 86400, ByStatusSeconds: map[BuildStatus]float64{StatusFailed: 172800}}
+	if !reflect.DeepEqual(doc.Retention, want) {
+		t.Errorf("retention: got %+v, want %+v", doc.Retention, want)
+	}
+	f := doc.Features
+	if !f.StrictIDs || f.StrictFIFO || !f.SpecDedup || f.Persistent || f.Audit {
+		t.Errorf("features: got %+v", f)
+	}
+	if f.QueuePaused == nil || *f.QueuePaused {
+		t.Errorf("queue: got %v, want open", f.QueuePaused)
+	}
+
+	queue.PauseQueue()
+	if p := get().Features.QueuePaused; p == nil || !*p {
+		t.Errorf("queue after pausing: got %v, want paused", p)
+	}
+	queue.ResumeQueue()
+	if p := get().Features.QueuePaused; p == nil || *p {
+		t.Errorf("queue after resuming: got %v, want open", p)
+	}
+}
+
+func TestGetLimitsOverHTTPDefaults(t *testing.T) {
+	srv := httptest.NewServer(MakeHTTPHandler(NewInmemService(), log.NewNopLogger()))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var doc map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["retention"]; ok {
+		t.Errorf("retention reported without WithReportedRetention: %v", doc["retention"])
+	}
+	if _, ok := doc["features"].(map[string]interface{})["queuePaused"]; ok {
+		t.Error("queue state reported without WithQueueGate")
+	}
+	if doc["defaultListLimit"] != float64(DefaultListLimit) || doc["maxListLimit"] != float64(DefaultMaxListLimit) {
+		t.Errorf("got lists of %v up to %v, want the defaults", doc["defaultListLimit"], doc["maxListLimit"])
+	}
+}
@@ -0,0 +1,154 @@
+package gokitbuildservice
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ListOptions controls which builds ListBuilds returns and in what order.
+type ListOptions struct {
+	// SortBy is one of "id", "createdAt", "updatedAt" or "name", optionally prefixed with
+	// "-" for descending order. Empty means DefaultSortBy.
+	SortBy string
+
+	// Selector restricts the result to builds whose labels match.
+	Selector Selector
+
+	// Quarantined restricts the result to quarantined builds.
+	Quarantined bool
+
+	// Predicate names a function registered with RegisterListPredicate
+	// that builds must satisfy.
+	Predicate string
+}
+
+// matches reports whether b passes the filters in o.
+func (o ListOptions) matches(b Build) bool {
+	if o.Quarantined && !b.Quarantined {
+		return false
+	}
+	if o.Predicate != "" && !listPredicate(o.Predicate)(b) {
+		return false
+	}
+	return o.Selector.Matches(b.Labels)
+}
+
+// validate returns ErrValidation if o names an unregistered predicate.
+func (o ListOptions) validate() error {
+	if o.Predicate != "" && listPredicate(o.Predicate) == nil {
+		var errs ValidationErrors
+		errs.add("predicate", "unknown predicate %q", o.Predicate)
+		return errs
+	}
+	return nil
+}
+
+var (
+	predicatesMtx sync.RWMutex
+	predicates    = map[string]func(Build) bool{}
+)
+
+// RegisterListPredicate makes fn available to ListBuilds as
+// ListOptions.Predicate, and to GET /builds/ as ?predicate=name, to filter
+// builds in ways the other options can't. It's meant to be called at
+// startup, and panics if name is empty or already registered.
+//
+// Only registered code ever runs: a request can pick a predicate by name,
+// but not supply one. Predicates run for every build listed while the
+// store is locked for reading, so they must be quick and free of side
+// effects, and must not call the service. One that panics is taken to
+// reject the build.
+func RegisterListPredicate(name string, fn func(Build) bool) {
+	predicatesMtx.Lock()
+	defer predicatesMtx.Unlock()
+	if name == "" {
+		panic("gokitbuildservice: empty list predicate name")
+	}
+	if _, ok := predicates[name]; ok {
+		panic(fmt.Sprintf("gokitbuildservice: list predicate %q registered twice", name))
+	}
+	predicates[name] = func(b Build) (ok bool) {
+		defer func() {
+			if recover() != nil {
+				ok = false
+			}
+		}()
+		return fn(b)
+	}
+}
+
+// listPredicate returns the predicate registered as name, or nil.
+func listPredicate(name string) func(Build) bool {
+	predicatesMtx.RLock()
+	defer predicatesMtx.RUnlock()
+	return predicates[name]
+}
+
+// ErrPartialResult is returned by ListBuilds, with the builds it gathered
+// before its context ended, when the context was made WithPartialResults.
+// The list is sorted and filtered as asked, but may be missing any of the
+// builds that match.
+var ErrPartialResult = errors.New("partial result")
+
+// DefaultSortBy lists the newest builds first.
+const DefaultSortBy = "-createdAt"
+
+// buildLess reports whether a sorts before b under key. Builds that compare
+// equal on key are ordered by Sequence and then by ID, which is unique, so
+// every sort is total and repeated calls over the same data always agree.
+type buildLess func(a, b Build) bool
+
+var sortKeys = map[string]buildLess{
+	"id": func(a, b Build) bool { return a.ID < b.ID },
+	"createdAt": func(a, b Build) bool {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return bySequence(a, b)
+	},
+	"updatedAt": func(a, b Build) bool {
+		if !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.Before(b.UpdatedAt)
+		}
+		return bySequence(a, b)
+	},
+	"name": func(a, b Build) bool {
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return bySequence(a, b)
+	},
+}
+
+// bySequence orders builds oldest first, by creation sequence and then ID.
+func bySequence(a, b Build) bool {
+	if a.Sequence != b.Sequence {
+		return a.Sequence < b.Sequence
+	}
+	return a.ID < b.ID
+}
+
+// lessFunc resolves a SortBy value, returning ErrValidation for unknown keys.
+func lessFunc(sortBy string) (buildLess, error) {
+	if sortBy == "" {
+		sortBy = DefaultSortBy
+	}
+	key, desc := strings.TrimPrefix(sortBy, "-"), strings.HasPrefix(sortBy, "-")
+	less, ok := sortKeys[key]
+	if !ok {
+		var errs ValidationErrors
+		errs.add("sortBy", "unknown sort key %q", key)
+		return nil, errs
+	}
+	if desc {
+		return func(a, b Build) bool { return less(b, a) }, nil
+	}
+	return less, nil
+}
+
+func sortBuilds(builds []Build, less buildLess) {
+	sort.Slice(builds, func(i, j int) bool { return less(builds[i], builds[j]) })
+}
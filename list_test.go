@@ -0,0 +1,170 @@
+package gokitbuildservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+func TestListBuildsPartialResultOverHTTP(t *testing.T) {
+	// A network backend that sends a few builds, then stalls until the
+	// call's deadline, and honors WithPartialResults as the service does.
+	fake := &servicetest.FakeService{
+		ListBuildsFunc: func(ctx context.Context, opts gokitbuildservice.ListOptions) ([]gokitbuildservice.Build, error) {
+			builds := []gokitbuildservice.Build{{ID: "b1"}, {ID: "b2"}, {ID: "b3"}}
+			<-ctx.Done()
+			if gokitbuildservice.PartialResultsFromContext(ctx) {
+				return builds, fmt.Errorf("%w: %v", gokitbuildservice.ErrPartialResult, ctx.Err())
+			}
+			return nil, ctx.Err()
+		},
+	}
+	s := gokitbuildservice.NewTimeoutService(fake, 20*time.Millisecond)
+	srv := httptest.NewServer(gokitbuildservice.MakeHTTPHandler(s, log.NewNopLogger()))
+	defer srv.Close()
+
+	list := func(allowPartial bool) (*http.Response, []gokitbuildservice.Build) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/builds/", nil)
+		if allowPartial {
+			req.Header.Set(gokitbuildservice.AllowPartialHeader, "true")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var page struct {
+			Items []gokitbuildservice.Build `json:"items"`
+		}
+		json.NewDecoder(resp.Body).Decode(&page)
+		return resp, page.Items
+	}
+
+	resp, builds := list(true)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(gokitbuildservice.PartialHeader) != "true" {
+		t.Errorf("allowing partial results: got %s with %s %q", resp.Status, gokitbuildservice.PartialHeader, resp.Header.Get(gokitbuildservice.PartialHeader))
+	}
+	if len(builds) != 3 {
+		t.Errorf("allowing partial results: got %d builds, want the 3 sent before the stall", len(builds))
+	}
+
+	resp, builds = list(false)
+	if resp.StatusCode != http.StatusGatewayTimeout || resp.Header.Get(gokitbuildservice.PartialHeader) != "" || len(builds) != 0 {
+		t.Errorf("all or nothing: got %s, %s %q, %d builds; want a timeout and no builds", resp.Status, gokitbuildservice.PartialHeader, resp.Header.Get(gokitbuildservice.PartialHeader), len(builds))
+	}
+}
+
+func TestListBuildsOrderIsStable(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, err := gokitbuildservice.NewService(gokitbuildservice.NewInmemRepository(), gokitbuildservice.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// Posted in this order. Pairs share a creation time and names repeat,
+	// so every key needs its tiebreaker.
+	for i, b := range []gokitbuildservice.Build{
+		{ID: "e", Name: "beta"},
+		{ID: "c", Name: "alpha"},
+		{ID: "f", Name: "alpha"},
+		{ID: "a", Name: "gamma"},
+		{ID: "d", Name: "beta"},
+		{ID: "b", Name: "alpha"},
+	} {
+		if i%2 == 0 {
+			clock.Advance(time.Second)
+		}
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		sortBy string
+		want   string
+	}{
+		{"", "bdafce"},
+		{"-createdAt", "bdafce"},
+		{"createdAt", "ecfadb"},
+		{"id", "abcdef"},
+		{"-id", "fedcba"},
+		{"name", "cfbeda"},
+		{"-name", "adebfc"},
+	} {
+		for i := 0; i < 20; i++ {
+			builds, err := s.ListBuilds(ctx, gokitbuildservice.ListOptions{SortBy: tc.sortBy})
+			if err != nil {
+				t.Fatalf("sortBy %q: %v", tc.sortBy, err)
+			}
+			var got string
+			for _, b := range builds {
+				got += b.ID
+			}
+			if got != tc.want {
+				t.Fatalf("sortBy %q, call %d: got %s, want %s", tc.sortBy, i, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestListBuildsUnknownSortKey(t *testing.T) {
+	s := gokitbuildservice.NewInmemService()
+	for _, sortBy := range []string{"status", "-status", "ID", "--id"} {
+		if _, err := s.ListBuilds(context.Background(), gokitbuildservice.ListOptions{SortBy: sortBy}); !errors.Is(err, gokitbuildservice.ErrValidation) {
+			t.Errorf("sortBy %q: got %v, want ErrValidation", sortBy, err)
+		}
+	}
+}
+
+func TestListBuildsPageSize(t *testing.T) {
+	s := gokitbuildservice.NewInmemService()
+	for i := 0; i < 12; i++ {
+		if err := s.PostBuild(context.Background(), gokitbuildservice.Build{ID: fmt.Sprintf("b%02d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(gokitbuildservice.MakeHTTPHandler(s, log.NewNopLogger(),
+		gokitbuildservice.WithDefaultListLimit(4),
+		gokitbuildservice.WithMaxListLimit(10),
+	))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		query     string
+		want      int
+		truncated string
+	}{
+		{"", 4, "true"},
+		{"?limit=6", 6, ""},
+		{"?limit=50", 10, "true"},
+		{"?offset=4&limit=50", 8, ""},
+	} {
+		resp, err := http.Get(srv.URL + "/builds/" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page struct {
+			Items []gokitbuildservice.Build `json:"items"`
+			Total int                       `json:"total"`
+		}
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if len(page.Items) != tc.want || page.Total != 12 {
+			t.Errorf("%q: got %d of %d builds, want %d of 12", tc.query, len(page.Items), page.Total, tc.want)
+		}
+		if got := resp.Header.Get(gokitbuildservice.ResultTruncatedHeader); got != tc.truncated {
+			t.Errorf("%q: %s = %q, want %q", tc.query, gokitbuildservice.ResultTruncatedHeader, got, tc.truncated)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// keyedMutex hands out one lock per key, kept only while someone holds or
+// waits for it, so locking different keys never contends.
+type keyedMutex struct {
+	mtx   sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	ch   chan struct{} // holds a value while locked
+	refs int           // holders and waiters
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*keyLock{}}
+}
+
+// lock locks every key in keys, in sorted order so that callers locking
+// overlapping keys can't deadlock, and returns the func unlocking them. It
+// gives up with ctx's error once ctx is done, holding none of them.
+func (m *keyedMutex) lock(ctx context.Context, keys ...string) (func(), error) {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	var held []string
+	unlock := func() {
+		for _, k := range held {
+			m.release(k, true)
+		}
+	}
+	for i, k := range keys {
+		if i > 0 && k == keys[i-1] {
+			continue
+		}
+		l := m.acquire(k)
+		select {
+		case l.ch <- struct{}{}:
+			held = append(held, k)
+		case <-ctx.Done():
+			m.release(k, false)
+			unlock()
+			return nil, ctx.Err()
+		}
+	}
+	return unlock, nil
+}
+
+func (m *keyedMutex) acquire(key string) *keyLock {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyLock{ch: make(chan struct{}, 1)}
+		m.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (m *keyedMutex) release(key string, locked bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	l := m.locks[key]
+	if locked {
+		<-l.ch
+	}
+	if l.refs--; l.refs == 0 {
+		delete(m.locks, key)
+	}
+}
+
+// BuildLockMiddleware serializes the mutations of each build: a mutation
+// waits for any other in progress on the same build to finish, while
+// mutations of different builds go ahead side by side. It's for stacks
+// whose read-modify-write cycles span several calls, such as an audit log
+// reading the build around each change, a composite mirroring writes to a
+// second backend, or a Repository shared without transactions, where two
+// concurrent writes to one build could otherwise interleave.
+//
+// Mutations are serialized by the IDs they're given: both IDs for
+// RenameBuild, all of them for PatchBuilds and BatchPostBuilds. LeaseBuild,
+// ClaimAndStart and CancelGroup don't know their builds in advance and
+// aren't serialized, nor are the dependents RenameBuild updates. A mutation
+// still waiting when its context ends fails with the context's error. Reads
+// are passed through unchanged.
+func BuildLockMiddleware() Middleware {
+	return func(next Service) Service {
+		return &buildLockMiddleware{Service: next, locks: newKeyedMutex()}
+	}
+}
+
+type buildLockMiddleware struct {
+	Service
+	locks *keyedMutex
+}
+
+func (mw *buildLockMiddleware) PostBuild(ctx context.Context, b Build) error {
+	unlock, err := mw.locks.lock(ctx, b.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mw.Service.PostBuild(ctx, b)
+}
+
+func (mw *buildLockMiddleware) GetOrCreateBuild(ctx context.Context, b Build) (Build, bool, error) {
+	unlock, err := mw.locks.lock(ctx, b.ID)
+	if err != nil {
+		return Build{}, false, err
+	}
+	defer unlock()
+	return mw.Service.GetOrCreateBuild(ctx, b)
+}
+
+func (mw *buildLockMiddleware) PutBuild(ctx context.Context, id string, b Build) error {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mw.Service.PutBuild(ctx, id, b)
+}
+
+func (mw *buildLockMiddleware) PatchBuild(ctx context.Context, id string, b Build) error {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mw.Service.PatchBuild(ctx, id, b)
+}
+
+func (mw *buildLockMiddleware) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) ([]BatchResult, error) {
+	unlock, err := mw.locks.lock(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return mw.Service.PatchBuilds(ctx, ids, patch)
+}
+
+func (mw *buildLockMiddleware) BatchPostBuilds(ctx context.Context, builds []Build) ([]BatchResult, error) {
+	ids := make([]string, len(builds))
+	for i, b := range builds {
+		ids[i] = b.ID
+	}
+	unlock, err := mw.locks.lock(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return mw.Service.BatchPostBuilds(ctx, builds)
+}
+
+func (mw *buildLockMiddleware) DeleteBuild(ctx context.Context, id string) error {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mw.Service.DeleteBuild(ctx, id)
+}
+
+func (mw *buildLockMiddleware) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (int64, error) {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	return mw.Service.AppendBuildLogs(ctx, id, offset, p)
+}
+
+func (mw *buildLockMiddleware) ForceReleaseLease(ctx context.Context, id string) error {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mw.Service.ForceReleaseLease(ctx, id)
+}
+
+func (mw *buildLockMiddleware) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (bool, error) {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	return mw.Service.CompareAndSetStatus(ctx, id, expected, next)
+}
+
+func (mw *buildLockMiddleware) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (bool, error) {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	return mw.Service.CompareAndDeleteBuild(ctx, id, updatedAt)
+}
+
+func (mw *buildLockMiddleware) RerunFailedSteps(ctx context.Context, id string) (Build, error) {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return Build{}, err
+	}
+	defer unlock()
+	return mw.Service.RerunFailedSteps(ctx, id)
+}
+
+func (mw *buildLockMiddleware) FailBuild(ctx context.Context, id, reason string, exitCode int) error {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mw.Service.FailBuild(ctx, id, reason, exitCode)
+}
+
+func (mw *buildLockMiddleware) RenameBuild(ctx context.Context, oldID, newID string) error {
+	unlock, err := mw.locks.lock(ctx, oldID, newID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mw.Service.RenameBuild(ctx, oldID, newID)
+}
+
+func (mw *buildLockMiddleware) SetOutput(ctx context.Context, id, key, value string) error {
+	unlock, err := mw.locks.lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mw.Service.SetOutput(ctx, id, key, value)
+}
+
+// LeaseBuild is passed through; see BuildLockMiddleware.
+func (mw *buildLockMiddleware) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (Build, bool, error) {
+	return mw.Service.LeaseBuild(ctx, workerID, ttl)
+}
@@ -0,0 +1,174 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutexSerializesOneKey(t *testing.T) {
+	m := newKeyedMutex()
+	var (
+		wg          sync.WaitGroup
+		mtx         sync.Mutex
+		inside, max int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := m.lock(context.Background(), "a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mtx.Lock()
+			if inside++; inside > max {
+				max = inside
+			}
+			mtx.Unlock()
+			time.Sleep(time.Millisecond)
+			mtx.Lock()
+			inside--
+			mtx.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if max != 1 {
+		t.Errorf("%d holders at once, want 1", max)
+	}
+	if len(m.locks) != 0 {
+		t.Errorf("%d locks left behind", len(m.locks))
+	}
+}
+
+func TestKeyedMutexDifferentKeysDontContend(t *testing.T) {
+	m := newKeyedMutex()
+	unlock, err := m.lock(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	other, err := m.lock(ctx, "b")
+	if err != nil {
+		t.Fatalf("locking b while a is held: %v", err)
+	}
+	other()
+}
+
+func TestKeyedMutexGivesUpWithTheContext(t *testing.T) {
+	m := newKeyedMutex()
+	unlock, err := m.lock(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.lock(ctx, "a", "b"); err != context.DeadlineExceeded {
+		t.Fatalf("waiting on a held key: got %v, want DeadlineExceeded", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	a, err := m.lock(ctx, "a")
+	if err != nil {
+		t.Fatalf("a is still held after giving up: %v", err)
+	}
+	a()
+	unlock()
+	if len(m.locks) != 0 {
+		t.Errorf("%d locks left behind", len(m.locks))
+	}
+}
+
+func TestKeyedMutexOverlappingKeysDontDeadlock(t *testing.T) {
+	m := newKeyedMutex()
+	sets := [][]string{{"a", "b"}, {"b", "a"}, {"b", "c"}, {"c", "a"}, {"a", "b", "c"}, {"c", "c", "b"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, keys := range sets {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(keys []string) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					unlock, err := m.lock(ctx, keys...)
+					if err != nil {
+						t.Errorf("locking %v: %v (deadlocked?)", keys, err)
+						return
+					}
+					unlock()
+				}
+			}(keys)
+		}
+	}
+	wg.Wait()
+}
+
+// slowPatcher is a backend whose PatchBuild takes a while, and which
+// records the most calls it had in progress at once, for each build and
+// overall.
+type slowPatcher struct {
+	Service
+	mtx     sync.Mutex
+	inside  map[string]int
+	perID   int
+	overall int
+	total   int
+}
+
+func (s *slowPatcher) PatchBuild(ctx context.Context, id string, b Build) error {
+	s.mtx.Lock()
+	s.inside[id]++
+	s.total++
+	s.perID = max(s.perID, s.inside[id])
+	s.overall = max(s.overall, s.total)
+	s.mtx.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	s.mtx.Lock()
+	s.inside[id]--
+	s.total--
+	s.mtx.Unlock()
+	return nil
+}
+
+func patchConcurrently(t *testing.T, s Service, ids ...string) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := s.PatchBuild(context.Background(), id, Build{Name: "patched"}); err != nil {
+				t.Error(err)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+func TestBuildLockMiddlewareSerializesOneBuild(t *testing.T) {
+	backend := &slowPatcher{inside: map[string]int{}}
+	s := BuildLockMiddleware()(backend)
+	begin := time.Now()
+	patchConcurrently(t, s, "a", "a", "a", "a")
+	if backend.perID != 1 {
+		t.Errorf("%d patches of a at once, want 1", backend.perID)
+	}
+	if d := time.Since(begin); d < 80*time.Millisecond {
+		t.Errorf("4 patches of 20ms took %s, want them one after another", d)
+	}
+}
+
+func TestBuildLockMiddlewareOverlapsDifferentBuilds(t *testing.T) {
+	backend := &slowPatcher{inside: map[string]int{}}
+	s := BuildLockMiddleware()(backend)
+	patchConcurrently(t, s, "a", "b", "c", "d")
+	if backend.perID != 1 || backend.overall < 2 {
+		t.Errorf("at most %d patches at once, %d of one build; want different builds patched side by side", backend.overall, backend.perID)
+	}
+}
@@ -0,0 +1,87 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"time"
+)
+
+// logSegment marks where, in a build's logs, the bytes of one append start.
+// It runs until the next segment. Step is the index of the step that was
+// running when the bytes were appended, or -1 if none was. Logs from before
+// segments were recorded have a single one, with no step and a zero At.
+type logSegment struct {
+	Step  int       `json:"step"`
+	Start int64     `json:"start"`
+	At    time.Time `json:"at"`
+}
+
+// currentStep is the index of b's first running step, or -1.
+func currentStep(b Build) int {
+	for i, st := range b.Steps {
+		if st.Status == StatusRunning {
+			return i
+		}
+	}
+	return -1
+}
+
+// appendLogs adds p to the logs of build id. segs say which steps p's bytes
+// belong to, with offsets from the start of p; none means no step. It must
+// be called with s.mtx held.
+func (s *buildService) appendLogs(id string, p []byte, segs []logSegment) {
+	if len(p) == 0 {
+		return
+	}
+	if len(segs) == 0 {
+		segs = []logSegment{{Step: -1}}
+	}
+	base := int64(len(s.logs[id]))
+	for _, seg := range segs {
+		have := s.logSteps[id]
+		if n := len(have); n > 0 && have[n-1].Step == seg.Step && seg.At.IsZero() {
+			continue
+		}
+		s.logSteps[id] = append(have, logSegment{Step: seg.Step, Start: base + seg.Start, At: seg.At})
+	}
+	s.logs[id] = append(s.logs[id], p...)
+}
+
+// segmentEnd is the offset in logs where segs[i] ends.
+func segmentEnd(segs []logSegment, i int, logs []byte) int64 {
+	if i+1 < len(segs) {
+		return segs[i+1].Start
+	}
+	return int64(len(logs))
+}
+
+// GetBuildLogs returns the logs of build id from byte from onwards. With a
+// step of zero or more, only that step's output counts, bytes and from
+// alike, so a caller can follow one step by asking again from where the
+// last answer ended. A negative step means every step. Bytes are assigned
+// to the step that was running when they were appended.
+func (s *buildService) GetBuildLogs(ctx context.Context, id string, step int, from int64) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if _, err := s.lookup(ctx, id); err != nil {
+		return nil, err
+	}
+	logs := s.logs[id]
+	if step >= 0 {
+		var filtered []byte
+		segs := s.logSteps[id]
+		for i, seg := range segs {
+			if seg.Step == step {
+				filtered = append(filtered, logs[seg.Start:segmentEnd(segs, i, logs)]...)
+			}
+		}
+		logs = filtered
+	}
+	if from >= int64(len(logs)) {
+		return []byte{}, nil
+	}
+	return append([]byte(nil), logs[from:]...), nil
+}
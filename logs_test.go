@@ -0,0 +1,56 @@
+package gokitbuildservice_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+)
+
+func TestAppendBuildLogsContentRange(t *testing.T) {
+	s := gokitbuildservice.NewInmemService()
+	if err := s.PostBuild(context.Background(), gokitbuildservice.Build{ID: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gokitbuildservice.MakeHTTPHandler(s, log.NewNopLogger()))
+	defer srv.Close()
+
+	// In order: each upload sees the log as the ones before it left it.
+	for _, tc := range []struct {
+		contentRange string
+		body         string
+		want         int
+	}{
+		{"bytes 0-5/*", "hello ", http.StatusOK},
+		{"bytes 6-10/11", "world", http.StatusOK},
+		{"bytes 3-7/*", "lo wo", http.StatusRequestedRangeNotSatisfiable}, // overlaps
+		{"bytes 20-22/*", "gap", http.StatusRequestedRangeNotSatisfiable},
+		{"bytes 11-13/*", "abcd", http.StatusBadRequest}, // longer than the range
+		{"bytes 11-13/12", "abc", http.StatusBadRequest}, // total ends inside the range
+		{"bytes 11-13/13", "abc", http.StatusBadRequest}, // total ends on its last byte
+		{"bytes 11-13/x", "abc", http.StatusBadRequest},  // total isn't a number
+		{"bytes 11-13/-1", "abc", http.StatusBadRequest}, // nor a negative one
+		{"bytes 11-13", "abc", http.StatusBadRequest},    // no total at all
+		{"bytes 11-13/14", "abc", http.StatusOK},         // the final chunk
+	} {
+		req, _ := http.NewRequest("PUT", srv.URL+"/builds/b1/logs", strings.NewReader(tc.body))
+		req.Header.Set("Content-Range", tc.contentRange)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s with %q: got %s, want %d", tc.contentRange, tc.body, resp.Status, tc.want)
+		}
+	}
+
+	if n, err := s.GetBuildLogLength(context.Background(), "b1"); err != nil || n != 14 {
+		t.Errorf("log length: got %d, %v; want the 14 bytes accepted", n, err)
+	}
+}
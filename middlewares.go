@@ -0,0 +1,783 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// Middleware describes a service (as opposed to endpoint) middleware.
+type Middleware func(Service) Service
+
+// LoggingMiddleware logs every call to the service. Reads are logged at debug
+// and mutations at info, so filter the logger with the level package to tune
+// verbosity. Label values whose key contains any of redactKeys (compared
+// case-insensitively) are logged as RedactedValue.
+func LoggingMiddleware(logger log.Logger, redactKeys ...string) Middleware {
+	keys := make([]string, 0, len(redactKeys))
+	for _, k := range redactKeys {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return func(next Service) Service {
+		return &loggingMiddleware{
+			next:       next,
+			logger:     logger,
+			redactKeys: keys,
+		}
+	}
+}
+
+type loggingMiddleware struct {
+	next       Service
+	logger     log.Logger
+	redactKeys []string
+}
+
+func (mw loggingMiddleware) PostBuild(ctx context.Context, b Build) (err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "PostBuild", "id", b.ID, "labels", mw.redact(b.Labels), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.PostBuild(ctx, b)
+}
+
+func (mw loggingMiddleware) GetBuild(ctx context.Context, id string) (b Build, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "GetBuild", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetBuild(ctx, id)
+}
+
+func (mw loggingMiddleware) ListBuilds(ctx context.Context, opts ListOptions) (builds []Build, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "ListBuilds", "sortBy", opts.SortBy, "n", len(builds), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ListBuilds(ctx, opts)
+}
+
+func (mw loggingMiddleware) PutBuild(ctx context.Context, id string, b Build) (err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "PutBuild", "id", id, "labels", mw.redact(b.Labels), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.PutBuild(ctx, id, b)
+}
+
+func (mw loggingMiddleware) PatchBuild(ctx context.Context, id string, b Build) (err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "PatchBuild", "id", id, "labels", mw.redact(b.Labels), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.PatchBuild(ctx, id, b)
+}
+
+func (mw loggingMiddleware) DeleteBuild(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "DeleteBuild", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.DeleteBuild(ctx, id)
+}
+
+func (mw loggingMiddleware) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (n int64, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "AppendBuildLogs", "id", id, "offset", offset, "bytes", len(p), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.AppendBuildLogs(ctx, id, offset, p)
+}
+
+func (mw loggingMiddleware) GetBuildLogLength(ctx context.Context, id string) (n int64, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "GetBuildLogLength", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetBuildLogLength(ctx, id)
+}
+
+func (mw loggingMiddleware) ValidateBuild(ctx context.Context, b Build) (problems ValidationErrors, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "ValidateBuild", "id", b.ID, "problems", len(problems), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ValidateBuild(ctx, b)
+}
+
+func (mw loggingMiddleware) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (b Build, ok bool, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "LeaseBuild", "worker", workerID, "ttl", ttl, "id", b.ID, "leased", ok, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.LeaseBuild(ctx, workerID, ttl)
+}
+
+func (mw loggingMiddleware) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (b Build, ok bool, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "ClaimAndStart", "worker", workerID, "id", b.ID, "claimed", ok, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ClaimAndStart(ctx, workerID, filter)
+}
+
+func (mw loggingMiddleware) ForceReleaseLease(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "ForceReleaseLease", "id", id, "actor", ActorFromContext(ctx), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ForceReleaseLease(ctx, id)
+}
+
+func (mw loggingMiddleware) GetBuilds(ctx context.Context, ids []string) (found map[string]Build, missing []string, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "GetBuilds", "ids", len(ids), "found", len(found), "missing", len(missing), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetBuilds(ctx, ids)
+}
+
+func (mw loggingMiddleware) ListBuildStatuses(ctx context.Context, ids []string) (statuses map[string]BuildStatus, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "ListBuildStatuses", "ids", len(ids), "found", len(statuses), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ListBuildStatuses(ctx, ids)
+}
+
+func (mw loggingMiddleware) ReserveID(ctx context.Context, prefix string) (id string, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "ReserveID", "prefix", prefix, "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ReserveID(ctx, prefix)
+}
+
+func (mw loggingMiddleware) QueuePosition(ctx context.Context, id string) (position int, wait time.Duration, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "QueuePosition", "id", id, "position", position, "wait", wait, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.QueuePosition(ctx, id)
+}
+
+func (mw loggingMiddleware) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (ok bool, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "CompareAndSetStatus", "id", id, "expected", expected, "next", next, "set", ok, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.CompareAndSetStatus(ctx, id, expected, next)
+}
+
+func (mw loggingMiddleware) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (ok bool, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "CompareAndDeleteBuild", "id", id, "updatedAt", updatedAt, "deleted", ok, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.CompareAndDeleteBuild(ctx, id, updatedAt)
+}
+
+func (mw loggingMiddleware) RerunFailedSteps(ctx context.Context, id string) (b Build, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "RerunFailedSteps", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.RerunFailedSteps(ctx, id)
+}
+
+func (mw loggingMiddleware) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) (builds []Build, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "ListBuildsModifiedBetween", "from", from, "to", to, "builds", len(builds), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ListBuildsModifiedBetween(ctx, from, to)
+}
+
+func (mw loggingMiddleware) FailBuild(ctx context.Context, id, reason string, exitCode int) (err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "FailBuild", "id", id, "reason", reason, "exitCode", exitCode, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.FailBuild(ctx, id, reason, exitCode)
+}
+
+func (mw loggingMiddleware) RenameBuild(ctx context.Context, oldID, newID string) (err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "RenameBuild", "old", oldID, "new", newID, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.RenameBuild(ctx, oldID, newID)
+}
+
+func (mw loggingMiddleware) GetOrCreateBuild(ctx context.Context, b Build) (got Build, created bool, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "GetOrCreateBuild", "id", b.ID, "created", created, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetOrCreateBuild(ctx, b)
+}
+
+func (mw loggingMiddleware) ListLabelKeys(ctx context.Context) (keys []string, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "ListLabelKeys", "keys", len(keys), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ListLabelKeys(ctx)
+}
+
+func (mw loggingMiddleware) ListLabelValues(ctx context.Context, key string) (values []string, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "ListLabelValues", "key", key, "values", len(values), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ListLabelValues(ctx, key)
+}
+
+func (mw loggingMiddleware) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) (results []BatchResult, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "PatchBuilds", "ids", len(ids), "failed", failedResults(results), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.PatchBuilds(ctx, ids, patch)
+}
+
+func (mw loggingMiddleware) BatchPostBuilds(ctx context.Context, builds []Build) (results []BatchResult, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "BatchPostBuilds", "builds", len(builds), "failed", failedResults(results), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.BatchPostBuilds(ctx, builds)
+}
+
+func (mw loggingMiddleware) FindBuildsBySpecHash(ctx context.Context, hash string) (builds []Build, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "FindBuildsBySpecHash", "hash", hash, "found", len(builds), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.FindBuildsBySpecHash(ctx, hash)
+}
+
+func (mw loggingMiddleware) GetBuildLogs(ctx context.Context, id string, step int, from int64) (p []byte, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "GetBuildLogs", "id", id, "step", step, "from", from, "bytes", len(p), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetBuildLogs(ctx, id, step, from)
+}
+
+func (mw loggingMiddleware) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) (err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "ReplayBuild", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ReplayBuild(ctx, id, sink)
+}
+
+func (mw loggingMiddleware) GetLimits(ctx context.Context) (l ServiceLimits, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "GetLimits", "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetLimits(ctx)
+}
+
+func (mw loggingMiddleware) BuildMetrics(ctx context.Context, window time.Duration) (m MetricsSummary, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "BuildMetrics", "window", window, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.BuildMetrics(ctx, window)
+}
+
+func (mw loggingMiddleware) FindSucceededByFingerprint(ctx context.Context, fp string) (b Build, found bool, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "FindSucceededByFingerprint", "fingerprint", fp, "found", found, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.FindSucceededByFingerprint(ctx, fp)
+}
+
+func (mw loggingMiddleware) SetOutput(ctx context.Context, id, key, value string) (err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "SetOutput", "id", id, "key", key, "bytes", len(value), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.SetOutput(ctx, id, key, value)
+}
+
+func (mw loggingMiddleware) GetOutput(ctx context.Context, id, key string) (value string, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "GetOutput", "id", id, "key", key, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetOutput(ctx, id, key)
+}
+
+func (mw loggingMiddleware) ListBuildsByGroup(ctx context.Context, groupID string) (builds []Build, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "ListBuildsByGroup", "group", groupID, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ListBuildsByGroup(ctx, groupID)
+}
+
+func (mw loggingMiddleware) CancelGroup(ctx context.Context, groupID string) (cancelled int, err error) {
+	defer func(begin time.Time) {
+		level.Info(mw.logger).Log("method", "CancelGroup", "group", groupID, "cancelled", cancelled, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.CancelGroup(ctx, groupID)
+}
+
+func (mw loggingMiddleware) GroupStatus(ctx context.Context, groupID string) (sum GroupSummary, err error) {
+	defer func(begin time.Time) {
+		level.Debug(mw.logger).Log("method", "GroupStatus", "group", groupID, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GroupStatus(ctx, groupID)
+}
+
+// redact returns a copy of labels that is safe to log.
+func (mw loggingMiddleware) redact(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+		lk := strings.ToLower(k)
+		for _, rk := range mw.redactKeys {
+			if strings.Contains(lk, rk) {
+				out[k] = RedactedValue
+				break
+			}
+		}
+	}
+	return out
+}
+
+// ErrInternal is returned in place of a panic recovered from the service.
+var ErrInternal = errors.New("internal error")
+
+// RecoveringMiddleware turns a panic in any service method into ErrInternal,
+// so one bad request can't take the process down. The panic value and stack
+// trace are logged with the request ID, and panics is incremented with a
+// "method" label.
+func RecoveringMiddleware(logger log.Logger, panics metrics.Counter) Middleware {
+	return func(next Service) Service {
+		return &recoveringMiddleware{
+			next:   next,
+			logger: logger,
+			panics: panics,
+		}
+	}
+}
+
+type recoveringMiddleware struct {
+	next   Service
+	logger log.Logger
+	panics metrics.Counter
+}
+
+// recover must be deferred directly by each method.
+func (mw recoveringMiddleware) recover(ctx context.Context, method string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	mw.panics.With("method", method).Add(1)
+	level.Error(mw.logger).Log("method", method, "request_id", RequestIDFromContext(ctx), "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+	*err = ErrInternal
+}
+
+func (mw recoveringMiddleware) PostBuild(ctx context.Context, b Build) (err error) {
+	defer mw.recover(ctx, "PostBuild", &err)
+	return mw.next.PostBuild(ctx, b)
+}
+
+func (mw recoveringMiddleware) GetBuild(ctx context.Context, id string) (b Build, err error) {
+	defer mw.recover(ctx, "GetBuild", &err)
+	return mw.next.GetBuild(ctx, id)
+}
+
+func (mw recoveringMiddleware) ListBuilds(ctx context.Context, opts ListOptions) (builds []Build, err error) {
+	defer mw.recover(ctx, "ListBuilds", &err)
+	return mw.next.ListBuilds(ctx, opts)
+}
+
+func (mw recoveringMiddleware) PutBuild(ctx context.Context, id string, b Build) (err error) {
+	defer mw.recover(ctx, "PutBuild", &err)
+	return mw.next.PutBuild(ctx, id, b)
+}
+
+func (mw recoveringMiddleware) PatchBuild(ctx context.Context, id string, b Build) (err error) {
+	defer mw.recover(ctx, "PatchBuild", &err)
+	return mw.next.PatchBuild(ctx, id, b)
+}
+
+func (mw recoveringMiddleware) DeleteBuild(ctx context.Context, id string) (err error) {
+	defer mw.recover(ctx, "DeleteBuild", &err)
+	return mw.next.DeleteBuild(ctx, id)
+}
+
+func (mw recoveringMiddleware) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (n int64, err error) {
+	defer mw.recover(ctx, "AppendBuildLogs", &err)
+	return mw.next.AppendBuildLogs(ctx, id, offset, p)
+}
+
+func (mw recoveringMiddleware) GetBuildLogLength(ctx context.Context, id string) (n int64, err error) {
+	defer mw.recover(ctx, "GetBuildLogLength", &err)
+	return mw.next.GetBuildLogLength(ctx, id)
+}
+
+func (mw recoveringMiddleware) ValidateBuild(ctx context.Context, b Build) (problems ValidationErrors, err error) {
+	defer mw.recover(ctx, "ValidateBuild", &err)
+	return mw.next.ValidateBuild(ctx, b)
+}
+
+func (mw recoveringMiddleware) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (b Build, ok bool, err error) {
+	defer mw.recover(ctx, "LeaseBuild", &err)
+	return mw.next.LeaseBuild(ctx, workerID, ttl)
+}
+
+func (mw recoveringMiddleware) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (b Build, ok bool, err error) {
+	defer mw.recover(ctx, "ClaimAndStart", &err)
+	return mw.next.ClaimAndStart(ctx, workerID, filter)
+}
+
+func (mw recoveringMiddleware) ForceReleaseLease(ctx context.Context, id string) (err error) {
+	defer mw.recover(ctx, "ForceReleaseLease", &err)
+	return mw.next.ForceReleaseLease(ctx, id)
+}
+
+func (mw recoveringMiddleware) QueuePosition(ctx context.Context, id string) (position int, wait time.Duration, err error) {
+	defer mw.recover(ctx, "QueuePosition", &err)
+	return mw.next.QueuePosition(ctx, id)
+}
+
+func (mw recoveringMiddleware) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (ok bool, err error) {
+	defer mw.recover(ctx, "CompareAndSetStatus", &err)
+	return mw.next.CompareAndSetStatus(ctx, id, expected, next)
+}
+
+func (mw recoveringMiddleware) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (ok bool, err error) {
+	defer mw.recover(ctx, "CompareAndDeleteBuild", &err)
+	return mw.next.CompareAndDeleteBuild(ctx, id, updatedAt)
+}
+
+func (mw recoveringMiddleware) GetBuilds(ctx context.Context, ids []string) (found map[string]Build, missing []string, err error) {
+	defer mw.recover(ctx, "GetBuilds", &err)
+	return mw.next.GetBuilds(ctx, ids)
+}
+
+func (mw recoveringMiddleware) ListBuildStatuses(ctx context.Context, ids []string) (statuses map[string]BuildStatus, err error) {
+	defer mw.recover(ctx, "ListBuildStatuses", &err)
+	return mw.next.ListBuildStatuses(ctx, ids)
+}
+
+func (mw recoveringMiddleware) ReserveID(ctx context.Context, prefix string) (id string, err error) {
+	defer mw.recover(ctx, "ReserveID", &err)
+	return mw.next.ReserveID(ctx, prefix)
+}
+
+func (mw recoveringMiddleware) RerunFailedSteps(ctx context.Context, id string) (b Build, err error) {
+	defer mw.recover(ctx, "RerunFailedSteps", &err)
+	return mw.next.RerunFailedSteps(ctx, id)
+}
+
+func (mw recoveringMiddleware) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) (builds []Build, err error) {
+	defer mw.recover(ctx, "ListBuildsModifiedBetween", &err)
+	return mw.next.ListBuildsModifiedBetween(ctx, from, to)
+}
+
+func (mw recoveringMiddleware) FailBuild(ctx context.Context, id, reason string, exitCode int) (err error) {
+	defer mw.recover(ctx, "FailBuild", &err)
+	return mw.next.FailBuild(ctx, id, reason, exitCode)
+}
+
+func (mw recoveringMiddleware) RenameBuild(ctx context.Context, oldID, newID string) (err error) {
+	defer mw.recover(ctx, "RenameBuild", &err)
+	return mw.next.RenameBuild(ctx, oldID, newID)
+}
+
+func (mw recoveringMiddleware) GetOrCreateBuild(ctx context.Context, b Build) (got Build, created bool, err error) {
+	defer mw.recover(ctx, "GetOrCreateBuild", &err)
+	return mw.next.GetOrCreateBuild(ctx, b)
+}
+
+func (mw recoveringMiddleware) ListLabelKeys(ctx context.Context) (keys []string, err error) {
+	defer mw.recover(ctx, "ListLabelKeys", &err)
+	return mw.next.ListLabelKeys(ctx)
+}
+
+func (mw recoveringMiddleware) ListLabelValues(ctx context.Context, key string) (values []string, err error) {
+	defer mw.recover(ctx, "ListLabelValues", &err)
+	return mw.next.ListLabelValues(ctx, key)
+}
+
+func (mw recoveringMiddleware) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) (results []BatchResult, err error) {
+	defer mw.recover(ctx, "PatchBuilds", &err)
+	return mw.next.PatchBuilds(ctx, ids, patch)
+}
+
+func (mw recoveringMiddleware) BatchPostBuilds(ctx context.Context, builds []Build) (results []BatchResult, err error) {
+	defer mw.recover(ctx, "BatchPostBuilds", &err)
+	return mw.next.BatchPostBuilds(ctx, builds)
+}
+
+func (mw recoveringMiddleware) FindBuildsBySpecHash(ctx context.Context, hash string) (builds []Build, err error) {
+	defer mw.recover(ctx, "FindBuildsBySpecHash", &err)
+	return mw.next.FindBuildsBySpecHash(ctx, hash)
+}
+
+func (mw recoveringMiddleware) GetBuildLogs(ctx context.Context, id string, step int, from int64) (p []byte, err error) {
+	defer mw.recover(ctx, "GetBuildLogs", &err)
+	return mw.next.GetBuildLogs(ctx, id, step, from)
+}
+
+func (mw recoveringMiddleware) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) (err error) {
+	defer mw.recover(ctx, "ReplayBuild", &err)
+	return mw.next.ReplayBuild(ctx, id, sink)
+}
+
+func (mw recoveringMiddleware) GetLimits(ctx context.Context) (l ServiceLimits, err error) {
+	defer mw.recover(ctx, "GetLimits", &err)
+	return mw.next.GetLimits(ctx)
+}
+
+func (mw recoveringMiddleware) BuildMetrics(ctx context.Context, window time.Duration) (m MetricsSummary, err error) {
+	defer mw.recover(ctx, "BuildMetrics", &err)
+	return mw.next.BuildMetrics(ctx, window)
+}
+
+func (mw recoveringMiddleware) FindSucceededByFingerprint(ctx context.Context, fp string) (b Build, found bool, err error) {
+	defer mw.recover(ctx, "FindSucceededByFingerprint", &err)
+	return mw.next.FindSucceededByFingerprint(ctx, fp)
+}
+
+func (mw recoveringMiddleware) SetOutput(ctx context.Context, id, key, value string) (err error) {
+	defer mw.recover(ctx, "SetOutput", &err)
+	return mw.next.SetOutput(ctx, id, key, value)
+}
+
+func (mw recoveringMiddleware) GetOutput(ctx context.Context, id, key string) (value string, err error) {
+	defer mw.recover(ctx, "GetOutput", &err)
+	return mw.next.GetOutput(ctx, id, key)
+}
+
+func (mw recoveringMiddleware) ListBuildsByGroup(ctx context.Context, groupID string) (builds []Build, err error) {
+	defer mw.recover(ctx, "ListBuildsByGroup", &err)
+	return mw.next.ListBuildsByGroup(ctx, groupID)
+}
+
+func (mw recoveringMiddleware) CancelGroup(ctx context.Context, groupID string) (cancelled int, err error) {
+	defer mw.recover(ctx, "CancelGroup", &err)
+	return mw.next.CancelGroup(ctx, groupID)
+}
+
+func (mw recoveringMiddleware) GroupStatus(ctx context.Context, groupID string) (sum GroupSummary, err error) {
+	defer mw.recover(ctx, "GroupStatus", &err)
+	return mw.next.GroupStatus(ctx, groupID)
+}
+
+// InstrumentingMiddleware observes the latency of every service method in
+// latency, labelled by "method" and "error" ("true" or "false"). When the
+// context carries a trace ID, as recorded by WithTraceID, the observation
+// gets an exemplar linking it to the trace; otherwise it's a plain
+// observation. Exemplars are only exposed when /metrics serves the
+// OpenMetrics format.
+//
+// In HTTP servers the trace ID is recorded by a ServerBefore func, so it's
+// in the context before any service middleware runs. A tracing middleware
+// that starts spans itself must wrap outside this one, so the span exists
+// when the observation is made:
+//
+//	s = InstrumentingMiddleware(latency)(s)
+//	s = tracingMiddleware(s)
+func InstrumentingMiddleware(latency stdprometheus.ObserverVec) Middleware {
+	return func(next Service) Service {
+		return &instrumentingMiddleware{
+			next:    next,
+			latency: latency,
+		}
+	}
+}
+
+type instrumentingMiddleware struct {
+	next    Service
+	latency stdprometheus.ObserverVec
+}
+
+func (mw instrumentingMiddleware) observe(ctx context.Context, method string, begin time.Time, err *error) {
+	o := mw.latency.WithLabelValues(method, fmt.Sprint(*err != nil))
+	took := time.Since(begin).Seconds()
+	if TraceSampledFromContext(ctx) {
+		if eo, ok := o.(stdprometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(took, stdprometheus.Labels{"trace_id": TraceIDFromContext(ctx)})
+			return
+		}
+	}
+	o.Observe(took)
+}
+
+func (mw instrumentingMiddleware) PostBuild(ctx context.Context, b Build) (err error) {
+	defer mw.observe(ctx, "PostBuild", time.Now(), &err)
+	return mw.next.PostBuild(ctx, b)
+}
+
+func (mw instrumentingMiddleware) GetBuild(ctx context.Context, id string) (b Build, err error) {
+	defer mw.observe(ctx, "GetBuild", time.Now(), &err)
+	return mw.next.GetBuild(ctx, id)
+}
+
+func (mw instrumentingMiddleware) ListBuilds(ctx context.Context, opts ListOptions) (builds []Build, err error) {
+	defer mw.observe(ctx, "ListBuilds", time.Now(), &err)
+	return mw.next.ListBuilds(ctx, opts)
+}
+
+func (mw instrumentingMiddleware) PutBuild(ctx context.Context, id string, b Build) (err error) {
+	defer mw.observe(ctx, "PutBuild", time.Now(), &err)
+	return mw.next.PutBuild(ctx, id, b)
+}
+
+func (mw instrumentingMiddleware) PatchBuild(ctx context.Context, id string, b Build) (err error) {
+	defer mw.observe(ctx, "PatchBuild", time.Now(), &err)
+	return mw.next.PatchBuild(ctx, id, b)
+}
+
+func (mw instrumentingMiddleware) DeleteBuild(ctx context.Context, id string) (err error) {
+	defer mw.observe(ctx, "DeleteBuild", time.Now(), &err)
+	return mw.next.DeleteBuild(ctx, id)
+}
+
+func (mw instrumentingMiddleware) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (n int64, err error) {
+	defer mw.observe(ctx, "AppendBuildLogs", time.Now(), &err)
+	return mw.next.AppendBuildLogs(ctx, id, offset, p)
+}
+
+func (mw instrumentingMiddleware) GetBuildLogLength(ctx context.Context, id string) (n int64, err error) {
+	defer mw.observe(ctx, "GetBuildLogLength", time.Now(), &err)
+	return mw.next.GetBuildLogLength(ctx, id)
+}
+
+func (mw instrumentingMiddleware) ValidateBuild(ctx context.Context, b Build) (problems ValidationErrors, err error) {
+	defer mw.observe(ctx, "ValidateBuild", time.Now(), &err)
+	return mw.next.ValidateBuild(ctx, b)
+}
+
+func (mw instrumentingMiddleware) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (b Build, ok bool, err error) {
+	defer mw.observe(ctx, "LeaseBuild", time.Now(), &err)
+	return mw.next.LeaseBuild(ctx, workerID, ttl)
+}
+
+func (mw instrumentingMiddleware) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (b Build, ok bool, err error) {
+	defer mw.observe(ctx, "ClaimAndStart", time.Now(), &err)
+	return mw.next.ClaimAndStart(ctx, workerID, filter)
+}
+
+func (mw instrumentingMiddleware) ForceReleaseLease(ctx context.Context, id string) (err error) {
+	defer mw.observe(ctx, "ForceReleaseLease", time.Now(), &err)
+	return mw.next.ForceReleaseLease(ctx, id)
+}
+
+func (mw instrumentingMiddleware) QueuePosition(ctx context.Context, id string) (position int, wait time.Duration, err error) {
+	defer mw.observe(ctx, "QueuePosition", time.Now(), &err)
+	return mw.next.QueuePosition(ctx, id)
+}
+
+func (mw instrumentingMiddleware) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (ok bool, err error) {
+	defer mw.observe(ctx, "CompareAndSetStatus", time.Now(), &err)
+	return mw.next.CompareAndSetStatus(ctx, id, expected, next)
+}
+
+func (mw instrumentingMiddleware) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (ok bool, err error) {
+	defer mw.observe(ctx, "CompareAndDeleteBuild", time.Now(), &err)
+	return mw.next.CompareAndDeleteBuild(ctx, id, updatedAt)
+}
+
+func (mw instrumentingMiddleware) GetBuilds(ctx context.Context, ids []string) (found map[string]Build, missing []string, err error) {
+	defer mw.observe(ctx, "GetBuilds", time.Now(), &err)
+	return mw.next.GetBuilds(ctx, ids)
+}
+
+func (mw instrumentingMiddleware) ListBuildStatuses(ctx context.Context, ids []string) (statuses map[string]BuildStatus, err error) {
+	defer mw.observe(ctx, "ListBuildStatuses", time.Now(), &err)
+	return mw.next.ListBuildStatuses(ctx, ids)
+}
+
+func (mw instrumentingMiddleware) ReserveID(ctx context.Context, prefix string) (id string, err error) {
+	defer mw.observe(ctx, "ReserveID", time.Now(), &err)
+	return mw.next.ReserveID(ctx, prefix)
+}
+
+func (mw instrumentingMiddleware) RerunFailedSteps(ctx context.Context, id string) (b Build, err error) {
+	defer mw.observe(ctx, "RerunFailedSteps", time.Now(), &err)
+	return mw.next.RerunFailedSteps(ctx, id)
+}
+
+func (mw instrumentingMiddleware) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) (builds []Build, err error) {
+	defer mw.observe(ctx, "ListBuildsModifiedBetween", time.Now(), &err)
+	return mw.next.ListBuildsModifiedBetween(ctx, from, to)
+}
+
+func (mw instrumentingMiddleware) FailBuild(ctx context.Context, id, reason string, exitCode int) (err error) {
+	defer mw.observe(ctx, "FailBuild", time.Now(), &err)
+	return mw.next.FailBuild(ctx, id, reason, exitCode)
+}
+
+func (mw instrumentingMiddleware) RenameBuild(ctx context.Context, oldID, newID string) (err error) {
+	defer mw.observe(ctx, "RenameBuild", time.Now(), &err)
+	return mw.next.RenameBuild(ctx, oldID, newID)
+}
+
+func (mw instrumentingMiddleware) GetOrCreateBuild(ctx context.Context, b Build) (got Build, created bool, err error) {
+	defer mw.observe(ctx, "GetOrCreateBuild", time.Now(), &err)
+	return mw.next.GetOrCreateBuild(ctx, b)
+}
+
+func (mw instrumentingMiddleware) ListLabelKeys(ctx context.Context) (keys []string, err error) {
+	defer mw.observe(ctx, "ListLabelKeys", time.Now(), &err)
+	return mw.next.ListLabelKeys(ctx)
+}
+
+func (mw instrumentingMiddleware) ListLabelValues(ctx context.Context, key string) (values []string, err error) {
+	defer mw.observe(ctx, "ListLabelValues", time.Now(), &err)
+	return mw.next.ListLabelValues(ctx, key)
+}
+
+func (mw instrumentingMiddleware) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) (results []BatchResult, err error) {
+	defer mw.observe(ctx, "PatchBuilds", time.Now(), &err)
+	return mw.next.PatchBuilds(ctx, ids, patch)
+}
+
+func (mw instrumentingMiddleware) BatchPostBuilds(ctx context.Context, builds []Build) (results []BatchResult, err error) {
+	defer mw.observe(ctx, "BatchPostBuilds", time.Now(), &err)
+	return mw.next.BatchPostBuilds(ctx, builds)
+}
+
+func (mw instrumentingMiddleware) FindBuildsBySpecHash(ctx context.Context, hash string) (builds []Build, err error) {
+	defer mw.observe(ctx, "FindBuildsBySpecHash", time.Now(), &err)
+	return mw.next.FindBuildsBySpecHash(ctx, hash)
+}
+
+func (mw instrumentingMiddleware) GetBuildLogs(ctx context.Context, id string, step int, from int64) (p []byte, err error) {
+	defer mw.observe(ctx, "GetBuildLogs", time.Now(), &err)
+	return mw.next.GetBuildLogs(ctx, id, step, from)
+}
+
+func (mw instrumentingMiddleware) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) (err error) {
+	defer mw.observe(ctx, "ReplayBuild", time.Now(), &err)
+	return mw.next.ReplayBuild(ctx, id, sink)
+}
+
+func (mw instrumentingMiddleware) GetLimits(ctx context.Context) (l ServiceLimits, err error) {
+	defer mw.observe(ctx, "GetLimits", time.Now(), &err)
+	return mw.next.GetLimits(ctx)
+}
+
+func (mw instrumentingMiddleware) BuildMetrics(ctx context.Context, window time.Duration) (m MetricsSummary, err error) {
+	defer mw.observe(ctx, "BuildMetrics", time.Now(), &err)
+	return mw.next.BuildMetrics(ctx, window)
+}
+
+func (mw instrumentingMiddleware) FindSucceededByFingerprint(ctx context.Context, fp string) (b Build, found bool, err error) {
+	defer mw.observe(ctx, "FindSucceededByFingerprint", time.Now(), &err)
+	return mw.next.FindSucceededByFingerprint(ctx, fp)
+}
+
+func (mw instrumentingMiddleware) SetOutput(ctx context.Context, id, key, value string) (err error) {
+	defer mw.observe(ctx, "SetOutput", time.Now(), &err)
+	return mw.next.SetOutput(ctx, id, key, value)
+}
+
+func (mw instrumentingMiddleware) GetOutput(ctx context.Context, id, key string) (value string, err error) {
+	defer mw.observe(ctx, "GetOutput", time.Now(), &err)
+	return mw.next.GetOutput(ctx, id, key)
+}
+
+func (mw instrumentingMiddleware) ListBuildsByGroup(ctx context.Context, groupID string) (builds []Build, err error) {
+	defer mw.observe(ctx, "ListBuildsByGroup", time.Now(), &err)
+	return mw.next.ListBuildsByGroup(ctx, groupID)
+}
+
+func (mw instrumentingMiddleware) CancelGroup(ctx context.Context, groupID string) (cancelled int, err error) {
+	defer mw.observe(ctx, "CancelGroup", time.Now(), &err)
+	return mw.next.CancelGroup(ctx, groupID)
+}
+
+func (mw instrumentingMiddleware) GroupStatus(ctx context.Context, groupID string) (sum GroupSummary, err error) {
+	defer mw.observe(ctx, "GroupStatus", time.Now(), &err)
+	return mw.next.GroupStatus(ctx, groupID)
+}
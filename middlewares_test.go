@@ -0,0 +1,83 @@
+package gokitbuildservice_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+// methodCounter counts by its "method" label.
+type methodCounter struct {
+	counts map[string]float64
+	method string
+}
+
+func (c *methodCounter) With(labelValues ...string) metrics.Counter {
+	for i := 0; i+1 < len(labelValues); i += 2 {
+		if labelValues[i] == "method" {
+			return &methodCounter{counts: c.counts, method: labelValues[i+1]}
+		}
+	}
+	return c
+}
+
+func (c *methodCounter) Add(delta float64) { c.counts[c.method] += delta }
+
+func TestRecoveringMiddleware(t *testing.T) {
+	fake := &servicetest.FakeService{
+		GetBuildFunc: func(ctx context.Context, id string) (gokitbuildservice.Build, error) {
+			if id == "bad" {
+				panic("nil map in " + id)
+			}
+			return gokitbuildservice.Build{ID: id}, nil
+		},
+		ReplayBuildFunc: func(ctx context.Context, id string, sink func(gokitbuildservice.BuildEvent) error) error {
+			var events []gokitbuildservice.BuildEvent
+			return sink(events[1]) // index out of range
+		},
+	}
+	var logs bytes.Buffer
+	panics := &methodCounter{counts: map[string]float64{}}
+	s := gokitbuildservice.RecoveringMiddleware(log.NewLogfmtLogger(&logs), panics)(fake)
+	ctx := gokitbuildservice.WithRequestID(context.Background(), "req-42")
+
+	if _, err := s.GetBuild(ctx, "bad"); err != gokitbuildservice.ErrInternal {
+		t.Errorf("panicking GetBuild: got %v, want ErrInternal", err)
+	}
+	if err := s.ReplayBuild(ctx, "b1", func(gokitbuildservice.BuildEvent) error { return nil }); err != gokitbuildservice.ErrInternal {
+		t.Errorf("panicking ReplayBuild: got %v, want ErrInternal", err)
+	}
+	if b, err := s.GetBuild(ctx, "good"); err != nil || b.ID != "good" {
+		t.Errorf("GetBuild after a panic: got %+v, %v", b, err)
+	}
+	if got := panics.counts; len(got) != 2 || got["GetBuild"] != 1 || got["ReplayBuild"] != 1 {
+		t.Errorf("panics counted: got %v, want one each for GetBuild and ReplayBuild", got)
+	}
+	for _, want := range []string{"method=GetBuild", "request_id=req-42", `panic="nil map in bad"`, "method=ReplayBuild", "stack="} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log doesn't have %s:\n%s", want, logs.String())
+		}
+	}
+
+	srv := httptest.NewServer(gokitbuildservice.MakeHTTPHandler(s, log.NewNopLogger()))
+	defer srv.Close()
+	for path, want := range map[string]int{"/builds/bad": http.StatusInternalServerError, "/builds/good": http.StatusOK} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: got %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package gokitbuildservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// Notifier tells someone, such as a chat channel or an on-call pager, that
+// a build finished. e is the BuildFinished event, carrying the build in its
+// terminal status.
+type Notifier interface {
+	Notify(ctx context.Context, e BuildEvent) error
+}
+
+// NotifierOption configures a NotifierRegistry.
+type NotifierOption func(*NotifierRegistry)
+
+// WithNotifyTimeout bounds each call to Notify. The default is ten seconds.
+func WithNotifyTimeout(d time.Duration) NotifierOption {
+	return func(r *NotifierRegistry) { r.timeout = d }
+}
+
+// WithNotifierMetrics counts successful and failed notifications, labelled
+// by "notifier" name.
+func WithNotifierMetrics(sent, failed metrics.Counter) NotifierOption {
+	return func(r *NotifierRegistry) { r.sent, r.failed = sent, failed }
+}
+
+// NotifierRegistry fans finished builds out to every registered Notifier.
+type NotifierRegistry struct {
+	logger  log.Logger
+	timeout time.Duration
+	sent    metrics.Counter
+	failed  metrics.Counter
+
+	mtx       sync.RWMutex
+	notifiers map[string]Notifier
+	wg        sync.WaitGroup
+}
+
+// NewNotifierRegistry returns a registry with no notifiers, logging their
+// failures to logger.
+func NewNotifierRegistry(logger log.Logger, opts ...NotifierOption) *NotifierRegistry {
+	r := &NotifierRegistry{
+		logger:    logger,
+		timeout:   10 * time.Second,
+		sent:      discard.NewCounter(),
+		failed:    discard.NewCounter(),
+		notifiers: map[string]Notifier{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Register starts notifying n, under name, of finished builds. It replaces
+// any notifier already registered under name.
+func (r *NotifierRegistry) Register(name string, n Notifier) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.notifiers[name] = n
+}
+
+// Unregister stops notifying the notifier registered under name.
+func (r *NotifierRegistry) Unregister(name string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.notifiers, name)
+}
+
+// Run notifies of every BuildFinished event until the channel is closed or
+// ctx is done, then waits for notifications in flight. Each notifier is
+// called in its own goroutine, so a slow or failing one never holds up the
+// others, and none of them can hold up or fail the mutation that finished
+// the build. Failures, panics included, are logged and counted.
+func (r *NotifierRegistry) Run(ctx context.Context, events <-chan BuildEvent) {
+	defer r.wg.Wait()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Type == BuildFinished {
+				r.dispatch(ctx, e)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *NotifierRegistry) dispatch(ctx context.Context, e BuildEvent) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for name, n := range r.notifiers {
+		r.wg.Add(1)
+		go func(name string, n Notifier) {
+			defer r.wg.Done()
+			if err := r.notify(ctx, n, e); err != nil {
+				r.failed.With("notifier", name).Add(1)
+				level.Error(r.logger).Log("notifier", name, "event", e.ID, "build", e.Build.ID, "err", err)
+				return
+			}
+			r.sent.With("notifier", name).Add(1)
+		}(name, n)
+	}
+}
+
+// notify calls n under the timeout, turning a panic into an error.
+func (r *NotifierRegistry) notify(ctx context.Context, n Notifier, e BuildEvent) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("notifier panicked: %v", p)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return n.Notify(ctx, e)
+}
+
+// SlackNotifier posts a message about each finished build to a Slack
+// incoming webhook.
+type SlackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewSlackNotifier returns a SlackNotifier posting to webhookURL.
+func NewSlackNotifier(webhookURL string) *SlackNotifier {
+	return &SlackNotifier{url: webhookURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify posts e's build, status, and failure reason if any.
+func (n *SlackNotifier) Notify(ctx context.Context, e BuildEvent) error {
+	b := e.Build
+	text := fmt.Sprintf("Build %s %s", b.ID, b.Status)
+	if b.Name != "" {
+		text = fmt.Sprintf("Build %s (%s) %s", b.ID, b.Name, b.Status)
+	}
+	if b.FailureReason != "" {
+		text += ": " + b.FailureReason
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("slack responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"fmt"
+)
+
+// SetOutput stores value as the output key of build id, replacing any
+// output already under key. Outputs are for small results, such as a
+// version string; a value over the service's MaxOutputBytes is rejected
+// with ErrValidation. They can be set whatever the build's status.
+func (s *buildService) SetOutput(ctx context.Context, id, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	prev, err := s.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	b := prev
+	b.Outputs = make(map[string]string, len(prev.Outputs)+1)
+	for k, v := range prev.Outputs {
+		b.Outputs[k] = v
+	}
+	b.Outputs[key] = value
+	if errs := b.ValidateWithin(s.limits); errs != nil {
+		return errs
+	}
+	_, err = s.save(ctx, BuildUpdated, prev, b)
+	return err
+}
+
+// GetOutput returns the output key of build id. A build without such an
+// output is ErrNotFound, as is a missing build.
+func (s *buildService) GetOutput(ctx context.Context, id, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	b, err := s.lookup(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	value, ok := b.Outputs[key]
+	if !ok {
+		return "", fmt.Errorf("%w: build has no output %q", ErrNotFound, key)
+	}
+	return value, nil
+}
@@ -0,0 +1,115 @@
+package gokitbuildservice_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+)
+
+func TestOutputs(t *testing.T) {
+	ctx := context.Background()
+	s := gokitbuildservice.NewInmemService()
+	if err := s.PostBuild(ctx, gokitbuildservice.Build{ID: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	max := gokitbuildservice.DefaultLimits.MaxOutputBytes
+
+	if err := s.SetOutput(ctx, "b1", "version", "1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOutput(ctx, "b1", "version", "1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.GetOutput(ctx, "b1", "version"); err != nil || v != "1.1" {
+		t.Errorf("got %q, %v; want the value set last", v, err)
+	}
+	if err := s.SetOutput(ctx, "b1", "full", strings.Repeat("x", max)); err != nil {
+		t.Errorf("value at the limit: %v", err)
+	}
+	if err := s.SetOutput(ctx, "b1", "big", strings.Repeat("x", max+1)); !errors.Is(err, gokitbuildservice.ErrValidation) {
+		t.Errorf("value over the limit: got %v, want ErrValidation", err)
+	}
+	if _, err := s.GetOutput(ctx, "b1", "big"); !errors.Is(err, gokitbuildservice.ErrNotFound) {
+		t.Errorf("rejected value was stored: %v", err)
+	}
+	if _, err := s.GetOutput(ctx, "b1", "missing"); !errors.Is(err, gokitbuildservice.ErrNotFound) {
+		t.Errorf("unknown key: got %v, want ErrNotFound", err)
+	}
+	if err := s.SetOutput(ctx, "nope", "k", "v"); !errors.Is(err, gokitbuildservice.ErrNotFound) {
+		t.Errorf("unknown build: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestOutputsOverHTTP(t *testing.T) {
+	s := gokitbuildservice.NewInmemService()
+	if err := s.PostBuild(context.Background(), gokitbuildservice.Build{ID: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gokitbuildservice.MakeHTTPHandler(s, log.NewNopLogger()))
+	defer srv.Close()
+	max := gokitbuildservice.DefaultLimits.MaxOutputBytes
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		p, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(p)
+	}
+
+	if code, _ := do("PUT", "/builds/b1/outputs/version", "1.2.3\n"); code != http.StatusOK {
+		t.Fatalf("PUT: got %d", code)
+	}
+	if code, body := do("GET", "/builds/b1/outputs/version", ""); code != http.StatusOK || body != "1.2.3\n" {
+		t.Errorf("GET: got %d %q, want the body as it was put", code, body)
+	}
+	if code, _ := do("GET", "/builds/b1/outputs/missing", ""); code != http.StatusNotFound {
+		t.Errorf("GET unknown key: got %d, want 404", code)
+	}
+	if code, _ := do("PUT", "/builds/nope/outputs/k", "v"); code != http.StatusNotFound {
+		t.Errorf("PUT unknown build: got %d, want 404", code)
+	}
+	for _, n := range []int{max + 1, max + 2, 1 << 20} {
+		code, body := do("PUT", "/builds/b1/outputs/big", strings.Repeat("x", n))
+		if code != http.StatusBadRequest || !strings.Contains(body, "outputs.big") {
+			t.Errorf("PUT of %d bytes: got %d %s, want a validation error", n, code, body)
+		}
+	}
+	if code, _ := do("GET", "/builds/b1/outputs/big", ""); code != http.StatusNotFound {
+		t.Errorf("oversized output was stored: got %d", code)
+	}
+}
+
+func TestOutputsOverHTTPWithRaisedLimit(t *testing.T) {
+	limits := gokitbuildservice.DefaultLimits
+	limits.MaxOutputBytes = 16 << 10
+	s := gokitbuildservice.NewInmemService(gokitbuildservice.WithLimits(limits))
+	if err := s.PostBuild(context.Background(), gokitbuildservice.Build{ID: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gokitbuildservice.MakeHTTPHandler(s, log.NewNopLogger(),
+		gokitbuildservice.WithMaxOutputBytes(limits.MaxOutputBytes),
+	))
+	defer srv.Close()
+	req, _ := http.NewRequest("PUT", srv.URL+"/builds/b1/outputs/k", strings.NewReader(strings.Repeat("x", 8<<10)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("8 KiB under a 16 KiB limit: got %s", resp.Status)
+	}
+}
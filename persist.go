@@ -0,0 +1,448 @@
+package gokitbuildservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WithPersistence makes the in-memory store durable across restarts. Every
+// mutation is appended to a write-ahead log in dir before it's applied, and
+// the log is compacted into a snapshot once it grows long enough, and on
+// startup. OpenInmemService loads the latest snapshot and replays the log
+// written since.
+//
+// Durability depends on flushInterval. Each record is written to the file
+// before the mutation returns, so a crashed process loses nothing. If
+// flushInterval is zero the file is also fsynced on every write, and nothing
+// acknowledged is lost when the machine goes down either; otherwise it's
+// fsynced every flushInterval, which is much cheaper but can lose up to that
+// much of the most recent writes on power loss or a kernel crash. A torn
+// record at the end of the log is discarded on load.
+//
+// Builds are written with their schema version, and upgraded on load with
+// the upgrades registered with RegisterSchemaUpgrade. Fields the running
+// version doesn't know are kept and written back with the build.
+//
+// Only one process may use dir at a time.
+func WithPersistence(dir string, flushInterval time.Duration) InmemOption {
+	return func(s *buildService) {
+		s.wal = &wal{dir: dir, interval: flushInterval, compactAfter: defaultCompactAfter}
+	}
+}
+
+// defaultCompactAfter is how many log records are written between
+// compactions.
+const defaultCompactAfter = 10000
+
+type walOp string
+
+const (
+	walPut    walOp = "put"
+	walDelete walOp = "delete"
+	walLogs   walOp = "logs"
+)
+
+// walRecord is one line of the write-ahead log. A put carries the whole
+// build, and the build's logs when it comes from Restore.
+type walRecord struct {
+	Op     walOp  `json:"op"`
+	ID     string `json:"id,omitempty"`
+	Build  *Build `json:"build,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+
+	// Steps are the logSegments of Data, for walLogs and walPut.
+	Steps []logSegment `json:"steps,omitempty"`
+}
+
+// wal is the on-disk state of a persistent in-memory service: a sequence of
+// generations, each a snapshot-<gen> of the store as of the start of
+// wal-<gen>, plus the records appended to it. Older generations are removed
+// once a newer snapshot is safely on disk.
+type wal struct {
+	dir          string
+	interval     time.Duration
+	compactAfter int
+
+	mtx        sync.Mutex // guards f against the flusher
+	f          *os.File
+	gen        uint64
+	written    int // records since the last compaction
+	compacting bool
+	err        error // last compaction failure, reported by Close
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func (w *wal) walPath(gen uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("wal-%020d.log", gen))
+}
+
+func (w *wal) snapshotPath(gen uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("snapshot-%020d.ndjson.gz", gen))
+}
+
+// append writes rec to the current log file.
+func (w *wal) append(rec walRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	if _, err := w.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	w.written++
+	if w.interval == 0 {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+// rotate syncs and closes the current log file, and starts gen.
+func (w *wal) rotate(gen uint64) error {
+	f, err := os.OpenFile(w.walPath(gen), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.f != nil {
+		w.f.Sync()
+		w.f.Close()
+	}
+	w.f, w.gen, w.written = f, gen, 0
+	return nil
+}
+
+func (w *wal) flush() {
+	for {
+		select {
+		case <-time.After(w.interval):
+			w.mtx.Lock()
+			if w.f != nil {
+				w.f.Sync()
+			}
+			w.mtx.Unlock()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// persist appends rec to the write-ahead log, if there is one. When a
+// compaction is due it's started first, since the snapshot must not include
+// rec before rec is applied. It must be called with s.mtx held.
+func (s *buildService) persist(rec walRecord) error {
+	if s.wal == nil {
+		return nil
+	}
+	if s.wal.written >= s.wal.compactAfter && !s.wal.compacting {
+		if err := s.compact(); err != nil {
+			s.wal.err = err
+		}
+	}
+	return s.wal.append(rec)
+}
+
+// compact starts a new log generation and writes the snapshot it starts
+// from in the background. The store is copied under the lock, as in
+// Snapshot, so writers aren't held up by the I/O. It must be called with
+// s.mtx held.
+func (s *buildService) compact() error {
+	gen, taken, records, err := s.startCompaction(context.Background())
+	if err != nil {
+		return err
+	}
+	s.wal.wg.Add(1)
+	go func() {
+		defer s.wal.wg.Done()
+		err := s.wal.writeSnapshot(gen, taken, records)
+		s.mtx.Lock()
+		s.wal.compacting = false
+		s.wal.err = err
+		s.mtx.Unlock()
+	}()
+	return nil
+}
+
+// startCompaction copies the store and starts the log generation gen, for
+// the snapshot of records, taken at taken, to be written. It must be called
+// with s.mtx held, and until the snapshot is written s.wal.compacting is
+// set.
+func (s *buildService) startCompaction(ctx context.Context) (gen uint64, taken time.Time, records []snapshotRecord, err error) {
+	records, err = s.records(ctx)
+	if err != nil {
+		return 0, time.Time{}, nil, err
+	}
+	taken = s.clock.Now()
+	gen = s.wal.gen + 1
+	if err := s.wal.rotate(gen); err != nil {
+		return 0, time.Time{}, nil, err
+	}
+	s.wal.compacting = true
+	return gen, taken, records, nil
+}
+
+// records copies every stored build and its logs, ordered by ID. It must
+// be called with s.mtx held.
+func (s *buildService) records(ctx context.Context) ([]snapshotRecord, error) {
+	builds, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]snapshotRecord, 0, len(builds))
+	for _, b := range builds {
+		records = append(records, snapshotRecord{Build: b, Logs: s.logs[b.ID], LogSteps: s.logSteps[b.ID]})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Build.ID < records[j].Build.ID })
+	return records, nil
+}
+
+// writeSnapshot writes the snapshot for gen to a temporary file and renames
+// it into place, so a crash never leaves a partial snapshot behind. Only then
+// are the older generations removed.
+func (w *wal) writeSnapshot(gen uint64, taken time.Time, records []snapshotRecord) error {
+	path := w.snapshotPath(gen)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = writeSnapshot(context.Background(), bw, taken.UTC(), records)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if d, err := os.Open(w.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	snapshots, wals, err := w.generations()
+	if err != nil {
+		return err
+	}
+	for _, g := range snapshots {
+		if g < gen {
+			os.Remove(w.snapshotPath(g))
+		}
+	}
+	for _, g := range wals {
+		if g < gen {
+			os.Remove(w.walPath(g))
+		}
+	}
+	return nil
+}
+
+// generations lists the snapshot and log generations in dir, oldest first.
+func (w *wal) generations() (snapshots, wals []uint64, err error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		var gen uint64
+		var rest string
+		if n, _ := fmt.Sscanf(e.Name(), "snapshot-%d.%s", &gen, &rest); n == 2 && rest == "ndjson.gz" {
+			snapshots = append(snapshots, gen)
+		} else if n, _ := fmt.Sscanf(e.Name(), "wal-%d.%s", &gen, &rest); n == 2 && rest == "log" {
+			wals = append(wals, gen)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	sort.Slice(wals, func(i, j int) bool { return wals[i] < wals[j] })
+	return snapshots, wals, nil
+}
+
+// load rebuilds the store from dir, then compacts everything it read into a
+// fresh generation before any new writes are accepted.
+func (s *buildService) load() error {
+	w := s.wal
+	if err := os.MkdirAll(w.dir, 0o700); err != nil {
+		return err
+	}
+	snapshots, wals, err := w.generations()
+	if err != nil {
+		return err
+	}
+
+	var base uint64
+	if len(snapshots) > 0 {
+		base = snapshots[len(snapshots)-1]
+		if err := s.loadSnapshot(w.snapshotPath(base)); err != nil {
+			return err
+		}
+	}
+	last := base
+	for _, gen := range wals {
+		if gen < base {
+			continue
+		}
+		if err := s.replay(w.walPath(gen)); err != nil {
+			return err
+		}
+		last = gen
+	}
+
+	gen := last + 1
+	if err := w.rotate(gen); err != nil {
+		return err
+	}
+	records, err := s.records(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := w.writeSnapshot(gen, s.clock.Now(), records); err != nil {
+		return err
+	}
+	w.stop = make(chan struct{})
+	if w.interval > 0 {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.flush()
+		}()
+	}
+	return nil
+}
+
+func (s *buildService) loadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := readSnapshot(context.Background(), f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, rec := range records {
+		if err := s.restore(context.Background(), rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errBadLog is returned by replay for a log that's corrupt anywhere but its
+// last line.
+var errBadLog = errors.New("corrupt write-ahead log")
+
+func (s *buildService) replay(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for n := 1; len(data) > 0; n++ {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return nil // torn final write
+		}
+		line := data[:i]
+		data = data[i+1:]
+
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("%s:%d: %w: %v", path, n, errBadLog, err)
+		}
+		if err := s.apply(rec); err != nil {
+			return fmt.Errorf("%s:%d: %w: %v", path, n, errBadLog, err)
+		}
+	}
+	return nil
+}
+
+func (s *buildService) apply(rec walRecord) error {
+	switch rec.Op {
+	case walPut:
+		if rec.Build == nil {
+			return errors.New("put without build")
+		}
+		return s.restore(context.Background(), snapshotRecord{Build: *rec.Build, Logs: rec.Data, LogSteps: rec.Steps})
+	case walDelete:
+		ctx := context.Background()
+		stored, _, err := s.repo.Get(ctx, rec.ID)
+		if err != nil {
+			return err
+		}
+		if err := s.repo.Delete(ctx, rec.ID); err != nil {
+			return err
+		}
+		s.track(stored.Status, "")
+		s.link(stored, Build{})
+		delete(s.logs, rec.ID)
+		delete(s.logSteps, rec.ID)
+	case walLogs:
+		if rec.Offset != int64(len(s.logs[rec.ID])) {
+			return fmt.Errorf("logs for %q at offset %d, have %d bytes", rec.ID, rec.Offset, len(s.logs[rec.ID]))
+		}
+		s.appendLogs(rec.ID, rec.Data, rec.Steps)
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+	return nil
+}
+
+// Close stops the service's background work and, if it's persistent, syncs
+// its log to disk; later mutations then fail. It returns the last compaction error, if any;
+// the previous generation is kept in that case, so nothing is lost.
+func (s *buildService) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.janitor.Wait()
+
+	w := s.wal
+	if w == nil {
+		return nil
+	}
+	w.stopOnce.Do(func() { close(w.stop) })
+	w.wg.Wait()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.f == nil {
+		return w.err
+	}
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	if err == nil {
+		err = w.err
+	}
+	return err
+}
+
+var _ io.Closer = (*buildService)(nil)
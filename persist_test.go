@@ -0,0 +1,65 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStepLogsSurviveRestoreAndRestart(t *testing.T) {
+	ctx := context.Background()
+	src := NewInmemService()
+	b := Build{ID: "b1", Steps: []Step{{Name: "compile", Image: "golang", Status: StatusRunning}, {Name: "test", Image: "golang"}}}
+	if err := src.PostBuild(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.AppendBuildLogs(ctx, "b1", 0, []byte("compiling\n")); err != nil {
+		t.Fatal(err)
+	}
+	b.Steps[0].Status, b.Steps[1].Status = StatusSucceeded, StatusRunning
+	if err := src.PutBuild(ctx, "b1", b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.AppendBuildLogs(ctx, "b1", 10, []byte("testing\n")); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := src.(Snapshotter).Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	dir := t.TempDir()
+	open := func() Service {
+		t.Helper()
+		s, err := OpenInmemService(WithPersistence(dir, time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	dst := open()
+	if _, err := dst.(Snapshotter).Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	check := func(s Service, when string) {
+		t.Helper()
+		for step, want := range []string{"compiling\n", "testing\n"} {
+			got, err := s.GetBuildLogs(ctx, "b1", step, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("%s: step %d logs: got %q, want %q", when, step, got, want)
+			}
+		}
+	}
+	check(dst, "after Restore")
+	if err := dst.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	re := open()
+	defer re.(io.Closer).Close()
+	check(re, "after a restart")
+}
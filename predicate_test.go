@@ -0,0 +1,140 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// withListPredicates registers fns in place of whatever is registered, for
+// the duration of the test.
+func withListPredicates(t *testing.T, fns map[string]func(Build) bool) {
+	t.Helper()
+	predicatesMtx.Lock()
+	saved := predicates
+	predicates = map[string]func(Build) bool{}
+	predicatesMtx.Unlock()
+	t.Cleanup(func() {
+		predicatesMtx.Lock()
+		defer predicatesMtx.Unlock()
+		predicates = saved
+	})
+	for name, fn := range fns {
+		RegisterListPredicate(name, fn)
+	}
+}
+
+func TestListPredicate(t *testing.T) {
+	withListPredicates(t, map[string]func(Build) bool{
+		"named": func(b Build) bool { return b.Name != "" },
+	})
+	ctx := context.Background()
+	s := NewInmemService()
+	for _, b := range []Build{{ID: "a", Name: "alpha"}, {ID: "b"}, {ID: "c", Name: "gamma"}} {
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	builds, err := s.ListBuilds(ctx, ListOptions{SortBy: "id", Predicate: "named"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || builds[0].ID != "a" || builds[1].ID != "c" {
+		t.Errorf("got %v, want a and c", builds)
+	}
+	if _, err := s.ListBuilds(ctx, ListOptions{Predicate: "unknown"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("unknown predicate: got %v, want ErrValidation", err)
+	}
+}
+
+func TestListPredicateOverHTTP(t *testing.T) {
+	withListPredicates(t, map[string]func(Build) bool{
+		"named": func(b Build) bool { return b.Name != "" },
+	})
+	s := NewInmemService()
+	for _, b := range []Build{{ID: "a", Name: "alpha"}, {ID: "b"}} {
+		if err := s.PostBuild(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(MakeHTTPHandler(s, log.NewNopLogger()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/builds/?predicate=named")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Items []Build `json:"items"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || len(list.Items) != 1 || list.Items[0].ID != "a" {
+		t.Errorf("got %s with %v, %v; want only a", resp.Status, list.Items, err)
+	}
+
+	resp, err = http.Get(srv.URL + "/builds/?predicate=unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown predicate: got %s, want 400", resp.Status)
+	}
+}
+
+func TestListPredicatePanicRejectsTheBuild(t *testing.T) {
+	withListPredicates(t, map[string]func(Build) bool{
+		"fragile": func(b Build) bool {
+			if b.Labels["team"] == "" {
+				panic("no team")
+			}
+			return true
+		},
+	})
+	ctx := context.Background()
+	s := NewInmemService()
+	for _, b := range []Build{{ID: "a", Labels: map[string]string{"team": "infra"}}, {ID: "b"}} {
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	builds, err := s.ListBuilds(ctx, ListOptions{Predicate: "fragile"})
+	if err != nil || len(builds) != 1 || builds[0].ID != "a" {
+		t.Fatalf("got %v, %v; want only a", builds, err)
+	}
+
+	// The store's lock was released: a write still goes through.
+	done := make(chan error, 1)
+	go func() { done <- s.PostBuild(ctx, Build{ID: "c"}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PostBuild blocked after a predicate panicked")
+	}
+}
+
+func TestRegisterListPredicatePanics(t *testing.T) {
+	withListPredicates(t, map[string]func(Build) bool{
+		"taken": func(Build) bool { return true },
+	})
+	for _, name := range []string{"taken", ""} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %q didn't panic", name)
+				}
+			}()
+			RegisterListPredicate(name, func(Build) bool { return false })
+		}()
+	}
+}
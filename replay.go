@@ -0,0 +1,103 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sort"
+)
+
+// LogAppend is the log output carried by a BuildLogsAppended event: the
+// bytes of one append, starting at Offset in the build's logs.
+type LogAppend struct {
+	Step   int    `json:"step"` // -1 if no step was running
+	Offset int64  `json:"offset"`
+	Data   string `json:"data"`
+}
+
+// ReplayBuild calls sink with what happened to build id, oldest first: an
+// event per status transition, BuildCreated, BuildUpdated or BuildFinished,
+// and a BuildLogsAppended per log append, interleaved by time. Each event's
+// build is the current one, as GetBuild would show it to the caller, with
+// the status and history it had then. Events are numbered from 1 within
+// the replay; appends with no recorded time come last.
+//
+// Only the status history, capped at MaxStatusHistory, and the logs are
+// kept, so other changes aren't replayed. The first error from sink stops
+// the replay and is returned.
+func (s *buildService) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
+	events, err := s.replayEvents(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if err := sink(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayEvents builds the events of ReplayBuild, so sink is called without
+// s.mtx held.
+func (s *buildService) replayEvents(ctx context.Context, id string) ([]BuildEvent, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	b, err := s.lookup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// Every event's build is derived from b, so one view covers them all.
+	if b, err = s.view(ctx, b); err != nil {
+		return nil, err
+	}
+	var events []BuildEvent
+	for i, tr := range b.StatusHistory {
+		then := b
+		then.Status = tr.To
+		then.StatusHistory = b.StatusHistory[:i+1]
+		t := BuildUpdated
+		switch {
+		case tr.From == "":
+			t = BuildCreated
+		case tr.To.Terminal():
+			t = BuildFinished
+		}
+		events = append(events, BuildEvent{Type: t, At: tr.At, Build: then})
+	}
+	logs, segs := s.logs[id], s.logSteps[id]
+	for i, seg := range segs {
+		events = append(events, BuildEvent{Type: BuildLogsAppended, At: seg.At, Log: &LogAppend{
+			Step:   seg.Step,
+			Offset: seg.Start,
+			Data:   string(logs[seg.Start:segmentEnd(segs, i, logs)]),
+		}})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		a, b := events[i].At, events[j].At
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero() && b.IsZero()
+		}
+		return a.Before(b)
+	})
+	for i := range events {
+		events[i].ID = uint64(i + 1)
+		if events[i].Type == BuildLogsAppended {
+			events[i].Build = latest(events[:i], b)
+		}
+	}
+	return events, nil
+}
+
+// latest is the build of the last status event in events, or b if there's
+// none.
+func latest(events []BuildEvent, b Build) Build {
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type != BuildLogsAppended {
+			return events[i].Build
+		}
+	}
+	return b
+}
@@ -0,0 +1,50 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestReplayRedactsSensitiveLabels(t *testing.T) {
+	s := NewInmemService(WithEncryption(testCipher(t), "secret."))
+	ctx := context.Background()
+	owner := WithActor(ctx, "alice")
+	if err := s.PostBuild(owner, Build{ID: "b1", Labels: map[string]string{"secret.pw": "hunter2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AppendBuildLogs(ctx, "b1", 0, []byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.CompareAndSetStatus(ctx, "b1", StatusPending, StatusRunning); !ok || err != nil {
+		t.Fatalf("CompareAndSetStatus: %v, %v", ok, err)
+	}
+
+	replay := func(ctx context.Context) []BuildEvent {
+		t.Helper()
+		var events []BuildEvent
+		if err := s.ReplayBuild(ctx, "b1", func(e BuildEvent) error {
+			events = append(events, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 3 {
+			t.Fatalf("got %d events, want 3", len(events))
+		}
+		return events
+	}
+	for _, e := range replay(ctx) {
+		if got := e.Build.Labels["secret.pw"]; got != RedactedValue {
+			t.Errorf("anonymous replay, event %d (%s): got %q, want %q", e.ID, e.Type, got, RedactedValue)
+		}
+	}
+	for _, e := range replay(owner) {
+		if got := e.Build.Labels["secret.pw"]; got != "hunter2" {
+			t.Errorf("authorized replay, event %d (%s): got %q, want the plaintext", e.ID, e.Type, got)
+		}
+		if strings.HasPrefix(e.Build.Labels["secret.pw"], encryptedPrefix) {
+			t.Errorf("event %d (%s) leaks the ciphertext", e.ID, e.Type)
+		}
+	}
+}
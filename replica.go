@@ -0,0 +1,318 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// ReplicaOption configures a read-replica service.
+type ReplicaOption func(*replicaService)
+
+// WithPinWindow sets how long reads of a build go to the primary after it
+// was written, for replicas that lag behind by up to d. The default is five
+// seconds; zero disables pinning.
+func WithPinWindow(d time.Duration) ReplicaOption {
+	return func(r *replicaService) { r.pinWindow = d }
+}
+
+// WithReplicaClock times pin windows with c rather than SystemClock.
+func WithReplicaClock(c Clock) ReplicaOption {
+	return func(r *replicaService) { r.clock = c }
+}
+
+// WithReplicaLogger logs, at debug, reads redirected to the primary because
+// their build was written recently.
+func WithReplicaLogger(logger log.Logger) ReplicaOption {
+	return func(r *replicaService) { r.logger = logger }
+}
+
+// NewReadReplicaService returns a Service that sends every mutation to
+// primary and spreads reads over replicas round-robin. Replicas are assumed
+// to catch up with the primary within the pin window: reads of a build
+// written through this service within the window go to the primary, so
+// callers never read their own writes stale. Lists and validation always
+// read a replica. With no replicas, everything goes to the primary.
+func NewReadReplicaService(primary Service, replicas []Service, opts ...ReplicaOption) Service {
+	r := &replicaService{
+		primary:   primary,
+		replicas:  replicas,
+		pinWindow: 5 * time.Second,
+		clock:     SystemClock,
+		logger:    log.NewNopLogger(),
+		pins:      map[string]time.Time{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+type replicaService struct {
+	primary   Service
+	replicas  []Service
+	pinWindow time.Duration
+	clock     Clock
+	logger    log.Logger
+	next      atomic.Uint64
+
+	mtx  sync.Mutex
+	pins map[string]time.Time // build ID to when its pin expires
+}
+
+// replica picks the next replica in turn.
+func (r *replicaService) replica() Service {
+	if len(r.replicas) == 0 {
+		return r.primary
+	}
+	n := r.next.Add(1)
+	return r.replicas[n%uint64(len(r.replicas))]
+}
+
+// reader picks the backend to read build id from.
+func (r *replicaService) reader(method, id string) Service {
+	if len(r.replicas) == 0 {
+		return r.primary
+	}
+	if r.pinned(id) {
+		level.Debug(r.logger).Log("method", method, "id", id, "read", "primary", "reason", "recently written")
+		return r.primary
+	}
+	return r.replica()
+}
+
+// pinned reports whether id was written within the pin window.
+func (r *replicaService) pinned(id string) bool {
+	r.mtx.Lock()
+	until, ok := r.pins[id]
+	r.mtx.Unlock()
+	return ok && r.clock.Now().Before(until)
+}
+
+// pin sends reads of id to the primary for the pin window. Expired pins are
+// dropped once enough of them pile up.
+func (r *replicaService) pin(id string, err error) error {
+	if err != nil || r.pinWindow <= 0 || len(r.replicas) == 0 || id == "" {
+		return err
+	}
+	now := r.clock.Now()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.pins) >= 1024 {
+		for k, until := range r.pins {
+			if now.After(until) {
+				delete(r.pins, k)
+			}
+		}
+	}
+	r.pins[id] = now.Add(r.pinWindow)
+	return nil
+}
+
+func (r *replicaService) PostBuild(ctx context.Context, b Build) error {
+	return r.pin(b.ID, r.primary.PostBuild(ctx, b))
+}
+
+func (r *replicaService) GetBuild(ctx context.Context, id string) (Build, error) {
+	return r.reader("GetBuild", id).GetBuild(ctx, id)
+}
+
+func (r *replicaService) GetBuilds(ctx context.Context, ids []string) (map[string]Build, []string, error) {
+	return r.batchReader("GetBuilds", ids).GetBuilds(ctx, ids)
+}
+
+func (r *replicaService) ListBuildStatuses(ctx context.Context, ids []string) (map[string]BuildStatus, error) {
+	return r.batchReader("ListBuildStatuses", ids).ListBuildStatuses(ctx, ids)
+}
+
+// batchReader picks the backend to read the builds in ids from: the primary
+// if any of them was written recently, so the batch is never partly stale.
+func (r *replicaService) batchReader(method string, ids []string) Service {
+	if len(r.replicas) == 0 {
+		return r.primary
+	}
+	for _, id := range ids {
+		if r.pinned(id) {
+			level.Debug(r.logger).Log("method", method, "id", id, "read", "primary", "reason", "recently written")
+			return r.primary
+		}
+	}
+	return r.replica()
+}
+
+func (r *replicaService) ReserveID(ctx context.Context, prefix string) (string, error) {
+	return r.primary.ReserveID(ctx, prefix)
+}
+
+func (r *replicaService) ListBuilds(ctx context.Context, opts ListOptions) ([]Build, error) {
+	return r.replica().ListBuilds(ctx, opts)
+}
+
+func (r *replicaService) PutBuild(ctx context.Context, id string, b Build) error {
+	return r.pin(id, r.primary.PutBuild(ctx, id, b))
+}
+
+func (r *replicaService) PatchBuild(ctx context.Context, id string, b Build) error {
+	return r.pin(id, r.primary.PatchBuild(ctx, id, b))
+}
+
+func (r *replicaService) DeleteBuild(ctx context.Context, id string) error {
+	return r.pin(id, r.primary.DeleteBuild(ctx, id))
+}
+
+func (r *replicaService) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (int64, error) {
+	n, err := r.primary.AppendBuildLogs(ctx, id, offset, p)
+	return n, r.pin(id, err)
+}
+
+func (r *replicaService) GetBuildLogLength(ctx context.Context, id string) (int64, error) {
+	return r.reader("GetBuildLogLength", id).GetBuildLogLength(ctx, id)
+}
+
+func (r *replicaService) ValidateBuild(ctx context.Context, b Build) (ValidationErrors, error) {
+	return r.replica().ValidateBuild(ctx, b)
+}
+
+func (r *replicaService) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (Build, bool, error) {
+	b, ok, err := r.primary.LeaseBuild(ctx, workerID, ttl)
+	return b, ok, r.pin(b.ID, err)
+}
+
+func (r *replicaService) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (Build, bool, error) {
+	b, ok, err := r.primary.ClaimAndStart(ctx, workerID, filter)
+	return b, ok, r.pin(b.ID, err)
+}
+
+func (r *replicaService) ForceReleaseLease(ctx context.Context, id string) error {
+	return r.pin(id, r.primary.ForceReleaseLease(ctx, id))
+}
+
+func (r *replicaService) QueuePosition(ctx context.Context, id string) (int, time.Duration, error) {
+	return r.reader("QueuePosition", id).QueuePosition(ctx, id)
+}
+
+func (r *replicaService) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (bool, error) {
+	ok, err := r.primary.CompareAndSetStatus(ctx, id, expected, next)
+	return ok, r.pin(id, err)
+}
+
+func (r *replicaService) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (bool, error) {
+	ok, err := r.primary.CompareAndDeleteBuild(ctx, id, updatedAt)
+	return ok, r.pin(id, err)
+}
+
+func (r *replicaService) RerunFailedSteps(ctx context.Context, id string) (Build, error) {
+	b, err := r.primary.RerunFailedSteps(ctx, id)
+	return b, r.pin(id, err)
+}
+
+func (r *replicaService) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) ([]Build, error) {
+	return r.replica().ListBuildsModifiedBetween(ctx, from, to)
+}
+
+func (r *replicaService) FailBuild(ctx context.Context, id, reason string, exitCode int) error {
+	return r.pin(id, r.primary.FailBuild(ctx, id, reason, exitCode))
+}
+
+// RenameBuild pins both IDs, so neither the old build nor the new one is
+// read stale. The dependents it updates aren't pinned.
+func (r *replicaService) RenameBuild(ctx context.Context, oldID, newID string) error {
+	if err := r.pin(oldID, r.primary.RenameBuild(ctx, oldID, newID)); err != nil {
+		return err
+	}
+	return r.pin(newID, nil)
+}
+
+func (r *replicaService) GetOrCreateBuild(ctx context.Context, b Build) (Build, bool, error) {
+	got, created, err := r.primary.GetOrCreateBuild(ctx, b)
+	return got, created, r.pin(b.ID, err)
+}
+
+func (r *replicaService) ListLabelKeys(ctx context.Context) ([]string, error) {
+	return r.replica().ListLabelKeys(ctx)
+}
+
+func (r *replicaService) ListLabelValues(ctx context.Context, key string) ([]string, error) {
+	return r.replica().ListLabelValues(ctx, key)
+}
+
+func (r *replicaService) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) ([]BatchResult, error) {
+	results, err := r.primary.PatchBuilds(ctx, ids, patch)
+	for _, res := range results {
+		if res.Err == nil {
+			r.pin(res.ID, nil)
+		}
+	}
+	return results, err
+}
+
+func (r *replicaService) BatchPostBuilds(ctx context.Context, builds []Build) ([]BatchResult, error) {
+	results, err := r.primary.BatchPostBuilds(ctx, builds)
+	for _, res := range results {
+		if res.Err == nil {
+			r.pin(res.ID, nil)
+		}
+	}
+	return results, err
+}
+
+func (r *replicaService) FindBuildsBySpecHash(ctx context.Context, hash string) ([]Build, error) {
+	return r.replica().FindBuildsBySpecHash(ctx, hash)
+}
+
+func (r *replicaService) GetBuildLogs(ctx context.Context, id string, step int, from int64) ([]byte, error) {
+	return r.reader("GetBuildLogs", id).GetBuildLogs(ctx, id, step, from)
+}
+
+func (r *replicaService) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) error {
+	return r.reader("ReplayBuild", id).ReplayBuild(ctx, id, sink)
+}
+
+func (r *replicaService) GetLimits(ctx context.Context) (ServiceLimits, error) {
+	return r.primary.GetLimits(ctx)
+}
+
+func (r *replicaService) BuildMetrics(ctx context.Context, window time.Duration) (MetricsSummary, error) {
+	return r.replica().BuildMetrics(ctx, window)
+}
+
+func (r *replicaService) FindSucceededByFingerprint(ctx context.Context, fp string) (Build, bool, error) {
+	return r.replica().FindSucceededByFingerprint(ctx, fp)
+}
+
+func (r *replicaService) SetOutput(ctx context.Context, id, key, value string) error {
+	return r.pin(id, r.primary.SetOutput(ctx, id, key, value))
+}
+
+func (r *replicaService) GetOutput(ctx context.Context, id, key string) (string, error) {
+	return r.reader("GetOutput", id).GetOutput(ctx, id, key)
+}
+
+func (r *replicaService) ListBuildsByGroup(ctx context.Context, groupID string) ([]Build, error) {
+	return r.replica().ListBuildsByGroup(ctx, groupID)
+}
+
+// CancelGroup pins the group's members once they're cancelled. Reads of
+// the group as a whole still go to a replica.
+func (r *replicaService) CancelGroup(ctx context.Context, groupID string) (int, error) {
+	n, err := r.primary.CancelGroup(ctx, groupID)
+	if n == 0 || len(r.replicas) == 0 {
+		return n, err
+	}
+	members, lerr := r.primary.ListBuildsByGroup(ctx, groupID)
+	if lerr != nil {
+		return n, err
+	}
+	for _, b := range members {
+		r.pin(b.ID, nil)
+	}
+	return n, err
+}
+
+func (r *replicaService) GroupStatus(ctx context.Context, groupID string) (GroupSummary, error) {
+	return r.replica().GroupStatus(ctx, groupID)
+}
@@ -0,0 +1,172 @@
+package gokitbuildservice_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+// replicaSet is a primary and replicas that are all fakes, so the calls
+// each one got show where the read-replica service sent them.
+type replicaSet struct {
+	primary  *servicetest.FakeService
+	replicas []*servicetest.FakeService
+	clock    *servicetest.FakeClock
+	svc      gokitbuildservice.Service
+}
+
+func newReplicaSet(n int, opts ...gokitbuildservice.ReplicaOption) *replicaSet {
+	rs := &replicaSet{
+		primary: &servicetest.FakeService{},
+		clock:   servicetest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	var replicas []gokitbuildservice.Service
+	for i := 0; i < n; i++ {
+		f := &servicetest.FakeService{}
+		rs.replicas = append(rs.replicas, f)
+		replicas = append(replicas, f)
+	}
+	opts = append([]gokitbuildservice.ReplicaOption{gokitbuildservice.WithReplicaClock(rs.clock)}, opts...)
+	rs.svc = gokitbuildservice.NewReadReplicaService(rs.primary, replicas, opts...)
+	return rs
+}
+
+// readFrom reports which backend served the last GetBuild of id: -1 for the
+// primary, or the replica's index.
+func (rs *replicaSet) readFrom(t *testing.T, id string) int {
+	t.Helper()
+	for _, f := range rs.replicas {
+		f.Reset()
+	}
+	rs.primary.Reset()
+	if _, err := rs.svc.GetBuild(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.primary.CallsTo("GetBuild")) == 1 {
+		return -1
+	}
+	for i, f := range rs.replicas {
+		if len(f.CallsTo("GetBuild")) == 1 {
+			return i
+		}
+	}
+	t.Fatalf("GetBuild(%q) reached no backend", id)
+	return 0
+}
+
+func TestReadReplicaRoundRobin(t *testing.T) {
+	rs := newReplicaSet(3)
+	ctx := context.Background()
+	for i := 0; i < 9; i++ {
+		if _, err := rs.svc.ListBuilds(ctx, gokitbuildservice.ListOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(rs.primary.Calls()); n != 0 {
+		t.Errorf("primary got %d reads, want none", n)
+	}
+	for i, f := range rs.replicas {
+		if n := len(f.CallsTo("ListBuilds")); n != 3 {
+			t.Errorf("replica %d got %d of 9 lists, want 3", i, n)
+		}
+	}
+
+	// With no replicas, the primary serves reads too.
+	primary := &servicetest.FakeService{}
+	s := gokitbuildservice.NewReadReplicaService(primary, nil)
+	if _, err := s.GetBuild(ctx, "b1"); err != nil || len(primary.CallsTo("GetBuild")) != 1 {
+		t.Errorf("no replicas: primary got %d reads, %v", len(primary.CallsTo("GetBuild")), err)
+	}
+}
+
+func TestReadReplicaPinsWrites(t *testing.T) {
+	rs := newReplicaSet(2, gokitbuildservice.WithPinWindow(5*time.Second))
+	ctx := context.Background()
+
+	if got := rs.readFrom(t, "b1"); got < 0 {
+		t.Fatal("unwritten build read from the primary")
+	}
+	if err := rs.svc.PatchBuild(ctx, "b1", gokitbuildservice.Build{Name: "n"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rs.readFrom(t, "b1"); got != -1 {
+		t.Errorf("read right after a write went to replica %d, want the primary", got)
+	}
+	if got := rs.readFrom(t, "b2"); got < 0 {
+		t.Error("another build's read was pinned too")
+	}
+	rs.clock.Advance(5 * time.Second)
+	if got := rs.readFrom(t, "b1"); got < 0 {
+		t.Error("read after the pin window still went to the primary")
+	}
+
+	// A failed write doesn't pin.
+	rs.primary.PutBuildFunc = func(context.Context, string, gokitbuildservice.Build) error {
+		return gokitbuildservice.ErrNotFound
+	}
+	if err := rs.svc.PutBuild(ctx, "b3", gokitbuildservice.Build{ID: "b3"}); !errors.Is(err, gokitbuildservice.ErrNotFound) {
+		t.Fatal(err)
+	}
+	if got := rs.readFrom(t, "b3"); got < 0 {
+		t.Error("failed write pinned its build")
+	}
+}
+
+func TestReadReplicaPinsBatches(t *testing.T) {
+	batchErr := errors.New("primary lost the end of the batch")
+	for _, tc := range []struct {
+		name  string
+		write func(gokitbuildservice.Service, *servicetest.FakeService) error
+	}{
+		{"PatchBuilds", func(s gokitbuildservice.Service, primary *servicetest.FakeService) error {
+			primary.PatchBuildsFunc = func(context.Context, []string, gokitbuildservice.BuildPatch) ([]gokitbuildservice.BatchResult, error) {
+				return []gokitbuildservice.BatchResult{{ID: "ok"}, {ID: "bad", Err: gokitbuildservice.ErrNotFound}}, batchErr
+			}
+			_, err := s.PatchBuilds(context.Background(), []string{"ok", "bad"}, gokitbuildservice.BuildPatch{})
+			return err
+		}},
+		{"BatchPostBuilds", func(s gokitbuildservice.Service, primary *servicetest.FakeService) error {
+			primary.BatchPostBuildsFunc = func(context.Context, []gokitbuildservice.Build) ([]gokitbuildservice.BatchResult, error) {
+				return []gokitbuildservice.BatchResult{{ID: "ok"}, {ID: "bad", Err: gokitbuildservice.ErrAlreadyExists}}, batchErr
+			}
+			_, err := s.BatchPostBuilds(context.Background(), []gokitbuildservice.Build{{ID: "ok"}, {ID: "bad"}})
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := newReplicaSet(2)
+			if err := tc.write(rs.svc, rs.primary); !errors.Is(err, batchErr) {
+				t.Fatalf("got %v, want the batch's error passed on", err)
+			}
+			if got := rs.readFrom(t, "ok"); got != -1 {
+				t.Errorf("build written by a batch that also failed read from replica %d, want the primary", got)
+			}
+			if got := rs.readFrom(t, "bad"); got < 0 {
+				t.Error("build the batch failed to write was pinned")
+			}
+		})
+	}
+}
+
+func TestReadReplicaPinsRenames(t *testing.T) {
+	rs := newReplicaSet(2)
+	if err := rs.svc.RenameBuild(context.Background(), "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"old", "new"} {
+		if got := rs.readFrom(t, id); got != -1 {
+			t.Errorf("%s read from replica %d after the rename, want the primary", id, got)
+		}
+	}
+	rs.primary.Reset()
+	if _, _, err := rs.svc.GetBuilds(context.Background(), []string{"other", "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.primary.CallsTo("GetBuilds")) != 1 {
+		t.Error("batch read including a pinned build didn't go to the primary")
+	}
+}
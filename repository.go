@@ -0,0 +1,97 @@
+package gokitbuildservice
+
+import "context"
+
+// Repository stores builds for the service returned by NewService. It only
+// stores and retrieves: validation, status transitions, leases, events and
+// every other rule live in the service, so they behave the same whichever
+// backend is plugged in.
+//
+// The service serializes its calls: Save and Delete are never called
+// concurrently with any other method, though Get and List may be called
+// concurrently with each other. A repository shared by several services
+// gets no such guarantee across them, and the services' read-modify-write
+// cycles aren't atomic against each other.
+type Repository interface {
+	// Get returns the build stored as id, and false if there is none.
+	Get(ctx context.Context, id string) (Build, bool, error)
+
+	// Save stores b under b.ID, replacing whatever was there.
+	Save(ctx context.Context, b Build) error
+
+	// Delete removes the build stored as id, if any.
+	Delete(ctx context.Context, id string) error
+
+	// List returns every stored build, in no particular order.
+	List(ctx context.Context) ([]Build, error)
+}
+
+// GroupRepository is a Repository that indexes builds by GroupID. The
+// service lists a group's members with ListGroup if its repository has it,
+// and by filtering List otherwise.
+type GroupRepository interface {
+	Repository
+
+	// ListGroup returns every stored build with GroupID groupID, in no
+	// particular order.
+	ListGroup(ctx context.Context, groupID string) ([]Build, error)
+}
+
+// NewInmemRepository returns a GroupRepository that keeps builds in a map.
+// It relies on the service's serialization and does no locking of its own.
+func NewInmemRepository() Repository {
+	return inmemRepository{builds: map[string]Build{}, groups: map[string]map[string]bool{}}
+}
+
+type inmemRepository struct {
+	builds map[string]Build
+	groups map[string]map[string]bool // group ID to the IDs of its builds
+}
+
+func (r inmemRepository) Get(_ context.Context, id string) (Build, bool, error) {
+	b, ok := r.builds[id]
+	return b, ok, nil
+}
+
+func (r inmemRepository) Save(_ context.Context, b Build) error {
+	r.unindex(r.builds[b.ID])
+	r.builds[b.ID] = b
+	if b.GroupID != "" {
+		if r.groups[b.GroupID] == nil {
+			r.groups[b.GroupID] = map[string]bool{}
+		}
+		r.groups[b.GroupID][b.ID] = true
+	}
+	return nil
+}
+
+func (r inmemRepository) Delete(_ context.Context, id string) error {
+	r.unindex(r.builds[id])
+	delete(r.builds, id)
+	return nil
+}
+
+// unindex drops b from its group's index.
+func (r inmemRepository) unindex(b Build) {
+	members := r.groups[b.GroupID]
+	delete(members, b.ID)
+	if len(members) == 0 {
+		delete(r.groups, b.GroupID)
+	}
+}
+
+func (r inmemRepository) List(_ context.Context) ([]Build, error) {
+	builds := make([]Build, 0, len(r.builds))
+	for _, b := range r.builds {
+		builds = append(builds, b)
+	}
+	return builds, nil
+}
+
+func (r inmemRepository) ListGroup(_ context.Context, groupID string) ([]Build, error) {
+	builds := make([]Build, 0, len(r.groups[groupID]))
+	for id := range r.groups[groupID] {
+		builds = append(builds, r.builds[id])
+	}
+	return builds, nil
+}
@@ -0,0 +1,69 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentRerunsGetDistinctAttempts(t *testing.T) {
+	const rounds, callers = 20, 8
+	ctx := context.Background()
+	s := NewInmemService()
+	failed := Build{ID: "b1", Status: StatusFailed, Steps: []Step{
+		{Name: "build", Image: "golang", Status: StatusSucceeded},
+		{Name: "test", Image: "golang", Status: StatusFailed},
+	}}
+	if err := s.PostBuild(ctx, failed); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[int]bool{1: true}
+	for round := 0; round < rounds; round++ {
+		var (
+			wg       sync.WaitGroup
+			mtx      sync.Mutex
+			attempts []int
+		)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b, err := s.RerunFailedSteps(ctx, "b1")
+				if errors.Is(err, ErrInvalidTransition) {
+					return // another caller's rerun got there first
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mtx.Lock()
+				attempts = append(attempts, b.Attempt)
+				mtx.Unlock()
+			}()
+		}
+		wg.Wait()
+		if len(attempts) != 1 {
+			t.Fatalf("round %d: %d reruns succeeded (attempts %v), want 1", round, len(attempts), attempts)
+		}
+		if seen[attempts[0]] {
+			t.Fatalf("round %d: attempt %d handed out twice", round, attempts[0])
+		}
+		seen[attempts[0]] = true
+
+		b, err := s.GetBuild(ctx, "b1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Attempt != attempts[0] || b.Status != StatusPending || b.Steps[0].Status != StatusSucceeded || b.Steps[1].Status != StatusPending {
+			t.Fatalf("round %d: got attempt %d, %s, steps %+v", round, b.Attempt, b.Status, b.Steps)
+		}
+		if err := s.PutBuild(ctx, "b1", failed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, _ := s.GetBuild(ctx, "b1"); b.Attempt != rounds+1 {
+		t.Errorf("final attempt: got %d, want %d", b.Attempt, rounds+1)
+	}
+}
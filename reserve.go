@@ -0,0 +1,81 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// DefaultReservationTTL is how long a reserved ID stays reserved unless the
+// service is constructed WithReservationTTL.
+const DefaultReservationTTL = time.Minute
+
+// WithReservationTTL sets how long ReserveID holds an ID for its build.
+func WithReservationTTL(d time.Duration) InmemOption {
+	return func(s *buildService) { s.reservationTTL = d }
+}
+
+// ReserveID returns a new ID, prefix followed by random hex digits, that
+// no build has and that ReserveID won't hand out again while it's
+// reserved. The reservation is claimed by creating the build, with POST or
+// PUT, as the same actor (see ActorFromContext), and lapses if that doesn't
+// happen within the reservation TTL. Until then, creating it as anyone else
+// fails with ErrAlreadyExists.
+//
+// Reservations aren't persisted; they're short-lived, and the random part
+// makes a collision after a restart vanishingly unlikely.
+func (s *buildService) ReserveID(ctx context.Context, prefix string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	ctx = s.begin(ctx)
+	if strings.ContainsAny(prefix, "/ ") {
+		var errs ValidationErrors
+		errs.add("prefix", "must not contain slashes or spaces")
+		return "", errs
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := s.now(ctx)
+	for id, r := range s.reservations {
+		if now.After(r.until) {
+			delete(s.reservations, id)
+		}
+	}
+	for {
+		var buf [8]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return "", err
+		}
+		id := prefix + hex.EncodeToString(buf[:])
+		if _, ok, err := s.repo.Get(ctx, id); err != nil {
+			return "", err
+		} else if ok {
+			continue
+		}
+		if _, ok := s.reservations[id]; ok {
+			continue
+		}
+		s.reservations[id] = reservation{until: now.Add(s.reservationTTL), by: ActorFromContext(ctx)}
+		return id, nil
+	}
+}
+
+// reservation is an ID held by ReserveID.
+type reservation struct {
+	until time.Time // when it lapses
+	by    string    // the actor who may claim it
+}
+
+// reserved returns ErrAlreadyExists if id is reserved, and the reservation
+// hasn't lapsed, for an actor other than the caller. It must be called
+// with s.mtx held.
+func (s *buildService) reserved(ctx context.Context, id string) error {
+	r, ok := s.reservations[id]
+	if !ok || s.now(ctx).After(r.until) || r.by == ActorFromContext(ctx) {
+		return nil
+	}
+	return ErrAlreadyExists
+}
@@ -0,0 +1,54 @@
+package gokitbuildservice_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+func TestReservedIDsOnlyGoToTheirHolder(t *testing.T) {
+	clock := servicetest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := gokitbuildservice.NewInmemService(gokitbuildservice.WithClock(clock), gokitbuildservice.WithReservationTTL(time.Minute))
+	alice := gokitbuildservice.WithActor(context.Background(), "alice")
+	bob := gokitbuildservice.WithActor(context.Background(), "bob")
+
+	creates := map[string]func(ctx context.Context, id string) error{
+		"PostBuild": func(ctx context.Context, id string) error {
+			return s.PostBuild(ctx, gokitbuildservice.Build{ID: id})
+		},
+		"PutBuild": func(ctx context.Context, id string) error {
+			return s.PutBuild(ctx, id, gokitbuildservice.Build{ID: id})
+		},
+		"GetOrCreateBuild": func(ctx context.Context, id string) error {
+			_, _, err := s.GetOrCreateBuild(ctx, gokitbuildservice.Build{ID: id})
+			return err
+		},
+	}
+	for name, create := range creates {
+		id, err := s.ReserveID(alice, "r-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := create(bob, id); err != gokitbuildservice.ErrAlreadyExists {
+			t.Errorf("%s by another actor: got %v, want ErrAlreadyExists", name, err)
+		}
+		if err := create(context.Background(), id); err != gokitbuildservice.ErrAlreadyExists {
+			t.Errorf("%s anonymously: got %v, want ErrAlreadyExists", name, err)
+		}
+		if err := create(alice, id); err != nil {
+			t.Errorf("%s by the holder: %v", name, err)
+		}
+
+		lapsed, err := s.ReserveID(alice, "r-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Minute + time.Second)
+		if err := create(bob, lapsed); err != nil {
+			t.Errorf("%s after the reservation lapsed: %v", name, err)
+		}
+	}
+}
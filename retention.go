@@ -0,0 +1,135 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// PinnedLabel marks a build the retention sweeper must keep, whatever its
+// age, when set to "true".
+const PinnedLabel = "build.pinned"
+
+// RetentionOption configures StartRetentionSweeper.
+type RetentionOption func(*retentionSweeper)
+
+// WithStatusRetention keeps terminal builds with the given status for d
+// rather than the default retention, so e.g. failed builds can be kept
+// around longer for debugging. A zero d keeps them forever.
+func WithStatusRetention(status BuildStatus, d time.Duration) RetentionOption {
+	return func(r *retentionSweeper) { r.byStatus[status] = d }
+}
+
+// WithRetentionBatch caps how many builds one sweep deletes. Whatever is
+// left over is deleted by the following sweeps.
+func WithRetentionBatch(n int) RetentionOption {
+	return func(r *retentionSweeper) { r.batch = n }
+}
+
+// WithRetentionClock judges builds' ages with c rather than SystemClock.
+func WithRetentionClock(c Clock) RetentionOption {
+	return func(r *retentionSweeper) { r.clock = c }
+}
+
+// WithRetentionLogger logs how many builds every sweep deleted.
+func WithRetentionLogger(logger log.Logger) RetentionOption {
+	return func(r *retentionSweeper) { r.logger = logger }
+}
+
+// WithRetentionMetrics counts deleted builds, labelled by "status".
+func WithRetentionMetrics(deleted metrics.Counter) RetentionOption {
+	return func(r *retentionSweeper) { r.deleted = deleted }
+}
+
+type retentionSweeper struct {
+	s         Service
+	retention time.Duration
+	byStatus  map[BuildStatus]time.Duration
+	batch     int
+	clock     Clock
+	logger    log.Logger
+	deleted   metrics.Counter
+}
+
+// StartRetentionSweeper deletes, every interval until ctx is done, the
+// terminal builds of s that finished longer than retention ago, except
+// those labelled with PinnedLabel. A zero retention keeps builds forever
+// unless WithStatusRetention says otherwise for their status.
+//
+// Builds are deleted one at a time through s, at most 500 per sweep by
+// default, so a sweep never holds the store for long. Each is deleted with
+// CompareAndDeleteBuild, so a build changed between being listed and being
+// deleted, say pinned or rerun, is kept and judged again by the next sweep.
+func StartRetentionSweeper(ctx context.Context, s Service, interval, retention time.Duration, opts ...RetentionOption) {
+	r := &retentionSweeper{
+		s:         s,
+		retention: retention,
+		byStatus:  map[BuildStatus]time.Duration{},
+		batch:     500,
+		clock:     SystemClock,
+		logger:    log.NewNopLogger(),
+		deleted:   discard.NewCounter(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				r.sweep(ctx, r.clock.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (r *retentionSweeper) sweep(ctx context.Context, now time.Time) {
+	builds, err := r.s.ListBuilds(ctx, ListOptions{SortBy: "createdAt"})
+	if err != nil {
+		level.Error(r.logger).Log("component", "retention", "err", err)
+		return
+	}
+	deleted := 0
+	for _, b := range builds {
+		if deleted >= r.batch {
+			break
+		}
+		if !r.expired(b, now) {
+			continue
+		}
+		ok, err := r.s.CompareAndDeleteBuild(ctx, b.ID, b.UpdatedAt)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			level.Error(r.logger).Log("component", "retention", "id", b.ID, "err", err)
+			break
+		}
+		if !ok {
+			continue // changed since it was listed
+		}
+		r.deleted.With("status", string(b.Status)).Add(1)
+		deleted++
+	}
+	level.Info(r.logger).Log("component", "retention", "deleted", deleted)
+}
+
+func (r *retentionSweeper) expired(b Build, now time.Time) bool {
+	if !b.Status.Terminal() || b.FinishedAt == nil || b.Labels[PinnedLabel] == "true" {
+		return false
+	}
+	keep, ok := r.byStatus[b.Status]
+	if !ok {
+		keep = r.retention
+	}
+	return keep > 0 && now.Sub(*b.FinishedAt) > keep
+}
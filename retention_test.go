@@ -0,0 +1,59 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// changingLister runs change after listing, as if other callers got in
+// between the sweeper's listing and its deletes.
+type changingLister struct {
+	Service
+	change func()
+}
+
+func (c changingLister) ListBuilds(ctx context.Context, opts ListOptions) ([]Build, error) {
+	builds, err := c.Service.ListBuilds(ctx, opts)
+	c.change()
+	return builds, err
+}
+
+func TestRetentionKeepsBuildsChangedSinceListed(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmemService()
+	for _, id := range []string{"pinned", "rerun", "stale"} {
+		if err := s.PostBuild(ctx, Build{ID: id, Steps: []Step{{Image: "golang", Status: StatusFailed}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.FailBuild(ctx, id, "boom", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &retentionSweeper{
+		s: changingLister{Service: s, change: func() {
+			if err := s.PatchBuild(ctx, "pinned", Build{Labels: map[string]string{PinnedLabel: "true"}}); err != nil {
+				t.Error(err)
+			}
+			if _, err := s.RerunFailedSteps(ctx, "rerun"); err != nil {
+				t.Error(err)
+			}
+		}},
+		retention: time.Hour,
+		byStatus:  map[BuildStatus]time.Duration{},
+		batch:     500,
+		clock:     SystemClock,
+		logger:    log.NewNopLogger(),
+		deleted:   discard.NewCounter(),
+	}
+	r.sweep(ctx, time.Now().Add(2*time.Hour))
+
+	for id, kept := range map[string]bool{"pinned": true, "rerun": true, "stale": false} {
+		if _, err := s.GetBuild(ctx, id); (err == nil) != kept {
+			t.Errorf("%s: got %v, want kept %v", id, err, kept)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package gokitbuildservice
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// RunStats keeps a rolling average of how long recent builds ran, for queue
+// wait estimates.
+type RunStats struct {
+	mtx    sync.Mutex
+	window []time.Duration // circular
+	next   int
+	full   bool
+	sum    time.Duration
+}
+
+// NewRunStats averages over the last window run durations.
+func NewRunStats(window int) *RunStats {
+	return &RunStats{window: make([]time.Duration, window)}
+}
+
+// Observe records one run duration.
+func (r *RunStats) Observe(d time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.window) == 0 {
+		return
+	}
+	r.sum += d - r.window[r.next]
+	r.window[r.next] = d
+	r.next = (r.next + 1) % len(r.window)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Average returns the mean of the observed durations, or zero before the
+// first observation.
+func (r *RunStats) Average() time.Duration {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.window)
+	}
+	if n == 0 {
+		return 0
+	}
+	return r.sum / time.Duration(n)
+}
+
+// WithQueueWaitMetrics observes into wait, in seconds, how long every build
+// that starts running waited since it last became pending: since it was
+// created, or since it was rerun or requeued. It's observed where the
+// status changes, under the store's lock, so every pending to running
+// transition counts once whichever method or transport made it.
+func WithQueueWaitMetrics(wait metrics.Histogram) InmemOption {
+	return func(s *buildService) { s.queueWait = wait }
+}
+
+// observeQueueWait is called by save for every transition from prev to
+// next, once next is stamped.
+func (s *buildService) observeQueueWait(prev, next Build) {
+	if s.queueWait == nil || prev.Status != StatusPending || next.Status != StatusRunning || next.StartedAt == nil {
+		return
+	}
+	s.queueWait.Observe(next.StartedAt.Sub(pendingSince(next)).Seconds())
+}
+
+// pendingSince returns when b last became pending, by its status history,
+// or its creation time if the history no longer shows it.
+func pendingSince(b Build) time.Time {
+	for i := len(b.StatusHistory) - 1; i >= 0; i-- {
+		if t := b.StatusHistory[i]; t.To == StatusPending {
+			return t.At
+		}
+	}
+	return b.CreatedAt
+}
+
+// ObserveRunDurations consumes build events until the channel is closed,
+// observing how long every finished build ran into duration (in seconds) and
+// stats. Builds that finished without ever running are ignored.
+func ObserveRunDurations(events <-chan BuildEvent, duration metrics.Histogram, stats *RunStats) {
+	for e := range events {
+		if e.Type != BuildFinished || e.Build.StartedAt == nil || e.Build.FinishedAt == nil {
+			continue
+		}
+		d := e.Build.FinishedAt.Sub(*e.Build.StartedAt)
+		duration.With("status", string(e.Build.Status)).Observe(d.Seconds())
+		stats.Observe(d)
+	}
+}
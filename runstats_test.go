@@ -0,0 +1,110 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// recordingHistogram keeps every observation, whatever its labels.
+type recordingHistogram struct {
+	mtx sync.Mutex
+	obs []float64
+}
+
+func (h *recordingHistogram) With(...string) metrics.Histogram { return h }
+
+func (h *recordingHistogram) Observe(v float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.obs = append(h.obs, v)
+}
+
+func TestQueueWaitIsObservedOnStart(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	wait := &recordingHistogram{}
+	s := NewInmemService(WithClock(clock), WithQueueWaitMetrics(wait))
+	for _, id := range []string{"leased", "set"} {
+		if err := s.PostBuild(ctx, Build{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(90 * time.Second)
+	if b, _, err := s.LeaseBuild(ctx, "w", time.Minute); err != nil || b.ID != "leased" {
+		t.Fatalf("LeaseBuild: %q, %v", b.ID, err)
+	}
+	clock.Advance(30 * time.Second)
+	if ok, err := s.CompareAndSetStatus(ctx, "set", StatusPending, StatusRunning); !ok || err != nil {
+		t.Fatalf("CompareAndSetStatus: %v, %v", ok, err)
+	}
+	// Changes that don't start a build aren't observed.
+	if err := s.PatchBuild(ctx, "set", Build{Name: "renamed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FailBuild(ctx, "leased", "boom", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []float64{90, 120}; len(wait.obs) != 2 || wait.obs[0] != want[0] || wait.obs[1] != want[1] {
+		t.Errorf("observed %v seconds, want %v", wait.obs, want)
+	}
+}
+
+func TestQueueWaitStartsAtLatestPending(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	wait := &recordingHistogram{}
+	s := NewInmemService(WithClock(clock), WithQueueWaitMetrics(wait))
+	for _, id := range []string{"rerun", "released"} {
+		if err := s.PostBuild(ctx, Build{ID: id, Steps: []Step{{Name: "test", Image: "golang"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := func(id string) {
+		t.Helper()
+		if ok, err := s.CompareAndSetStatus(ctx, id, StatusPending, StatusRunning); !ok || err != nil {
+			t.Fatalf("starting %s: %v, %v", id, ok, err)
+		}
+	}
+
+	// Rerun: ran for a minute, sat failed for an hour, then waited 20s.
+	clock.Advance(10 * time.Second)
+	start("rerun")
+	clock.Advance(time.Minute)
+	if err := s.PatchBuild(ctx, "rerun", Build{Steps: []Step{{Name: "test", Image: "golang", Status: StatusFailed}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FailBuild(ctx, "rerun", "boom", 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := s.RerunFailedSteps(ctx, "rerun"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(20 * time.Second)
+	start("rerun")
+
+	// Requeue: leased, force-released after 5m, then leased again 7s later.
+	if b, _, err := s.LeaseBuild(ctx, "w", time.Hour); err != nil || b.ID != "released" {
+		t.Fatalf("LeaseBuild: %q, %v", b.ID, err)
+	}
+	clock.Advance(5 * time.Minute)
+	if err := s.ForceReleaseLease(ctx, "released"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(7 * time.Second)
+	if b, _, err := s.LeaseBuild(ctx, "w", time.Hour); err != nil || b.ID != "released" {
+		t.Fatalf("LeaseBuild again: %q, %v", b.ID, err)
+	}
+
+	// The first lease of "released" waited from creation until then.
+	lease := (10*time.Second + time.Minute + time.Hour + 20*time.Second).Seconds()
+	if want := []float64{10, 20, lease, 7}; len(wait.obs) != 4 || wait.obs[0] != want[0] || wait.obs[1] != want[1] || wait.obs[2] != want[2] || wait.obs[3] != want[3] {
+		t.Errorf("observed %v seconds, want %v", wait.obs, want)
+	}
+}
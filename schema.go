@@ -0,0 +1,183 @@
+package gokitbuildservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// SchemaUpgrade migrates a persisted build, as its JSON fields, from one
+// schema version to the next, editing fields in place.
+type SchemaUpgrade func(fields map[string]json.RawMessage) error
+
+var (
+	upgradesMtx sync.RWMutex
+	upgrades    []SchemaUpgrade // upgrades[i] migrates version i+1 to i+2
+)
+
+// RegisterSchemaUpgrade adds the upgrade from schema version from to the
+// next, which becomes the current version. Builds persisted by a
+// persistent service, or exported by Snapshot, carry the version they were
+// written with, and are upgraded through every later version when they're
+// read back; builds from before versions existed are version 1. Upgrades
+// must be registered in order, at startup, and it panics if from isn't the
+// current version.
+func RegisterSchemaUpgrade(from int, up SchemaUpgrade) {
+	upgradesMtx.Lock()
+	defer upgradesMtx.Unlock()
+	if from != len(upgrades)+1 {
+		panic(fmt.Sprintf("gokitbuildservice: schema upgrade from version %d registered at version %d", from, len(upgrades)+1))
+	}
+	upgrades = append(upgrades, up)
+}
+
+// CurrentSchemaVersion is the version builds are persisted with: 1 plus
+// the number of registered upgrades.
+func CurrentSchemaVersion() int {
+	upgradesMtx.RLock()
+	defer upgradesMtx.RUnlock()
+	return len(upgrades) + 1
+}
+
+// schemaVersionField is the key the version is persisted under.
+const schemaVersionField = "schemaVersion"
+
+// buildFields are the JSON keys of Build's fields.
+var buildFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Build{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// persistedBuild is how a Build is persisted: its own fields, the fields
+// it was read back with that this version doesn't know, such as ones added
+// by a newer version, and schemaVersion. Known fields win over unknown
+// ones of the same name.
+type persistedBuild struct {
+	Build
+}
+
+func (p persistedBuild) MarshalJSON() ([]byte, error) {
+	known, err := json.Marshal(p.Build)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.extra) == 0 && p.schema == 0 {
+		return append(known[:len(known)-1], fmt.Sprintf(`,%q:%d}`, schemaVersionField, CurrentSchemaVersion())...), nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(known, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range p.extra {
+		if _, ok := fields[k]; !ok && !buildFields[k] {
+			fields[k] = v
+		}
+	}
+	version := CurrentSchemaVersion()
+	if p.schema > version {
+		version = p.schema // written by a newer version; keep its claim
+	}
+	fields[schemaVersionField] = json.RawMessage(fmt.Sprint(version))
+	return json.Marshal(fields)
+}
+
+func (p *persistedBuild) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	version := 1
+	if raw, ok := fields[schemaVersionField]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return fmt.Errorf("%s: %v", schemaVersionField, err)
+		}
+		delete(fields, schemaVersionField)
+	}
+	upgradesMtx.RLock()
+	pending := upgrades
+	upgradesMtx.RUnlock()
+	for v := version; v >= 1 && v <= len(pending); v++ {
+		if err := pending[v-1](fields); err != nil {
+			return fmt.Errorf("upgrading schema version %d: %v", v, err)
+		}
+	}
+	upgraded, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	var b Build
+	if err := json.Unmarshal(upgraded, &b); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		if !buildFields[k] {
+			if b.extra == nil {
+				b.extra = map[string]json.RawMessage{}
+			}
+			b.extra[k] = v
+		}
+	}
+	if version > len(pending)+1 {
+		b.schema = version
+	}
+	p.Build = b
+	return nil
+}
+
+func (r walRecord) MarshalJSON() ([]byte, error) {
+	type plain walRecord
+	v := struct {
+		plain
+		Build *persistedBuild `json:"build,omitempty"`
+	}{plain: plain(r)}
+	if r.Build != nil {
+		v.Build = &persistedBuild{*r.Build}
+	}
+	return json.Marshal(v)
+}
+
+func (r *walRecord) UnmarshalJSON(data []byte) error {
+	type plain walRecord
+	var v struct {
+		plain
+		Build *persistedBuild `json:"build,omitempty"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = walRecord(v.plain)
+	if v.Build != nil {
+		r.Build = &v.Build.Build
+	}
+	return nil
+}
+
+func (r snapshotRecord) MarshalJSON() ([]byte, error) {
+	type plain snapshotRecord
+	return json.Marshal(struct {
+		plain
+		Build persistedBuild `json:"build"`
+	}{plain(r), persistedBuild{r.Build}})
+}
+
+func (r *snapshotRecord) UnmarshalJSON(data []byte) error {
+	type plain snapshotRecord
+	var v struct {
+		plain
+		Build persistedBuild `json:"build"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = snapshotRecord(v.plain)
+	r.Build = v.Build.Build
+	return nil
+}
@@ -0,0 +1,96 @@
+package gokitbuildservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+// withSchemaUpgrades registers ups, in order from version 1, in place of
+// whatever is registered, for the duration of the test.
+func withSchemaUpgrades(t *testing.T, ups ...SchemaUpgrade) {
+	t.Helper()
+	upgradesMtx.Lock()
+	saved := upgrades
+	upgrades = nil
+	upgradesMtx.Unlock()
+	t.Cleanup(func() {
+		upgradesMtx.Lock()
+		defer upgradesMtx.Unlock()
+		upgrades = saved
+	})
+	for i, up := range ups {
+		RegisterSchemaUpgrade(i+1, up)
+	}
+}
+
+func TestSchemaUpgradeOfPersistedBuilds(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	open := func() *buildService {
+		t.Helper()
+		s, err := OpenInmemService(WithPersistence(dir, time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.(*buildService)
+	}
+
+	// Version 1 knows the build's display name as "title", which this
+	// version doesn't, and "shard" is a field from some newer version.
+	withSchemaUpgrades(t)
+	var snap bytes.Buffer
+	zw := gzip.NewWriter(&snap)
+	io.WriteString(zw, `{"timestamp":"2024-01-01T00:00:00Z","count":1}`+"\n")
+	io.WriteString(zw, `{"build":{"id":"b1","status":"pending","title":"nightly","shard":{"n":3}}}`+"\n")
+	zw.Close()
+	s := open()
+	if _, err := s.Restore(ctx, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	withSchemaUpgrades(t, func(fields map[string]json.RawMessage) error {
+		if title, ok := fields["title"]; ok {
+			fields["name"] = title
+			delete(fields, "title")
+		}
+		return nil
+	})
+	s = open()
+	defer s.Close()
+	b, err := s.GetBuild(ctx, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Name != "nightly" {
+		t.Errorf("Name: got %q, want it migrated from title", b.Name)
+	}
+	if _, ok := b.extra["title"]; ok {
+		t.Error("title kept after its upgrade moved it")
+	}
+	if got := string(b.extra["shard"]); got != `{"n":3}` {
+		t.Errorf("unknown field shard: got %q, want it kept", got)
+	}
+
+	data, err := json.Marshal(persistedBuild{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fields[schemaVersionField]); got != "2" {
+		t.Errorf("persisted again as version %s, want 2", got)
+	}
+	if got := string(fields["shard"]); got != `{"n":3}` {
+		t.Errorf("persisted again without shard: %s", data)
+	}
+}
@@ -0,0 +1,172 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Selector matches builds by their labels. It's parsed from a
+// Kubernetes-style expression such as
+//
+//	env=prod,tier!=batch,team in (a,b),!legacy
+//
+// where requirements separated by commas must all hold. Supported operators
+// are = (or ==), !=, in (...), notin (...), a bare key (label present) and
+// !key (label absent). As in Kubernetes, != and notin also match builds
+// without the label.
+type Selector []labelRequirement
+
+type labelRequirement struct {
+	key    string
+	op     string // "=", "!=", "in", "notin", "exists", "!exists"
+	values []string
+}
+
+// Matches reports whether labels satisfy every requirement. An empty
+// selector matches everything.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	v, ok := labels[r.key]
+	switch r.op {
+	case "exists":
+		return ok
+	case "!exists":
+		return !ok
+	case "=":
+		return ok && v == r.values[0]
+	case "!=":
+		return !ok || v != r.values[0]
+	case "in":
+		return ok && contains(r.values, v)
+	case "notin":
+		return !ok || !contains(r.values, v)
+	}
+	return false
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSelector parses a selector expression. Syntax errors are returned as
+// ValidationErrors on the "selector" field.
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, part := range splitRequirements(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, selectorError("empty requirement in %q", s)
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// splitRequirements splits on commas outside parentheses.
+func splitRequirements(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseRequirement(part string) (labelRequirement, error) {
+	if strings.HasPrefix(part, "!") && !strings.ContainsAny(part, "=()") {
+		key := strings.TrimSpace(part[1:])
+		if !validLabelKey(key) {
+			return labelRequirement{}, selectorError("invalid label key %q", key)
+		}
+		return labelRequirement{key: key, op: "!exists"}, nil
+	}
+	for _, op := range []string{"!=", "==", "="} {
+		if i := strings.Index(part, op); i >= 0 {
+			key, value := strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+len(op):])
+			if !validLabelKey(key) {
+				return labelRequirement{}, selectorError("invalid label key %q", key)
+			}
+			if strings.ContainsAny(value, "=!() ") {
+				return labelRequirement{}, selectorError("invalid value %q for key %q", value, key)
+			}
+			if op == "==" {
+				op = "="
+			}
+			return labelRequirement{key: key, op: op, values: []string{value}}, nil
+		}
+	}
+	if open := strings.Index(part, "("); open >= 0 {
+		if !strings.HasSuffix(part, ")") {
+			return labelRequirement{}, selectorError("missing ')' in %q", part)
+		}
+		fields := strings.Fields(part[:open])
+		if len(fields) != 2 || (fields[1] != "in" && fields[1] != "notin") {
+			return labelRequirement{}, selectorError("expected '<key> in (...)' or '<key> notin (...)', got %q", part)
+		}
+		key, op := fields[0], fields[1]
+		if !validLabelKey(key) {
+			return labelRequirement{}, selectorError("invalid label key %q", key)
+		}
+		var values []string
+		for _, v := range strings.Split(part[open+1:len(part)-1], ",") {
+			if v = strings.TrimSpace(v); v == "" || strings.ContainsAny(v, "=!() ") {
+				return labelRequirement{}, selectorError("invalid value %q in %q", v, part)
+			}
+			values = append(values, v)
+		}
+		return labelRequirement{key: key, op: op, values: values}, nil
+	}
+	if !validLabelKey(part) {
+		return labelRequirement{}, selectorError("invalid label key %q", part)
+	}
+	return labelRequirement{key: part, op: "exists"}, nil
+}
+
+func validLabelKey(k string) bool {
+	return k != "" && !strings.ContainsAny(k, "=!(), ")
+}
+
+func selectorError(format string, args ...interface{}) error {
+	return ValidationErrors{{Field: "selector", Message: fmt.Sprintf(format, args...)}}
+}
+
+// SelectBuilds returns the builds whose labels match the selector
+// expression, in the default list order.
+func SelectBuilds(ctx context.Context, s Service, selector string) ([]Build, error) {
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return s.ListBuilds(ctx, ListOptions{Selector: sel})
+}
@@ -2,85 +2,624 @@ package gokitbuildservice
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
 )
 
 // Build represents a single cloud build.
-// ID should be globally unique.
+// ID should be globally unique. CreatedAt, UpdatedAt, Sequence, Attempt,
+// StartedAt and FinishedAt are assigned by the service, and an empty Status is stored as
+// StatusPending. Sequence increases strictly with every build created by a
+// backend, giving a stable oldest-first order that doesn't depend on clock
+// resolution. Attempt starts at 1 and counts the times the build has been
+// sent back to run again. Pending builds with a higher Priority are leased
+// first. A build past its ExpiresAt is treated as gone, and eventually
+// deleted, unless it's labelled with PinnedLabel.
 type Build struct {
-	ID   string `json:"id"`
-	Name string `json:"name,omitempty"`
+	ID         string            `json:"id"`
+	Name       string            `json:"name,omitempty"`
+	Steps      []Step            `json:"steps,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	DependsOn  []string          `json:"dependsOn,omitempty"`
+	Status     BuildStatus       `json:"status,omitempty"`
+	Priority   int               `json:"priority,omitempty"`
+	Lease      *Lease            `json:"lease,omitempty"`
+	Sequence   int64             `json:"sequence"`
+	Attempt    int               `json:"attempt"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	UpdatedAt  time.Time         `json:"updatedAt"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	ExpiresAt  *time.Time        `json:"expiresAt,omitempty"`
+
+	// FailureReason and ExitCode say why a failed build failed. They're
+	// set by FailBuild, and dropped whenever the build leaves failed.
+	FailureReason string `json:"failureReason,omitempty"`
+	ExitCode      int    `json:"exitCode,omitempty"`
+
+	// Quarantined is set by the service on a stored build that it can't
+	// read cleanly, such as one written before a validation rule tightened;
+	// Problems says why. Such builds are still listed, so operators can find
+	// and fix them without one bad record breaking every list.
+	Quarantined bool             `json:"quarantined,omitempty"`
+	Problems    ValidationErrors `json:"problems,omitempty"`
+
+	// StatusHistory is kept by the service: every status the build has
+	// been through, up to MaxStatusHistory of the latest.
+	StatusHistory []StatusTransition `json:"statusHistory,omitempty"`
+
+	// SpecHash is kept by the service: a hash of the build's spec, equal
+	// for builds with the same name, steps, labels, parameters and
+	// dependencies, to find duplicates with FindBuildsBySpecHash.
+	SpecHash string `json:"specHash,omitempty"`
+
+	// Outputs are small results of the build, such as a version string,
+	// each at most Limits.MaxOutputBytes. They're usually set one at a time
+	// with SetOutput.
+	Outputs map[string]string `json:"outputs,omitempty"`
+
+	// GroupID puts the build in a group, such as the jobs of one CI
+	// matrix, to be listed, summarized and cancelled together.
+	GroupID string `json:"groupId,omitempty"`
+
+	// CreatedBy is kept by the service: the actor (see ActorFromContext)
+	// who created the build, if there was one. Unlike StatusHistory it's
+	// never trimmed, so it's what says who owns the build.
+	CreatedBy string `json:"createdBy,omitempty"`
+
+	// extra and schema are kept by the service for persisted builds: the
+	// fields they were read back with that this version doesn't know, and
+	// the schema version they were written with if it's newer than
+	// CurrentSchemaVersion. They're written back with the build.
+	extra  map[string]json.RawMessage
+	schema int
+}
+
+// Lease records which worker is running a build, and until when. A worker
+// that doesn't finish or renew before ExpiresAt loses the build.
+type Lease struct {
+	WorkerID  string    `json:"workerId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// BuildStatus is where a build is in its lifecycle.
+type BuildStatus string
+
+const (
+	StatusPending   BuildStatus = "pending"
+	StatusRunning   BuildStatus = "running"
+	StatusSucceeded BuildStatus = "succeeded"
+	StatusFailed    BuildStatus = "failed"
+	StatusCancelled BuildStatus = "cancelled"
+)
+
+// Terminal reports whether a build in this status has finished.
+func (s BuildStatus) Terminal() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusCancelled
+}
+
+func (s BuildStatus) valid() bool {
+	return s == StatusPending || s == StatusRunning || s.Terminal()
+}
+
+// Step is a single unit of work within a build, run in order. Status is
+// reported by the worker running the build; empty means pending.
+type Step struct {
+	Name   string      `json:"name,omitempty"`
+	Image  string      `json:"image,omitempty"`
+	Args   []string    `json:"args,omitempty"`
+	Status BuildStatus `json:"status,omitempty"`
 }
 
 // Service is a simple CRUD interface for user profiles.
 type Service interface {
 	PostBuild(ctx context.Context, b Build) error
+	GetOrCreateBuild(ctx context.Context, b Build) (build Build, created bool, err error)
 	GetBuild(ctx context.Context, id string) (Build, error)
+	GetBuilds(ctx context.Context, ids []string) (found map[string]Build, missing []string, err error)
+	ListBuildStatuses(ctx context.Context, ids []string) (map[string]BuildStatus, error)
+	ReserveID(ctx context.Context, prefix string) (string, error)
+	ListBuilds(ctx context.Context, opts ListOptions) ([]Build, error)
+	ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) ([]Build, error)
 	PutBuild(ctx context.Context, id string, b Build) error
 	PatchBuild(ctx context.Context, id string, b Build) error
+	PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) ([]BatchResult, error)
+	BatchPostBuilds(ctx context.Context, builds []Build) ([]BatchResult, error)
 	DeleteBuild(ctx context.Context, id string) error
+	AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (int64, error)
+	GetBuildLogLength(ctx context.Context, id string) (int64, error)
+	GetBuildLogs(ctx context.Context, id string, step int, from int64) ([]byte, error)
+	ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) error
+	GetLimits(ctx context.Context) (ServiceLimits, error)
+	BuildMetrics(ctx context.Context, window time.Duration) (MetricsSummary, error)
+	FindSucceededByFingerprint(ctx context.Context, fp string) (Build, bool, error)
+	SetOutput(ctx context.Context, id, key, value string) error
+	GetOutput(ctx context.Context, id, key string) (string, error)
+	ListBuildsByGroup(ctx context.Context, groupID string) ([]Build, error)
+	CancelGroup(ctx context.Context, groupID string) (cancelled int, err error)
+	GroupStatus(ctx context.Context, groupID string) (GroupSummary, error)
+	ValidateBuild(ctx context.Context, b Build) (ValidationErrors, error)
+	LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (Build, bool, error)
+	ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (Build, bool, error)
+	ForceReleaseLease(ctx context.Context, id string) error
+	QueuePosition(ctx context.Context, id string) (position int, estimatedWait time.Duration, err error)
+	CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (bool, error)
+	CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (bool, error)
+	RerunFailedSteps(ctx context.Context, id string) (Build, error)
+	FailBuild(ctx context.Context, id, reason string, exitCode int) error
+	RenameBuild(ctx context.Context, oldID, newID string) error
+	ListLabelKeys(ctx context.Context) ([]string, error)
+	ListLabelValues(ctx context.Context, key string) ([]string, error)
+	FindBuildsBySpecHash(ctx context.Context, hash string) ([]Build, error)
 }
 
 var (
 	ErrInconsistentIDs = errors.New("inconsistent IDs")
 	ErrAlreadyExists   = errors.New("already exists")
 	ErrNotFound        = errors.New("not found")
+
+	// ErrRangeNotSatisfiable is returned when appended log bytes don't start
+	// exactly at the current end of the stored log.
+	ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+	// ErrInvalidTransition is returned when a build isn't in a status the
+	// requested change can start from.
+	ErrInvalidTransition = errors.New("invalid status transition")
 )
 
-type inmemService struct {
-	mtx sync.RWMutex
-	m   map[string]Build
+type buildService struct {
+	mtx       sync.RWMutex
+	repo      Repository
+	clock     Clock
+	logs      map[string][]byte
+	logSteps  map[string][]logSegment // which step wrote each part of logs
+	events    *EventHub
+	limits    Limits
+	seq       int64 // last assigned Sequence; restarts from zero with the process
+	stats     *RunStats
+	queueWait metrics.Histogram // nil unless WithQueueWaitMetrics
+	wal       *wal              // nil unless WithPersistence
+	strict    bool              // WithStrictIDs
+	fifo      bool              // WithStrictFIFO
+	dedup     bool              // WithSpecDedup
+
+	maxRunning int // WithMaxConcurrentRunning
+	running    int // builds in s.repo with StatusRunning
+
+	dependents map[string]map[string]struct{} // see link
+
+	reservations   map[string]reservation
+	reservationTTL time.Duration
+
+	defaultTTL      time.Duration // WithDefaultTTL
+	janitorInterval time.Duration // WithExpiryJanitor
+	stop            chan struct{} // closed by Close to stop the janitor
+	stopOnce        sync.Once
+	janitor         sync.WaitGroup
+
+	cipher          Cipher // nil unless WithEncryption
+	sensitivePrefix string
+	labelAuthz      Authorizer // nil unless WithLabelAuthorizer
+}
+
+// InmemOption configures the service returned by NewService, and by
+// NewInmemService, which is NewService over NewInmemRepository.
+type InmemOption func(*buildService)
+
+// WithEvents publishes a BuildEvent to hub after every successful mutation.
+// Events are published while the store is locked, so subscribers see them in
+// the order the mutations were applied.
+func WithEvents(hub *EventHub) InmemOption {
+	return func(s *buildService) { s.events = hub }
+}
+
+// WithLimits replaces DefaultLimits for every build written to the service.
+func WithLimits(l Limits) InmemOption {
+	return func(s *buildService) { s.limits = l }
+}
+
+// WithStrictIDs makes PatchBuild require the body's ID, which must match
+// the path ID. By default, a blank body ID is taken to mean the path ID, and
+// only a different one is rejected. Either way mismatches return
+// ErrInconsistentIDs; strict mode also catches clients that forgot the ID.
+func WithStrictIDs(strict bool) InmemOption {
+	return func(s *buildService) { s.strict = strict }
+}
+
+// WithRunStats bases QueuePosition's wait estimates on stats, which is
+// normally fed by ObserveRunDurations. Without it, estimates are zero.
+func WithRunStats(stats *RunStats) InmemOption {
+	return func(s *buildService) { s.stats = stats }
 }
 
-func NewInmemService() Service {
-	return &inmemService{
-		m: map[string]Build{},
+// NewInmemService returns an in-memory Service. It panics if the store
+// can't be opened, which only happens WithPersistence; use OpenInmemService
+// to handle that error instead.
+func NewInmemService(opts ...InmemOption) Service {
+	s, err := OpenInmemService(opts...)
+	if err != nil {
+		panic(err)
 	}
+	return s
 }
 
-func (s *inmemService) PostBuild(ctx context.Context, b Build) error {
+// OpenInmemService is like NewInmemService, but returns an error if the
+// persisted store can't be loaded.
+func OpenInmemService(opts ...InmemOption) (Service, error) {
+	return NewService(NewInmemRepository(), opts...)
+}
+
+// NewService returns a Service storing its builds in repo. Build logs,
+// reservations and the sequence counter are kept in memory whichever
+// repository is used; the sequence resumes from the highest one in repo.
+// WithPersistence logs writes on top of repo, and replays them into it on
+// startup.
+func NewService(repo Repository, opts ...InmemOption) (Service, error) {
+	s := &buildService{
+		repo:     repo,
+		logs:     map[string][]byte{},
+		logSteps: map[string][]logSegment{},
+		limits:   DefaultLimits,
+		clock:    SystemClock,
+
+		reservations:   map[string]reservation{},
+		dependents:     map[string]map[string]struct{}{},
+		reservationTTL: DefaultReservationTTL,
+
+		stop: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	builds, err := repo.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range builds {
+		if b.Sequence > s.seq {
+			s.seq = b.Sequence
+		}
+		s.track("", b.Status)
+		s.link(Build{}, b)
+	}
+	if s.wal != nil {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	if s.janitorInterval > 0 {
+		s.startJanitor()
+	}
+	return s, nil
+}
+
+func (s *buildService) PostBuild(ctx context.Context, b Build) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
+	if errs := b.ValidateWithin(s.limits); errs != nil {
+		return errs
+	}
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	if _, ok := s.m[b.ID]; ok {
+	return s.post(ctx, b)
+}
+
+// post creates b, once it's been validated, unless there's a build with
+// its ID already. It must be called with s.mtx held.
+func (s *buildService) post(ctx context.Context, b Build) error {
+	if err := s.reap(ctx, b.ID); err != nil {
+		return err
+	}
+	if _, err := s.lookup(ctx, b.ID); err == nil {
 		return ErrAlreadyExists // POST = create, don't overwrite
+	} else if err != ErrNotFound {
+		return err
 	}
-	s.m[b.ID] = b
-	return nil
+	if err := s.reserved(ctx, b.ID); err != nil {
+		return err
+	}
+	if err := s.checkDependencies(ctx, b, Build{}); err != nil {
+		return err
+	}
+	if err := s.duplicateSpec(ctx, b); err != nil {
+		return err
+	}
+	_, err := s.create(ctx, b)
+	return err
 }
 
-func (s *inmemService) GetBuild(ctx context.Context, id string) (Build, error) {
+// GetOrCreateBuild returns the build stored as b.ID, creating it from b
+// first if there's none. The check and the creation happen under one
+// write lock, so of concurrent callers with the same ID exactly one
+// creates it. An existing build is returned as is, however it differs
+// from b.
+func (s *buildService) GetOrCreateBuild(ctx context.Context, b Build) (Build, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return Build{}, false, err
+	}
+	ctx = s.begin(ctx)
+	if errs := b.ValidateWithin(s.limits); errs != nil {
+		return Build{}, false, errs
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.reap(ctx, b.ID); err != nil {
+		return Build{}, false, err
+	}
+	existing, err := s.lookup(ctx, b.ID)
+	if err == nil {
+		existing, err = s.view(ctx, existing)
+		return existing, false, err
+	} else if err != ErrNotFound {
+		return Build{}, false, err
+	}
+	if err := s.reserved(ctx, b.ID); err != nil {
+		return Build{}, false, err
+	}
+	if err := s.checkDependencies(ctx, b, Build{}); err != nil {
+		return Build{}, false, err
+	}
+	created, err := s.create(ctx, b)
+	if err != nil {
+		return Build{}, false, err
+	}
+	created, err = s.view(ctx, created)
+	return created, true, err
+}
+
+// create stores b as a new build. It must be called with s.mtx held, once
+// b.ID is known to be free.
+func (s *buildService) create(ctx context.Context, b Build) (Build, error) {
+	b.CreatedAt = s.now(ctx)
+	b.CreatedBy = ActorFromContext(ctx)
+	s.defaultExpiry(&b)
+	s.seq++
+	b.Sequence = s.seq
+	b.Attempt = 1
+	if b.Status == "" {
+		b.Status = StatusPending
+	}
+	return s.save(ctx, BuildCreated, Build{}, b)
+}
+
+func (s *buildService) GetBuild(ctx context.Context, id string) (Build, error) {
+	if err := ctx.Err(); err != nil {
+		return Build{}, err
+	}
+	ctx = s.begin(ctx)
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
-	b, ok := s.m[id]
-	if !ok {
-		return Build{}, ErrNotFound
+	b, err := s.lookup(ctx, id)
+	if err != nil {
+		return Build{}, err
 	}
-	return b, nil
+	return s.view(ctx, b)
+}
+
+// GetBuilds looks up every build in ids under one read lock, so the
+// result is a consistent view of the store. Builds that don't exist are
+// returned in missing, in the order they were asked for; duplicate IDs are
+// looked up once.
+func (s *buildService) GetBuilds(ctx context.Context, ids []string) (map[string]Build, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	found := make(map[string]Build, len(ids))
+	var missing []string
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		b, err := s.lookup(ctx, id)
+		if err == ErrNotFound {
+			missing = append(missing, id)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := s.view(ctx, b)
+		if err != nil {
+			return nil, nil, err
+		}
+		found[id] = v
+	}
+	return found, missing, nil
+}
+
+// ListBuildStatuses returns the status of every build in ids that exists,
+// read under one read lock like GetBuilds. It skips decrypting labels,
+// so it's much cheaper than fetching the builds themselves.
+func (s *buildService) ListBuildStatuses(ctx context.Context, ids []string) (map[string]BuildStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	statuses := make(map[string]BuildStatus, len(ids))
+	for _, id := range ids {
+		b, err := s.lookup(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		statuses[id] = b.Status
+	}
+	return statuses, nil
 }
 
-func (s *inmemService) PutBuild(ctx context.Context, id string, b Build) error {
+// ListBuilds returns every build matching opts.Selector, sorted by
+// opts.SortBy.
+func (s *buildService) ListBuilds(ctx context.Context, opts ListOptions) ([]Build, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+	less, err := lessFunc(opts.SortBy)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	s.mtx.RLock()
+	all, err := s.repo.List(ctx)
+	if err != nil {
+		s.mtx.RUnlock()
+		return nil, err
+	}
+	builds := make([]Build, 0, len(all))
+	now := s.now(ctx)
+	for _, b := range all {
+		if err := ctx.Err(); err != nil {
+			s.mtx.RUnlock()
+			if PartialResultsFromContext(ctx) {
+				sortBuilds(builds, less)
+				return builds, fmt.Errorf("%w: %v", ErrPartialResult, err)
+			}
+			return nil, err
+		}
+		if s.expired(b, now) {
+			continue
+		}
+		b, err := s.view(ctx, b)
+		if err != nil {
+			s.mtx.RUnlock()
+			return nil, err
+		}
+		if opts.matches(b) {
+			builds = append(builds, b)
+		}
+	}
+	s.mtx.RUnlock()
+	sortBuilds(builds, less)
+	return builds, nil
+}
+
+// ListBuildsModifiedBetween returns the builds last changed at or after
+// from and before to, least recently changed first. A zero from or to
+// leaves that end of the range open. Deleted builds aren't reported.
+func (s *buildService) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) ([]Build, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	all, err := s.repo.List(ctx)
+	if err != nil {
+		s.mtx.RUnlock()
+		return nil, err
+	}
+	var builds []Build
+	now := s.now(ctx)
+	for _, b := range all {
+		if s.expired(b, now) || b.UpdatedAt.Before(from) || (!to.IsZero() && !b.UpdatedAt.Before(to)) {
+			continue
+		}
+		b, err := s.view(ctx, b)
+		if err != nil {
+			s.mtx.RUnlock()
+			return nil, err
+		}
+		builds = append(builds, b)
+	}
+	s.mtx.RUnlock()
+	sortBuilds(builds, sortKeys["updatedAt"])
+	return builds, nil
+}
+
+func (s *buildService) PutBuild(ctx context.Context, id string, b Build) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
 	if id != b.ID {
 		return ErrInconsistentIDs
 	}
+	if errs := b.ValidateWithin(s.limits); errs != nil {
+		return errs
+	}
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	s.m[id] = b // PUT = create or update
-	return nil
+	if err := s.reap(ctx, id); err != nil {
+		return err
+	}
+	existing, ok, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.reserved(ctx, id); err != nil {
+			return err
+		}
+	}
+	if err := s.checkDependencies(ctx, b, existing); err != nil {
+		return err
+	}
+	if ok {
+		b.CreatedAt = existing.CreatedAt
+		b.CreatedBy = existing.CreatedBy
+		b.Sequence = existing.Sequence
+		b.Attempt = existing.Attempt
+		if b.ExpiresAt == nil {
+			b.ExpiresAt = existing.ExpiresAt
+		}
+	} else {
+		b.CreatedAt = s.now(ctx)
+		b.CreatedBy = ActorFromContext(ctx)
+		s.defaultExpiry(&b)
+		s.seq++
+		b.Sequence = s.seq
+		b.Attempt = 1
+	}
+	if b.Status == "" {
+		b.Status = StatusPending
+	}
+	if ok {
+		_, err := s.save(ctx, BuildUpdated, existing, b) // PUT = create or update
+		return err
+	}
+	_, err = s.save(ctx, BuildCreated, Build{}, b)
+	return err
 }
 
-func (s *inmemService) PatchBuild(ctx context.Context, id string, b Build) error {
-	if b.ID != "" && id != b.ID {
+func (s *buildService) PatchBuild(ctx context.Context, id string, b Build) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
+	if id != b.ID && (b.ID != "" || s.strict) {
 		return ErrInconsistentIDs
 	}
 
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
+	return s.patch(ctx, id, b)
+}
 
-	existing, ok := s.m[id]
-	if !ok {
-		return ErrNotFound // PATCH = update existing, don't create
+// patch merges b into build id. The caller must hold the write lock.
+func (s *buildService) patch(ctx context.Context, id string, b Build) error {
+	prev, err := s.lookup(ctx, id)
+	if err != nil {
+		return err // PATCH = update existing, don't create
 	}
+	existing := prev
 
 	// We assume that it's not possible to PATCH the ID, and that it's not
 	// possible to PATCH any field to its zero value. That is, the zero value
@@ -91,16 +630,456 @@ func (s *inmemService) PatchBuild(ctx context.Context, id string, b Build) error
 	if b.Name != "" {
 		existing.Name = b.Name
 	}
-	s.m[id] = existing
+	if b.Steps != nil {
+		existing.Steps = b.Steps
+	}
+	if b.Labels != nil {
+		existing.Labels = b.Labels
+	}
+	if b.Parameters != nil {
+		existing.Parameters = b.Parameters
+	}
+	if b.DependsOn != nil {
+		existing.DependsOn = b.DependsOn
+	}
+	if b.Priority != 0 {
+		existing.Priority = b.Priority // PUT to reset it to zero
+	}
+	if b.ExpiresAt != nil {
+		existing.ExpiresAt = b.ExpiresAt
+	}
+	if b.Status != "" {
+		existing.Status = b.Status
+	}
+	if b.Outputs != nil {
+		existing.Outputs = b.Outputs
+	}
+	if b.GroupID != "" {
+		existing.GroupID = b.GroupID
+	}
+	if errs := existing.ValidateWithin(s.limits); errs != nil {
+		return errs
+	}
+	if err := s.checkDependencies(ctx, existing, prev); err != nil {
+		return err
+	}
+	_, err = s.save(ctx, BuildUpdated, prev, existing)
+	return err
+}
+
+// CompareAndSetStatus sets the status of a build to next only if it's
+// currently expected, and reports whether it did. The check and the update
+// happen under one lock, so workers reporting results concurrently can't
+// overwrite each other.
+func (s *buildService) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	ctx = s.begin(ctx)
+	if !next.valid() {
+		var errs ValidationErrors
+		errs.add("status", "unknown status %q", next)
+		return false, errs
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	prev, err := s.lookup(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if prev.Status != expected {
+		return false, nil
+	}
+	b := prev
+	b.Status = next
+	if _, err := s.save(ctx, BuildUpdated, prev, b); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CompareAndDeleteBuild deletes a build only if it's unchanged since it was
+// read with the given UpdatedAt, and reports whether it did. The check and
+// the delete happen under one lock, so a caller deciding from a listing
+// can't delete a build that has changed since.
+func (s *buildService) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	b, err := s.lookup(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if !b.UpdatedAt.Equal(updatedAt) {
+		return false, nil
+	}
+	return true, s.remove(ctx, b)
+}
+
+// RerunFailedSteps sends a finished build back to pending so only what
+// didn't succeed runs again: failed steps, and the steps after the first
+// failure that never got to succeed, are reset to pending, while succeeded
+// steps keep their status, and Attempt is incremented. ErrInvalidTransition
+// is returned if the build isn't terminal or has no failed step.
+//
+// The check and the increment happen under one lock, so of several
+// concurrent reruns of the same build exactly one succeeds, with a new
+// attempt number; the others find the build pending again and get
+// ErrInvalidTransition. No two attempts ever share a number.
+func (s *buildService) RerunFailedSteps(ctx context.Context, id string) (Build, error) {
+	if err := ctx.Err(); err != nil {
+		return Build{}, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	prev, err := s.lookup(ctx, id)
+	if err != nil {
+		return Build{}, err
+	}
+	if !prev.Status.Terminal() {
+		return Build{}, fmt.Errorf("%w: build is %s", ErrInvalidTransition, prev.Status)
+	}
+	b := prev
+	b.Steps = make([]Step, len(prev.Steps))
+	failed := false
+	for i, st := range prev.Steps {
+		if st.Status == StatusFailed {
+			failed = true
+		}
+		if failed && st.Status != StatusSucceeded {
+			st.Status = StatusPending
+		}
+		b.Steps[i] = st
+	}
+	if !failed {
+		return Build{}, fmt.Errorf("%w: build has no failed steps", ErrInvalidTransition)
+	}
+	b.Status = StatusPending
+	b.Lease = nil
+	b.Attempt = prev.Attempt + 1
+	b, err = s.save(ctx, BuildUpdated, prev, b)
+	if err != nil {
+		return Build{}, err
+	}
+	return s.view(ctx, b)
+}
+
+// FailBuild moves a build that hasn't finished to failed, recording why.
+// ErrInvalidTransition is returned if it's already terminal.
+func (s *buildService) FailBuild(ctx context.Context, id, reason string, exitCode int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	prev, err := s.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if prev.Status.Terminal() {
+		return fmt.Errorf("%w: build is %s", ErrInvalidTransition, prev.Status)
+	}
+	b := prev
+	b.Status = StatusFailed
+	b.Lease = nil
+	b.FailureReason, b.ExitCode = reason, exitCode
+	_, err = s.save(ctx, BuildUpdated, prev, b)
+	return err
+}
+
+// RenameBuild moves build oldID, with its logs, to newID, and points every
+// build that depends on oldID at newID instead, as found in the reverse
+// dependency index. It all happens under one write lock, so readers see
+// either the old ID or the new one, never both or neither. Subscribers see
+// oldID deleted, newID created, then each dependent updated. Like a
+// create, it fails with ErrAlreadyExists if newID is reserved for someone
+// else.
+func (s *buildService) RenameBuild(ctx context.Context, oldID, newID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
+	if p := idProblem(newID); p != "" {
+		var errs ValidationErrors
+		errs.add("id", "%s", p)
+		return errs
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.reap(ctx, newID); err != nil {
+		return err
+	}
+	prev, err := s.lookup(ctx, oldID)
+	if err != nil {
+		return err
+	}
+	if oldID == newID {
+		return nil
+	}
+	if _, err := s.lookup(ctx, newID); err == nil {
+		return ErrAlreadyExists
+	} else if err != ErrNotFound {
+		return err
+	}
+	if err := s.reserved(ctx, newID); err != nil {
+		return err
+	}
+	dependents := s.dependentsOf(oldID)
+
+	logs, steps := s.logs[oldID], s.logSteps[oldID]
+	if err := s.remove(ctx, prev); err != nil {
+		return err
+	}
+	renamed := prev
+	renamed.ID = newID
+	if _, err := s.save(ctx, BuildCreated, prev, renamed); err != nil {
+		return err
+	}
+	if len(logs) > 0 {
+		if err := s.persist(walRecord{Op: walLogs, ID: newID, Data: logs, Steps: steps}); err != nil {
+			return err
+		}
+		s.appendLogs(newID, logs, steps)
+	}
+
+	for _, id := range dependents {
+		b, err := s.lookup(ctx, id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		deps, changed := make([]string, len(b.DependsOn)), false
+		for i, dep := range b.DependsOn {
+			if dep == oldID {
+				dep, changed = newID, true
+			}
+			deps[i] = dep
+		}
+		if !changed {
+			continue
+		}
+		next := b
+		next.DependsOn = deps
+		if _, err := s.save(ctx, BuildUpdated, b, next); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (s *inmemService) DeleteBuild(ctx context.Context, id string) error {
+func (s *buildService) DeleteBuild(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx = s.begin(ctx)
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	if _, ok := s.m[id]; !ok {
-		return ErrNotFound
+	b, err := s.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.remove(ctx, b)
+}
+
+// remove deletes b and its logs. It must be called with s.mtx held.
+func (s *buildService) remove(ctx context.Context, b Build) error {
+	if err := s.persist(walRecord{Op: walDelete, ID: b.ID}); err != nil {
+		return err
+	}
+	if err := s.repo.Delete(ctx, b.ID); err != nil {
+		return err
 	}
-	delete(s.m, id)
+	delete(s.logs, b.ID)
+	delete(s.logSteps, b.ID)
+	s.track(b.Status, "")
+	s.link(b, Build{})
+	s.publish(ctx, BuildDeleted, b, b)
 	return nil
 }
+
+// save stores next, stamping the run timestamps for any status transition
+// from prev, and publishes t. If the service is persistent, the write-ahead
+// log is appended first, and nothing changes if that fails. It must be
+// called with s.mtx held.
+func (s *buildService) save(ctx context.Context, t BuildEventType, prev, next Build) (Build, error) {
+	if err := s.admit(prev, next); err != nil {
+		return Build{}, err
+	}
+	now := s.now(ctx)
+	stampTransition(prev, &next, now)
+	recordTransition(ctx, prev, &next, now)
+	next.UpdatedAt = now
+	if next.extra == nil && next.schema == 0 {
+		next.extra, next.schema = prev.extra, prev.schema // unknown to the caller, not dropped by it
+	}
+	if next.Status != StatusFailed {
+		next.FailureReason, next.ExitCode = "", 0
+	}
+	next.Quarantined, next.Problems = false, nil
+	next.SpecHash = s.specHash(next)
+	if prev.Quarantined {
+		next = s.quarantine(next) // a status change alone doesn't fix it
+	}
+	labels, err := s.seal(prev.Labels, next.Labels)
+	if err != nil {
+		return Build{}, err
+	}
+	next.Labels = labels
+	if err := s.persist(walRecord{Op: walPut, Build: &next}); err != nil {
+		return Build{}, err
+	}
+	stored, _, err := s.repo.Get(ctx, next.ID)
+	if err != nil {
+		return Build{}, err
+	}
+	if err := s.repo.Save(ctx, next); err != nil {
+		return Build{}, err
+	}
+	s.track(stored.Status, next.Status)
+	s.link(stored, next)
+	delete(s.reservations, next.ID) // claimed
+	s.observeQueueWait(prev, next)
+	s.publish(ctx, t, prev, next)
+	return next, nil
+}
+
+// stampTransition maintains StartedAt and FinishedAt, which are owned by the
+// service: they're carried over from prev, set when next enters running or a
+// terminal status, and cleared when it goes back to pending.
+func stampTransition(prev Build, next *Build, now time.Time) {
+	next.StartedAt, next.FinishedAt = prev.StartedAt, prev.FinishedAt
+	switch {
+	case next.Status == StatusPending:
+		next.StartedAt, next.FinishedAt = nil, nil
+	case next.Status == StatusRunning && prev.Status != StatusRunning:
+		next.StartedAt, next.FinishedAt = &now, nil
+	case next.Status.Terminal() && !prev.Status.Terminal():
+		next.FinishedAt = &now
+	}
+}
+
+// publish emits t for the mutation from prev to next, plus BuildFinished if
+// the mutation moved the build into a terminal status. It must be called with
+// s.mtx held.
+func (s *buildService) publish(ctx context.Context, t BuildEventType, prev, next Build) {
+	if s.events == nil {
+		return
+	}
+	baggage := BaggageFromContext(ctx)
+	at := s.now(ctx)
+	s.events.Publish(BuildEvent{Type: t, At: at, Build: next, baggage: baggage})
+	if t != BuildDeleted && next.Status.Terminal() && !prev.Status.Terminal() {
+		s.events.Publish(BuildEvent{Type: BuildFinished, At: at, Build: next, baggage: baggage})
+	}
+}
+
+func (s *buildService) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	b, err := s.lookup(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	logs := s.logs[id]
+	if offset != int64(len(logs)) {
+		// A gap would lose lines and an overlap would duplicate them, so the
+		// caller has to resume from exactly where we left off.
+		return int64(len(logs)), ErrRangeNotSatisfiable
+	}
+	steps := []logSegment{{Step: currentStep(b), At: s.now(ctx)}}
+	if err := s.persist(walRecord{Op: walLogs, ID: id, Offset: offset, Data: p, Steps: steps}); err != nil {
+		return int64(len(logs)), err
+	}
+	s.appendLogs(id, p, steps)
+	return int64(len(s.logs[id])), nil
+}
+
+// ValidateBuild reports every problem with b, including dependencies on
+// missing builds and dependency cycles, without side effects. An existing
+// build with the same ID is not a problem; it's treated as being replaced.
+// The writes that set DependsOn make the same checks, so a build that
+// passes here is one PostBuild or PutBuild will accept.
+func (s *buildService) ValidateBuild(ctx context.Context, b Build) (ValidationErrors, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var lookupErr error
+	errs := validateAgainst(b, s.limits, func(id string) (Build, bool) {
+		b, err := s.lookup(ctx, id)
+		if err != nil && err != ErrNotFound && lookupErr == nil {
+			lookupErr = err
+		}
+		return b, err == nil
+	})
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	return errs, nil
+}
+
+// checkDependencies runs ValidateBuild's dependency checks on b as it's
+// about to replace prev, the zero Build for a create: dependencies must
+// exist, unless prev already had them, and b mustn't close a cycle. It
+// must be called with s.mtx held.
+func (s *buildService) checkDependencies(ctx context.Context, b, prev Build) error {
+	if len(b.DependsOn) == 0 {
+		return nil // nothing to check, and nothing can lead back to b
+	}
+	var lookupErr error
+	// Only a build something depends on can close a cycle.
+	mayCycle := len(s.dependents[b.ID]) > 0
+	errs := dependencyProblems(b, prev.DependsOn, mayCycle, func(id string) (Build, bool) {
+		b, err := s.lookup(ctx, id)
+		if err != nil && err != ErrNotFound && lookupErr == nil {
+			lookupErr = err
+		}
+		return b, err == nil
+	})
+	if lookupErr != nil {
+		return lookupErr
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// lookup returns the build stored as id, treating an expired build as
+// gone whether or not it has been reaped yet: ErrNotFound is returned for
+// either. It must be called with s.mtx held.
+func (s *buildService) lookup(ctx context.Context, id string) (Build, error) {
+	b, ok, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return Build{}, err
+	}
+	if !ok || s.expired(b, s.now(ctx)) {
+		return Build{}, ErrNotFound
+	}
+	return b, nil
+}
+
+func (s *buildService) GetBuildLogLength(ctx context.Context, id string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if _, err := s.lookup(ctx, id); err != nil {
+		return 0, err
+	}
+	return int64(len(s.logs[id])), nil
+}
@@ -0,0 +1,43 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPatchBuildIDConsistency(t *testing.T) {
+	for _, tc := range []struct {
+		mode   string
+		strict bool
+		bodyID string
+		want   error
+	}{
+		{"lenient", false, "", nil},
+		{"lenient", false, "b1", nil},
+		{"lenient", false, "b2", ErrInconsistentIDs},
+		{"strict", true, "", ErrInconsistentIDs},
+		{"strict", true, "b1", nil},
+		{"strict", true, "b2", ErrInconsistentIDs},
+	} {
+		t.Run(tc.mode+"/body ID "+tc.bodyID, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewInmemService(WithStrictIDs(tc.strict))
+			if err := s.PostBuild(ctx, Build{ID: "b1", Name: "before"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.PatchBuild(ctx, "b1", Build{ID: tc.bodyID, Name: "after"}); err != tc.want {
+				t.Fatalf("PatchBuild: got %v, want %v", err, tc.want)
+			}
+			want := "after"
+			if tc.want != nil {
+				want = "before"
+			}
+			if b, _ := s.GetBuild(ctx, "b1"); b.Name != want {
+				t.Errorf("Name: got %q, want %q", b.Name, want)
+			}
+			if _, err := s.GetBuild(ctx, "b2"); err != ErrNotFound {
+				t.Errorf("b2: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
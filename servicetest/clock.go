@@ -0,0 +1,43 @@
+package servicetest
+
+import (
+	"sync"
+	"time"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+)
+
+// FakeClock is a gokitbuildservice.Clock that only moves when told to.
+// It's safe for concurrent use.
+type FakeClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+var _ gokitbuildservice.Clock = (*FakeClock)(nil)
+
+// NewFakeClock returns a FakeClock stopped at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to now, which may be in the past.
+func (c *FakeClock) Set(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = now
+}
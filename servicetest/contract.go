@@ -0,0 +1,255 @@
+package servicetest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+)
+
+// ContractTest runs the behavior every Service implementation must share
+// against s, as subtests of t. s should start out empty, or at least hold
+// no pending builds, since the lease checks expect to find only their own.
+// Every build the suite creates has a random ID prefix, and the suite
+// deletes what it creates, so one s can be reused across runs.
+func ContractTest(t *testing.T, s gokitbuildservice.Service) {
+	prefix := randomPrefix(t)
+	id := func(name string) string { return prefix + "-" + name }
+	ctx := context.Background()
+
+	mustPost := func(t *testing.T, b gokitbuildservice.Build) {
+		t.Helper()
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatalf("PostBuild(%q): %v", b.ID, err)
+		}
+		t.Cleanup(func() { s.DeleteBuild(ctx, b.ID) })
+	}
+	wantErr := func(t *testing.T, op string, err, want error) {
+		t.Helper()
+		if !errors.Is(err, want) {
+			t.Fatalf("%s: got error %v, want %v", op, err, want)
+		}
+	}
+
+	t.Run("PostThenGet", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("post"), Name: "post", Labels: map[string]string{"env": "test"}})
+		b, err := s.GetBuild(ctx, id("post"))
+		if err != nil {
+			t.Fatalf("GetBuild: %v", err)
+		}
+		if b.Name != "post" || b.Labels["env"] != "test" {
+			t.Errorf("GetBuild: got %+v", b)
+		}
+		if b.Status != gokitbuildservice.StatusPending {
+			t.Errorf("new build status: got %q, want %q", b.Status, gokitbuildservice.StatusPending)
+		}
+		if b.CreatedAt.IsZero() || b.Sequence == 0 {
+			t.Errorf("new build: CreatedAt and Sequence must be assigned, got %v and %d", b.CreatedAt, b.Sequence)
+		}
+	})
+
+	t.Run("PostDuplicate", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("dup")})
+		wantErr(t, "second PostBuild", s.PostBuild(ctx, gokitbuildservice.Build{ID: id("dup")}), gokitbuildservice.ErrAlreadyExists)
+	})
+
+	t.Run("PostInvalid", func(t *testing.T) {
+		wantErr(t, "PostBuild without ID", s.PostBuild(ctx, gokitbuildservice.Build{}), gokitbuildservice.ErrValidation)
+	})
+
+	t.Run("GetMissing", func(t *testing.T) {
+		_, err := s.GetBuild(ctx, id("missing"))
+		wantErr(t, "GetBuild", err, gokitbuildservice.ErrNotFound)
+	})
+
+	t.Run("PutCreatesAndReplaces", func(t *testing.T) {
+		t.Cleanup(func() { s.DeleteBuild(ctx, id("put")) })
+		if err := s.PutBuild(ctx, id("put"), gokitbuildservice.Build{ID: id("put"), Name: "first"}); err != nil {
+			t.Fatalf("PutBuild (create): %v", err)
+		}
+		created, _ := s.GetBuild(ctx, id("put"))
+		if err := s.PutBuild(ctx, id("put"), gokitbuildservice.Build{ID: id("put"), Name: "second"}); err != nil {
+			t.Fatalf("PutBuild (replace): %v", err)
+		}
+		b, _ := s.GetBuild(ctx, id("put"))
+		if b.Name != "second" {
+			t.Errorf("after replace: got name %q, want %q", b.Name, "second")
+		}
+		if b.Sequence != created.Sequence || !b.CreatedAt.Equal(created.CreatedAt) {
+			t.Errorf("replace must keep CreatedAt and Sequence")
+		}
+	})
+
+	t.Run("PutInconsistentIDs", func(t *testing.T) {
+		wantErr(t, "PutBuild", s.PutBuild(ctx, id("a"), gokitbuildservice.Build{ID: id("b")}), gokitbuildservice.ErrInconsistentIDs)
+	})
+
+	t.Run("PatchMergesFields", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("patch"), Name: "before", Labels: map[string]string{"k": "v"}})
+		if err := s.PatchBuild(ctx, id("patch"), gokitbuildservice.Build{ID: id("patch"), Name: "after"}); err != nil {
+			t.Fatalf("PatchBuild: %v", err)
+		}
+		b, _ := s.GetBuild(ctx, id("patch"))
+		if b.Name != "after" || b.Labels["k"] != "v" {
+			t.Errorf("PatchBuild must only change the given fields, got %+v", b)
+		}
+		wantErr(t, "PatchBuild missing", s.PatchBuild(ctx, id("missing"), gokitbuildservice.Build{ID: id("missing"), Name: "x"}), gokitbuildservice.ErrNotFound)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := s.PostBuild(ctx, gokitbuildservice.Build{ID: id("delete")}); err != nil {
+			t.Fatalf("PostBuild: %v", err)
+		}
+		if err := s.DeleteBuild(ctx, id("delete")); err != nil {
+			t.Fatalf("DeleteBuild: %v", err)
+		}
+		_, err := s.GetBuild(ctx, id("delete"))
+		wantErr(t, "GetBuild after delete", err, gokitbuildservice.ErrNotFound)
+		wantErr(t, "second DeleteBuild", s.DeleteBuild(ctx, id("delete")), gokitbuildservice.ErrNotFound)
+	})
+
+	t.Run("ListSortsAndSelects", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("list-b"), Name: "b", Labels: map[string]string{"suite": prefix}})
+		mustPost(t, gokitbuildservice.Build{ID: id("list-a"), Name: "a", Labels: map[string]string{"suite": prefix}})
+		sel, err := gokitbuildservice.ParseSelector("suite=" + prefix)
+		if err != nil {
+			t.Fatalf("ParseSelector: %v", err)
+		}
+		builds, err := s.ListBuilds(ctx, gokitbuildservice.ListOptions{SortBy: "id", Selector: sel})
+		if err != nil {
+			t.Fatalf("ListBuilds: %v", err)
+		}
+		if len(builds) != 2 || builds[0].ID != id("list-a") || builds[1].ID != id("list-b") {
+			t.Errorf("ListBuilds by id: got %v", ids(builds))
+		}
+		builds, _ = s.ListBuilds(ctx, gokitbuildservice.ListOptions{Selector: sel})
+		if len(builds) != 2 || builds[0].ID != id("list-a") {
+			t.Errorf("ListBuilds must default to newest first: got %v", ids(builds))
+		}
+		_, err = s.ListBuilds(ctx, gokitbuildservice.ListOptions{SortBy: "bogus"})
+		wantErr(t, "ListBuilds with unknown sort key", err, gokitbuildservice.ErrValidation)
+	})
+
+	t.Run("AppendLogs", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("logs")})
+		if n, err := s.AppendBuildLogs(ctx, id("logs"), 0, []byte("hello ")); err != nil || n != 6 {
+			t.Fatalf("AppendBuildLogs: got %d, %v; want 6, nil", n, err)
+		}
+		if n, err := s.AppendBuildLogs(ctx, id("logs"), 6, []byte("world")); err != nil || n != 11 {
+			t.Fatalf("AppendBuildLogs: got %d, %v; want 11, nil", n, err)
+		}
+		n, err := s.AppendBuildLogs(ctx, id("logs"), 3, []byte("x"))
+		wantErr(t, "AppendBuildLogs at a stale offset", err, gokitbuildservice.ErrRangeNotSatisfiable)
+		if n != 11 {
+			t.Errorf("a rejected append must report the current length, got %d", n)
+		}
+		if n, _ := s.GetBuildLogLength(ctx, id("logs")); n != 11 {
+			t.Errorf("GetBuildLogLength: got %d, want 11", n)
+		}
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		problems, err := s.ValidateBuild(ctx, gokitbuildservice.Build{ID: id("validate"), DependsOn: []string{id("validate")}})
+		if err != nil {
+			t.Fatalf("ValidateBuild: %v", err)
+		}
+		if len(problems) == 0 {
+			t.Errorf("ValidateBuild must report a self-dependency")
+		}
+		if _, err := s.GetBuild(ctx, id("validate")); !errors.Is(err, gokitbuildservice.ErrNotFound) {
+			t.Errorf("ValidateBuild must not create the build")
+		}
+	})
+
+	t.Run("LeaseAndRelease", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("lease")})
+		b, ok, err := s.LeaseBuild(ctx, "contract-worker", time.Minute)
+		if err != nil || !ok {
+			t.Fatalf("LeaseBuild: got %v, %v", ok, err)
+		}
+		if b.ID != id("lease") || b.Status != gokitbuildservice.StatusRunning || b.Lease == nil || b.Lease.WorkerID != "contract-worker" {
+			t.Fatalf("LeaseBuild: got %+v", b)
+		}
+		if _, ok, _ := s.LeaseBuild(ctx, "other-worker", time.Minute); ok {
+			t.Errorf("a leased build must not be leased again before it expires")
+		}
+		if err := s.ForceReleaseLease(ctx, id("lease")); err != nil {
+			t.Fatalf("ForceReleaseLease: %v", err)
+		}
+		b, _ = s.GetBuild(ctx, id("lease"))
+		if b.Lease != nil || b.Status != gokitbuildservice.StatusPending {
+			t.Errorf("after ForceReleaseLease: got %+v", b)
+		}
+		wantErr(t, "second ForceReleaseLease", s.ForceReleaseLease(ctx, id("lease")), gokitbuildservice.ErrNotFound)
+	})
+
+	t.Run("CompareAndSetStatus", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("cas")})
+		if ok, err := s.CompareAndSetStatus(ctx, id("cas"), gokitbuildservice.StatusRunning, gokitbuildservice.StatusFailed); err != nil || ok {
+			t.Errorf("CompareAndSetStatus with the wrong expectation: got %v, %v; want false, nil", ok, err)
+		}
+		if ok, err := s.CompareAndSetStatus(ctx, id("cas"), gokitbuildservice.StatusPending, gokitbuildservice.StatusRunning); err != nil || !ok {
+			t.Errorf("CompareAndSetStatus: got %v, %v; want true, nil", ok, err)
+		}
+		if b, _ := s.GetBuild(ctx, id("cas")); b.Status != gokitbuildservice.StatusRunning {
+			t.Errorf("after CompareAndSetStatus: got status %q", b.Status)
+		}
+		_, err := s.CompareAndSetStatus(ctx, id("missing"), gokitbuildservice.StatusPending, gokitbuildservice.StatusRunning)
+		wantErr(t, "CompareAndSetStatus missing", err, gokitbuildservice.ErrNotFound)
+	})
+
+	t.Run("CompareAndDeleteBuild", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("cad")})
+		b, err := s.GetBuild(ctx, id("cad"))
+		if err != nil {
+			t.Fatalf("GetBuild: %v", err)
+		}
+		if ok, err := s.CompareAndDeleteBuild(ctx, id("cad"), b.UpdatedAt.Add(-time.Second)); err != nil || ok {
+			t.Errorf("CompareAndDeleteBuild with a stale UpdatedAt: got %v, %v; want false, nil", ok, err)
+		}
+		if ok, err := s.CompareAndDeleteBuild(ctx, id("cad"), b.UpdatedAt); err != nil || !ok {
+			t.Errorf("CompareAndDeleteBuild: got %v, %v; want true, nil", ok, err)
+		}
+		_, err = s.GetBuild(ctx, id("cad"))
+		wantErr(t, "GetBuild after CompareAndDeleteBuild", err, gokitbuildservice.ErrNotFound)
+	})
+
+	t.Run("QueuePosition", func(t *testing.T) {
+		mustPost(t, gokitbuildservice.Build{ID: id("queue")})
+		if pos, _, err := s.QueuePosition(ctx, id("queue")); err != nil || pos < 1 {
+			t.Errorf("QueuePosition: got %d, %v", pos, err)
+		}
+		_, _, err := s.QueuePosition(ctx, id("missing"))
+		wantErr(t, "QueuePosition missing", err, gokitbuildservice.ErrNotFound)
+	})
+
+	t.Run("CanceledContext", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		wantErr(t, "PostBuild", s.PostBuild(ctx, gokitbuildservice.Build{ID: id("canceled")}), context.Canceled)
+		_, err := s.GetBuild(ctx, id("canceled"))
+		wantErr(t, "GetBuild", err, context.Canceled)
+		_, err = s.ListBuilds(ctx, gokitbuildservice.ListOptions{})
+		wantErr(t, "ListBuilds", err, context.Canceled)
+	})
+}
+
+func randomPrefix(t *testing.T) string {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	return "contract-" + hex.EncodeToString(buf[:])
+}
+
+func ids(builds []gokitbuildservice.Build) []string {
+	out := make([]string, len(builds))
+	for i, b := range builds {
+		out[i] = b.ID
+	}
+	return out
+}
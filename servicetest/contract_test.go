@@ -0,0 +1,12 @@
+package servicetest_test
+
+import (
+	"testing"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+func TestInmemServiceContract(t *testing.T) {
+	servicetest.ContractTest(t, gokitbuildservice.NewInmemService())
+}
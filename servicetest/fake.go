@@ -0,0 +1,501 @@
+// Package servicetest provides helpers for testing code that uses, or
+// implements, the build service.
+package servicetest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+)
+
+// Call is one recorded call to a FakeService. Args holds every argument
+// after the context, in order.
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// FakeService is a Service whose behavior is programmed per method. Each
+// method calls the matching Func field if it's set, and returns zero values
+// otherwise. If Delays has an entry for the method, the call first waits
+// that long, or returns the context's error if it's done sooner. Every call
+// is recorded, whatever it returns.
+//
+// The zero value is ready to use. Set the fields before sharing the fake
+// between goroutines.
+type FakeService struct {
+	PostBuildFunc                  func(ctx context.Context, b gokitbuildservice.Build) error
+	GetBuildFunc                   func(ctx context.Context, id string) (gokitbuildservice.Build, error)
+	GetBuildsFunc                  func(ctx context.Context, ids []string) (map[string]gokitbuildservice.Build, []string, error)
+	ListBuildStatusesFunc          func(ctx context.Context, ids []string) (map[string]gokitbuildservice.BuildStatus, error)
+	ReserveIDFunc                  func(ctx context.Context, prefix string) (string, error)
+	ListBuildsFunc                 func(ctx context.Context, opts gokitbuildservice.ListOptions) ([]gokitbuildservice.Build, error)
+	PutBuildFunc                   func(ctx context.Context, id string, b gokitbuildservice.Build) error
+	PatchBuildFunc                 func(ctx context.Context, id string, b gokitbuildservice.Build) error
+	DeleteBuildFunc                func(ctx context.Context, id string) error
+	AppendBuildLogsFunc            func(ctx context.Context, id string, offset int64, p []byte) (int64, error)
+	GetBuildLogLengthFunc          func(ctx context.Context, id string) (int64, error)
+	ValidateBuildFunc              func(ctx context.Context, b gokitbuildservice.Build) (gokitbuildservice.ValidationErrors, error)
+	LeaseBuildFunc                 func(ctx context.Context, workerID string, ttl time.Duration) (gokitbuildservice.Build, bool, error)
+	ClaimAndStartFunc              func(ctx context.Context, workerID string, filter gokitbuildservice.BuildFilter) (gokitbuildservice.Build, bool, error)
+	ForceReleaseLeaseFunc          func(ctx context.Context, id string) error
+	QueuePositionFunc              func(ctx context.Context, id string) (int, time.Duration, error)
+	CompareAndSetStatusFunc        func(ctx context.Context, id string, expected, next gokitbuildservice.BuildStatus) (bool, error)
+	CompareAndDeleteBuildFunc      func(ctx context.Context, id string, updatedAt time.Time) (bool, error)
+	RerunFailedStepsFunc           func(ctx context.Context, id string) (gokitbuildservice.Build, error)
+	ListBuildsModifiedBetweenFunc  func(ctx context.Context, from, to time.Time) ([]gokitbuildservice.Build, error)
+	FailBuildFunc                  func(ctx context.Context, id, reason string, exitCode int) error
+	RenameBuildFunc                func(ctx context.Context, oldID, newID string) error
+	GetOrCreateBuildFunc           func(ctx context.Context, b gokitbuildservice.Build) (gokitbuildservice.Build, bool, error)
+	ListLabelKeysFunc              func(ctx context.Context) ([]string, error)
+	ListLabelValuesFunc            func(ctx context.Context, key string) ([]string, error)
+	PatchBuildsFunc                func(ctx context.Context, ids []string, patch gokitbuildservice.BuildPatch) ([]gokitbuildservice.BatchResult, error)
+	BatchPostBuildsFunc            func(ctx context.Context, builds []gokitbuildservice.Build) ([]gokitbuildservice.BatchResult, error)
+	FindBuildsBySpecHashFunc       func(ctx context.Context, hash string) ([]gokitbuildservice.Build, error)
+	GetBuildLogsFunc               func(ctx context.Context, id string, step int, from int64) ([]byte, error)
+	ReplayBuildFunc                func(ctx context.Context, id string, sink func(gokitbuildservice.BuildEvent) error) error
+	GetLimitsFunc                  func(ctx context.Context) (gokitbuildservice.ServiceLimits, error)
+	BuildMetricsFunc               func(ctx context.Context, window time.Duration) (gokitbuildservice.MetricsSummary, error)
+	FindSucceededByFingerprintFunc func(ctx context.Context, fp string) (gokitbuildservice.Build, bool, error)
+	SetOutputFunc                  func(ctx context.Context, id, key, value string) error
+	GetOutputFunc                  func(ctx context.Context, id, key string) (string, error)
+	ListBuildsByGroupFunc          func(ctx context.Context, groupID string) ([]gokitbuildservice.Build, error)
+	CancelGroupFunc                func(ctx context.Context, groupID string) (int, error)
+	GroupStatusFunc                func(ctx context.Context, groupID string) (gokitbuildservice.GroupSummary, error)
+
+	// Delays maps method names, such as "GetBuild", to how long they take.
+	Delays map[string]time.Duration
+
+	mtx   sync.Mutex
+	calls []Call
+}
+
+var _ gokitbuildservice.Service = (*FakeService)(nil)
+
+// Calls returns every call made so far, oldest first.
+func (f *FakeService) Calls() []Call {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// CallsTo returns the calls made so far to method, oldest first.
+func (f *FakeService) CallsTo(method string) []Call {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var calls []Call
+	for _, c := range f.calls {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the recorded calls.
+func (f *FakeService) Reset() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls = nil
+}
+
+// enter records the call and waits out its delay.
+func (f *FakeService) enter(ctx context.Context, method string, args ...interface{}) error {
+	f.mtx.Lock()
+	f.calls = append(f.calls, Call{Method: method, Args: args})
+	f.mtx.Unlock()
+	d := f.Delays[method]
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *FakeService) PostBuild(ctx context.Context, b gokitbuildservice.Build) error {
+	if err := f.enter(ctx, "PostBuild", b); err != nil {
+		return err
+	}
+	if f.PostBuildFunc == nil {
+		return nil
+	}
+	return f.PostBuildFunc(ctx, b)
+}
+
+func (f *FakeService) GetBuild(ctx context.Context, id string) (gokitbuildservice.Build, error) {
+	if err := f.enter(ctx, "GetBuild", id); err != nil {
+		return gokitbuildservice.Build{}, err
+	}
+	if f.GetBuildFunc == nil {
+		return gokitbuildservice.Build{}, nil
+	}
+	return f.GetBuildFunc(ctx, id)
+}
+
+func (f *FakeService) GetBuilds(ctx context.Context, ids []string) (map[string]gokitbuildservice.Build, []string, error) {
+	if err := f.enter(ctx, "GetBuilds", ids); err != nil {
+		return nil, nil, err
+	}
+	if f.GetBuildsFunc == nil {
+		return nil, nil, nil
+	}
+	return f.GetBuildsFunc(ctx, ids)
+}
+
+func (f *FakeService) ListBuildStatuses(ctx context.Context, ids []string) (map[string]gokitbuildservice.BuildStatus, error) {
+	if err := f.enter(ctx, "ListBuildStatuses", ids); err != nil {
+		return nil, err
+	}
+	if f.ListBuildStatusesFunc == nil {
+		return nil, nil
+	}
+	return f.ListBuildStatusesFunc(ctx, ids)
+}
+
+func (f *FakeService) ReserveID(ctx context.Context, prefix string) (string, error) {
+	if err := f.enter(ctx, "ReserveID", prefix); err != nil {
+		return "", err
+	}
+	if f.ReserveIDFunc == nil {
+		return "", nil
+	}
+	return f.ReserveIDFunc(ctx, prefix)
+}
+
+func (f *FakeService) ListBuilds(ctx context.Context, opts gokitbuildservice.ListOptions) ([]gokitbuildservice.Build, error) {
+	if err := f.enter(ctx, "ListBuilds", opts); err != nil {
+		return nil, err
+	}
+	if f.ListBuildsFunc == nil {
+		return nil, nil
+	}
+	return f.ListBuildsFunc(ctx, opts)
+}
+
+func (f *FakeService) PutBuild(ctx context.Context, id string, b gokitbuildservice.Build) error {
+	if err := f.enter(ctx, "PutBuild", id, b); err != nil {
+		return err
+	}
+	if f.PutBuildFunc == nil {
+		return nil
+	}
+	return f.PutBuildFunc(ctx, id, b)
+}
+
+func (f *FakeService) PatchBuild(ctx context.Context, id string, b gokitbuildservice.Build) error {
+	if err := f.enter(ctx, "PatchBuild", id, b); err != nil {
+		return err
+	}
+	if f.PatchBuildFunc == nil {
+		return nil
+	}
+	return f.PatchBuildFunc(ctx, id, b)
+}
+
+func (f *FakeService) DeleteBuild(ctx context.Context, id string) error {
+	if err := f.enter(ctx, "DeleteBuild", id); err != nil {
+		return err
+	}
+	if f.DeleteBuildFunc == nil {
+		return nil
+	}
+	return f.DeleteBuildFunc(ctx, id)
+}
+
+func (f *FakeService) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (int64, error) {
+	if err := f.enter(ctx, "AppendBuildLogs", id, offset, p); err != nil {
+		return 0, err
+	}
+	if f.AppendBuildLogsFunc == nil {
+		return 0, nil
+	}
+	return f.AppendBuildLogsFunc(ctx, id, offset, p)
+}
+
+func (f *FakeService) GetBuildLogLength(ctx context.Context, id string) (int64, error) {
+	if err := f.enter(ctx, "GetBuildLogLength", id); err != nil {
+		return 0, err
+	}
+	if f.GetBuildLogLengthFunc == nil {
+		return 0, nil
+	}
+	return f.GetBuildLogLengthFunc(ctx, id)
+}
+
+func (f *FakeService) ValidateBuild(ctx context.Context, b gokitbuildservice.Build) (gokitbuildservice.ValidationErrors, error) {
+	if err := f.enter(ctx, "ValidateBuild", b); err != nil {
+		return nil, err
+	}
+	if f.ValidateBuildFunc == nil {
+		return nil, nil
+	}
+	return f.ValidateBuildFunc(ctx, b)
+}
+
+func (f *FakeService) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (gokitbuildservice.Build, bool, error) {
+	if err := f.enter(ctx, "LeaseBuild", workerID, ttl); err != nil {
+		return gokitbuildservice.Build{}, false, err
+	}
+	if f.LeaseBuildFunc == nil {
+		return gokitbuildservice.Build{}, false, nil
+	}
+	return f.LeaseBuildFunc(ctx, workerID, ttl)
+}
+
+func (f *FakeService) ClaimAndStart(ctx context.Context, workerID string, filter gokitbuildservice.BuildFilter) (gokitbuildservice.Build, bool, error) {
+	if err := f.enter(ctx, "ClaimAndStart", workerID, filter); err != nil {
+		return gokitbuildservice.Build{}, false, err
+	}
+	if f.ClaimAndStartFunc == nil {
+		return gokitbuildservice.Build{}, false, nil
+	}
+	return f.ClaimAndStartFunc(ctx, workerID, filter)
+}
+
+func (f *FakeService) ForceReleaseLease(ctx context.Context, id string) error {
+	if err := f.enter(ctx, "ForceReleaseLease", id); err != nil {
+		return err
+	}
+	if f.ForceReleaseLeaseFunc == nil {
+		return nil
+	}
+	return f.ForceReleaseLeaseFunc(ctx, id)
+}
+
+func (f *FakeService) QueuePosition(ctx context.Context, id string) (int, time.Duration, error) {
+	if err := f.enter(ctx, "QueuePosition", id); err != nil {
+		return 0, 0, err
+	}
+	if f.QueuePositionFunc == nil {
+		return 0, 0, nil
+	}
+	return f.QueuePositionFunc(ctx, id)
+}
+
+func (f *FakeService) CompareAndSetStatus(ctx context.Context, id string, expected, next gokitbuildservice.BuildStatus) (bool, error) {
+	if err := f.enter(ctx, "CompareAndSetStatus", id, expected, next); err != nil {
+		return false, err
+	}
+	if f.CompareAndSetStatusFunc == nil {
+		return false, nil
+	}
+	return f.CompareAndSetStatusFunc(ctx, id, expected, next)
+}
+
+func (f *FakeService) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (bool, error) {
+	if err := f.enter(ctx, "CompareAndDeleteBuild", id, updatedAt); err != nil {
+		return false, err
+	}
+	if f.CompareAndDeleteBuildFunc == nil {
+		return false, nil
+	}
+	return f.CompareAndDeleteBuildFunc(ctx, id, updatedAt)
+}
+
+func (f *FakeService) RerunFailedSteps(ctx context.Context, id string) (gokitbuildservice.Build, error) {
+	if err := f.enter(ctx, "RerunFailedSteps", id); err != nil {
+		return gokitbuildservice.Build{}, err
+	}
+	if f.RerunFailedStepsFunc == nil {
+		return gokitbuildservice.Build{}, nil
+	}
+	return f.RerunFailedStepsFunc(ctx, id)
+}
+
+func (f *FakeService) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) ([]gokitbuildservice.Build, error) {
+	if err := f.enter(ctx, "ListBuildsModifiedBetween", from, to); err != nil {
+		return nil, err
+	}
+	if f.ListBuildsModifiedBetweenFunc == nil {
+		return nil, nil
+	}
+	return f.ListBuildsModifiedBetweenFunc(ctx, from, to)
+}
+
+func (f *FakeService) FailBuild(ctx context.Context, id, reason string, exitCode int) error {
+	if err := f.enter(ctx, "FailBuild", id, reason, exitCode); err != nil {
+		return err
+	}
+	if f.FailBuildFunc == nil {
+		return nil
+	}
+	return f.FailBuildFunc(ctx, id, reason, exitCode)
+}
+
+func (f *FakeService) RenameBuild(ctx context.Context, oldID, newID string) error {
+	if err := f.enter(ctx, "RenameBuild", oldID, newID); err != nil {
+		return err
+	}
+	if f.RenameBuildFunc == nil {
+		return nil
+	}
+	return f.RenameBuildFunc(ctx, oldID, newID)
+}
+
+func (f *FakeService) GetOrCreateBuild(ctx context.Context, b gokitbuildservice.Build) (gokitbuildservice.Build, bool, error) {
+	if err := f.enter(ctx, "GetOrCreateBuild", b); err != nil {
+		return gokitbuildservice.Build{}, false, err
+	}
+	if f.GetOrCreateBuildFunc == nil {
+		return gokitbuildservice.Build{}, false, nil
+	}
+	return f.GetOrCreateBuildFunc(ctx, b)
+}
+
+func (f *FakeService) ListLabelKeys(ctx context.Context) ([]string, error) {
+	if err := f.enter(ctx, "ListLabelKeys"); err != nil {
+		return nil, err
+	}
+	if f.ListLabelKeysFunc == nil {
+		return nil, nil
+	}
+	return f.ListLabelKeysFunc(ctx)
+}
+
+func (f *FakeService) ListLabelValues(ctx context.Context, key string) ([]string, error) {
+	if err := f.enter(ctx, "ListLabelValues", key); err != nil {
+		return nil, err
+	}
+	if f.ListLabelValuesFunc == nil {
+		return nil, nil
+	}
+	return f.ListLabelValuesFunc(ctx, key)
+}
+
+func (f *FakeService) PatchBuilds(ctx context.Context, ids []string, patch gokitbuildservice.BuildPatch) ([]gokitbuildservice.BatchResult, error) {
+	if err := f.enter(ctx, "PatchBuilds", ids, patch); err != nil {
+		return nil, err
+	}
+	if f.PatchBuildsFunc == nil {
+		return nil, nil
+	}
+	return f.PatchBuildsFunc(ctx, ids, patch)
+}
+
+func (f *FakeService) BatchPostBuilds(ctx context.Context, builds []gokitbuildservice.Build) ([]gokitbuildservice.BatchResult, error) {
+	if err := f.enter(ctx, "BatchPostBuilds", builds); err != nil {
+		return nil, err
+	}
+	if f.BatchPostBuildsFunc == nil {
+		return nil, nil
+	}
+	return f.BatchPostBuildsFunc(ctx, builds)
+}
+
+func (f *FakeService) FindBuildsBySpecHash(ctx context.Context, hash string) ([]gokitbuildservice.Build, error) {
+	if err := f.enter(ctx, "FindBuildsBySpecHash", hash); err != nil {
+		return nil, err
+	}
+	if f.FindBuildsBySpecHashFunc == nil {
+		return nil, nil
+	}
+	return f.FindBuildsBySpecHashFunc(ctx, hash)
+}
+
+func (f *FakeService) GetBuildLogs(ctx context.Context, id string, step int, from int64) ([]byte, error) {
+	if err := f.enter(ctx, "GetBuildLogs", id, step, from); err != nil {
+		return nil, err
+	}
+	if f.GetBuildLogsFunc == nil {
+		return nil, nil
+	}
+	return f.GetBuildLogsFunc(ctx, id, step, from)
+}
+
+func (f *FakeService) ReplayBuild(ctx context.Context, id string, sink func(gokitbuildservice.BuildEvent) error) error {
+	if err := f.enter(ctx, "ReplayBuild", id); err != nil {
+		return err
+	}
+	if f.ReplayBuildFunc == nil {
+		return nil
+	}
+	return f.ReplayBuildFunc(ctx, id, sink)
+}
+
+func (f *FakeService) GetLimits(ctx context.Context) (gokitbuildservice.ServiceLimits, error) {
+	if err := f.enter(ctx, "GetLimits"); err != nil {
+		return gokitbuildservice.ServiceLimits{}, err
+	}
+	if f.GetLimitsFunc == nil {
+		return gokitbuildservice.ServiceLimits{}, nil
+	}
+	return f.GetLimitsFunc(ctx)
+}
+
+func (f *FakeService) BuildMetrics(ctx context.Context, window time.Duration) (gokitbuildservice.MetricsSummary, error) {
+	if err := f.enter(ctx, "BuildMetrics", window); err != nil {
+		return gokitbuildservice.MetricsSummary{}, err
+	}
+	if f.BuildMetricsFunc == nil {
+		return gokitbuildservice.MetricsSummary{}, nil
+	}
+	return f.BuildMetricsFunc(ctx, window)
+}
+
+func (f *FakeService) FindSucceededByFingerprint(ctx context.Context, fp string) (gokitbuildservice.Build, bool, error) {
+	if err := f.enter(ctx, "FindSucceededByFingerprint", fp); err != nil {
+		return gokitbuildservice.Build{}, false, err
+	}
+	if f.FindSucceededByFingerprintFunc == nil {
+		return gokitbuildservice.Build{}, false, nil
+	}
+	return f.FindSucceededByFingerprintFunc(ctx, fp)
+}
+
+func (f *FakeService) SetOutput(ctx context.Context, id, key, value string) error {
+	if err := f.enter(ctx, "SetOutput", id, key, value); err != nil {
+		return err
+	}
+	if f.SetOutputFunc == nil {
+		return nil
+	}
+	return f.SetOutputFunc(ctx, id, key, value)
+}
+
+func (f *FakeService) GetOutput(ctx context.Context, id, key string) (string, error) {
+	if err := f.enter(ctx, "GetOutput", id, key); err != nil {
+		return "", err
+	}
+	if f.GetOutputFunc == nil {
+		return "", nil
+	}
+	return f.GetOutputFunc(ctx, id, key)
+}
+
+func (f *FakeService) ListBuildsByGroup(ctx context.Context, groupID string) ([]gokitbuildservice.Build, error) {
+	if err := f.enter(ctx, "ListBuildsByGroup", groupID); err != nil {
+		return nil, err
+	}
+	if f.ListBuildsByGroupFunc == nil {
+		return nil, nil
+	}
+	return f.ListBuildsByGroupFunc(ctx, groupID)
+}
+
+func (f *FakeService) CancelGroup(ctx context.Context, groupID string) (int, error) {
+	if err := f.enter(ctx, "CancelGroup", groupID); err != nil {
+		return 0, err
+	}
+	if f.CancelGroupFunc == nil {
+		return 0, nil
+	}
+	return f.CancelGroupFunc(ctx, groupID)
+}
+
+func (f *FakeService) GroupStatus(ctx context.Context, groupID string) (gokitbuildservice.GroupSummary, error) {
+	if err := f.enter(ctx, "GroupStatus", groupID); err != nil {
+		return gokitbuildservice.GroupSummary{}, err
+	}
+	if f.GroupStatusFunc == nil {
+		return gokitbuildservice.GroupSummary{}, nil
+	}
+	return f.GroupStatusFunc(ctx, groupID)
+}
@@ -0,0 +1,298 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+)
+
+// SlowThresholds says how long a service call may take before the slow
+// request log reports it: a default, and overrides for some methods. A
+// zero threshold turns reporting off. They may be changed while the service
+// is in use.
+type SlowThresholds struct {
+	mtx      sync.RWMutex
+	def      time.Duration
+	byMethod map[string]time.Duration
+}
+
+// NewSlowThresholds returns SlowThresholds with default def and no
+// overrides.
+func NewSlowThresholds(def time.Duration) *SlowThresholds {
+	return &SlowThresholds{def: def, byMethod: map[string]time.Duration{}}
+}
+
+// Get returns the default threshold and a copy of the overrides, keyed by
+// method name.
+func (t *SlowThresholds) Get() (time.Duration, map[string]time.Duration) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	byMethod := make(map[string]time.Duration, len(t.byMethod))
+	for m, d := range t.byMethod {
+		byMethod[m] = d
+	}
+	return t.def, byMethod
+}
+
+// Set replaces the default threshold and the overrides, failing if any of
+// them is negative.
+func (t *SlowThresholds) Set(def time.Duration, byMethod map[string]time.Duration) error {
+	var errs ValidationErrors
+	if def < 0 {
+		errs.add("default", "must not be negative")
+	}
+	copied := make(map[string]time.Duration, len(byMethod))
+	for m, d := range byMethod {
+		if d < 0 {
+			errs.add("methods."+m, "must not be negative")
+		}
+		copied[m] = d
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	t.mtx.Lock()
+	t.def, t.byMethod = def, copied
+	t.mtx.Unlock()
+	return nil
+}
+
+// threshold returns the threshold for method.
+func (t *SlowThresholds) threshold(method string) time.Duration {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	if d, ok := t.byMethod[method]; ok {
+		return d
+	}
+	return t.def
+}
+
+// SlowRequestMiddleware logs, at warn, every call to the service that takes
+// longer than its threshold in t, with the method, build ID, if the call has
+// one, and duration. slow is incremented with a "method" label for each.
+func SlowRequestMiddleware(logger log.Logger, slow metrics.Counter, t *SlowThresholds) Middleware {
+	return func(next Service) Service {
+		return &slowMiddleware{
+			next:       next,
+			logger:     logger,
+			slow:       slow,
+			thresholds: t,
+		}
+	}
+}
+
+type slowMiddleware struct {
+	next       Service
+	logger     log.Logger
+	slow       metrics.Counter
+	thresholds *SlowThresholds
+}
+
+func (mw slowMiddleware) observe(ctx context.Context, method, id string, begin time.Time) {
+	took := time.Since(begin)
+	threshold := mw.thresholds.threshold(method)
+	if threshold <= 0 || took <= threshold {
+		return
+	}
+	mw.slow.With("method", method).Add(1)
+	keyvals := []interface{}{"method", method}
+	if id != "" {
+		keyvals = append(keyvals, "id", id)
+	}
+	keyvals = append(keyvals, "took", took, "threshold", threshold, "request_id", RequestIDFromContext(ctx))
+	level.Warn(mw.logger).Log(keyvals...)
+}
+
+func (mw slowMiddleware) PostBuild(ctx context.Context, b Build) (err error) {
+	defer mw.observe(ctx, "PostBuild", b.ID, time.Now())
+	return mw.next.PostBuild(ctx, b)
+}
+
+func (mw slowMiddleware) GetBuild(ctx context.Context, id string) (b Build, err error) {
+	defer mw.observe(ctx, "GetBuild", id, time.Now())
+	return mw.next.GetBuild(ctx, id)
+}
+
+func (mw slowMiddleware) ListBuilds(ctx context.Context, opts ListOptions) (builds []Build, err error) {
+	defer mw.observe(ctx, "ListBuilds", "", time.Now())
+	return mw.next.ListBuilds(ctx, opts)
+}
+
+func (mw slowMiddleware) PutBuild(ctx context.Context, id string, b Build) (err error) {
+	defer mw.observe(ctx, "PutBuild", id, time.Now())
+	return mw.next.PutBuild(ctx, id, b)
+}
+
+func (mw slowMiddleware) PatchBuild(ctx context.Context, id string, b Build) (err error) {
+	defer mw.observe(ctx, "PatchBuild", id, time.Now())
+	return mw.next.PatchBuild(ctx, id, b)
+}
+
+func (mw slowMiddleware) DeleteBuild(ctx context.Context, id string) (err error) {
+	defer mw.observe(ctx, "DeleteBuild", id, time.Now())
+	return mw.next.DeleteBuild(ctx, id)
+}
+
+func (mw slowMiddleware) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (n int64, err error) {
+	defer mw.observe(ctx, "AppendBuildLogs", id, time.Now())
+	return mw.next.AppendBuildLogs(ctx, id, offset, p)
+}
+
+func (mw slowMiddleware) GetBuildLogLength(ctx context.Context, id string) (n int64, err error) {
+	defer mw.observe(ctx, "GetBuildLogLength", id, time.Now())
+	return mw.next.GetBuildLogLength(ctx, id)
+}
+
+func (mw slowMiddleware) ValidateBuild(ctx context.Context, b Build) (problems ValidationErrors, err error) {
+	defer mw.observe(ctx, "ValidateBuild", b.ID, time.Now())
+	return mw.next.ValidateBuild(ctx, b)
+}
+
+func (mw slowMiddleware) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (b Build, ok bool, err error) {
+	defer func(begin time.Time) { mw.observe(ctx, "LeaseBuild", b.ID, begin) }(time.Now())
+	return mw.next.LeaseBuild(ctx, workerID, ttl)
+}
+
+func (mw slowMiddleware) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (b Build, ok bool, err error) {
+	defer func(begin time.Time) { mw.observe(ctx, "ClaimAndStart", b.ID, begin) }(time.Now())
+	return mw.next.ClaimAndStart(ctx, workerID, filter)
+}
+
+func (mw slowMiddleware) ForceReleaseLease(ctx context.Context, id string) (err error) {
+	defer mw.observe(ctx, "ForceReleaseLease", id, time.Now())
+	return mw.next.ForceReleaseLease(ctx, id)
+}
+
+func (mw slowMiddleware) GetBuilds(ctx context.Context, ids []string) (found map[string]Build, missing []string, err error) {
+	defer mw.observe(ctx, "GetBuilds", "", time.Now())
+	return mw.next.GetBuilds(ctx, ids)
+}
+
+func (mw slowMiddleware) ListBuildStatuses(ctx context.Context, ids []string) (statuses map[string]BuildStatus, err error) {
+	defer mw.observe(ctx, "ListBuildStatuses", "", time.Now())
+	return mw.next.ListBuildStatuses(ctx, ids)
+}
+
+func (mw slowMiddleware) ReserveID(ctx context.Context, prefix string) (id string, err error) {
+	defer mw.observe(ctx, "ReserveID", "", time.Now())
+	return mw.next.ReserveID(ctx, prefix)
+}
+
+func (mw slowMiddleware) QueuePosition(ctx context.Context, id string) (position int, wait time.Duration, err error) {
+	defer mw.observe(ctx, "QueuePosition", id, time.Now())
+	return mw.next.QueuePosition(ctx, id)
+}
+
+func (mw slowMiddleware) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (ok bool, err error) {
+	defer mw.observe(ctx, "CompareAndSetStatus", id, time.Now())
+	return mw.next.CompareAndSetStatus(ctx, id, expected, next)
+}
+
+func (mw slowMiddleware) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (ok bool, err error) {
+	defer mw.observe(ctx, "CompareAndDeleteBuild", id, time.Now())
+	return mw.next.CompareAndDeleteBuild(ctx, id, updatedAt)
+}
+
+func (mw slowMiddleware) RerunFailedSteps(ctx context.Context, id string) (b Build, err error) {
+	defer mw.observe(ctx, "RerunFailedSteps", id, time.Now())
+	return mw.next.RerunFailedSteps(ctx, id)
+}
+
+func (mw slowMiddleware) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) (builds []Build, err error) {
+	defer mw.observe(ctx, "ListBuildsModifiedBetween", "", time.Now())
+	return mw.next.ListBuildsModifiedBetween(ctx, from, to)
+}
+
+func (mw slowMiddleware) FailBuild(ctx context.Context, id, reason string, exitCode int) (err error) {
+	defer mw.observe(ctx, "FailBuild", id, time.Now())
+	return mw.next.FailBuild(ctx, id, reason, exitCode)
+}
+
+func (mw slowMiddleware) RenameBuild(ctx context.Context, oldID, newID string) (err error) {
+	defer mw.observe(ctx, "RenameBuild", oldID, time.Now())
+	return mw.next.RenameBuild(ctx, oldID, newID)
+}
+
+func (mw slowMiddleware) GetOrCreateBuild(ctx context.Context, b Build) (got Build, created bool, err error) {
+	defer mw.observe(ctx, "GetOrCreateBuild", b.ID, time.Now())
+	return mw.next.GetOrCreateBuild(ctx, b)
+}
+
+func (mw slowMiddleware) ListLabelKeys(ctx context.Context) (keys []string, err error) {
+	defer mw.observe(ctx, "ListLabelKeys", "", time.Now())
+	return mw.next.ListLabelKeys(ctx)
+}
+
+func (mw slowMiddleware) ListLabelValues(ctx context.Context, key string) (values []string, err error) {
+	defer mw.observe(ctx, "ListLabelValues", "", time.Now())
+	return mw.next.ListLabelValues(ctx, key)
+}
+
+func (mw slowMiddleware) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) (results []BatchResult, err error) {
+	defer mw.observe(ctx, "PatchBuilds", "", time.Now())
+	return mw.next.PatchBuilds(ctx, ids, patch)
+}
+
+func (mw slowMiddleware) BatchPostBuilds(ctx context.Context, builds []Build) (results []BatchResult, err error) {
+	defer mw.observe(ctx, "BatchPostBuilds", "", time.Now())
+	return mw.next.BatchPostBuilds(ctx, builds)
+}
+
+func (mw slowMiddleware) FindBuildsBySpecHash(ctx context.Context, hash string) (builds []Build, err error) {
+	defer mw.observe(ctx, "FindBuildsBySpecHash", "", time.Now())
+	return mw.next.FindBuildsBySpecHash(ctx, hash)
+}
+
+func (mw slowMiddleware) GetBuildLogs(ctx context.Context, id string, step int, from int64) (p []byte, err error) {
+	defer mw.observe(ctx, "GetBuildLogs", id, time.Now())
+	return mw.next.GetBuildLogs(ctx, id, step, from)
+}
+
+func (mw slowMiddleware) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) (err error) {
+	defer mw.observe(ctx, "ReplayBuild", id, time.Now())
+	return mw.next.ReplayBuild(ctx, id, sink)
+}
+
+func (mw slowMiddleware) GetLimits(ctx context.Context) (l ServiceLimits, err error) {
+	defer mw.observe(ctx, "GetLimits", "", time.Now())
+	return mw.next.GetLimits(ctx)
+}
+
+func (mw slowMiddleware) BuildMetrics(ctx context.Context, window time.Duration) (m MetricsSummary, err error) {
+	defer mw.observe(ctx, "BuildMetrics", "", time.Now())
+	return mw.next.BuildMetrics(ctx, window)
+}
+
+func (mw slowMiddleware) FindSucceededByFingerprint(ctx context.Context, fp string) (b Build, found bool, err error) {
+	defer mw.observe(ctx, "FindSucceededByFingerprint", "", time.Now())
+	return mw.next.FindSucceededByFingerprint(ctx, fp)
+}
+
+func (mw slowMiddleware) SetOutput(ctx context.Context, id, key, value string) (err error) {
+	defer mw.observe(ctx, "SetOutput", id, time.Now())
+	return mw.next.SetOutput(ctx, id, key, value)
+}
+
+func (mw slowMiddleware) GetOutput(ctx context.Context, id, key string) (value string, err error) {
+	defer mw.observe(ctx, "GetOutput", id, time.Now())
+	return mw.next.GetOutput(ctx, id, key)
+}
+
+func (mw slowMiddleware) ListBuildsByGroup(ctx context.Context, groupID string) (builds []Build, err error) {
+	defer mw.observe(ctx, "ListBuildsByGroup", groupID, time.Now())
+	return mw.next.ListBuildsByGroup(ctx, groupID)
+}
+
+func (mw slowMiddleware) CancelGroup(ctx context.Context, groupID string) (cancelled int, err error) {
+	defer mw.observe(ctx, "CancelGroup", groupID, time.Now())
+	return mw.next.CancelGroup(ctx, groupID)
+}
+
+func (mw slowMiddleware) GroupStatus(ctx context.Context, groupID string) (sum GroupSummary, err error) {
+	defer mw.observe(ctx, "GroupStatus", groupID, time.Now())
+	return mw.next.GroupStatus(ctx, groupID)
+}
@@ -0,0 +1,187 @@
+package gokitbuildservice
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Snapshotter is implemented by backends that can export a consistent
+// point-in-time copy of their whole store, and restore one into a fresh
+// instance.
+type Snapshotter interface {
+	Snapshot(ctx context.Context) (io.ReadCloser, error)
+	Restore(ctx context.Context, r io.Reader) (int, error)
+}
+
+// ErrBadSnapshot is returned by Restore when the input isn't a snapshot
+// produced by Snapshot, or its record count disagrees with its header.
+var ErrBadSnapshot = errors.New("bad snapshot")
+
+// snapshotHeader is the first line of every snapshot.
+type snapshotHeader struct {
+	Timestamp time.Time `json:"timestamp"`
+	Count     int       `json:"count"`
+}
+
+// snapshotRecord is every subsequent line, one per build.
+type snapshotRecord struct {
+	Build Build  `json:"build"`
+	Logs  []byte `json:"logs,omitempty"`
+
+	// LogSteps are the logSegments of Logs. Snapshots from before they
+	// existed have none, and their logs belong to no step.
+	LogSteps []logSegment `json:"logSteps,omitempty"`
+}
+
+// Snapshot returns a gzip-compressed NDJSON stream of every build and its
+// logs: a header line carrying the timestamp and build count, then one record
+// per build ordered by ID. The store is copied under the read lock, and the
+// lock is released before any encoding or I/O happens, so slow consumers
+// never block writers. Stored values are replaced rather than mutated in
+// place, which is what makes the shallow copy safe.
+func (s *buildService) Snapshot(ctx context.Context) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+
+	s.mtx.RLock()
+	records, err := s.records(ctx)
+	taken := s.now(ctx).UTC()
+	s.mtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeSnapshot(ctx, pw, taken, records))
+	}()
+	return pr, nil
+}
+
+func writeSnapshot(ctx context.Context, w io.Writer, taken time.Time, records []snapshotRecord) error {
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	if err := enc.Encode(snapshotHeader{Timestamp: taken, Count: len(records)}); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Restore loads a stream produced by Snapshot and returns the number of
+// builds restored. The whole snapshot is decoded before the store is touched,
+// and it's applied all-or-nothing: if any build already exists, nothing is
+// written and ErrAlreadyExists is returned.
+//
+// If the service is persistent, the restored builds are written to the log
+// as well; should that fail part way, the builds logged so far are kept and
+// counted.
+func (s *buildService) Restore(ctx context.Context, r io.Reader) (int, error) {
+	records, err := readSnapshot(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, rec := range records {
+		if _, ok, err := s.repo.Get(ctx, rec.Build.ID); err != nil {
+			return 0, err
+		} else if ok {
+			return 0, ErrAlreadyExists
+		}
+	}
+	for i, rec := range records {
+		labels, err := s.seal(nil, rec.Build.Labels)
+		if err != nil {
+			return i, err
+		}
+		rec.Build.Labels = labels
+		if err := s.persist(walRecord{Op: walPut, Build: &rec.Build, Data: rec.Logs, Steps: rec.LogSteps}); err != nil {
+			return i, err
+		}
+		if err := s.restore(ctx, rec); err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// restore stores rec as is. It must be called with s.mtx held.
+func (s *buildService) restore(ctx context.Context, rec snapshotRecord) error {
+	stored, _, err := s.repo.Get(ctx, rec.Build.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.Save(ctx, s.quarantine(rec.Build)); err != nil {
+		return err
+	}
+	if rec.Build.Sequence > s.seq {
+		s.seq = rec.Build.Sequence
+	}
+	s.track(stored.Status, rec.Build.Status)
+	s.link(stored, rec.Build)
+	if len(rec.Logs) > 0 {
+		delete(s.logs, rec.Build.ID)
+		delete(s.logSteps, rec.Build.ID)
+		s.appendLogs(rec.Build.ID, rec.Logs, rec.LogSteps)
+	}
+	return nil
+}
+
+// quarantine flags b if it no longer passes validation within the
+// service's limits. Builds are validated on the way in, so only records
+// read back from storage, which may predate the current rules, need it.
+func (s *buildService) quarantine(b Build) Build {
+	b.Quarantined, b.Problems = false, nil
+	if errs := b.ValidateWithin(s.limits); errs != nil {
+		b.Quarantined, b.Problems = true, errs
+	}
+	return b
+}
+
+func readSnapshot(ctx context.Context, r io.Reader) ([]snapshotRecord, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(zr))
+	var h snapshotHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrBadSnapshot, err)
+	}
+	records := make([]snapshotRecord, 0, h.Count)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var rec snapshotRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: record %d: %v", ErrBadSnapshot, len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != h.Count {
+		return nil, fmt.Errorf("%w: header says %d builds, found %d", ErrBadSnapshot, h.Count, len(records))
+	}
+	return records, nil
+}
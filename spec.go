@@ -0,0 +1,138 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// DeduplicatedHeader is set, to the ID of the existing build, on the
+// response to a POST /builds/ that was deduplicated WithSpecDedup.
+const DeduplicatedHeader = "X-Build-Deduplicated"
+
+// DuplicateSpecError is returned by PostBuild WithSpecDedup in place of
+// creating a build whose spec matches Existing, an unfinished build. It
+// matches ErrAlreadyExists with errors.Is.
+type DuplicateSpecError struct {
+	Existing Build
+}
+
+func (e *DuplicateSpecError) Error() string {
+	return fmt.Sprintf("build %s has the same spec", e.Existing.ID)
+}
+
+// Is makes a duplicate spec ErrAlreadyExists.
+func (e *DuplicateSpecError) Is(target error) bool { return target == ErrAlreadyExists }
+
+// WithSpecDedup makes PostBuild return a DuplicateSpecError, rather than
+// create the build, when an unfinished build already has the same SpecHash.
+func WithSpecDedup(dedup bool) InmemOption {
+	return func(s *buildService) { s.dedup = dedup }
+}
+
+// specHash is the hex SHA-256 of b's spec: its name, steps without their
+// statuses, labels, parameters and dependencies. Only the keys of sensitive
+// labels count, as their values may be stored encrypted. encoding/json
+// sorts map keys, so equal specs always encode the same way.
+func (s *buildService) specHash(b Build) string {
+	type step struct {
+		Name  string   `json:"name"`
+		Image string   `json:"image"`
+		Args  []string `json:"args"`
+	}
+	spec := struct {
+		Name       string            `json:"name"`
+		Steps      []step            `json:"steps"`
+		Labels     map[string]string `json:"labels"`
+		Parameters map[string]string `json:"parameters"`
+		DependsOn  []string          `json:"dependsOn"`
+	}{
+		Name:       b.Name,
+		Steps:      make([]step, len(b.Steps)),
+		Labels:     make(map[string]string, len(b.Labels)),
+		Parameters: b.Parameters,
+		DependsOn:  b.DependsOn,
+	}
+	for k, v := range b.Labels {
+		if s.sensitive(k) {
+			v = ""
+		}
+		spec.Labels[k] = v
+	}
+	for i, st := range b.Steps {
+		spec.Steps[i] = step{Name: st.Name, Image: st.Image, Args: st.Args}
+	}
+	p, err := json.Marshal(spec)
+	if err != nil {
+		panic(err) // strings, slices and maps of strings always encode
+	}
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:])
+}
+
+// FindBuildsBySpecHash returns the builds whose SpecHash is hash, oldest
+// first. It scans the whole store under the read lock, like ListLabelKeys.
+// Builds last written before SpecHash existed have none until they're
+// written again.
+func (s *buildService) FindBuildsBySpecHash(ctx context.Context, hash string) ([]Build, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = s.begin(ctx)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	matches, err := s.withSpecHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range matches {
+		if matches[i], err = s.view(ctx, b); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// withSpecHash returns the stored builds whose SpecHash is hash, oldest
+// first. It must be called with s.mtx held.
+func (s *buildService) withSpecHash(ctx context.Context, hash string) ([]Build, error) {
+	builds, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	matches := []Build{}
+	now := s.now(ctx)
+	for _, b := range builds {
+		if b.SpecHash == hash && !s.expired(b, now) {
+			matches = append(matches, b)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return bySequence(matches[i], matches[j]) })
+	return matches, nil
+}
+
+// duplicateSpec returns a DuplicateSpecError if dedup is on and an
+// unfinished build has the same spec as b. It must be called with s.mtx
+// held.
+func (s *buildService) duplicateSpec(ctx context.Context, b Build) error {
+	if !s.dedup {
+		return nil
+	}
+	matches, err := s.withSpecHash(ctx, s.specHash(b))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if !m.Status.Terminal() {
+			existing, err := s.view(ctx, m)
+			if err != nil {
+				return err
+			}
+			return &DuplicateSpecError{Existing: existing}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// MetricsSummary aggregates the builds that finished within a window, for
+// reporting. Run durations cover only finished builds that ran, and are
+// zero when there are none; SuccessRatio is succeeded over finished, or
+// zero when nothing finished.
+type MetricsSummary struct {
+	From         time.Time           `json:"from"`
+	To           time.Time           `json:"to"`
+	Finished     int                 `json:"finished"`
+	ByStatus     map[BuildStatus]int `json:"byStatus"`
+	SuccessRatio float64             `json:"successRatio"`
+	RunP50       float64             `json:"runP50Seconds"`
+	RunP95       float64             `json:"runP95Seconds"`
+	PerHour      float64             `json:"throughputPerHour"`
+}
+
+// BuildMetrics summarizes the builds that finished in the last window, up
+// to the time of the call. It finds them with ListBuildsModifiedBetween,
+// since finishing a build modifies it; deleted builds aren't counted.
+func (s *buildService) BuildMetrics(ctx context.Context, window time.Duration) (MetricsSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return MetricsSummary{}, err
+	}
+	ctx = s.begin(ctx)
+	to := s.now(ctx)
+	from := to.Add(-window)
+	builds, err := s.ListBuildsModifiedBetween(ctx, from, time.Time{})
+	if err != nil {
+		return MetricsSummary{}, err
+	}
+	m := MetricsSummary{From: from, To: to, ByStatus: map[BuildStatus]int{}}
+	var runs []time.Duration
+	for _, b := range builds {
+		if !b.Status.Terminal() || b.FinishedAt == nil || b.FinishedAt.Before(from) || b.FinishedAt.After(to) {
+			continue
+		}
+		m.Finished++
+		m.ByStatus[b.Status]++
+		if b.StartedAt != nil {
+			runs = append(runs, b.FinishedAt.Sub(*b.StartedAt))
+		}
+	}
+	if m.Finished > 0 {
+		m.SuccessRatio = float64(m.ByStatus[StatusSucceeded]) / float64(m.Finished)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i] < runs[j] })
+	m.RunP50, m.RunP95 = percentile(runs, 0.50).Seconds(), percentile(runs, 0.95).Seconds()
+	if window > 0 {
+		m.PerHour = float64(m.Finished) / window.Hours()
+	}
+	return m, nil
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted ds: the
+// smallest value at least p of them are no greater than.
+func percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(ds)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(ds) {
+		i = len(ds) - 1
+	}
+	return ds[i]
+}
@@ -0,0 +1,87 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBuildMetricsUsesTheServiceClock(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start}
+	s := NewInmemService(WithClock(clock))
+	run := func(id string, d time.Duration, finished BuildStatus) {
+		t.Helper()
+		if err := s.PostBuild(ctx, Build{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.CompareAndSetStatus(ctx, id, StatusPending, StatusRunning); !ok || err != nil {
+			t.Fatalf("starting %s: %v, %v", id, ok, err)
+		}
+		clock.Advance(d)
+		if ok, err := s.CompareAndSetStatus(ctx, id, StatusRunning, finished); !ok || err != nil {
+			t.Fatalf("finishing %s: %v, %v", id, ok, err)
+		}
+	}
+
+	run("old", time.Minute, StatusSucceeded)
+	clock.Advance(2 * time.Hour)
+	run("ok", 10*time.Second, StatusSucceeded)
+	run("bad", 30*time.Second, StatusFailed)
+	if err := s.PostBuild(ctx, Build{ID: "waiting"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s.BuildMetrics(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now := clock.Now(); !m.To.Equal(now) || !m.From.Equal(now.Add(-time.Hour)) {
+		t.Errorf("window %s to %s, want the hour up to the fake clock's %s", m.From, m.To, now)
+	}
+	if m.Finished != 2 || m.ByStatus[StatusSucceeded] != 1 || m.ByStatus[StatusFailed] != 1 {
+		t.Errorf("got %d finished, %v; want only the two in the last hour", m.Finished, m.ByStatus)
+	}
+	if m.SuccessRatio != 0.5 || m.RunP50 != 10 || m.RunP95 != 30 || m.PerHour != 2 {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestPercentileIsNearestRank(t *testing.T) {
+	seconds := func(n int) []time.Duration {
+		ds := make([]time.Duration, n)
+		for i := range ds {
+			ds[i] = time.Duration(i+1) * time.Second
+		}
+		return ds
+	}
+	for _, tc := range []struct {
+		n    int
+		p    float64
+		want time.Duration // the ceil(p*n)th value, 1-based
+	}{
+		{0, 0.5, 0},
+		{1, 0.5, 1 * time.Second},
+		{1, 0.95, 1 * time.Second},
+		{3, 0.5, 2 * time.Second},
+		{4, 0.5, 2 * time.Second},
+		{5, 0.95, 5 * time.Second},
+		{6, 0.25, 2 * time.Second},
+		{10, 0.5, 5 * time.Second},
+		{10, 0.75, 8 * time.Second},
+		{15, 0.9, 14 * time.Second},
+		{20, 0.95, 19 * time.Second},
+		{21, 0.95, 20 * time.Second},
+		{100, 0.95, 95 * time.Second},
+		{7, 0.2, 2 * time.Second}, // rounding 1.4 would give the 1st
+		{10, 0.91, 10 * time.Second},
+		{20, 0.51, 11 * time.Second},
+		{7, 0, 1 * time.Second},
+		{7, 1, 7 * time.Second},
+	} {
+		if got := percentile(seconds(tc.n), tc.p); got != tc.want {
+			t.Errorf("p%v of %d: got %s, want %s", tc.p*100, tc.n, got, tc.want)
+		}
+	}
+}
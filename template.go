@@ -0,0 +1,109 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Template is a reusable build definition. Step images and arguments may
+// refer to parameters as ${name}; they're substituted when a build is
+// created from the template.
+type Template struct {
+	Name       string            `json:"name,omitempty"`
+	Steps      []Step            `json:"steps,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	DependsOn  []string          `json:"dependsOn,omitempty"`
+	Parameters []ParameterSpec   `json:"parameters,omitempty"`
+}
+
+// ParameterSpec declares a template parameter. A parameter that isn't
+// Required and isn't given takes its Default, or is empty if it has none.
+// If Allowed is non-empty, a given value or a default must be one of them.
+type ParameterSpec struct {
+	Name     string   `json:"name"`
+	Required bool     `json:"required,omitempty"`
+	Default  string   `json:"default,omitempty"`
+	Allowed  []string `json:"allowed,omitempty"`
+}
+
+// CreateFromTemplate posts a new build with the given ID from t, with its
+// parameters bound to params. Missing required parameters, values outside
+// their allowed set and parameters t doesn't declare are all reported
+// together as ValidationErrors, each naming the parameter. It only relies on
+// PostBuild, so it works against any Service implementation.
+func CreateFromTemplate(ctx context.Context, s Service, t Template, id string, params map[string]string) (Build, error) {
+	bound, errs := bindParameters(t.Parameters, params)
+	if errs != nil {
+		return Build{}, errs
+	}
+	expand := strings.NewReplacer(replacements(bound)...).Replace
+	b := Build{
+		ID:         id,
+		Name:       t.Name,
+		Labels:     t.Labels,
+		DependsOn:  t.DependsOn,
+		Parameters: bound,
+	}
+	for _, st := range t.Steps {
+		st.Image = expand(st.Image)
+		args := make([]string, len(st.Args))
+		for i, a := range st.Args {
+			args[i] = expand(a)
+		}
+		st.Args = args
+		b.Steps = append(b.Steps, st)
+	}
+	if err := s.PostBuild(ctx, b); err != nil {
+		return Build{}, err
+	}
+	return s.GetBuild(ctx, id)
+}
+
+func bindParameters(specs []ParameterSpec, params map[string]string) (map[string]string, ValidationErrors) {
+	var errs ValidationErrors
+	bound := map[string]string{}
+	declared := map[string]bool{}
+	for _, p := range specs {
+		declared[p.Name] = true
+		field := "parameters." + p.Name
+		v, ok := params[p.Name]
+		switch {
+		case !ok && p.Required:
+			errs.add(field, "is required")
+			continue
+		case !ok && p.Default == "":
+			bound[p.Name] = "" // left out on purpose, whatever Allowed says
+			continue
+		case !ok:
+			v = p.Default
+		}
+		if len(p.Allowed) > 0 && !contains(p.Allowed, v) {
+			errs.add(field, "%q is not one of %s", v, strings.Join(p.Allowed, ", "))
+			continue
+		}
+		bound[p.Name] = v
+	}
+	var unknown []string
+	for name := range params {
+		if !declared[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs.add("parameters."+name, "is not declared by the template")
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return bound, nil
+}
+
+func replacements(params map[string]string) []string {
+	var r []string
+	for k, v := range params {
+		r = append(r, "${"+k+"}", v)
+	}
+	return r
+}
@@ -0,0 +1,89 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCreateFromTemplate(t *testing.T) {
+	tmpl := Template{
+		Name: "release",
+		Steps: []Step{
+			{Name: "build", Image: "golang:${go}", Args: []string{"build", "-tags=${tags}", "./${pkg}"}},
+		},
+		Parameters: []ParameterSpec{
+			{Name: "pkg", Required: true},
+			{Name: "go", Default: "1.21", Allowed: []string{"1.21", "1.22"}},
+			{Name: "tags", Allowed: []string{"netgo", "debug"}},
+		},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params map[string]string
+		image  string
+		args   []string
+		fields []string // of the validation errors, if any
+	}{
+		{
+			name:   "only the required one",
+			params: map[string]string{"pkg": "cmd"},
+			image:  "golang:1.21",
+			args:   []string{"build", "-tags=", "./cmd"},
+		},
+		{
+			name:   "all given",
+			params: map[string]string{"pkg": "cmd", "go": "1.22", "tags": "netgo"},
+			image:  "golang:1.22",
+			args:   []string{"build", "-tags=netgo", "./cmd"},
+		},
+		{
+			name:   "required missing",
+			params: map[string]string{"go": "1.22"},
+			fields: []string{"parameters.pkg"},
+		},
+		{
+			name:   "not allowed, with and without a default",
+			params: map[string]string{"pkg": "cmd", "go": "1.19", "tags": "race"},
+			fields: []string{"parameters.go", "parameters.tags"},
+		},
+		{
+			name:   "undeclared",
+			params: map[string]string{"pkg": "cmd", "os": "linux", "arch": "arm64"},
+			fields: []string{"parameters.arch", "parameters.os"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewInmemService()
+			b, err := CreateFromTemplate(context.Background(), s, tmpl, "b1", tc.params)
+			if tc.fields != nil {
+				var errs ValidationErrors
+				if !errors.As(err, &errs) {
+					t.Fatalf("got %v, want ValidationErrors", err)
+				}
+				var fields []string
+				for _, e := range errs {
+					fields = append(fields, e.Field)
+				}
+				if !reflect.DeepEqual(fields, tc.fields) {
+					t.Errorf("errors on %v, want %v", fields, tc.fields)
+				}
+				if _, err := s.GetBuild(context.Background(), "b1"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("build created anyway: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st := b.Steps[0]; st.Image != tc.image || !reflect.DeepEqual(st.Args, tc.args) {
+				t.Errorf("got %s %q, want %s %q", st.Image, st.Args, tc.image, tc.args)
+			}
+			if b.Name != "release" || b.Parameters["pkg"] != "cmd" {
+				t.Errorf("got name %q and parameters %v", b.Name, b.Parameters)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBackendTimeout is returned by a service from NewTimeoutService when a
+// single call to the service it wraps took longer than allowed.
+var ErrBackendTimeout = errors.New("backend operation timed out")
+
+// NewTimeoutService returns a Service that gives every call to inner at
+// most perOp, on top of whatever deadline the caller's context has, so one
+// slow backend operation can't use up a whole request's budget. Streaming
+// calls are the exception; see ReplayBuild. A call that fails because perOp
+// ran out returns ErrBackendTimeout; one that outlives the caller's own
+// deadline returns the caller's context error, as before.
+//
+// Wrap the backend itself, beneath any caching or retrying, so a retry gets
+// a fresh perOp. inner must honor context cancellation for the timeout to
+// cut a call short.
+func NewTimeoutService(inner Service, perOp time.Duration) Service {
+	return &timeoutService{next: inner, perOp: perOp}
+}
+
+type timeoutService struct {
+	next  Service
+	perOp time.Duration
+}
+
+// withTimeout derives the context for one call. The returned func must be
+// deferred by the call with its error, which it turns into
+// ErrBackendTimeout if the call's own deadline, rather than the caller's,
+// ran out.
+func (t *timeoutService) withTimeout(ctx context.Context) (context.Context, func(*error)) {
+	opCtx, cancel := context.WithTimeout(ctx, t.perOp)
+	return opCtx, func(err *error) {
+		if *err != nil && !errors.Is(*err, ErrPartialResult) && errors.Is(opCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			*err = ErrBackendTimeout
+		}
+		cancel()
+	}
+}
+
+func (t *timeoutService) PostBuild(ctx context.Context, b Build) (err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.PostBuild(ctx, b)
+}
+
+func (t *timeoutService) GetBuild(ctx context.Context, id string) (b Build, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.GetBuild(ctx, id)
+}
+
+func (t *timeoutService) ListBuilds(ctx context.Context, opts ListOptions) (builds []Build, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ListBuilds(ctx, opts)
+}
+
+func (t *timeoutService) PutBuild(ctx context.Context, id string, b Build) (err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.PutBuild(ctx, id, b)
+}
+
+func (t *timeoutService) PatchBuild(ctx context.Context, id string, b Build) (err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.PatchBuild(ctx, id, b)
+}
+
+func (t *timeoutService) DeleteBuild(ctx context.Context, id string) (err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.DeleteBuild(ctx, id)
+}
+
+func (t *timeoutService) AppendBuildLogs(ctx context.Context, id string, offset int64, p []byte) (n int64, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.AppendBuildLogs(ctx, id, offset, p)
+}
+
+func (t *timeoutService) GetBuildLogLength(ctx context.Context, id string) (n int64, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.GetBuildLogLength(ctx, id)
+}
+
+func (t *timeoutService) ValidateBuild(ctx context.Context, b Build) (problems ValidationErrors, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ValidateBuild(ctx, b)
+}
+
+func (t *timeoutService) LeaseBuild(ctx context.Context, workerID string, ttl time.Duration) (b Build, ok bool, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.LeaseBuild(ctx, workerID, ttl)
+}
+
+func (t *timeoutService) ClaimAndStart(ctx context.Context, workerID string, filter BuildFilter) (b Build, ok bool, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ClaimAndStart(ctx, workerID, filter)
+}
+
+func (t *timeoutService) ForceReleaseLease(ctx context.Context, id string) (err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ForceReleaseLease(ctx, id)
+}
+
+func (t *timeoutService) GetBuilds(ctx context.Context, ids []string) (found map[string]Build, missing []string, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.GetBuilds(ctx, ids)
+}
+
+func (t *timeoutService) ListBuildStatuses(ctx context.Context, ids []string) (statuses map[string]BuildStatus, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ListBuildStatuses(ctx, ids)
+}
+
+func (t *timeoutService) ReserveID(ctx context.Context, prefix string) (id string, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ReserveID(ctx, prefix)
+}
+
+func (t *timeoutService) QueuePosition(ctx context.Context, id string) (position int, wait time.Duration, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.QueuePosition(ctx, id)
+}
+
+func (t *timeoutService) CompareAndSetStatus(ctx context.Context, id string, expected, next BuildStatus) (ok bool, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.CompareAndSetStatus(ctx, id, expected, next)
+}
+
+func (t *timeoutService) CompareAndDeleteBuild(ctx context.Context, id string, updatedAt time.Time) (ok bool, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.CompareAndDeleteBuild(ctx, id, updatedAt)
+}
+
+func (t *timeoutService) RerunFailedSteps(ctx context.Context, id string) (b Build, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.RerunFailedSteps(ctx, id)
+}
+
+func (t *timeoutService) ListBuildsModifiedBetween(ctx context.Context, from, to time.Time) (builds []Build, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ListBuildsModifiedBetween(ctx, from, to)
+}
+
+func (t *timeoutService) FailBuild(ctx context.Context, id, reason string, exitCode int) (err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.FailBuild(ctx, id, reason, exitCode)
+}
+
+func (t *timeoutService) RenameBuild(ctx context.Context, oldID, newID string) (err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.RenameBuild(ctx, oldID, newID)
+}
+
+func (t *timeoutService) GetOrCreateBuild(ctx context.Context, b Build) (got Build, created bool, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.GetOrCreateBuild(ctx, b)
+}
+
+func (t *timeoutService) ListLabelKeys(ctx context.Context) (keys []string, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ListLabelKeys(ctx)
+}
+
+func (t *timeoutService) ListLabelValues(ctx context.Context, key string) (values []string, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ListLabelValues(ctx, key)
+}
+
+func (t *timeoutService) PatchBuilds(ctx context.Context, ids []string, patch BuildPatch) (results []BatchResult, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.PatchBuilds(ctx, ids, patch)
+}
+
+func (t *timeoutService) BatchPostBuilds(ctx context.Context, builds []Build) (results []BatchResult, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.BatchPostBuilds(ctx, builds)
+}
+
+func (t *timeoutService) FindBuildsBySpecHash(ctx context.Context, hash string) (builds []Build, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.FindBuildsBySpecHash(ctx, hash)
+}
+
+func (t *timeoutService) GetBuildLogs(ctx context.Context, id string, step int, from int64) (p []byte, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.GetBuildLogs(ctx, id, step, from)
+}
+
+// ReplayBuild only gives inner perOp to produce the first event. The rest
+// of the replay is paced by sink, a slow SSE client say, not the backend,
+// so it runs as long as the caller's context allows.
+func (t *timeoutService) ReplayBuild(ctx context.Context, id string, sink func(BuildEvent) error) (err error) {
+	opCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(t.perOp, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	defer timer.Stop()
+	err = t.next.ReplayBuild(opCtx, id, func(e BuildEvent) error {
+		timer.Stop()
+		return sink(e)
+	})
+	if err != nil && timedOut.Load() && ctx.Err() == nil {
+		err = ErrBackendTimeout
+	}
+	return err
+}
+
+func (t *timeoutService) GetLimits(ctx context.Context) (l ServiceLimits, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.GetLimits(ctx)
+}
+
+func (t *timeoutService) BuildMetrics(ctx context.Context, window time.Duration) (m MetricsSummary, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.BuildMetrics(ctx, window)
+}
+
+func (t *timeoutService) FindSucceededByFingerprint(ctx context.Context, fp string) (b Build, found bool, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.FindSucceededByFingerprint(ctx, fp)
+}
+
+func (t *timeoutService) SetOutput(ctx context.Context, id, key, value string) (err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.SetOutput(ctx, id, key, value)
+}
+
+func (t *timeoutService) GetOutput(ctx context.Context, id, key string) (value string, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.GetOutput(ctx, id, key)
+}
+
+func (t *timeoutService) ListBuildsByGroup(ctx context.Context, groupID string) (builds []Build, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.ListBuildsByGroup(ctx, groupID)
+}
+
+func (t *timeoutService) CancelGroup(ctx context.Context, groupID string) (cancelled int, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.CancelGroup(ctx, groupID)
+}
+
+func (t *timeoutService) GroupStatus(ctx context.Context, groupID string) (sum GroupSummary, err error) {
+	ctx, done := t.withTimeout(ctx)
+	defer done(&err)
+	return t.next.GroupStatus(ctx, groupID)
+}
@@ -0,0 +1,64 @@
+package gokitbuildservice_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+func TestTimeoutServiceSlowBackend(t *testing.T) {
+	fake := &servicetest.FakeService{Delays: map[string]time.Duration{"GetBuild": time.Second}}
+	s := gokitbuildservice.NewTimeoutService(fake, 20*time.Millisecond)
+
+	if _, err := s.GetBuild(context.Background(), "b1"); err != gokitbuildservice.ErrBackendTimeout {
+		t.Errorf("slow call: got %v, want ErrBackendTimeout", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := s.GetBuild(ctx, "b1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow call past the caller's deadline: got %v, want the caller's error", err)
+	}
+
+	if _, err := s.ListBuilds(context.Background(), gokitbuildservice.ListOptions{}); err != nil {
+		t.Errorf("fast call: %v", err)
+	}
+}
+
+func TestTimeoutServiceLetsReplaysStream(t *testing.T) {
+	const perOp = 20 * time.Millisecond
+	fake := &servicetest.FakeService{
+		ReplayBuildFunc: func(ctx context.Context, id string, sink func(gokitbuildservice.BuildEvent) error) error {
+			for i := 1; i <= 5; i++ {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := sink(gokitbuildservice.BuildEvent{ID: uint64(i)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	s := gokitbuildservice.NewTimeoutService(fake, perOp)
+
+	var got int
+	err := s.ReplayBuild(context.Background(), "b1", func(gokitbuildservice.BuildEvent) error {
+		time.Sleep(perOp / 2) // a slow client: the whole replay takes 2.5 perOp
+		got++
+		return nil
+	})
+	if err != nil || got != 5 {
+		t.Errorf("replay to a slow sink: got %d events, %v; want all 5", got, err)
+	}
+
+	fake.Delays = map[string]time.Duration{"ReplayBuild": time.Second}
+	err = s.ReplayBuild(context.Background(), "b1", func(gokitbuildservice.BuildEvent) error { return nil })
+	if err != gokitbuildservice.ErrBackendTimeout {
+		t.Errorf("backend too slow to start the replay: got %v, want ErrBackendTimeout", err)
+	}
+}
@@ -0,0 +1,1647 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/transport"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ErrBadRouting is returned when an expected path variable is missing.
+	// It always indicates programmer error.
+	ErrBadRouting = errors.New("inconsistent mapping between route and handler (programmer error)")
+
+	// ErrBadContentRange is returned when a log upload carries a Content-Range
+	// header we can't parse, or one that disagrees with the body length.
+	ErrBadContentRange = errors.New("malformed Content-Range header")
+
+	// ErrPreconditionFailed is returned when a conditional PATCH finds the
+	// build in a status other than its If-Status header.
+	ErrPreconditionFailed = errors.New("build status does not match If-Status")
+)
+
+// MakeHTTPHandler mounts all of the service endpoints into an http.Handler.
+// Responses carrying builds send them compact, leaving out empty fields,
+// unless the Accept header asks for FullProfile. Callers presenting
+// "Authorization: Bearer <token>" for one of the tokens given WithActorTokens
+// are recorded as the actor, and WithAuthorizer every endpoint asks its
+// Authorizer first.
+func MakeHTTPHandler(s Service, logger log.Logger, opts ...HandlerOption) http.Handler {
+	r := mux.NewRouter()
+	e := MakeServerEndpoints(s)
+	c := newHandlerConfig(opts)
+	if c.authorizer != nil {
+		e = e.authorized(c.authorizer, s)
+	}
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, requestIDToContext, traceToContext(c.traceSample), baggageToContext, errorFormatToContext(c.errorFormat), tokenToContext(c.actors)),
+	}
+
+	// GET     /health                             {"status":"ok"}, plus "queuePaused" WithQueueGate
+	// GET     /limits                             the limits and settings in force, read afresh on every
+	//                                             request; clients should adapt to these rather than
+	//                                             assume the defaults
+	// POST    /builds/                            adds another build; WithSpecDedup, if an unfinished build
+	//                                             has the same spec, returns {"build"} with that build
+	//                                             instead, and sets X-Build-Deduplicated to its ID
+	// POST    /builds/?getOrCreate=true           returns the build with the body's id, adding the
+	//                                             body as a new build first if there's none
+	// GET     /builds/                            lists builds, ordered by ?sort=[-]id|createdAt|name
+	//                                             and filtered by ?selector=<label selector>, one
+	//                                             page of ?offset=&limit= at a time; no limit means
+	//                                             WithDefaultListLimit, and one over WithMaxListLimit is
+	//                                             clamped to the maximum, either way with
+	//                                             X-Result-Truncated: true if that leaves builds out;
+	//                                             ?quarantined=true lists only quarantined builds;
+	//                                             ?predicate= only those a predicate registered under
+	//                                             that name with RegisterListPredicate accepts;
+	//                                             ?modifiedAfter=&modifiedBefore= (RFC 3339) lists
+	//                                             builds changed in [after, before), oldest change first;
+	//                                             with ?partial=true or X-Allow-Partial: true, a list
+	//                                             cut short by a timeout returns what it gathered, with
+	//                                             X-Partial: true, rather than failing
+	// GET     /builds/?specHash=                  the builds whose specHash is the given one, oldest first
+	// GET     /builds/?fingerprint=               {"build"}, the latest to succeed with the given
+	//                                             Fingerprint, for reusing its result; 404 if none did
+	// POST    /builds/get                         retrieves the builds in {"ids":[...]} at once,
+	//                                             reporting the ones that don't exist as missing
+	// POST    /builds/statuses                    just the statuses of the builds in {"ids":[...]};
+	//                                             the ones that don't exist are left out
+	// POST    /builds/reserve                     reserves a fresh ID, starting with ?prefix=, for a
+	//                                             build to be created shortly
+	// GET     /builds/metrics                     counts, success ratio, run duration percentiles and
+	//                                             throughput of builds finished in the last ?window=
+	//                                             (default 24h); routed ahead of /builds/:id
+	// GET     /builds/:id                         retrieves the given build by id
+	// PUT     /builds/:id                         post updated build information about the build
+	// PATCH   /builds/:id                         partial updated build information; with an
+	//                                             If-Status header, only {"status"} is allowed and
+	//                                             it's applied only if the current status matches
+	// PATCH   /builds/batch                       apply {"patch"} to each of the builds in {"ids":[...]},
+	//                                             with a result per build; 207 if any failed
+	// POST    /builds/batch                       create each of the builds in {"builds":[...]}, with
+	//                                             a result per build, in order; 207 if any failed
+	// DELETE  /builds/:id                         remove the given build
+	// PUT     /builds/:id/logs                    append log bytes at the offset in Content-Range
+	// HEAD    /builds/:id/logs                    report the stored log length
+	// GET     /builds/:id/logs                    the logs as text from byte ?from=, only those of step
+	//                                             ?step= (0-based) if given; from counts in that step's output
+	// PUT     /builds/:id/outputs/:key            set the build's output key to the body, as text, of at
+	//                                             most WithMaxOutputBytes
+	// GET     /builds/:id/outputs/:key            the build's output key, as text
+	// GET     /builds/:id/queue                   position and estimated wait of a pending build
+	// GET     /builds/:id/tree                    transitive dependencies, ?depth= levels deep (default all)
+	// GET     /builds/:id/history                 every status the build has been through, oldest first
+	// GET     /builds/:id/replay                  the build's status changes and log appends, oldest
+	//                                             first, as server-sent events; the stream then ends
+	// POST    /builds/:id/rerun-failed            reset failed steps of a finished build and requeue it
+	// GET     /builds/:id/audit                   the build's audit entries, newest first, filtered by
+	//                                             ?method=&actor=&since=&until= (RFC 3339), one page of
+	//                                             ?limit= at a time from ?cursor=; only WithAuditLog
+	// POST    /builds/:id/fail                    fail an unfinished build with {"reason","exitCode"}
+	// POST    /builds/:id/rename                  move the build and its logs to {"newId"}, updating
+	//                                             the builds that depend on it
+	// GET     /builds/:idA/diff/:idB              compare the specs of two builds
+	// POST    /builds/validate                    report problems with a build without creating it
+	// POST    /builds/import                      create builds from NDJSON, one per line; with
+	//                                             Accept: application/x-ndjson, stream each line's
+	//                                             outcome and then the summary (see NDJSONMediaType)
+	// GET     /labels                             every label key in use, sorted
+	// GET     /labels/:key/values                 every value of the label key, sorted
+	// GET     /groups/:id                         {"group"}, the counts of the group's builds by status
+	//                                             and its overall status; 404 if it has no builds
+	// GET     /groups/:id/builds                  the builds in the group, oldest first
+	// POST    /groups/:id/cancel                  cancel the group's unfinished builds, returning
+	//                                             {"cancelled"}, how many
+
+	r.Methods("GET").Path("/health").Handler(httptransport.NewServer(
+		func(context.Context, interface{}) (interface{}, error) {
+			resp := healthResponse{Status: "ok"}
+			if c.queue != nil {
+				paused := c.queue.Paused()
+				resp.QueuePaused = &paused
+			}
+			return resp, nil
+		},
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/limits").Handler(httptransport.NewServer(
+		e.GetLimitsEndpoint,
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeGetLimitsResponse(c),
+		options...,
+	))
+	r.Methods("POST").Path("/builds/").Queries("getOrCreate", "true").Handler(httptransport.NewServer(
+		e.GetOrCreateBuildEndpoint,
+		decodePostBuildRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/").Handler(httptransport.NewServer(
+		e.PostBuildEndpoint,
+		decodePostBuildRequest,
+		encodePostBuildResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/").Queries("specHash", "{specHash}").Handler(httptransport.NewServer(
+		e.FindBuildsBySpecHashEndpoint,
+		decodeFindBuildsBySpecHashRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/").Queries("fingerprint", "{fingerprint}").Handler(httptransport.NewServer(
+		e.FindByFingerprintEndpoint,
+		decodeFindByFingerprintRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/").Handler(httptransport.NewServer(
+		e.ListBuildsEndpoint,
+		decodeListBuildsRequest(c.listLimit),
+		encodeListBuildsResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/metrics").Handler(httptransport.NewServer(
+		e.BuildMetricsEndpoint,
+		decodeBuildMetricsRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/{id}").Handler(httptransport.NewServer(
+		e.GetBuildEndpoint,
+		decodeGetBuildRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/builds/{id}").Handler(httptransport.NewServer(
+		e.PutBuildEndpoint,
+		decodePutBuildRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/batch").Handler(httptransport.NewServer(
+		e.BatchPostBuildsEndpoint,
+		decodeBatchPostBuildsRequest,
+		encodePatchBuildsResponse,
+		options...,
+	))
+	r.Methods("PATCH").Path("/builds/batch").Handler(httptransport.NewServer(
+		e.PatchBuildsEndpoint,
+		decodePatchBuildsRequest,
+		encodePatchBuildsResponse,
+		options...,
+	))
+	r.Methods("PATCH").Path("/builds/{id}").Headers("If-Status", "").Handler(httptransport.NewServer(
+		e.CompareAndSetStatusEndpoint,
+		decodeCompareAndSetStatusRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PATCH").Path("/builds/{id}").Handler(httptransport.NewServer(
+		e.PatchBuildEndpoint,
+		decodePatchBuildRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/builds/{id}").Handler(httptransport.NewServer(
+		e.DeleteBuildEndpoint,
+		decodeDeleteBuildRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/builds/{id}/logs").Handler(httptransport.NewServer(
+		e.AppendBuildLogsEndpoint,
+		decodeAppendBuildLogsRequest,
+		encodeBuildLogLengthResponse,
+		options...,
+	))
+	r.Methods("HEAD").Path("/builds/{id}/logs").Handler(httptransport.NewServer(
+		e.GetBuildLogLengthEndpoint,
+		decodeGetBuildLogLengthRequest,
+		encodeBuildLogLengthResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/{id}/logs").Handler(httptransport.NewServer(
+		e.GetBuildLogsEndpoint,
+		decodeGetBuildLogsRequest,
+		encodeGetBuildLogsResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/builds/{id}/outputs/{key}").Handler(limitBody(c.maxOutput+1, httptransport.NewServer(
+		e.SetOutputEndpoint,
+		decodeSetOutputRequest,
+		encodeResponse,
+		options...,
+	)))
+	r.Methods("GET").Path("/builds/{id}/outputs/{key}").Handler(httptransport.NewServer(
+		e.GetOutputEndpoint,
+		decodeGetOutputRequest,
+		encodeGetOutputResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/{id}/replay").Handler(httptransport.NewServer(
+		e.ReplayBuildEndpoint,
+		decodeReplayBuildRequest,
+		encodeReplayBuildResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/{id}/queue").Handler(httptransport.NewServer(
+		e.QueuePositionEndpoint,
+		decodeQueuePositionRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/{id}/tree").Handler(httptransport.NewServer(
+		e.GetDependencyTreeEndpoint,
+		decodeGetDependencyTreeRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/{id}/history").Handler(httptransport.NewServer(
+		e.GetStatusHistoryEndpoint,
+		decodeGetStatusHistoryRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/{id}/rerun-failed").Handler(httptransport.NewServer(
+		e.RerunFailedStepsEndpoint,
+		decodeRerunFailedStepsRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/{id}/fail").Handler(httptransport.NewServer(
+		e.FailBuildEndpoint,
+		decodeFailBuildRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/{id}/rename").Handler(httptransport.NewServer(
+		e.RenameBuildEndpoint,
+		decodeRenameBuildRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/builds/{idA}/diff/{idB}").Handler(httptransport.NewServer(
+		e.DiffBuildsEndpoint,
+		decodeDiffBuildsRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/import").Handler(streamImports(httptransport.NewServer(
+		e.ImportBuildsEndpoint,
+		decodeImportBuildsRequest,
+		encodeImportBuildsResponse,
+		options...,
+	)))
+	r.Methods("POST").Path("/builds/get").Handler(httptransport.NewServer(
+		e.GetBuildsEndpoint,
+		decodeGetBuildsRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/statuses").Handler(httptransport.NewServer(
+		e.ListBuildStatusesEndpoint,
+		decodeListBuildStatusesRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/reserve").Handler(httptransport.NewServer(
+		e.ReserveIDEndpoint,
+		decodeReserveIDRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/builds/validate").Handler(httptransport.NewServer(
+		e.ValidateBuildEndpoint,
+		decodeValidateBuildRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/labels").Handler(httptransport.NewServer(
+		e.ListLabelKeysEndpoint,
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/labels/{key:.+}/values").Handler(httptransport.NewServer(
+		e.ListLabelValuesEndpoint,
+		decodeListLabelValuesRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/groups/{id}").Handler(httptransport.NewServer(
+		e.GroupStatusEndpoint,
+		decodeGroupStatusRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/groups/{id}/builds").Handler(httptransport.NewServer(
+		e.ListBuildsByGroupEndpoint,
+		decodeListBuildsByGroupRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/groups/{id}/cancel").Handler(httptransport.NewServer(
+		e.CancelGroupEndpoint,
+		decodeCancelGroupRequest,
+		encodeResponse,
+		options...,
+	))
+	if c.audit != nil {
+		getAuditLog := func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(getAuditLogRequest)
+			entries, next, e := c.audit.GetAuditLog(ctx, req.ID, req.Filter)
+			return getAuditLogResponse{Entries: entries, Next: next, Err: e}, nil
+		}
+		if c.authorizer != nil {
+			getAuditLog = AuthorizingEndpoint(c.authorizer, s, "GetAuditLog")(getAuditLog)
+		}
+		r.Methods("GET").Path("/builds/{id}/audit").Handler(httptransport.NewServer(
+			getAuditLog,
+			decodeGetAuditLogRequest,
+			encodeResponse,
+			options...,
+		))
+	}
+	return r
+}
+
+// MakeAdminHTTPHandler mounts the operator endpoints into an http.Handler.
+// Every request must carry "Authorization: Bearer <token>" for one of the
+// tokens in admins, which maps tokens to the admin's name. That name is
+// recorded as the actor for logging.
+//
+// POST    /admin/builds/:id/release           drop the build's lease and return it to pending
+// GET     /admin/config/canary                the canary weight; only WithCanaryWeight
+// PUT     /admin/config/canary                set the canary weight to {"weight"}, from 0 to 1
+// GET     /admin/config/slow                  the slow request thresholds; only WithSlowThresholds
+// PUT     /admin/config/slow                  set them to {"default", "methods"}, as durations like "1s"
+// POST    /admin/queue/pause                  stop builds from being leased; only WithQueueGate
+// POST    /admin/queue/resume                 let builds be leased again
+// POST    /admin/compact                      compact storage now; {"reclaimedBytes","duration"}, zero without WithCompactor
+func MakeAdminHTTPHandler(s Service, admins map[string]string, logger log.Logger, opts ...HandlerOption) http.Handler {
+	r := mux.NewRouter()
+	e := MakeServerEndpoints(s)
+	c := newHandlerConfig(opts)
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, requestIDToContext, traceToContext(c.traceSample), baggageToContext, errorFormatToContext(c.errorFormat), tokenToContext(admins)),
+	}
+	r.Methods("POST").Path("/admin/builds/{id}/release").Handler(httptransport.NewServer(
+		requireActor(e.ForceReleaseLeaseEndpoint),
+		decodeForceReleaseLeaseRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/admin/compact").Handler(httptransport.NewServer(
+		requireActor(func(ctx context.Context, _ interface{}) (interface{}, error) {
+			if c.compactor == nil {
+				return newCompactResponse(CompactStats{}, nil), nil
+			}
+			return newCompactResponse(c.compactor.Compact(ctx)), nil
+		}),
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+	if c.canary != nil {
+		r.Methods("GET").Path("/admin/config/canary").Handler(httptransport.NewServer(
+			requireActor(func(context.Context, interface{}) (interface{}, error) {
+				return canaryConfig{Weight: c.canary.Get()}, nil
+			}),
+			func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+			encodeResponse,
+			options...,
+		))
+		r.Methods("PUT").Path("/admin/config/canary").Handler(httptransport.NewServer(
+			requireActor(func(_ context.Context, request interface{}) (interface{}, error) {
+				req := request.(canaryConfig)
+				if e := c.canary.Set(req.Weight); e != nil {
+					return canaryConfig{Err: e}, nil
+				}
+				return canaryConfig{Weight: c.canary.Get()}, nil
+			}),
+			func(_ context.Context, r *http.Request) (interface{}, error) {
+				var req canaryConfig
+				if e := decodeBody(r, &req); e != nil {
+					return nil, e
+				}
+				return req, nil
+			},
+			encodeResponse,
+			options...,
+		))
+	}
+	if c.queue != nil {
+		r.Methods("POST").Path("/admin/queue/pause").Handler(httptransport.NewServer(
+			requireActor(func(context.Context, interface{}) (interface{}, error) {
+				c.queue.PauseQueue()
+				return queueState{Paused: c.queue.Paused()}, nil
+			}),
+			func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+			encodeResponse,
+			options...,
+		))
+		r.Methods("POST").Path("/admin/queue/resume").Handler(httptransport.NewServer(
+			requireActor(func(context.Context, interface{}) (interface{}, error) {
+				c.queue.ResumeQueue()
+				return queueState{Paused: c.queue.Paused()}, nil
+			}),
+			func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+			encodeResponse,
+			options...,
+		))
+	}
+	if c.slow != nil {
+		r.Methods("GET").Path("/admin/config/slow").Handler(httptransport.NewServer(
+			requireActor(func(context.Context, interface{}) (interface{}, error) {
+				return newSlowConfig(c.slow), nil
+			}),
+			func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+			encodeResponse,
+			options...,
+		))
+		r.Methods("PUT").Path("/admin/config/slow").Handler(httptransport.NewServer(
+			requireActor(func(_ context.Context, request interface{}) (interface{}, error) {
+				def, byMethod, e := request.(slowConfig).parse()
+				if e == nil {
+					e = c.slow.Set(def, byMethod)
+				}
+				if e != nil {
+					return slowConfig{Err: e}, nil
+				}
+				return newSlowConfig(c.slow), nil
+			}),
+			func(_ context.Context, r *http.Request) (interface{}, error) {
+				var req slowConfig
+				if e := decodeBody(r, &req); e != nil {
+					return nil, e
+				}
+				return req, nil
+			},
+			encodeResponse,
+			options...,
+		))
+	}
+	return r
+}
+
+type healthResponse struct {
+	Status      string `json:"status"`
+	QueuePaused *bool  `json:"queuePaused,omitempty"`
+}
+
+// limitsDocument is the body of GET /limits. Durations are in seconds, and
+// zero means no limit, or that the setting is off.
+type limitsDocument struct {
+	Build struct {
+		MaxSteps  int `json:"maxSteps"`
+		MaxLabels int `json:"maxLabels"`
+		MaxBytes  int `json:"maxBytes"`
+
+		MaxOutputBytes int `json:"maxOutputBytes"`
+	} `json:"build"`
+	MaxRunning            int     `json:"maxRunning"`
+	DefaultTTLSeconds     float64 `json:"defaultTTLSeconds"`
+	ReservationTTLSeconds float64 `json:"reservationTTLSeconds"`
+	DefaultListLimit      int     `json:"defaultListLimit"` // the limit of lists that give none
+	MaxListLimit          int     `json:"maxListLimit"`
+	MaxBatchIDs           int     `json:"maxBatchIds"`
+	MaxImportLineBytes    int     `json:"maxImportLineBytes"`
+
+	Retention *limitsRetention `json:"retention,omitempty"` // only WithReportedRetention
+
+	Features struct {
+		StrictIDs   bool  `json:"strictIds"`
+		StrictFIFO  bool  `json:"strictFifo"`
+		SpecDedup   bool  `json:"specDedup"`
+		Persistent  bool  `json:"persistent"`
+		Audit       bool  `json:"audit"`
+		QueuePaused *bool `json:"queuePaused,omitempty"` // only WithQueueGate
+	} `json:"features"`
+}
+
+type limitsRetention struct {
+	Seconds         float64                 `json:"seconds"`
+	ByStatusSeconds map[BuildStatus]float64 `json:"byStatusSeconds,omitempty"`
+}
+
+// encodeGetLimitsResponse adds the limits the HTTP layer enforces to those
+// of the service. Those that can change at runtime are read as they are now.
+func encodeGetLimitsResponse(c handlerConfig) httptransport.EncodeResponseFunc {
+	return func(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+		resp := response.(getLimitsResponse)
+		if resp.Err != nil {
+			return encodeResponse(ctx, w, response)
+		}
+		l := resp.Limits
+		var doc limitsDocument
+		doc.Build.MaxSteps = l.Build.MaxSteps
+		doc.Build.MaxLabels = l.Build.MaxLabels
+		doc.Build.MaxBytes = l.Build.MaxBytes
+		doc.Build.MaxOutputBytes = l.Build.MaxOutputBytes
+		doc.MaxRunning = l.MaxRunning
+		doc.DefaultTTLSeconds = l.DefaultTTL.Seconds()
+		doc.ReservationTTLSeconds = l.ReservationTTL.Seconds()
+		doc.DefaultListLimit = c.listLimit(0)
+		doc.MaxListLimit = c.maxList
+		doc.MaxBatchIDs = maxGetBuilds
+		doc.MaxImportLineBytes = maxImportLine
+		if c.retention != nil {
+			doc.Retention = &limitsRetention{Seconds: c.retention.retention.Seconds()}
+			if len(c.retention.byStatus) > 0 {
+				doc.Retention.ByStatusSeconds = map[BuildStatus]float64{}
+			}
+			for status, d := range c.retention.byStatus {
+				doc.Retention.ByStatusSeconds[status] = d.Seconds()
+			}
+		}
+		doc.Features.StrictIDs = l.StrictIDs
+		doc.Features.StrictFIFO = l.StrictFIFO
+		doc.Features.SpecDedup = l.SpecDedup
+		doc.Features.Persistent = l.Persistent
+		doc.Features.Audit = c.audit != nil
+		if c.queue != nil {
+			paused := c.queue.Paused()
+			doc.Features.QueuePaused = &paused
+		}
+		return encodeResponse(ctx, w, doc)
+	}
+}
+
+type compactResponse struct {
+	ReclaimedBytes int64  `json:"reclaimedBytes"`
+	Duration       string `json:"duration"`
+	Err            error  `json:"err,omitempty"`
+}
+
+func newCompactResponse(stats CompactStats, err error) compactResponse {
+	return compactResponse{ReclaimedBytes: stats.ReclaimedBytes, Duration: stats.Duration.String(), Err: err}
+}
+
+func (r compactResponse) error() error { return r.Err }
+
+type queueState struct {
+	Paused bool `json:"paused"`
+}
+
+type canaryConfig struct {
+	Weight float64 `json:"weight"`
+	Err    error   `json:"err,omitempty"`
+}
+
+func (r canaryConfig) error() error { return r.Err }
+
+// slowConfig is SlowThresholds on the wire, with durations as strings.
+type slowConfig struct {
+	Default string            `json:"default"`
+	Methods map[string]string `json:"methods"`
+	Err     error             `json:"err,omitempty"`
+}
+
+func newSlowConfig(t *SlowThresholds) slowConfig {
+	def, byMethod := t.Get()
+	methods := make(map[string]string, len(byMethod))
+	for m, d := range byMethod {
+		methods[m] = d.String()
+	}
+	return slowConfig{Default: def.String(), Methods: methods}
+}
+
+func (r slowConfig) parse() (time.Duration, map[string]time.Duration, error) {
+	var errs ValidationErrors
+	def, err := time.ParseDuration(r.Default)
+	if err != nil {
+		errs.add("default", "must be a duration like \"1s\"")
+	}
+	byMethod := make(map[string]time.Duration, len(r.Methods))
+	for m, s := range r.Methods {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			errs.add("methods."+m, "must be a duration like \"1s\"")
+		}
+		byMethod[m] = d
+	}
+	if len(errs) > 0 {
+		return 0, nil, errs
+	}
+	return def, byMethod, nil
+}
+
+func (r slowConfig) error() error { return r.Err }
+
+// MakeDebugHTTPHandler mounts diagnostics into an http.Handler. They're
+// meant for operators, so only mount it when debugging is enabled.
+//
+// GET     /debug/subscriptions                the event hub's live subscriptions, oldest first
+func MakeDebugHTTPHandler(hub *EventHub, logger log.Logger, opts ...HandlerOption) http.Handler {
+	r := mux.NewRouter()
+	c := newHandlerConfig(opts)
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, requestIDToContext, traceToContext(c.traceSample), baggageToContext, errorFormatToContext(c.errorFormat)),
+	}
+	r.Methods("GET").Path("/debug/subscriptions").Handler(httptransport.NewServer(
+		func(context.Context, interface{}) (interface{}, error) {
+			subs := hub.Subscriptions()
+			return subscriptionsResponse{Count: len(subs), Subscriptions: subs}, nil
+		},
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+	return r
+}
+
+type subscriptionsResponse struct {
+	Count         int            `json:"count"`
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// MakeWebhookHTTPHandler mounts webhook registration into an http.Handler.
+//
+// POST    /webhooks/                          registers {"url": ..., "events": [...]}
+// DELETE  /webhooks/:id                       removes the given registration
+func MakeWebhookHTTPHandler(d *WebhookDispatcher, logger log.Logger, opts ...HandlerOption) http.Handler {
+	r := mux.NewRouter()
+	c := newHandlerConfig(opts)
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, requestIDToContext, traceToContext(c.traceSample), baggageToContext, errorFormatToContext(c.errorFormat)),
+	}
+	r.Methods("POST").Path("/webhooks/").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(registerWebhookRequest)
+			id, e := d.RegisterWebhook(ctx, req.URL, req.Events)
+			return registerWebhookResponse{ID: id, Err: e}, nil
+		},
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			var req registerWebhookRequest
+			if e := decodeBody(r, &req); e != nil {
+				return nil, e
+			}
+			return req, nil
+		},
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/webhooks/{id}").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			e := d.UnregisterWebhook(ctx, request.(string))
+			return registerWebhookResponse{Err: e}, nil
+		},
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			id, ok := mux.Vars(r)["id"]
+			if !ok {
+				return nil, ErrBadRouting
+			}
+			return id, nil
+		},
+		encodeResponse,
+		options...,
+	))
+	return r
+}
+
+type registerWebhookRequest struct {
+	URL    string           `json:"url"`
+	Events []BuildEventType `json:"events"`
+}
+
+type registerWebhookResponse struct {
+	ID  string `json:"id,omitempty"`
+	Err error  `json:"err,omitempty"`
+}
+
+func (r registerWebhookResponse) error() error { return r.Err }
+
+// GapHeader is set on an event feed response when events after the requested
+// ID have already been evicted from the hub's history. The client should do a
+// full refresh rather than rely on the replay.
+const GapHeader = "X-Events-Gap"
+
+// MakeEventsHTTPHandler serves the live event feed as server-sent events.
+//
+// GET     /events?since=:eventID              replays events after eventID, then streams live
+// GET     /events?build=:id                   only the events of build id; combines with since
+//
+// The standard Last-Event-ID header is honored when since isn't given, so
+// browsers' EventSource reconnects resume where they left off. A client
+// that reads too slowly to keep up is sent a final "error" event saying so,
+// and disconnected; it can reconnect and resume.
+func MakeEventsHTTPHandler(hub *EventHub, logger log.Logger, opts ...HandlerOption) http.Handler {
+	c := newHandlerConfig(opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		since := r.URL.Query().Get("since")
+		if since == "" {
+			since = r.Header.Get("Last-Event-ID")
+		}
+		subOpts := []SubscribeOption{DropWhenFull()}
+		if id := r.URL.Query().Get("build"); id != "" {
+			subOpts = append(subOpts, ForBuild(id))
+		}
+		var replay []BuildEvent
+		var gap bool
+		var events <-chan BuildEvent
+		var cancel func()
+		if since == "" {
+			events, cancel = hub.Subscribe(64, subOpts...)
+		} else {
+			id, err := strconv.ParseUint(since, 10, 64)
+			if err != nil {
+				ctx := errorFormatToContext(c.errorFormat)(r.Context(), r)
+				encodeError(ctx, ValidationErrors{{Field: "since", Message: "must be an event ID"}}, w)
+				return
+			}
+			replay, gap, events, cancel = hub.SubscribeSince(id, 64, subOpts...)
+		}
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		if gap {
+			w.Header().Set(GapHeader, "true")
+		}
+		w.WriteHeader(http.StatusOK)
+		for _, e := range replay {
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					// Only the hub closes the channel while we're reading it,
+					// when we've fallen too far behind.
+					fmt.Fprint(w, "event: error\ndata: too slow\n\n")
+					flusher.Flush()
+					return
+				}
+				if err := writeEvent(w, e); err != nil {
+					logger.Log("feed", "events", "err", err)
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+func writeEvent(w io.Writer, e BuildEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+func decodePostBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req postBuildRequest
+	if e := decodeBody(r, &req.Build); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeGetBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getBuildRequest{ID: id}, nil
+}
+
+// maxGetBuilds caps how many builds one POST /builds/get,
+// /builds/statuses or PATCH /builds/batch may ask for.
+const maxGetBuilds = 1000
+
+func decodeGetBuildsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req getBuildsRequest
+	if e := decodeBody(r, &req); e != nil {
+		return nil, e
+	}
+	if e := checkIDs(req.IDs); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeListBuildStatusesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req listBuildStatusesRequest
+	if e := decodeBody(r, &req); e != nil {
+		return nil, e
+	}
+	if e := checkIDs(req.IDs); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+// checkIDs validates the IDs of a batch request.
+func checkIDs(ids []string) error {
+	var errs ValidationErrors
+	if len(ids) > maxGetBuilds {
+		errs.add("ids", "%d IDs exceeds the limit of %d", len(ids), maxGetBuilds)
+	}
+	for i, id := range ids {
+		if id == "" {
+			errs.add(fmt.Sprintf("ids[%d]", i), "required")
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+func decodeReserveIDRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return reserveIDRequest{Prefix: r.URL.Query().Get("prefix")}, nil
+}
+
+// DefaultListLimit is the page size of GET /builds/ lists that give no
+// limit, unless WithDefaultListLimit says otherwise.
+const DefaultListLimit = 100
+
+// DefaultMaxListLimit is the largest page of builds GET /builds/ returns
+// unless WithMaxListLimit says otherwise.
+const DefaultMaxListLimit = 1000
+
+// ResultTruncatedHeader is set to "true" on a page of builds that was
+// clamped to the maximum limit and left some out. The envelope's total
+// still counts them, so clients can page through the rest.
+const ResultTruncatedHeader = "X-Result-Truncated"
+
+// AllowPartialHeader, set to "true" like ?partial=true, asks for a list cut
+// short by a timeout to return the builds gathered so far, which are then
+// marked with PartialHeader. Without it, such a list fails as a whole.
+const AllowPartialHeader = "X-Allow-Partial"
+
+// PartialHeader is set to "true" on a page of builds returned with
+// ErrPartialResult.
+const PartialHeader = "X-Partial"
+
+// decodeListBuildsRequest resolves the limit with limitFor, so no list is
+// unbounded. Asking for more than the maximum isn't an error: it gets the
+// maximum.
+func decodeListBuildsRequest(limitFor func(requested int) int) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (request interface{}, err error) {
+		q := r.URL.Query()
+		sel, err := ParseSelector(q.Get("selector"))
+		if err != nil {
+			return nil, err
+		}
+		var errs ValidationErrors
+		offset, limit := intParam(q, "offset", &errs), intParam(q, "limit", &errs)
+		var quarantined bool
+		if v := q.Get("quarantined"); v != "" {
+			if quarantined, err = strconv.ParseBool(v); err != nil {
+				errs.add("quarantined", "must be true or false")
+			}
+		}
+		after, before := timeParam(q, "modifiedAfter", &errs), timeParam(q, "modifiedBefore", &errs)
+		partial := r.Header.Get(AllowPartialHeader) == "true"
+		if v := q.Get("partial"); v != "" {
+			if partial, err = strconv.ParseBool(v); err != nil {
+				errs.add("partial", "must be true or false")
+			}
+		}
+		if errs != nil {
+			return nil, errs
+		}
+		limit = limitFor(limit)
+		return listBuildsRequest{
+			Options: ListOptions{
+				SortBy:      q.Get("sort"),
+				Selector:    sel,
+				Quarantined: quarantined,
+				Predicate:   q.Get("predicate"),
+			},
+			Offset:         offset,
+			Limit:          limit,
+			ModifiedAfter:  after,
+			ModifiedBefore: before,
+			AllowPartial:   partial,
+		}, nil
+	}
+}
+
+// timeParam parses an RFC 3339 timestamp query parameter, which defaults
+// to the zero time.
+func timeParam(q url.Values, name string, errs *ValidationErrors) time.Time {
+	s := q.Get(name)
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		errs.add(name, "must be an RFC 3339 timestamp")
+	}
+	return t
+}
+
+// intParam parses a non-negative integer query parameter, which defaults
+// to zero.
+func intParam(q url.Values, name string, errs *ValidationErrors) int {
+	s := q.Get(name)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		errs.add(name, "must be a non-negative integer, got %q", s)
+	}
+	return n
+}
+
+// encodeListBuildsResponse writes a page of builds, with RFC 8288 Link
+// headers to the next and previous pages. The links keep every other query
+// parameter, so filters and sort order carry over. A page whose limit was
+// clamped, and that leaves builds out, is marked with
+// ResultTruncatedHeader.
+func encodeListBuildsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp, ok := response.(listBuildsResponse)
+	if ok && resp.Partial {
+		w.Header().Set(PartialHeader, "true")
+	}
+	if !ok || resp.Err != nil || resp.Limit == 0 {
+		return encodeResponse(ctx, w, response)
+	}
+	u, err := url.ParseRequestURI(ctxString(ctx, httptransport.ContextKeyRequestURI))
+	if err != nil {
+		return encodeResponse(ctx, w, response)
+	}
+	page := func(offset int) string {
+		q := u.Query()
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(resp.Limit))
+		return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+	}
+	if requested, _ := strconv.Atoi(u.Query().Get("limit")); requested != resp.Limit && resp.Offset+len(resp.Items) < resp.Total {
+		w.Header().Set(ResultTruncatedHeader, "true")
+	}
+	var links []string
+	if next := resp.Offset + resp.Limit; next < resp.Total {
+		resp.Next = page(next)
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, resp.Next))
+	}
+	if resp.Offset > 0 {
+		prev := resp.Offset - resp.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, page(prev)))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	return encodeResponse(ctx, w, resp)
+}
+
+func ctxString(ctx context.Context, key interface{}) string {
+	s, _ := ctx.Value(key).(string)
+	return s
+}
+
+func decodePutBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var build Build
+	if err := decodeBody(r, &build); err != nil {
+		return nil, err
+	}
+	return putBuildRequest{
+		ID:    id,
+		Build: build,
+	}, nil
+}
+
+func decodePatchBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var build Build
+	if err := decodeBody(r, &build); err != nil {
+		return nil, err
+	}
+	return patchBuildRequest{
+		ID:    id,
+		Build: build,
+	}, nil
+}
+
+func decodePatchBuildsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req patchBuildsRequest
+	if e := decodeBody(r, &req); e != nil {
+		return nil, e
+	}
+	if e := checkIDs(req.IDs); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeBatchPostBuildsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req batchPostBuildsRequest
+	if e := decodeBody(r, &req); e != nil {
+		return nil, e
+	}
+	if len(req.Builds) > maxGetBuilds {
+		var errs ValidationErrors
+		errs.add("builds", "%d builds exceeds the limit of %d", len(req.Builds), maxGetBuilds)
+		return nil, errs
+	}
+	return req, nil
+}
+
+func decodeCompareAndSetStatusRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var build Build
+	if err := decodeBody(r, &build); err != nil {
+		return nil, err
+	}
+	var errs ValidationErrors
+	if build.Status == "" {
+		errs.add("status", "required with If-Status")
+	}
+	if build.ID != "" || build.Name != "" || build.Steps != nil || build.Labels != nil || build.Parameters != nil || build.DependsOn != nil || build.Priority != 0 {
+		errs.add("body", "only status can be patched with If-Status")
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return compareAndSetStatusRequest{
+		ID:       id,
+		Expected: BuildStatus(r.Header.Get("If-Status")),
+		Next:     build.Status,
+	}, nil
+}
+
+func decodeDeleteBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return deleteBuildRequest{ID: id}, nil
+}
+
+func decodeAppendBuildLogsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var offset int64 // no Content-Range means the upload starts from scratch
+	if h := r.Header.Get("Content-Range"); h != "" {
+		start, end, total, err := parseContentRange(h)
+		if err != nil {
+			return nil, err
+		}
+		if end-start+1 != int64(len(data)) {
+			return nil, ErrBadContentRange
+		}
+		if total >= 0 && total <= end {
+			var errs ValidationErrors
+			errs.add("Content-Range", "total %d ends before byte %d of the range", total, end)
+			return nil, errs
+		}
+		offset = start
+	}
+	return appendBuildLogsRequest{
+		ID:     id,
+		Offset: offset,
+		Data:   data,
+	}, nil
+}
+
+func decodeGetBuildLogLengthRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getBuildLogLengthRequest{ID: id}, nil
+}
+
+func decodeGetBuildLogsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	q := r.URL.Query()
+	var errs ValidationErrors
+	step := -1
+	if q.Get("step") != "" {
+		step = intParam(q, "step", &errs)
+	}
+	from := intParam(q, "from", &errs)
+	if errs != nil {
+		return nil, errs
+	}
+	return getBuildLogsRequest{ID: id, Step: step, From: int64(from)}, nil
+}
+
+func decodeSetOutputRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	key, ok := vars["key"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	value, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		var errs ValidationErrors
+		errs.add("outputs."+key, "more than %d bytes exceeds the limit of %d", tooLarge.Limit-1, tooLarge.Limit-1)
+		return nil, errs
+	}
+	if err != nil {
+		return nil, err
+	}
+	return setOutputRequest{ID: id, Key: key, Value: string(value)}, nil
+}
+
+// limitBody stops next from reading more than n bytes of a request body.
+// Outputs are read up to one byte past their limit, so a value just over it
+// still reaches the service and is rejected there like any other write.
+func limitBody(n int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(n))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decodeGetOutputRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	key, ok := vars["key"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getOutputRequest{ID: id, Key: key}, nil
+}
+
+func decodeReplayBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return replayBuildRequest{ID: id}, nil
+}
+
+func decodeBuildMetricsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	window := 24 * time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			var errs ValidationErrors
+			errs.add("window", "must be a positive duration such as 24h")
+			return nil, errs
+		}
+		window = d
+	}
+	return buildMetricsRequest{Window: window}, nil
+}
+
+func decodeGetDependencyTreeRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var errs ValidationErrors
+	depth := intParam(r.URL.Query(), "depth", &errs)
+	if errs != nil {
+		return nil, errs
+	}
+	return getDependencyTreeRequest{ID: id, Depth: depth}, nil
+}
+
+func decodeFindBuildsBySpecHashRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	hash, ok := vars["specHash"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return findBuildsBySpecHashRequest{Hash: hash}, nil
+}
+
+func decodeFindByFingerprintRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	fp, ok := vars["fingerprint"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return findByFingerprintRequest{Fingerprint: fp}, nil
+}
+
+func decodeListLabelValuesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	key, ok := vars["key"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return listLabelValuesRequest{Key: key}, nil
+}
+
+func decodeGroupStatusRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return groupStatusRequest{GroupID: id}, nil
+}
+
+func decodeListBuildsByGroupRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return listBuildsByGroupRequest{GroupID: id}, nil
+}
+
+func decodeCancelGroupRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return cancelGroupRequest{GroupID: id}, nil
+}
+
+func decodeGetStatusHistoryRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getStatusHistoryRequest{ID: id}, nil
+}
+
+func decodeRerunFailedStepsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return rerunFailedStepsRequest{ID: id}, nil
+}
+
+func decodeFailBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var req failBuildRequest
+	if e := decodeBody(r, &req); e != nil {
+		return nil, e
+	}
+	if req.Reason == "" {
+		var errs ValidationErrors
+		errs.add("reason", "is required")
+		return nil, errs
+	}
+	req.ID = id
+	return req, nil
+}
+
+func decodeRenameBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var req renameBuildRequest
+	if e := decodeBody(r, &req); e != nil {
+		return nil, e
+	}
+	req.ID = id
+	return req, nil
+}
+
+type getAuditLogRequest struct {
+	ID     string
+	Filter AuditFilter
+}
+
+type getAuditLogResponse struct {
+	Entries []AuditEntry `json:"entries"`
+	Next    string       `json:"next,omitempty"`
+	Err     error        `json:"err,omitempty"`
+}
+
+func (r getAuditLogResponse) error() error { return r.Err }
+
+func decodeGetAuditLogRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	q := r.URL.Query()
+	var errs ValidationErrors
+	f := AuditFilter{
+		Method: q.Get("method"),
+		Actor:  q.Get("actor"),
+		Since:  timeParam(q, "since", &errs),
+		Until:  timeParam(q, "until", &errs),
+		Cursor: q.Get("cursor"),
+		Limit:  intParam(q, "limit", &errs),
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return getAuditLogRequest{ID: id, Filter: f}, nil
+}
+
+func decodeQueuePositionRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return queuePositionRequest{ID: id}, nil
+}
+
+func decodeDiffBuildsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idA, ok := vars["idA"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	idB, ok := vars["idB"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return diffBuildsRequest{IDA: idA, IDB: idB}, nil
+}
+
+func decodeForceReleaseLeaseRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return forceReleaseLeaseRequest{ID: id}, nil
+}
+
+func decodeImportBuildsRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	req := importBuildsRequest{Body: r.Body}
+	if st := importStreamFromContext(ctx); st != nil {
+		req.Progress = st.progress
+	}
+	return req, nil
+}
+
+func decodeValidateBuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req validateBuildRequest
+	if e := decodeBody(r, &req.Build); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+// parseContentRange parses a header of the form "bytes <start>-<end>/<total>",
+// where total may be "*" because workers don't know the final log size; it's
+// returned as -1 then.
+func parseContentRange(h string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(h, "bytes ")
+	if !ok {
+		return 0, 0, 0, ErrBadContentRange
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, ErrBadContentRange
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, ErrBadContentRange
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, ErrBadContentRange
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, ErrBadContentRange
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total < 0 {
+			return 0, 0, 0, ErrBadContentRange
+		}
+	}
+	return start, end, total, nil
+}
+
+// errorer is implemented by all concrete response types that may contain
+// errors. It allows us to change the HTTP response code without needing to
+// trigger an endpoint (transport-level) error.
+type errorer interface {
+	error() error
+}
+
+// encodeResponse is the common method to encode all response types to the
+// client, as JSON unless the request's Accept header asks for YAML. It's
+// certainly possible to specialize on a per-response (per-method) basis.
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		// Not a Go kit transport error, but a business-logic error.
+		// Provide those as HTTP errors.
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+	return writeBody(ctx, w, 0, response)
+}
+
+// encodePostBuildResponse answers a deduplicated create with the existing
+// build, as a success.
+func encodePostBuildResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	var dup *DuplicateSpecError
+	if resp := response.(postBuildResponse); errors.As(resp.Err, &dup) {
+		w.Header().Set(DeduplicatedHeader, dup.Existing.ID)
+		return writeBody(ctx, w, 0, getBuildResponse{Build: dup.Existing})
+	}
+	return encodeResponse(ctx, w, response)
+}
+
+// encodeBuildLogLengthResponse reports the stored log length in a header as
+// well as the body, so a worker can resume even from a HEAD or a 416.
+func encodeBuildLogLengthResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(buildLogLengthResponse)
+	w.Header().Set("X-Log-Length", strconv.FormatInt(resp.Length, 10))
+	if resp.Err == ErrRangeNotSatisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", resp.Length))
+	}
+	return encodeResponse(ctx, w, response)
+}
+
+// encodeGetBuildLogsResponse writes the logs as they are, rather than as
+// JSON. Errors are still encoded as JSON.
+func encodeGetBuildLogsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(getBuildLogsResponse)
+	if resp.Err != nil {
+		return encodeResponse(ctx, w, response)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := w.Write(resp.Data)
+	return err
+}
+
+// encodeGetOutputResponse writes the output as it is, rather than as JSON.
+// Errors are still encoded as JSON.
+func encodeGetOutputResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(getOutputResponse)
+	if resp.Err != nil {
+		return encodeResponse(ctx, w, response)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := io.WriteString(w, resp.Value)
+	return err
+}
+
+// encodeReplayBuildResponse writes the replay as server-sent events, in the
+// same form as the event feed. Errors are still encoded as JSON.
+func encodeReplayBuildResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(replayBuildResponse)
+	if resp.Err != nil {
+		return encodeResponse(ctx, w, response)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, e := range resp.Events {
+		if err := writeEvent(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeImportBuildsResponse answers 207 Multi-Status when some lines
+// weren't imported, so clients notice without parsing the summary. A
+// streamed import instead ends its stream.
+func encodeImportBuildsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(importBuildsResponse)
+	if st := importStreamFromContext(ctx); st != nil {
+		return st.end(resp)
+	}
+	if resp.Err != nil {
+		return encodeResponse(ctx, w, response)
+	}
+	code := http.StatusOK
+	if resp.Summary.Partial() {
+		code = http.StatusMultiStatus
+	}
+	return writeBody(ctx, w, code, resp.Summary)
+}
+
+func encodePatchBuildsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(patchBuildsResponse)
+	if resp.Err != nil {
+		return encodeResponse(ctx, w, response)
+	}
+	code := http.StatusOK
+	if failedResults(resp.Results) > 0 {
+		code = http.StatusMultiStatus
+	}
+	return writeBody(ctx, w, code, resp)
+}
+
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	if err == nil {
+		panic("encodeError with nil error")
+	}
+	code := codeFrom(err)
+	if errorFormatFromContext(ctx) == ErrorFormatBare {
+		writeBody(ctx, w, code, map[string]interface{}{"message": err.Error()})
+		return
+	}
+	detail := map[string]interface{}{
+		"code":    code,
+		"message": err.Error(),
+	}
+	var problems ValidationErrors
+	if errors.As(err, &problems) {
+		detail["problems"] = problems
+	}
+	writeBody(ctx, w, code, map[string]interface{}{"error": detail})
+}
+
+func codeFrom(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAlreadyExists), errors.Is(err, ErrInconsistentIDs), errors.Is(err, ErrBadContentRange), errors.Is(err, ErrValidation), errors.Is(err, ErrBadWebhook):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrCompactionInProgress):
+		return http.StatusConflict
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrConcurrencyLimit):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrRangeNotSatisfiable):
+		return http.StatusRequestedRangeNotSatisfiable
+	case errors.Is(err, ErrBackendTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,68 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+)
+
+// DependencyNode is a build in a dependency tree, with the builds it
+// depends on as children. A build reachable along several paths is only
+// expanded the first time it's met, in depth-first order; later occurrences
+// have Seen set and no Build or children, which also makes cycles safe.
+// Missing marks a dependency that doesn't exist, and Truncated one that
+// wasn't expanded because the depth limit was reached.
+type DependencyNode struct {
+	ID           string           `json:"id"`
+	Build        *Build           `json:"build,omitempty"`
+	Dependencies []DependencyNode `json:"dependencies,omitempty"`
+	Seen         bool             `json:"seen,omitempty"`
+	Missing      bool             `json:"missing,omitempty"`
+	Truncated    bool             `json:"truncated,omitempty"`
+}
+
+// GetDependencyTree returns the builds reachable from id through DependsOn,
+// down to maxDepth levels below it; zero or less means no limit. ErrNotFound
+// is returned only if id itself is missing. It relies on GetBuild alone, so
+// it works against any Service implementation, but it isn't a consistent
+// snapshot if builds change while it runs.
+func GetDependencyTree(ctx context.Context, s Service, id string, maxDepth int) (DependencyNode, error) {
+	root, err := s.GetBuild(ctx, id)
+	if err != nil {
+		return DependencyNode{}, err
+	}
+	w := treeWalker{s: s, maxDepth: maxDepth, seen: map[string]bool{}}
+	return w.expand(ctx, root, 0)
+}
+
+type treeWalker struct {
+	s        Service
+	maxDepth int
+	seen     map[string]bool
+}
+
+func (w treeWalker) expand(ctx context.Context, b Build, depth int) (DependencyNode, error) {
+	w.seen[b.ID] = true
+	n := DependencyNode{ID: b.ID, Build: &b}
+	for _, dep := range b.DependsOn {
+		child := DependencyNode{ID: dep}
+		switch {
+		case w.seen[dep]:
+			child.Seen = true
+		case w.maxDepth > 0 && depth+1 > w.maxDepth:
+			child.Truncated = true
+		default:
+			d, err := w.s.GetBuild(ctx, dep)
+			if errors.Is(err, ErrNotFound) {
+				child.Missing = true
+				break
+			} else if err != nil {
+				return DependencyNode{}, err
+			}
+			if child, err = w.expand(ctx, d, depth+1); err != nil {
+				return DependencyNode{}, err
+			}
+		}
+		n.Dependencies = append(n.Dependencies, child)
+	}
+	return n, nil
+}
@@ -0,0 +1,138 @@
+package gokitbuildservice_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	gokitbuildservice "github.com/chaitanyapantheor/go-kit-build-service"
+	"github.com/chaitanyapantheor/go-kit-build-service/servicetest"
+)
+
+// treeService serves builds from GetBuild, and ErrNotFound for any other.
+func treeService(builds ...gokitbuildservice.Build) *servicetest.FakeService {
+	byID := map[string]gokitbuildservice.Build{}
+	for _, b := range builds {
+		byID[b.ID] = b
+	}
+	return &servicetest.FakeService{
+		GetBuildFunc: func(ctx context.Context, id string) (gokitbuildservice.Build, error) {
+			b, ok := byID[id]
+			if !ok {
+				return gokitbuildservice.Build{}, gokitbuildservice.ErrNotFound
+			}
+			return b, nil
+		},
+	}
+}
+
+func dependsOn(id string, deps ...string) gokitbuildservice.Build {
+	return gokitbuildservice.Build{ID: id, DependsOn: deps}
+}
+
+// renderTree writes n as id(children...), marking nodes that were seen
+// before with *, missing ones with ! and truncated ones with ..., and
+// checking that only expanded nodes carry their build.
+func renderTree(t *testing.T, n gokitbuildservice.DependencyNode) string {
+	t.Helper()
+	expanded := !n.Seen && !n.Missing && !n.Truncated
+	if expanded != (n.Build != nil) || (n.Build != nil && n.Build.ID != n.ID) {
+		t.Errorf("%s: build %v on a node with seen %v, missing %v, truncated %v", n.ID, n.Build, n.Seen, n.Missing, n.Truncated)
+	}
+	s := n.ID
+	switch {
+	case n.Seen:
+		s += "*"
+	case n.Missing:
+		s += "!"
+	case n.Truncated:
+		s += "..."
+	}
+	if len(n.Dependencies) > 0 {
+		var deps []string
+		for _, d := range n.Dependencies {
+			deps = append(deps, renderTree(t, d))
+		}
+		s += "(" + strings.Join(deps, " ") + ")"
+	}
+	return s
+}
+
+func TestGetDependencyTree(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		builds []gokitbuildservice.Build
+		depth  int
+		want   string
+	}{
+		{"leaf", []gokitbuildservice.Build{dependsOn("a")}, 0, "a"},
+		{"chain", []gokitbuildservice.Build{dependsOn("a", "b"), dependsOn("b", "c"), dependsOn("c")}, 0, "a(b(c))"},
+		{"missing", []gokitbuildservice.Build{dependsOn("a", "b", "gone"), dependsOn("b", "gone")}, 0, "a(b(gone!) gone!)"},
+		{"diamond", []gokitbuildservice.Build{dependsOn("a", "b", "c"), dependsOn("b", "d"), dependsOn("c", "d"), dependsOn("d")}, 0, "a(b(d) c(d*))"},
+		{"cycle", []gokitbuildservice.Build{dependsOn("a", "b"), dependsOn("b", "c"), dependsOn("c", "a")}, 0, "a(b(c(a*)))"},
+		{"self", []gokitbuildservice.Build{dependsOn("a", "a")}, 0, "a(a*)"},
+		{"depth 1", []gokitbuildservice.Build{dependsOn("a", "b", "c"), dependsOn("b", "d"), dependsOn("c"), dependsOn("d")}, 1, "a(b(d...) c)"},
+		{"depth 2", []gokitbuildservice.Build{dependsOn("a", "b"), dependsOn("b", "c"), dependsOn("c", "d"), dependsOn("d")}, 2, "a(b(c(d...)))"},
+		{"depth past the tree", []gokitbuildservice.Build{dependsOn("a", "b"), dependsOn("b")}, 5, "a(b)"},
+		{"negative depth", []gokitbuildservice.Build{dependsOn("a", "b"), dependsOn("b", "c"), dependsOn("c")}, -1, "a(b(c))"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := treeService(tc.builds...)
+			tree, err := gokitbuildservice.GetDependencyTree(context.Background(), s, "a", tc.depth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := renderTree(t, tree); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetDependencyTreeExpandsEachBuildOnce(t *testing.T) {
+	// d is reached four ways, and e through d and directly.
+	s := treeService(
+		dependsOn("a", "b", "c", "d"),
+		dependsOn("b", "d", "e"),
+		dependsOn("c", "d", "a"),
+		dependsOn("d", "e"),
+		dependsOn("e"),
+	)
+	tree, err := gokitbuildservice.GetDependencyTree(context.Background(), s, "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := renderTree(t, tree), "a(b(d(e) e*) c(d* a*) d*)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	got := map[string]int{}
+	for _, c := range s.CallsTo("GetBuild") {
+		got[c.Args[0].(string)]++
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if got[id] != 1 {
+			t.Errorf("%s fetched %d times, want once", id, got[id])
+		}
+	}
+}
+
+func TestGetDependencyTreeErrors(t *testing.T) {
+	ctx := context.Background()
+	if _, err := gokitbuildservice.GetDependencyTree(ctx, treeService(), "a", 0); !errors.Is(err, gokitbuildservice.ErrNotFound) {
+		t.Errorf("missing root: got %v, want ErrNotFound", err)
+	}
+
+	// Any other error fetching a dependency fails the whole tree.
+	s := treeService(dependsOn("a", "b"))
+	get := s.GetBuildFunc
+	s.GetBuildFunc = func(ctx context.Context, id string) (gokitbuildservice.Build, error) {
+		if id == "b" {
+			return gokitbuildservice.Build{}, gokitbuildservice.ErrBackendTimeout
+		}
+		return get(ctx, id)
+	}
+	if _, err := gokitbuildservice.GetDependencyTree(ctx, s, "a", 0); !errors.Is(err, gokitbuildservice.ErrBackendTimeout) {
+		t.Errorf("failing dependency: got %v, want ErrBackendTimeout", err)
+	}
+}
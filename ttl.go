@@ -0,0 +1,79 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"time"
+)
+
+// WithDefaultTTL sets ExpiresAt to d after creation on every build created
+// without one.
+func WithDefaultTTL(d time.Duration) InmemOption {
+	return func(s *buildService) { s.defaultTTL = d }
+}
+
+// WithExpiryJanitor deletes expired builds every interval, until the
+// service is closed. Expired builds are hidden from every method as soon as
+// they expire, so the janitor only reclaims their memory; their deletion is
+// published as BuildDeleted and persisted like any other.
+func WithExpiryJanitor(interval time.Duration) InmemOption {
+	return func(s *buildService) { s.janitorInterval = interval }
+}
+
+// expired reports whether b is past its ExpiresAt and not pinned.
+func (s *buildService) expired(b Build, now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt) && b.Labels[PinnedLabel] != "true"
+}
+
+// defaultExpiry applies the default TTL to a build being created.
+func (s *buildService) defaultExpiry(b *Build) {
+	if s.defaultTTL > 0 && b.ExpiresAt == nil {
+		t := b.CreatedAt.Add(s.defaultTTL)
+		b.ExpiresAt = &t
+	}
+}
+
+// reap deletes build id if it has expired, so that its ID can be reused.
+// It must be called with s.mtx held.
+func (s *buildService) reap(ctx context.Context, id string) error {
+	b, ok, err := s.repo.Get(ctx, id)
+	if err != nil || !ok || !s.expired(b, s.now(ctx)) {
+		return err
+	}
+	return s.remove(ctx, b)
+}
+
+func (s *buildService) startJanitor() {
+	s.janitor.Add(1)
+	go func() {
+		defer s.janitor.Done()
+		t := time.NewTicker(s.janitorInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.reapExpired(s.clock.Now())
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// reapExpired deletes every build that had expired by now. It stops at the
+// first failure, which the next run retries.
+func (s *buildService) reapExpired(now time.Time) {
+	ctx := context.Background()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	builds, err := s.repo.List(ctx)
+	if err != nil {
+		return
+	}
+	for _, b := range builds {
+		if s.expired(b, now) {
+			if err := s.remove(ctx, b); err != nil {
+				return
+			}
+		}
+	}
+}
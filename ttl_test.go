@@ -0,0 +1,97 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a Clock that only moves when told to.
+type testClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestExpiryLazyAndJanitorAgree(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		janitor bool
+	}{
+		{"lazy", false},
+		{"janitor", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			opts := []InmemOption{WithClock(clock), WithDefaultTTL(time.Hour)}
+			if tc.janitor {
+				opts = append(opts, WithExpiryJanitor(time.Millisecond))
+			}
+			s := NewInmemService(opts...).(*buildService)
+			defer s.Close()
+			for _, b := range []Build{
+				{ID: "temp"},
+				{ID: "pinned", Labels: map[string]string{PinnedLabel: "true"}},
+			} {
+				if err := s.PostBuild(ctx, b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stored := func(id string) bool {
+				s.mtx.RLock()
+				defer s.mtx.RUnlock()
+				_, ok, _ := s.repo.Get(ctx, id)
+				return ok
+			}
+
+			clock.Advance(time.Hour - time.Second)
+			if _, err := s.GetBuild(ctx, "temp"); err != nil {
+				t.Fatalf("before its TTL: %v", err)
+			}
+
+			clock.Advance(time.Second)
+			if _, err := s.GetBuild(ctx, "temp"); err != ErrNotFound {
+				t.Errorf("GetBuild of an expired build: got %v, want ErrNotFound", err)
+			}
+			if _, err := s.GetBuild(ctx, "pinned"); err != nil {
+				t.Errorf("GetBuild of a pinned build past its TTL: %v", err)
+			}
+			builds, err := s.ListBuilds(ctx, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(builds) != 1 || builds[0].ID != "pinned" {
+				t.Errorf("ListBuilds: got %v, want only the pinned build", builds)
+			}
+
+			if tc.janitor {
+				for deadline := time.Now().Add(5 * time.Second); stored("temp"); time.Sleep(time.Millisecond) {
+					if time.Now().After(deadline) {
+						t.Fatal("the janitor never removed the expired build")
+					}
+				}
+			} else if !stored("temp") {
+				t.Error("removed without a janitor; expiry should only hide it")
+			}
+			if !stored("pinned") {
+				t.Error("the pinned build was removed")
+			}
+			if err := s.PostBuild(ctx, Build{ID: "temp"}); err != nil {
+				t.Errorf("reusing the expired build's ID: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package gokitbuildservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrValidation is matched (via errors.Is) by every ValidationErrors value,
+// so callers that don't care about the individual problems can test for it.
+var ErrValidation = errors.New("validation failed")
+
+// ValidationError is a single problem with a build definition.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every problem found with a build definition.
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return ErrValidation.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+// Is reports ErrValidation as the kind of every ValidationErrors.
+func (v ValidationErrors) Is(target error) bool { return target == ErrValidation }
+
+func (v *ValidationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Limits bounds the size of a single build, so an oversized request can't
+// exhaust memory whichever transport it arrives on. A zero field means no
+// limit.
+type Limits struct {
+	MaxSteps  int // steps per build
+	MaxLabels int // labels per build
+	MaxBytes  int // size of the build serialized as JSON
+
+	MaxOutputBytes int // size of each of the build's Outputs
+}
+
+// DefaultLimits are used unless the service is constructed WithLimits.
+var DefaultLimits = Limits{
+	MaxSteps:  1000,
+	MaxLabels: 64,
+	MaxBytes:  1 << 20,
+
+	MaxOutputBytes: 4 << 10,
+}
+
+// Validate checks the structure of the build on its own, without reference to
+// any other build, within DefaultLimits. It returns nil if no problems were
+// found.
+func (b Build) Validate() ValidationErrors {
+	return b.ValidateWithin(DefaultLimits)
+}
+
+// idProblem describes what's wrong with id as a build ID, if anything.
+func idProblem(id string) string {
+	switch {
+	case id == "":
+		return "is required"
+	case strings.ContainsAny(id, "/ "):
+		return "must not contain slashes or spaces"
+	}
+	return ""
+}
+
+// ValidateWithin is Validate with explicit limits.
+func (b Build) ValidateWithin(l Limits) ValidationErrors {
+	var errs ValidationErrors
+	if l.MaxSteps > 0 && len(b.Steps) > l.MaxSteps {
+		errs.add("steps", "%d steps exceeds the limit of %d", len(b.Steps), l.MaxSteps)
+	}
+	if l.MaxLabels > 0 && len(b.Labels) > l.MaxLabels {
+		errs.add("labels", "%d labels exceeds the limit of %d", len(b.Labels), l.MaxLabels)
+	}
+	for k, v := range b.Outputs {
+		if l.MaxOutputBytes > 0 && len(v) > l.MaxOutputBytes {
+			errs.add("outputs."+k, "%d bytes exceeds the limit of %d", len(v), l.MaxOutputBytes)
+		}
+	}
+	if l.MaxBytes > 0 {
+		if p, err := json.Marshal(b); err == nil && len(p) > l.MaxBytes {
+			errs.add("build", "%d bytes exceeds the limit of %d", len(p), l.MaxBytes)
+		}
+	}
+	if len(errs) > 0 {
+		return errs // don't walk an oversized build any further
+	}
+	if p := idProblem(b.ID); p != "" {
+		errs.add("id", "%s", p)
+	}
+	stepNames := map[string]int{}
+	for i, st := range b.Steps {
+		if st.Image == "" {
+			errs.add(fmt.Sprintf("steps[%d].image", i), "is required")
+		}
+		if st.Name == "" {
+			continue // unnamed steps are known by position
+		}
+		if first, ok := stepNames[st.Name]; ok {
+			errs.add(fmt.Sprintf("steps[%d].name", i), "duplicate step name %q, first used by steps[%d]", st.Name, first)
+		} else {
+			stepNames[st.Name] = i
+		}
+	}
+	if p := idProblem(b.GroupID); b.GroupID != "" && p != "" {
+		errs.add("groupId", "%s", p)
+	}
+	if _, ok := b.Outputs[""]; ok {
+		errs.add("outputs", "keys must not be empty")
+	}
+	seen := map[string]bool{}
+	for i, dep := range b.DependsOn {
+		field := fmt.Sprintf("dependsOn[%d]", i)
+		switch {
+		case dep == "":
+			errs.add(field, "must not be empty")
+		case dep == b.ID:
+			errs.add(field, "build can't depend on itself")
+		case seen[dep]:
+			errs.add(field, "duplicate dependency %q", dep)
+		}
+		seen[dep] = true
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validateAgainst runs ValidateWithin and then checks b's dependencies against the
+// other builds, as returned by lookup: every dependency must exist, and adding
+// b must not close a cycle. A stored build with b's ID is treated as replaced
+// by b.
+func validateAgainst(b Build, l Limits, lookup func(id string) (Build, bool)) ValidationErrors {
+	errs := append(b.ValidateWithin(l), dependencyProblems(b, nil, true, lookup)...)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// dependencyProblems is the part of validateAgainst that needs the other
+// builds. Dependencies in known aren't required to exist, so a build whose
+// dependency has since been deleted can still be updated. The search for a
+// cycle is skipped unless mayCycle; it's false when nothing depends on b,
+// as then nothing can lead back to it.
+func dependencyProblems(b Build, known []string, mayCycle bool, lookup func(id string) (Build, bool)) ValidationErrors {
+	var errs ValidationErrors
+	had := stringSet(known)
+	for i, dep := range b.DependsOn {
+		if dep == "" || dep == b.ID {
+			continue // already reported
+		}
+		if _, ok := had[dep]; ok {
+			continue
+		}
+		if _, ok := lookup(dep); !ok {
+			errs.add(fmt.Sprintf("dependsOn[%d]", i), "unknown build %q", dep)
+		}
+	}
+	if !mayCycle {
+		return errs
+	}
+	if cycle := findCycle(b, lookup); cycle != nil {
+		errs.add("dependsOn", "dependency cycle %s", strings.Join(cycle, " -> "))
+	}
+	return errs
+}
+
+// findCycle returns the first dependency cycle reachable from root, as a path
+// that starts and ends at the same ID, or nil if there is none.
+func findCycle(root Build, lookup func(id string) (Build, bool)) []string {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var path []string
+	var visit func(b Build) []string
+	visit = func(b Build) []string {
+		state[b.ID] = visiting
+		path = append(path, b.ID)
+		for _, dep := range b.DependsOn {
+			if dep == b.ID {
+				continue // self-dependencies are reported by Validate
+			}
+			switch state[dep] {
+			case visiting:
+				for i, id := range path {
+					if id == dep {
+						return append(append([]string{}, path[i:]...), dep)
+					}
+				}
+			case done:
+				continue
+			}
+			next, ok := lookup(dep)
+			if !ok {
+				continue
+			}
+			if c := visit(next); c != nil {
+				return c
+			}
+		}
+		path = path[:len(path)-1]
+		state[b.ID] = done
+		return nil
+	}
+	return visit(root)
+}
@@ -0,0 +1,95 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWritesCheckDependencies(t *testing.T) {
+	ctx := context.Background()
+	s := NewInmemService()
+	wantInvalid := func(what string, err error) {
+		t.Helper()
+		if !errors.Is(err, ErrValidation) {
+			t.Errorf("%s: got %v, want a validation error", what, err)
+		}
+	}
+
+	wantInvalid("POST with an unknown dependency", s.PostBuild(ctx, Build{ID: "x", DependsOn: []string{"nope"}}))
+	_, _, err := s.GetOrCreateBuild(ctx, Build{ID: "x", DependsOn: []string{"nope"}})
+	wantInvalid("GetOrCreate with an unknown dependency", err)
+	wantInvalid("PUT with an unknown dependency", s.PutBuild(ctx, "x", Build{ID: "x", DependsOn: []string{"nope"}}))
+	if _, err := s.GetBuild(ctx, "x"); err != ErrNotFound {
+		t.Fatalf("rejected writes created x: %v", err)
+	}
+
+	for _, b := range []Build{{ID: "a"}, {ID: "b", DependsOn: []string{"a"}}, {ID: "c", DependsOn: []string{"b"}}} {
+		if err := s.PostBuild(ctx, b); err != nil {
+			t.Fatalf("POST %s: %v", b.ID, err)
+		}
+	}
+	wantInvalid("PUT closing a cycle", s.PutBuild(ctx, "a", Build{ID: "a", DependsOn: []string{"c"}}))
+	wantInvalid("PATCH closing a cycle", s.PatchBuild(ctx, "a", Build{DependsOn: []string{"c"}}))
+	wantInvalid("PATCH adding an unknown dependency", s.PatchBuild(ctx, "c", Build{DependsOn: []string{"b", "nope"}}))
+	if problems, err := s.ValidateBuild(ctx, Build{ID: "a", DependsOn: []string{"c"}}); err != nil || problems == nil {
+		t.Errorf("ValidateBuild disagrees with the writes: %v, %v", problems, err)
+	}
+
+	if err := s.DeleteBuild(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutBuild(ctx, "b", Build{ID: "b", Name: "renamed", DependsOn: []string{"a"}}); err != nil {
+		t.Errorf("PUT keeping a dependency that's since been deleted: %v", err)
+	}
+}
+
+func TestDuplicateStepNames(t *testing.T) {
+	steps := func(names ...string) []Step {
+		out := make([]Step, len(names))
+		for i, n := range names {
+			out[i] = Step{Name: n, Image: "golang"}
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		names []string
+		want  []string // fields reported, in order
+	}{
+		{nil, nil},
+		{[]string{"build", "test", "deploy"}, nil},
+		{[]string{"", "", ""}, nil},
+		{[]string{"build", "", "test", ""}, nil},
+		{[]string{"build", "Build"}, nil},
+		{[]string{"build", "build"}, []string{"steps[1].name"}},
+		{[]string{"build", "test", "build"}, []string{"steps[2].name"}},
+		{[]string{"build", "", "build", "build"}, []string{"steps[2].name", "steps[3].name"}},
+		{[]string{"a", "b", "a", "b"}, []string{"steps[2].name", "steps[3].name"}},
+	} {
+		errs := Build{ID: "b1", Steps: steps(tc.names...)}.Validate()
+		var got []string
+		for _, e := range errs {
+			got = append(got, e.Field)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("steps %q: got problems %v, want %v", tc.names, errs, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("steps %q: got problems %v, want %v", tc.names, errs, tc.want)
+				break
+			}
+			var step int
+			fmt.Sscanf(got[i], "steps[%d]", &step)
+			if name := fmt.Sprintf("%q", tc.names[step]); !strings.Contains(errs[i].Message, name) {
+				t.Errorf("steps %q: %q doesn't name the duplicate %s", tc.names, errs[i].Message, name)
+			}
+		}
+		if tc.want != nil && !errors.Is(errs, ErrValidation) {
+			t.Errorf("steps %q: %v isn't a validation error", tc.names, errs)
+		}
+	}
+}
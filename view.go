@@ -0,0 +1,179 @@
+package gokitbuildservice
+
+import (
+	"context"
+	"mime"
+	"strings"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// FullProfile is the Accept media type parameter, as in
+//
+//	Accept: application/json; profile=full
+//
+// asking for builds with every field present, rather than the compact form
+// that leaves out empty ones. Empty lists and maps come out as [] and {},
+// and unset optional values as null, so every build has the same shape.
+const FullProfile = "full"
+
+// acceptsFull reports whether the request that produced ctx asked for
+// FullProfile. It relies on httptransport.PopulateRequestContext having run.
+func acceptsFull(ctx context.Context) bool {
+	accept, _ := ctx.Value(httptransport.ContextKeyRequestAccept).(string)
+	for _, part := range strings.Split(accept, ",") {
+		if _, params, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && params["profile"] == FullProfile {
+			return true
+		}
+	}
+	return false
+}
+
+// fullViewer is implemented by responses carrying builds, returning the
+// same response with them in their full form.
+type fullViewer interface {
+	full() interface{}
+}
+
+// fullBuild is the FullProfile view of a Build: the same fields, none of
+// them omitted. A field added to Build must be added here too.
+type fullBuild struct {
+	ID            string             `json:"id"`
+	Name          string             `json:"name"`
+	Steps         []fullStep         `json:"steps"`
+	Labels        map[string]string  `json:"labels"`
+	Parameters    map[string]string  `json:"parameters"`
+	DependsOn     []string           `json:"dependsOn"`
+	Status        BuildStatus        `json:"status"`
+	Priority      int                `json:"priority"`
+	Lease         *Lease             `json:"lease"`
+	Sequence      int64              `json:"sequence"`
+	Attempt       int                `json:"attempt"`
+	CreatedAt     time.Time          `json:"createdAt"`
+	UpdatedAt     time.Time          `json:"updatedAt"`
+	StartedAt     *time.Time         `json:"startedAt"`
+	FinishedAt    *time.Time         `json:"finishedAt"`
+	ExpiresAt     *time.Time         `json:"expiresAt"`
+	FailureReason string             `json:"failureReason"`
+	ExitCode      int                `json:"exitCode"`
+	Quarantined   bool               `json:"quarantined"`
+	Problems      []ValidationError  `json:"problems"`
+	StatusHistory []StatusTransition `json:"statusHistory"`
+	SpecHash      string             `json:"specHash"`
+	Outputs       map[string]string  `json:"outputs"`
+	GroupID       string             `json:"groupId"`
+	CreatedBy     string             `json:"createdBy"`
+}
+
+type fullStep struct {
+	Name   string      `json:"name"`
+	Image  string      `json:"image"`
+	Args   []string    `json:"args"`
+	Status BuildStatus `json:"status"`
+}
+
+func newFullBuild(b Build) fullBuild {
+	steps := make([]fullStep, len(b.Steps))
+	for i, st := range b.Steps {
+		steps[i] = fullStep{Name: st.Name, Image: st.Image, Args: nonNil(st.Args), Status: st.Status}
+	}
+	labels, params := b.Labels, b.Parameters
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	problems := []ValidationError(b.Problems)
+	if problems == nil {
+		problems = []ValidationError{}
+	}
+	outputs := b.Outputs
+	if outputs == nil {
+		outputs = map[string]string{}
+	}
+	history := b.StatusHistory
+	if history == nil {
+		history = []StatusTransition{}
+	}
+	return fullBuild{
+		ID:            b.ID,
+		Name:          b.Name,
+		Steps:         steps,
+		Labels:        labels,
+		Parameters:    params,
+		DependsOn:     nonNil(b.DependsOn),
+		Status:        b.Status,
+		Priority:      b.Priority,
+		Lease:         b.Lease,
+		Sequence:      b.Sequence,
+		Attempt:       b.Attempt,
+		CreatedAt:     b.CreatedAt,
+		UpdatedAt:     b.UpdatedAt,
+		StartedAt:     b.StartedAt,
+		FinishedAt:    b.FinishedAt,
+		ExpiresAt:     b.ExpiresAt,
+		FailureReason: b.FailureReason,
+		ExitCode:      b.ExitCode,
+		Quarantined:   b.Quarantined,
+		Problems:      problems,
+		StatusHistory: history,
+		SpecHash:      b.SpecHash,
+		Outputs:       outputs,
+		GroupID:       b.GroupID,
+		CreatedBy:     b.CreatedBy,
+	}
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func (r getBuildResponse) full() interface{} {
+	return struct {
+		Build fullBuild `json:"build"`
+	}{newFullBuild(r.Build)}
+}
+
+func (r getOrCreateBuildResponse) full() interface{} {
+	return struct {
+		Build   fullBuild `json:"build"`
+		Created bool      `json:"created"`
+	}{newFullBuild(r.Build), r.Created}
+}
+
+func (r getBuildsResponse) full() interface{} {
+	builds := make(map[string]fullBuild, len(r.Builds))
+	for id, b := range r.Builds {
+		builds[id] = newFullBuild(b)
+	}
+	return struct {
+		Builds  map[string]fullBuild `json:"builds"`
+		Missing []string             `json:"missing"`
+	}{builds, r.Missing}
+}
+
+func (r listBuildsResponse) full() interface{} {
+	items := make([]fullBuild, len(r.Items))
+	for i, b := range r.Items {
+		items[i] = newFullBuild(b)
+	}
+	return struct {
+		Items   []fullBuild `json:"items"`
+		Total   int         `json:"total"`
+		Offset  int         `json:"offset"`
+		Limit   int         `json:"limit"`
+		Next    string      `json:"next,omitempty"`
+		Partial bool        `json:"partial,omitempty"`
+	}{items, r.Total, r.Offset, r.Limit, r.Next, r.Partial}
+}
+
+func (r rerunFailedStepsResponse) full() interface{} {
+	return struct {
+		Build fullBuild `json:"build"`
+	}{newFullBuild(r.Build)}
+}
@@ -0,0 +1,222 @@
+package gokitbuildservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, keyed
+// with the dispatcher's secret, so receivers can verify deliveries.
+const SignatureHeader = "X-Build-Signature"
+
+// ErrBadWebhook is returned when registering a webhook with an unusable URL.
+var ErrBadWebhook = errors.New("webhook URL must be absolute http or https")
+
+// Webhook is a registered notification target. An empty Events list
+// subscribes to every event type.
+type Webhook struct {
+	ID     string           `json:"id"`
+	URL    string           `json:"url"`
+	Events []BuildEventType `json:"events,omitempty"`
+}
+
+func (w Webhook) wants(t BuildEventType) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookOption configures a WebhookDispatcher.
+type WebhookOption func(*WebhookDispatcher)
+
+// WithWebhookClient sets the HTTP client used for deliveries.
+func WithWebhookClient(c *http.Client) WebhookOption {
+	return func(d *WebhookDispatcher) { d.client = c }
+}
+
+// WithWebhookRetries sets how many times a failed delivery is retried, and
+// the delay before the first retry. The delay doubles on every attempt.
+func WithWebhookRetries(max int, backoff time.Duration) WebhookOption {
+	return func(d *WebhookDispatcher) {
+		d.maxRetries = max
+		d.backoff = backoff
+	}
+}
+
+// WithWebhookMetrics counts delivered and permanently failed notifications.
+func WithWebhookMetrics(delivered, failed metrics.Counter) WebhookOption {
+	return func(d *WebhookDispatcher) {
+		d.delivered = delivered
+		d.failed = failed
+	}
+}
+
+// WebhookDispatcher POSTs build events to registered webhooks.
+type WebhookDispatcher struct {
+	secret     []byte
+	logger     log.Logger
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+	delivered  metrics.Counter
+	failed     metrics.Counter
+
+	mtx   sync.RWMutex
+	hooks map[string]Webhook
+	wg    sync.WaitGroup
+}
+
+// NewWebhookDispatcher returns a dispatcher signing deliveries with secret.
+func NewWebhookDispatcher(secret []byte, logger log.Logger, opts ...WebhookOption) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		secret:     secret,
+		logger:     logger,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		maxRetries: 5,
+		backoff:    time.Second,
+		delivered:  discard.NewCounter(),
+		failed:     discard.NewCounter(),
+		hooks:      map[string]Webhook{},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// RegisterWebhook starts delivering events of the given types to rawURL, and
+// returns the ID of the new registration.
+func (d *WebhookDispatcher) RegisterWebhook(ctx context.Context, rawURL string, events []BuildEventType) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", ErrBadWebhook
+	}
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	w := Webhook{ID: hex.EncodeToString(buf[:]), URL: u.String(), Events: events}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.hooks[w.ID] = w
+	return w.ID, nil
+}
+
+// UnregisterWebhook stops deliveries to the given registration.
+func (d *WebhookDispatcher) UnregisterWebhook(ctx context.Context, id string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.hooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(d.hooks, id)
+	return nil
+}
+
+// Run delivers events until the channel is closed or ctx is done, then waits
+// for deliveries in flight. Each delivery runs in its own goroutine, so a
+// slow receiver never holds up the others or the mutation that caused it.
+func (d *WebhookDispatcher) Run(ctx context.Context, events <-chan BuildEvent) {
+	defer d.wg.Wait()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			d.dispatch(ctx, e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) dispatch(ctx context.Context, e BuildEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		level.Error(d.logger).Log("event", e.ID, "err", err)
+		return
+	}
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	for _, w := range d.hooks {
+		if !w.wants(e.Type) {
+			continue
+		}
+		d.wg.Add(1)
+		go func(w Webhook) {
+			defer d.wg.Done()
+			d.deliver(ctx, w, e, body)
+		}(w)
+	}
+}
+
+// deliver POSTs body to w, retrying with exponential backoff on transport
+// errors and non-2xx responses.
+func (d *WebhookDispatcher) deliver(ctx context.Context, w Webhook, e BuildEvent, body []byte) {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	delay := d.backoff
+	var err error
+	for attempt := 0; attempt <= d.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err = d.post(ctx, w.URL, signature, e.baggage, body); err == nil {
+			d.delivered.Add(1)
+			return
+		}
+	}
+	d.failed.Add(1)
+	level.Error(d.logger).Log("webhook", w.ID, "url", w.URL, "event", e.ID, "type", e.Type, "attempts", d.maxRetries+1, "err", err)
+}
+
+func (d *WebhookDispatcher) post(ctx context.Context, url, signature, baggage string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	if baggage != "" {
+		req.Header.Set(BaggageHeader, baggage)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}